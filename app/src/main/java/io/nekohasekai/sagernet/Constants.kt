@@ -134,6 +134,7 @@ object Key {
     const val SERVER_HEADERS = "serverHeaders"
     const val SERVER_MULTI_MODE = "serverMultiMode"
     const val SERVER_ALLOW_INSECURE = "serverAllowInsecure"
+    const val SERVER_UDP = "serverUDP"
 
     const val SERVER_AUTH_TYPE = "serverAuthType"
     const val SERVER_UPLOAD_SPEED = "serverUploadSpeed"
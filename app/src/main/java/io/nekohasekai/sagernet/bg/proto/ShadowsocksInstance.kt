@@ -62,7 +62,8 @@ class ShadowsocksInstance(val server: ShadowsocksBean, val port: Int) : ClashBas
             server.password,
             server.method,
             pluginName,
-            pluginOpts.toStringPretty()
+            pluginOpts.toStringPretty(),
+            server.udp
         )
     }
 
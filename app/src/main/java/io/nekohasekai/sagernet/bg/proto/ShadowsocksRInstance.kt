@@ -35,7 +35,8 @@ class ShadowsocksRInstance(val server: ShadowsocksRBean, val port: Int) : ClashB
             server.obfs,
             server.obfsParam,
             server.protocol,
-            server.protocolParam
+            server.protocolParam,
+            server.udp
         )
     }
 
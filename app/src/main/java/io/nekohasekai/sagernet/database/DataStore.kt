@@ -236,6 +236,7 @@ object DataStore : OnPreferenceDataStoreChangeListener {
     var serverWsBrowserForwarding by profileCacheStore.boolean(Key.SERVER_WS_BROWSER_FORWARDING)
     var serverHeaders by profileCacheStore.string(Key.SERVER_HEADERS)
     var serverAllowInsecure by profileCacheStore.boolean(Key.SERVER_ALLOW_INSECURE)
+    var serverUDP by profileCacheStore.boolean(Key.SERVER_UDP)
     var serverMultiMode by profileCacheStore.boolean(Key.SERVER_MULTI_MODE)
 
     var serverVMessExperimentalAuthenticatedLength by profileCacheStore.boolean(Key.SERVER_VMESS_EXPERIMENTAL_AUTHENTICATED_LENGTH)
@@ -36,6 +36,7 @@ public class ShadowsocksBean extends AbstractBean {
     public String method;
     public String password;
     public String plugin;
+    public Boolean udp;
 
     @Override
     public void initializeDefaultValues() {
@@ -45,15 +46,17 @@ public class ShadowsocksBean extends AbstractBean {
         if (method == null) method = "";
         if (password == null) password = "";
         if (plugin == null) plugin = "";
+        if (udp == null) udp = false;
     }
 
     @Override
     public void serialize(ByteBufferOutput output) {
-        output.writeInt(0);
+        output.writeInt(1);
         super.serialize(output);
         output.writeString(method);
         output.writeString(password);
         output.writeString(plugin);
+        output.writeBoolean(udp);
     }
 
     @Override
@@ -63,6 +66,9 @@ public class ShadowsocksBean extends AbstractBean {
         method = input.readString();
         password = input.readString();
         plugin = input.readString();
+        if (version >= 1) {
+            udp = input.readBoolean();
+        }
     }
 
     @NotNull
@@ -39,6 +39,7 @@ public class ShadowsocksRBean extends AbstractBean {
     public String protocolParam;
     public String obfs;
     public String obfsParam;
+    public Boolean udp;
 
     @Override
     public void initializeDefaultValues() {
@@ -50,12 +51,13 @@ public class ShadowsocksRBean extends AbstractBean {
         if (protocolParam == null) protocolParam = "";
         if (StrUtil.isBlank(obfs)) obfs = "plain";
         if (obfsParam == null) obfsParam = "";
+        if (udp == null) udp = true;
 
     }
 
     @Override
     public void serialize(ByteBufferOutput output) {
-        output.writeInt(0);
+        output.writeInt(1);
         super.serialize(output);
         output.writeString(password);
         output.writeString(method);
@@ -63,6 +65,7 @@ public class ShadowsocksRBean extends AbstractBean {
         output.writeString(protocolParam);
         output.writeString(obfs);
         output.writeString(obfsParam);
+        output.writeBoolean(udp);
     }
 
     @Override
@@ -75,7 +78,9 @@ public class ShadowsocksRBean extends AbstractBean {
         protocolParam = input.readString();
         obfs = input.readString();
         obfsParam = input.readString();
-
+        if (version >= 1) {
+            udp = input.readBoolean();
+        }
     }
 
     @NotNull
@@ -42,6 +42,7 @@ class ShadowsocksRSettingsActivity : ProfileSettingsActivity<ShadowsocksRBean>()
         DataStore.serverProtocolParam = protocolParam
         DataStore.serverObfs = obfs
         DataStore.serverObfsParam = obfsParam
+        DataStore.serverUDP = udp
     }
 
     override fun ShadowsocksRBean.serialize() {
@@ -54,6 +55,7 @@ class ShadowsocksRSettingsActivity : ProfileSettingsActivity<ShadowsocksRBean>()
         protocolParam = DataStore.serverProtocolParam
         obfs = DataStore.serverObfs
         obfsParam = DataStore.serverObfsParam
+        udp = DataStore.serverUDP
     }
 
     override fun PreferenceFragmentCompat.createPreferences(
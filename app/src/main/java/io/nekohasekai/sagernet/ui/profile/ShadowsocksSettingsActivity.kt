@@ -66,6 +66,7 @@ class ShadowsocksSettingsActivity : ProfileSettingsActivity<ShadowsocksBean>(),
         DataStore.serverMethod = method
         DataStore.serverPassword = password
         DataStore.serverPlugin = plugin
+        DataStore.serverUDP = udp
     }
 
     override fun ShadowsocksBean.serialize() {
@@ -75,7 +76,7 @@ class ShadowsocksSettingsActivity : ProfileSettingsActivity<ShadowsocksBean>(),
         method = DataStore.serverMethod
         password = DataStore.serverPassword
         plugin = DataStore.serverPlugin
-
+        udp = DataStore.serverUDP
     }
 
     override fun onAttachedToWindow() {
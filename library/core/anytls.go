@@ -0,0 +1,535 @@
+package libcore
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const (
+	anyTLSCmdWaste               = 0
+	anyTLSCmdSYN                 = 1
+	anyTLSCmdPSH                 = 2
+	anyTLSCmdFIN                 = 3
+	anyTLSCmdSettings            = 4
+	anyTLSCmdAlert               = 5
+	anyTLSCmdUpdatePaddingScheme = 6
+	anyTLSCmdSYNACK              = 7
+	anyTLSCmdHeartRequest        = 8
+	anyTLSCmdHeartResponse       = 9
+	anyTLSCmdServerSettings      = 10
+
+	anyTLSHeaderSize  = 7
+	anyTLSMaxFrame    = 0xffff
+	anyTLSIdleTimeout = 30 * time.Second
+	anyTLSCheckMark   = -1
+)
+
+const anyTLSDefaultPadding = `stop=8
+0=30-30
+1=100-400
+2=400-500,c,500-1000,c,500-1000,c,500-1000,c,500-1000
+3=9-9,500-1000
+4=500-1000
+5=500-1000
+6=500-1000
+7=500-1000`
+
+// anyTLSPadding is a padding scheme: the record sizes of the first stop
+// packets of a session, "c" stopping the padding of a packet once its payload
+// is written.
+type anyTLSPadding struct {
+	md5    string
+	stop   uint32
+	scheme map[uint32][]string
+}
+
+func parseAnyTLSPadding(raw string) (*anyTLSPadding, error) {
+	sum := md5.Sum([]byte(raw))
+	padding := &anyTLSPadding{md5: hex.EncodeToString(sum[:]), scheme: map[uint32][]string{}}
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid padding scheme line %q", line)
+		}
+		if parts[0] == "stop" {
+			stop, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid padding stop %q", parts[1])
+			}
+			padding.stop = uint32(stop)
+			continue
+		}
+		pkt, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid padding scheme line %q", line)
+		}
+		padding.scheme[uint32(pkt)] = strings.Split(parts[1], ",")
+	}
+	if padding.stop == 0 {
+		return nil, errors.New("padding scheme without stop")
+	}
+	return padding, nil
+}
+
+// sizes returns the record sizes of the packet, anyTLSCheckMark for "c".
+func (p *anyTLSPadding) sizes(pkt uint32) []int {
+	var sizes []int
+	for _, item := range p.scheme[pkt] {
+		if item == "c" {
+			sizes = append(sizes, anyTLSCheckMark)
+			continue
+		}
+		bounds := strings.SplitN(item, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(bounds[1]); err != nil || max < min {
+				continue
+			}
+		}
+		size := min
+		if max > min {
+			n, _ := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+			size += int(n.Int64())
+		}
+		if size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+func appendAnyTLSFrame(b []byte, cmd byte, streamID uint32, data []byte) []byte {
+	var header [anyTLSHeaderSize]byte
+	header[0] = cmd
+	binary.BigEndian.PutUint32(header[1:], streamID)
+	binary.BigEndian.PutUint16(header[5:], uint16(len(data)))
+	return append(append(b, header[:]...), data...)
+}
+
+// anyTLSInstance is an AnyTLS client. Each connection is a stream of a TLS
+// session, idle sessions being reused for the next connections.
+type anyTLSInstance struct {
+	*outbound.Base
+	server    string
+	tlsConfig *tls.Config
+	password  [32]byte
+
+	access  sync.Mutex
+	padding *anyTLSPadding
+	idle    []*anyTLSSession
+}
+
+func (a *anyTLSInstance) currentPadding() *anyTLSPadding {
+	a.access.Lock()
+	defer a.access.Unlock()
+	return a.padding
+}
+
+func (a *anyTLSInstance) getSession(ctx context.Context) (*anyTLSSession, bool, error) {
+	a.access.Lock()
+	for len(a.idle) > 0 {
+		// the most recently used session is the least likely to be timed out
+		session := a.idle[len(a.idle)-1]
+		a.idle = a.idle[:len(a.idle)-1]
+		if !session.isClosed() {
+			a.access.Unlock()
+			return session, false, nil
+		}
+	}
+	a.access.Unlock()
+	session, err := a.newSession(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return session, true, nil
+}
+
+func (a *anyTLSInstance) newSession(ctx context.Context) (*anyTLSSession, error) {
+	rawConn, err := dialServer(ctx, "tcp", a.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(rawConn)
+	conn := tls.Client(rawConn, a.tlsConfig)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err = conn.Handshake(); err != nil {
+		_ = rawConn.Close()
+		return nil, errors.WithMessage(err, "tls handshake")
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	padding := a.currentPadding()
+	session := &anyTLSSession{
+		instance:    a,
+		conn:        conn,
+		padding:     padding,
+		sendPadding: true,
+		closed:      make(chan struct{}),
+	}
+	// the authentication is the packet 0, padded to the first size
+	auth := append([]byte(nil), a.password[:]...)
+	paddingLen := 0
+	if sizes := padding.sizes(0); len(sizes) > 0 && sizes[0] > 0 {
+		paddingLen = sizes[0]
+	}
+	auth = appendUint16(auth, uint16(paddingLen))
+	auth = append(auth, make([]byte, paddingLen)...)
+	if _, err = conn.Write(auth); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go session.readLoop()
+	return session, nil
+}
+
+func (a *anyTLSInstance) putSession(session *anyTLSSession) {
+	session.idleSince = time.Now()
+	a.access.Lock()
+	defer a.access.Unlock()
+	alive := a.idle[:0]
+	for _, idle := range a.idle {
+		if time.Since(idle.idleSince) > anyTLSIdleTimeout {
+			_ = idle.Close()
+		} else {
+			alive = append(alive, idle)
+		}
+	}
+	a.idle = append(alive, session)
+}
+
+func (a *anyTLSInstance) Close() error {
+	a.access.Lock()
+	defer a.access.Unlock()
+	for _, session := range a.idle {
+		_ = session.Close()
+	}
+	a.idle = nil
+	return nil
+}
+
+func (a *anyTLSInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	session, created, err := a.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.openStream(created, socks5.ParseAddr(metadata.RemoteAddress()))
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	return outbound.NewConn(stream, a), nil
+}
+
+// dialDedicated opens the stream on a new session, closed along with it.
+func (a *anyTLSInstance) dialDedicated(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	session, err := a.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session.dedicated = true
+	stream, err := session.openStream(true, socks5.ParseAddr(metadata.RemoteAddress()))
+	if err != nil {
+		_ = session.Close()
+		return nil, err
+	}
+	return outbound.NewConn(stream, a), nil
+}
+
+func (a *anyTLSInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported by the anytls instance")
+}
+
+type anyTLSSession struct {
+	instance  *anyTLSInstance
+	conn      net.Conn
+	idleSince time.Time
+	dedicated bool
+
+	writeAccess sync.Mutex
+	padding     *anyTLSPadding
+	sendPadding bool
+	pkt         uint32
+
+	streamAccess sync.Mutex
+	streamID     uint32
+	stream       *anyTLSStream
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (s *anyTLSSession) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *anyTLSSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		_ = s.conn.Close()
+		s.streamAccess.Lock()
+		if s.stream != nil {
+			_ = s.stream.writer.CloseWithError(io.ErrUnexpectedEOF)
+		}
+		s.streamAccess.Unlock()
+	})
+	return nil
+}
+
+// write sends framed bytes, shaped by the padding scheme for the first packets.
+func (s *anyTLSSession) write(b []byte) error {
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	if !s.sendPadding {
+		_, err := s.conn.Write(b)
+		return err
+	}
+	s.pkt++
+	if s.pkt >= s.padding.stop {
+		s.sendPadding = false
+	}
+	for _, size := range s.padding.sizes(s.pkt) {
+		if size == anyTLSCheckMark {
+			if len(b) == 0 {
+				break
+			}
+			continue
+		}
+		switch {
+		case len(b) > size:
+			if _, err := s.conn.Write(b[:size]); err != nil {
+				return err
+			}
+			b = b[size:]
+		case len(b) > 0:
+			if paddingLen := size - len(b) - anyTLSHeaderSize; paddingLen > 0 {
+				b = appendAnyTLSFrame(b, anyTLSCmdWaste, 0, make([]byte, paddingLen))
+			}
+			if _, err := s.conn.Write(b); err != nil {
+				return err
+			}
+			b = nil
+		default:
+			if _, err := s.conn.Write(appendAnyTLSFrame(nil, anyTLSCmdWaste, 0, make([]byte, size))); err != nil {
+				return err
+			}
+		}
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(b)
+	return err
+}
+
+func (s *anyTLSSession) openStream(created bool, destination []byte) (*anyTLSStream, error) {
+	reader, writer := io.Pipe()
+	s.streamAccess.Lock()
+	s.streamID++
+	stream := &anyTLSStream{session: s, id: s.streamID, reader: reader, writer: writer}
+	s.stream = stream
+	s.streamAccess.Unlock()
+
+	var b []byte
+	if created {
+		settings := "v=2\nclient=AnXray\npadding-md5=" + s.padding.md5
+		b = appendAnyTLSFrame(b, anyTLSCmdSettings, 0, []byte(settings))
+	}
+	b = appendAnyTLSFrame(b, anyTLSCmdSYN, stream.id, nil)
+	b = appendAnyTLSFrame(b, anyTLSCmdPSH, stream.id, destination)
+	if err := s.write(b); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *anyTLSSession) readLoop() {
+	defer s.Close()
+	header := make([]byte, anyTLSHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		streamID := binary.BigEndian.Uint32(header[1:])
+		data := make([]byte, binary.BigEndian.Uint16(header[5:]))
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return
+		}
+
+		s.streamAccess.Lock()
+		stream := s.stream
+		s.streamAccess.Unlock()
+		if stream != nil && stream.id != streamID {
+			stream = nil
+		}
+
+		switch header[0] {
+		case anyTLSCmdPSH:
+			if stream != nil {
+				if _, err := stream.writer.Write(data); err != nil {
+					// closed by the client, the FIN is on its way
+					continue
+				}
+			}
+		case anyTLSCmdFIN:
+			if stream != nil {
+				_ = stream.writer.Close()
+			}
+		case anyTLSCmdSYNACK:
+			if stream != nil && len(data) > 0 {
+				_ = stream.writer.CloseWithError(fmt.Errorf("server refused: %s", data))
+			}
+		case anyTLSCmdAlert:
+			log.Warnf("[AnyTLS] server alert: %s", data)
+			return
+		case anyTLSCmdUpdatePaddingScheme:
+			padding, err := parseAnyTLSPadding(string(data))
+			if err != nil {
+				log.Warnf("[AnyTLS] invalid padding scheme from server: %s", err.Error())
+				continue
+			}
+			s.instance.access.Lock()
+			s.instance.padding = padding
+			s.instance.access.Unlock()
+		case anyTLSCmdHeartRequest:
+			if err := s.write(appendAnyTLSFrame(nil, anyTLSCmdHeartResponse, streamID, nil)); err != nil {
+				return
+			}
+		case anyTLSCmdWaste, anyTLSCmdSettings, anyTLSCmdServerSettings, anyTLSCmdHeartResponse:
+		}
+	}
+}
+
+// anyTLSStream is a connection carried by a session.
+type anyTLSStream struct {
+	session   *anyTLSSession
+	id        uint32
+	reader    *io.PipeReader
+	writer    *io.PipeWriter
+	closeOnce sync.Once
+}
+
+func (s *anyTLSStream) Read(b []byte) (int, error) {
+	return s.reader.Read(b)
+}
+
+func (s *anyTLSStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > anyTLSMaxFrame {
+			chunk = chunk[:anyTLSMaxFrame]
+		}
+		if err := s.session.write(appendAnyTLSFrame(nil, anyTLSCmdPSH, s.id, chunk)); err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close ends the stream and returns the session to the idle pool.
+func (s *anyTLSStream) Close() error {
+	s.closeOnce.Do(func() {
+		_ = s.reader.Close()
+		s.session.streamAccess.Lock()
+		if s.session.stream == s {
+			s.session.stream = nil
+		}
+		s.session.streamAccess.Unlock()
+		if s.session.write(appendAnyTLSFrame(nil, anyTLSCmdFIN, s.id, nil)) != nil {
+			_ = s.session.Close()
+			return
+		}
+		if s.session.dedicated {
+			_ = s.session.Close()
+		} else if !s.session.isClosed() {
+			s.session.instance.putSession(s.session)
+		}
+	})
+	return nil
+}
+
+func (s *anyTLSStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *anyTLSStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *anyTLSStream) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (s *anyTLSStream) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (s *anyTLSStream) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// NewAnyTLSInstance creates an AnyTLS instance. paddingScheme may be empty for
+// the default scheme, servers can replace it for the next sessions.
+func NewAnyTLSInstance(socksPort int32, server string, port int32, password string, sni string, skipCertVerify bool, paddingScheme string) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password); err != nil {
+		return nil, err
+	}
+	if paddingScheme == "" {
+		paddingScheme = anyTLSDefaultPadding
+	}
+	padding, err := parseAnyTLSPadding(paddingScheme)
+	if err != nil {
+		return nil, err
+	}
+	if sni == "" {
+		sni = server
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	out := &anyTLSInstance{
+		Base:   outbound.NewBase("anytls", address, clashC.Direct, false),
+		server: address,
+		tlsConfig: &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: skipCertVerify,
+		},
+		password: sha256.Sum256([]byte(password)),
+		padding:  padding,
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
@@ -0,0 +1,59 @@
+package libcore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAnyTLSPadding(t *testing.T) {
+	tests := []struct {
+		scheme string
+		stop   uint32
+		valid  bool
+	}{
+		{anyTLSDefaultPadding, 8, true},
+		{"stop=2\n\n  0=10-10  \n", 2, true},
+		{"0=10-10", 0, false},
+		{"stop=0", 0, false},
+		{"stop=x", 0, false},
+		{"stop=2\na=10", 0, false},
+		{"stop=2\n0", 0, false},
+	}
+	for _, test := range tests {
+		padding, err := parseAnyTLSPadding(test.scheme)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got error %v", test.scheme, err)
+			continue
+		}
+		if test.valid && padding.stop != test.stop {
+			t.Errorf("%q: got stop %d, want %d", test.scheme, padding.stop, test.stop)
+		}
+	}
+}
+
+func TestAnyTLSPaddingSizes(t *testing.T) {
+	padding, err := parseAnyTLSPadding("stop=4\n0=30-30\n1=20,c,5-5\n2=x,20-10,0-0,7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pkt   uint32
+		sizes []int
+	}{
+		{0, []int{30}},
+		{1, []int{20, anyTLSCheckMark, 5}},
+		{2, []int{7}},
+		{3, nil},
+	}
+	for _, test := range tests {
+		if sizes := padding.sizes(test.pkt); !reflect.DeepEqual(sizes, test.sizes) {
+			t.Errorf("packet %d: got %v, want %v", test.pkt, sizes, test.sizes)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		sizes := (&anyTLSPadding{scheme: map[uint32][]string{0: {"10-20"}}}).sizes(0)
+		if len(sizes) != 1 || sizes[0] < 10 || sizes[0] > 20 {
+			t.Fatalf("got %v, want one size in 10-20", sizes)
+		}
+	}
+}
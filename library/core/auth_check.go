@@ -0,0 +1,116 @@
+package libcore
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clashC "github.com/Dreamacro/clash/constant"
+)
+
+// Shadowsocks and Trojan servers do not answer a wrong password, they close the
+// connection or stall, so "it connects but nothing loads". These codes classify
+// the likely cause from the connections relayed.
+const (
+	AuthFailureNone int32 = iota
+	// AuthFailureSuspected means repeated connections were closed by the
+	// server right after the request without any response.
+	AuthFailureSuspected
+	// AuthFailureDecrypt means responses failed AEAD authentication, the
+	// password or cipher does not match the server.
+	AuthFailureDecrypt
+)
+
+const (
+	authImmediateClose   = 3 * time.Second
+	authSuspectThreshold = 5
+)
+
+type AuthFailureListener interface {
+	OnAuthFailure(code int32, message string)
+}
+
+type authCheck struct {
+	access      sync.Mutex
+	code        int32
+	consecutive int
+	listener    AuthFailureListener
+}
+
+// authConn records what happened on an outbound connection.
+type authConn struct {
+	net.Conn
+	read    int64
+	written int64
+	readErr atomic.Value
+}
+
+func (c *authConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	if err != nil {
+		c.readErr.Store(err.Error())
+	}
+	return
+}
+
+func (c *authConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return
+}
+
+func (s *ClashBasedInstance) SetAuthFailureListener(listener AuthFailureListener) {
+	s.auth.access.Lock()
+	s.auth.listener = listener
+	s.auth.access.Unlock()
+}
+
+// AuthFailure returns the current AuthFailure code of the instance.
+func (s *ClashBasedInstance) AuthFailure() int32 {
+	s.auth.access.Lock()
+	defer s.auth.access.Unlock()
+	return s.auth.code
+}
+
+func (s *ClashBasedInstance) checksAuth() bool {
+	switch s.out.Type() {
+	case clashC.Shadowsocks, clashC.ShadowsocksR, clashC.Trojan:
+		return true
+	}
+	return false
+}
+
+func (a *authCheck) observe(conn *authConn, duration time.Duration) {
+	read := atomic.LoadInt64(&conn.read)
+	written := atomic.LoadInt64(&conn.written)
+	readErr, _ := conn.readErr.Load().(string)
+
+	a.access.Lock()
+	code := a.code
+	var message string
+	switch {
+	case strings.Contains(readErr, "authentication failed"):
+		code = AuthFailureDecrypt
+		message = "response failed to decrypt, check the password and cipher: " + readErr
+	case read > 0:
+		a.consecutive = 0
+		code = AuthFailureNone
+	case written > 0 && duration < authImmediateClose:
+		a.consecutive++
+		if a.consecutive >= authSuspectThreshold && code == AuthFailureNone {
+			code = AuthFailureSuspected
+			message = "server closed repeated connections without responding, check the password and cipher"
+		}
+	}
+	changed := code != a.code
+	a.code = code
+	listener := a.listener
+	a.access.Unlock()
+
+	if changed && listener != nil {
+		listener.OnAuthFailure(code, message)
+	}
+}
@@ -0,0 +1,265 @@
+package libcore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	backupMagic         = "ANXB"
+	backupFormatVersion = 1
+	backupFlagEncrypted = 1 << 0
+	backupSaltSize      = 16
+)
+
+// backupMigrations upgrades the content of older schema versions, indexed by
+// the version being upgraded from.
+var backupMigrations = map[int]func(content *backupContent) error{}
+
+type backupContent struct {
+	Version  int                          `json:"version"`
+	Created  int64                        `json:"created"`
+	Sections map[string][]json.RawMessage `json:"sections"`
+}
+
+// BackupBuilder collects profiles, groups, rules and subscriptions (as JSON
+// objects, grouped by section name) into a backup bundle.
+type BackupBuilder struct {
+	content backupContent
+}
+
+func NewBackupBuilder() *BackupBuilder {
+	return &BackupBuilder{
+		content: backupContent{
+			Version:  backupFormatVersion,
+			Sections: map[string][]json.RawMessage{},
+		},
+	}
+}
+
+func (b *BackupBuilder) Add(section string, item string) error {
+	if !json.Valid([]byte(item)) {
+		return fmt.Errorf("invalid json item in section %s", section)
+	}
+	b.content.Sections[section] = append(b.content.Sections[section], json.RawMessage(item))
+	return nil
+}
+
+// Build serializes the bundle, encrypting it if password is not empty.
+func (b *BackupBuilder) Build(password string) ([]byte, error) {
+	b.content.Created = time.Now().Unix()
+	content, err := json.Marshal(&b.content)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &bytes.Buffer{}
+	writer := gzip.NewWriter(payload)
+	if _, err = writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	bundle := &bytes.Buffer{}
+	bundle.WriteString(backupMagic)
+	bundle.WriteByte(backupFormatVersion)
+	if password == "" {
+		bundle.WriteByte(0)
+		bundle.Write(payload.Bytes())
+		return bundle.Bytes(), nil
+	}
+
+	salt := make([]byte, backupSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := deriveBackupKey(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := aesGcmSeal(key, payload.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	bundle.WriteByte(backupFlagEncrypted)
+	bundle.Write(salt)
+	bundle.Write(sealed)
+	return bundle.Bytes(), nil
+}
+
+type BackupReader struct {
+	content backupContent
+}
+
+// OpenBackup decodes a bundle, upgrading older schema versions.
+func OpenBackup(data []byte, password string) (*BackupReader, error) {
+	if len(data) < len(backupMagic)+2 || string(data[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("not a backup file")
+	}
+	data = data[len(backupMagic):]
+	if data[0] != backupFormatVersion {
+		return nil, fmt.Errorf("unsupported backup format %d", data[0])
+	}
+	flags := data[1]
+	payload := data[2:]
+
+	if flags&backupFlagEncrypted != 0 {
+		if password == "" {
+			return nil, errors.New("backup is encrypted, password required")
+		}
+		if len(payload) < backupSaltSize {
+			return nil, errors.New("truncated backup")
+		}
+		key, err := deriveBackupKey(password, payload[:backupSaltSize])
+		if err != nil {
+			return nil, err
+		}
+		payload, err = aesGcmOpen(key, payload[backupSaltSize:])
+		if err != nil {
+			return nil, errors.New("wrong password or corrupted backup")
+		}
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, errors.WithMessage(err, "decompress backup")
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.WithMessage(err, "decompress backup")
+	}
+
+	r := &BackupReader{}
+	if err = json.Unmarshal(content, &r.content); err != nil {
+		return nil, errors.WithMessage(err, "parse backup")
+	}
+	if r.content.Version > backupFormatVersion {
+		return nil, fmt.Errorf("backup version %d is newer than supported version %d", r.content.Version, backupFormatVersion)
+	}
+	for r.content.Version < backupFormatVersion {
+		if migrate := backupMigrations[r.content.Version]; migrate != nil {
+			if err = migrate(&r.content); err != nil {
+				return nil, errors.WithMessagef(err, "upgrade backup from version %d", r.content.Version)
+			}
+		}
+		r.content.Version++
+	}
+	return r, nil
+}
+
+func (r *BackupReader) Version() int32 {
+	return int32(r.content.Version)
+}
+
+func (r *BackupReader) CreatedAt() int64 {
+	return r.content.Created
+}
+
+// Sections returns the section names, separated by commas.
+func (r *BackupReader) Sections() string {
+	var names []string
+	for name := range r.content.Sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (r *BackupReader) Count(section string) int32 {
+	return int32(len(r.content.Sections[section]))
+}
+
+func (r *BackupReader) Item(section string, index int32) (string, error) {
+	items := r.content.Sections[section]
+	if index < 0 || int(index) >= len(items) {
+		return "", fmt.Errorf("index %d out of range for section %s", index, section)
+	}
+	return string(items[index]), nil
+}
+
+// Merge merges the section into existing, a JSON array of objects. Items
+// with the same key field are replaced by the ones from the backup, others
+// are appended.
+func (r *BackupReader) Merge(section string, existing string, key string) (string, error) {
+	var current []map[string]interface{}
+	if existing != "" {
+		if err := json.Unmarshal([]byte(existing), &current); err != nil {
+			return "", errors.WithMessage(err, "parse existing items")
+		}
+	}
+	index := map[string]int{}
+	for i, item := range current {
+		if value, ok := item[key]; ok {
+			index[fmt.Sprint(value)] = i
+		}
+	}
+	for _, raw := range r.content.Sections[section] {
+		var item map[string]interface{}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return "", errors.WithMessagef(err, "parse item in section %s", section)
+		}
+		if value, ok := item[key]; ok {
+			if i, exists := index[fmt.Sprint(value)]; exists {
+				current[i] = item
+				continue
+			}
+			index[fmt.Sprint(value)] = len(current)
+		}
+		current = append(current, item)
+	}
+	merged, err := json.Marshal(current)
+	if err != nil {
+		return "", err
+	}
+	return string(merged), nil
+}
+
+func deriveBackupKey(password string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(password), salt, 1<<15, 8, 1, 32)
+}
+
+// aesGcmSeal encrypts plaintext with a random nonce prepended to the output.
+func aesGcmSeal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func aesGcmOpen(key []byte, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
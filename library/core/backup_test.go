@@ -0,0 +1,68 @@
+package libcore
+
+import "testing"
+
+func buildTestBackup(t *testing.T, password string) []byte {
+	builder := NewBackupBuilder()
+	for _, item := range []struct{ section, item string }{
+		{"profiles", `{"id":1}`},
+		{"profiles", `{"id":2}`},
+		{"rules", `{"id":"r"}`},
+	} {
+		if err := builder.Add(item.section, item.item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := builder.Build(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	for _, password := range []string{"", "secret"} {
+		reader, err := OpenBackup(buildTestBackup(t, password), password)
+		if err != nil {
+			t.Errorf("password %q: %v", password, err)
+			continue
+		}
+		if reader.Version() != backupFormatVersion || reader.Sections() != "profiles,rules" || reader.Count("profiles") != 2 {
+			t.Errorf("password %q: got version %d, sections %q", password, reader.Version(), reader.Sections())
+		}
+		if item, err := reader.Item("profiles", 1); err != nil || item != `{"id":2}` {
+			t.Errorf("password %q: got item %q, %v", password, item, err)
+		}
+		if _, err := reader.Item("rules", 1); err == nil {
+			t.Errorf("password %q: out of range item returned", password)
+		}
+	}
+}
+
+func TestOpenBackupErrors(t *testing.T) {
+	plain := buildTestBackup(t, "")
+	encrypted := buildTestBackup(t, "secret")
+	unknownFormat := append([]byte(nil), plain...)
+	unknownFormat[len(backupMagic)] = backupFormatVersion + 1
+	corrupted := append([]byte(nil), plain[:len(backupMagic)+2]...)
+	corrupted = append(corrupted, "not gzip"...)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		password string
+	}{
+		{"not a backup", []byte("not a backup"), ""},
+		{"magic only", []byte(backupMagic), ""},
+		{"unknown format", unknownFormat, ""},
+		{"corrupted", corrupted, ""},
+		{"missing password", encrypted, ""},
+		{"wrong password", encrypted, "wrong"},
+		{"truncated", encrypted[:len(backupMagic)+2+backupSaltSize/2], "secret"},
+	}
+	for _, test := range tests {
+		if _, err := OpenBackup(test.data, test.password); err == nil {
+			t.Errorf("%s: opened", test.name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package libcore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type ThroughputListener interface {
+	// UpdateThroughput reports the measured throughput in bytes per second.
+	UpdateThroughput(uplink int64, downlink int64)
+}
+
+// bandwidthHint holds the up/down rates a hysteria client announces to the
+// server, which sends at the announced down rate.
+type bandwidthHint struct {
+	access   sync.RWMutex
+	upMbps   int
+	downMbps int
+	onChange func()
+}
+
+func newBandwidthHint(upMbps int32, downMbps int32) (*bandwidthHint, error) {
+	if upMbps <= 0 || downMbps <= 0 {
+		return nil, fmt.Errorf("up and down bandwidth are required, got %d/%d Mbps", upMbps, downMbps)
+	}
+	return &bandwidthHint{upMbps: int(upMbps), downMbps: int(downMbps)}, nil
+}
+
+// update changes the bandwidth hints of a running outbound.
+func (b *bandwidthHint) update(upMbps int32, downMbps int32) error {
+	if upMbps <= 0 || downMbps <= 0 {
+		return fmt.Errorf("up and down bandwidth are required, got %d/%d Mbps", upMbps, downMbps)
+	}
+	b.access.Lock()
+	b.upMbps = int(upMbps)
+	b.downMbps = int(downMbps)
+	onChange := b.onChange
+	b.access.Unlock()
+
+	if onChange != nil {
+		onChange()
+	}
+	return nil
+}
+
+func (b *bandwidthHint) upBytesPerSecond() uint64 {
+	b.access.RLock()
+	defer b.access.RUnlock()
+	return uint64(b.upMbps) * 1000 * 1000 / 8
+}
+
+func (b *bandwidthHint) downBytesPerSecond() uint64 {
+	b.access.RLock()
+	defer b.access.RUnlock()
+	return uint64(b.downMbps) * 1000 * 1000 / 8
+}
+
+// SetBandwidthHint changes the up/down bandwidth hints of a running hysteria
+// instance. They apply to the connections made from then on, on a new session,
+// while live connections keep the former session until they are closed.
+func (s *ClashBasedInstance) SetBandwidthHint(upMbps int32, downMbps int32) error {
+	if s.bandwidth == nil {
+		return errors.New("bandwidth hints are not supported by this instance")
+	}
+	return s.bandwidth.update(upMbps, downMbps)
+}
+
+// SetThroughputListener reports the relayed throughput every intervalMs
+// milliseconds until the instance is closed, or stops reporting if listener is nil.
+func (s *ClashBasedInstance) SetThroughputListener(listener ThroughputListener, intervalMs int32) {
+	s.stopThroughputListener()
+	if listener == nil || intervalMs <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	s.statsAccess.Lock()
+	s.throughputDone = done
+	s.statsAccess.Unlock()
+
+	interval := time.Duration(intervalMs) * time.Millisecond
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastUplink := atomic.LoadUint64(&s.uplink)
+		lastDownlink := atomic.LoadUint64(&s.downlink)
+		lastTime := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				uplink := atomic.LoadUint64(&s.uplink)
+				downlink := atomic.LoadUint64(&s.downlink)
+				elapsed := now.Sub(lastTime).Seconds()
+				listener.UpdateThroughput(int64(float64(uplink-lastUplink)/elapsed), int64(float64(downlink-lastDownlink)/elapsed))
+				lastUplink, lastDownlink, lastTime = uplink, downlink, now
+			}
+		}
+	}()
+}
+
+func (s *ClashBasedInstance) stopThroughputListener() {
+	s.statsAccess.Lock()
+	defer s.statsAccess.Unlock()
+
+	if s.throughputDone != nil {
+		close(s.throughputDone)
+		s.throughputDone = nil
+	}
+}
@@ -0,0 +1,59 @@
+package libcore
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	BindErrorUnknown int32 = iota
+	BindErrorAddressInUse
+	BindErrorPermissionDenied
+)
+
+type BindError struct {
+	Port  int32
+	Code  int32
+	Cause string
+	err   error
+}
+
+func (e *BindError) Error() string {
+	return fmt.Sprintf("bind port %d failed: %s (%s)", e.Port, e.Cause, e.err.Error())
+}
+
+func (e *BindError) Unwrap() error {
+	return e.err
+}
+
+func newBindError(port int32, err error) *BindError {
+	bindErr := &BindError{
+		Port:  port,
+		Code:  BindErrorUnknown,
+		Cause: "unknown error",
+		err:   err,
+	}
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		bindErr.Code = BindErrorAddressInUse
+		bindErr.Cause = "port already in use, probably by another VPN or proxy app"
+	case errors.Is(err, syscall.EACCES):
+		bindErr.Code = BindErrorPermissionDenied
+		if port < 1024 {
+			bindErr.Cause = "ports below 1024 require root, use a port above 1023"
+		} else {
+			bindErr.Cause = "permission denied"
+		}
+	}
+	return bindErr
+}
+
+// LastBindError returns the structured error of the last failed bind of the
+// inbound, or nil.
+func (s *ClashBasedInstance) LastBindError() *BindError {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.bindError
+}
@@ -0,0 +1,115 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// BLAKE3 limited to inputs of one chunk and 32 byte outputs, which is all the
+// key derivation of Shadowsocks 2022 needs.
+
+const (
+	blake3BlockLen          = 64
+	blake3ChunkLen          = 1024
+	blake3ChunkStart        = 1 << 0
+	blake3ChunkEnd          = 1 << 1
+	blake3Root              = 1 << 3
+	blake3DeriveKeyContext  = 1 << 5
+	blake3DeriveKeyMaterial = 1 << 6
+)
+
+var blake3IV = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, x, y uint32) {
+	s[a] += s[b] + x
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + y
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// blake3Compress compresses a block of the first chunk, whose counter is zero.
+func blake3Compress(cv [8]uint32, m [16]uint32, blockLen uint32, flags uint32) [8]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		0, 0, blockLen, flags,
+	}
+	for round := 0; round < 7; round++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var permuted [16]uint32
+		for i, index := range blake3Permutation {
+			permuted[i] = m[index]
+		}
+		m = permuted
+	}
+	for i := range cv {
+		cv[i] = s[i] ^ s[i+8]
+	}
+	return cv
+}
+
+func blake3Hash(key [8]uint32, flags uint32, input []byte) [8]uint32 {
+	if len(input) > blake3ChunkLen {
+		panic("blake3 input longer than a chunk")
+	}
+	blocks := (len(input) + blake3BlockLen - 1) / blake3BlockLen
+	if blocks == 0 {
+		blocks = 1
+	}
+	cv := key
+	for i := 0; i < blocks; i++ {
+		block := input[i*blake3BlockLen:]
+		if len(block) > blake3BlockLen {
+			block = block[:blake3BlockLen]
+		}
+		var buf [blake3BlockLen]byte
+		copy(buf[:], block)
+		var m [16]uint32
+		for j := range m {
+			m[j] = binary.LittleEndian.Uint32(buf[j*4:])
+		}
+		blockFlags := flags
+		if i == 0 {
+			blockFlags |= blake3ChunkStart
+		}
+		if i == blocks-1 {
+			blockFlags |= blake3ChunkEnd | blake3Root
+		}
+		cv = blake3Compress(cv, m, uint32(len(block)), blockFlags)
+	}
+	return cv
+}
+
+func blake3Bytes(words [8]uint32) []byte {
+	out := make([]byte, 32)
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(out[i*4:], word)
+	}
+	return out
+}
+
+func blake3Sum256(input []byte) []byte {
+	return blake3Bytes(blake3Hash(blake3IV, 0, input))
+}
+
+// blake3DeriveKey returns size bytes, at most 32, derived from material.
+func blake3DeriveKey(context string, material []byte, size int) []byte {
+	contextKey := blake3Hash(blake3IV, blake3DeriveKeyContext, []byte(context))
+	return blake3Bytes(blake3Hash(contextKey, blake3DeriveKeyMaterial, material))[:size]
+}
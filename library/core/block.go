@@ -0,0 +1,400 @@
+package libcore
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type DomainBlocker struct {
+	blocked     int64
+	lookups     int64
+	lookupNanos int64
+
+	access         sync.RWMutex
+	enabled        bool
+	suffix         map[string]struct{}
+	full           map[string]struct{}
+	compiledSuffix *compiledDomains
+	compiledFull   *compiledDomains
+	// reject modes of the rules with one, full rules prefixed with "full:"
+	modes map[string]int32
+}
+
+// DomainBlockerStats reports the size and the cost of a blocker.
+type DomainBlockerStats struct {
+	Entries         int32
+	CompiledEntries int32
+	// estimated bytes held by the entries
+	MemoryBytes        int64
+	Lookups            int64
+	Blocked            int64
+	AverageLookupNanos int64
+}
+
+func NewDomainBlocker() *DomainBlocker {
+	return &DomainBlocker{
+		enabled: true,
+		suffix:  map[string]struct{}{},
+		full:    map[string]struct{}{},
+		modes:   map[string]int32{},
+	}
+}
+
+var (
+	domainBlockerAccess sync.RWMutex
+	domainBlocker       *DomainBlocker
+)
+
+func SetDomainBlocker(blocker *DomainBlocker) {
+	domainBlockerAccess.Lock()
+	domainBlocker = blocker
+	domainBlockerAccess.Unlock()
+}
+
+func currentDomainBlocker() *DomainBlocker {
+	domainBlockerAccess.RLock()
+	defer domainBlockerAccess.RUnlock()
+	return domainBlocker
+}
+
+func (b *DomainBlocker) SetEnabled(enabled bool) {
+	b.access.Lock()
+	b.enabled = enabled
+	b.access.Unlock()
+}
+
+// LoadHosts adds every domain of a hosts-format list ("0.0.0.0 ads.example.com")
+// and returns the number of entries loaded.
+func (b *DomainBlocker) LoadHosts(content string) int32 {
+	count, _ := b.loadHosts(strings.NewReader(content))
+	return count
+}
+
+// LoadHostsFile is LoadHosts reading the list from path, without copying the
+// whole list of a large blocklist through the app.
+func (b *DomainBlocker) LoadHostsFile(path string) (int32, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return b.loadHosts(file)
+}
+
+func (b *DomainBlocker) loadHosts(reader io.Reader) (int32, error) {
+	var count int32
+	b.access.Lock()
+	defer b.access.Unlock()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexByte(line, '#'); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		for _, domain := range fields[1:] {
+			domain = normalizeDomain(domain)
+			if domain == "" || domain == "localhost" {
+				continue
+			}
+			b.full[domain] = struct{}{}
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// rejectModeNames are the values of the "$reject=" rule option.
+var rejectModeNames = map[string]int32{
+	"reset": RejectModeReset,
+	"drop":  RejectModeDrop,
+	"http":  RejectModeHttp,
+	"zero":  RejectModeZeroAddress,
+}
+
+// LoadDomainList adds one rule per line. Plain and "domain:" entries match the
+// domain and all its subdomains, "full:" entries only match exactly. A rule
+// ending with "$reject=<reset|drop|http|zero>" is rejected in that mode
+// instead of the one set by SetRejectMode.
+func (b *DomainBlocker) LoadDomainList(content string) int32 {
+	var count int32
+	b.access.Lock()
+	defer b.access.Unlock()
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		mode := int32(-1)
+		if index := strings.LastIndex(line, "$reject="); index >= 0 {
+			var ok bool
+			if mode, ok = rejectModeNames[strings.TrimSpace(line[index+8:])]; !ok {
+				continue
+			}
+			line = strings.TrimSpace(line[:index])
+		}
+		switch {
+		case strings.HasPrefix(line, "full:"):
+			if domain := normalizeDomain(line[5:]); domain != "" {
+				b.full[domain] = struct{}{}
+				if mode >= 0 {
+					b.modes["full:"+domain] = mode
+				}
+				count++
+			}
+			continue
+		case strings.HasPrefix(line, "domain:"):
+			line = line[7:]
+		case strings.HasPrefix(line, "||"):
+			line = strings.TrimSuffix(line[2:], "^")
+		}
+		if domain := normalizeDomain(line); domain != "" {
+			b.suffix[domain] = struct{}{}
+			if mode >= 0 {
+				b.modes[domain] = mode
+			}
+			count++
+		}
+	}
+	return count
+}
+
+func (b *DomainBlocker) Clear() {
+	b.access.Lock()
+	b.suffix = map[string]struct{}{}
+	b.full = map[string]struct{}{}
+	b.compiledSuffix = nil
+	b.compiledFull = nil
+	b.modes = map[string]int32{}
+	b.access.Unlock()
+}
+
+// Compile moves the loaded entries into sorted tables packed in one string,
+// which take a fraction of the memory of the maps for lists of hundreds of
+// thousands of hosts. Entries loaded afterwards are kept apart until the next
+// Compile.
+func (b *DomainBlocker) Compile() {
+	b.access.Lock()
+	defer b.access.Unlock()
+	b.compiledSuffix = compileDomains(b.compiledSuffix, b.suffix)
+	b.compiledFull = compileDomains(b.compiledFull, b.full)
+	b.suffix = map[string]struct{}{}
+	b.full = map[string]struct{}{}
+}
+
+func (b *DomainBlocker) Size() int32 {
+	b.access.RLock()
+	defer b.access.RUnlock()
+	return int32(len(b.suffix) + len(b.full) + b.compiledSuffix.len() + b.compiledFull.len())
+}
+
+func (b *DomainBlocker) Stats() *DomainBlockerStats {
+	b.access.RLock()
+	compiled := b.compiledSuffix.len() + b.compiledFull.len()
+	memory := b.compiledSuffix.size() + b.compiledFull.size() + mapSize(b.suffix) + mapSize(b.full)
+	entries := len(b.suffix) + len(b.full) + compiled
+	b.access.RUnlock()
+
+	stats := &DomainBlockerStats{
+		Entries:         int32(entries),
+		CompiledEntries: int32(compiled),
+		MemoryBytes:     memory,
+		Lookups:         atomic.LoadInt64(&b.lookups),
+		Blocked:         atomic.LoadInt64(&b.blocked),
+	}
+	if stats.Lookups > 0 {
+		stats.AverageLookupNanos = atomic.LoadInt64(&b.lookupNanos) / stats.Lookups
+	}
+	return stats
+}
+
+func (b *DomainBlocker) BlockedCount() int64 {
+	return atomic.LoadInt64(&b.blocked)
+}
+
+func (b *DomainBlocker) ResetBlockedCount() {
+	atomic.StoreInt64(&b.blocked, 0)
+}
+
+func (b *DomainBlocker) Match(domain string) bool {
+	matched, _ := b.match(domain)
+	return matched
+}
+
+// match reports whether domain is blocked, along with the reject mode of the
+// rule, -1 if it has none.
+func (b *DomainBlocker) match(domain string) (bool, int32) {
+	domain = normalizeDomain(domain)
+	if domain == "" {
+		return false, -1
+	}
+
+	b.access.RLock()
+	defer b.access.RUnlock()
+
+	if !b.enabled {
+		return false, -1
+	}
+	start := time.Now()
+	matched := false
+	mode, hasMode := int32(-1), false
+	if _, ok := b.full[domain]; ok || b.compiledFull.contains(domain) {
+		matched = true
+		mode, hasMode = b.modes["full:"+domain]
+	}
+	for name := domain; !matched; {
+		if _, ok := b.suffix[name]; ok || b.compiledSuffix.contains(name) {
+			matched = true
+			mode, hasMode = b.modes[name]
+			break
+		}
+		index := strings.IndexByte(name, '.')
+		if index < 0 {
+			break
+		}
+		name = name[index+1:]
+	}
+	atomic.AddInt64(&b.lookups, 1)
+	atomic.AddInt64(&b.lookupNanos, int64(time.Since(start)))
+	if matched {
+		atomic.AddInt64(&b.blocked, 1)
+	}
+	if !hasMode {
+		mode = -1
+	}
+	return matched, mode
+}
+
+// compiledDomains is a sorted table of domains, packed in data and delimited
+// by offsets.
+type compiledDomains struct {
+	data    string
+	offsets []uint32
+}
+
+func compileDomains(base *compiledDomains, set map[string]struct{}) *compiledDomains {
+	domains := make([]string, 0, base.len()+len(set))
+	for i := 0; i < base.len(); i++ {
+		domains = append(domains, base.at(i))
+	}
+	for domain := range set {
+		domains = append(domains, domain)
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	sort.Strings(domains)
+
+	var data strings.Builder
+	offsets := make([]uint32, 1, len(domains)+1)
+	for i, domain := range domains {
+		if i > 0 && domain == domains[i-1] {
+			continue
+		}
+		data.WriteString(domain)
+		offsets = append(offsets, uint32(data.Len()))
+	}
+	return &compiledDomains{data: data.String(), offsets: offsets}
+}
+
+func (c *compiledDomains) len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.offsets) - 1
+}
+
+func (c *compiledDomains) at(i int) string {
+	return c.data[c.offsets[i]:c.offsets[i+1]]
+}
+
+func (c *compiledDomains) contains(domain string) bool {
+	n := c.len()
+	if n == 0 {
+		return false
+	}
+	i := sort.Search(n, func(i int) bool {
+		return c.at(i) >= domain
+	})
+	return i < n && c.at(i) == domain
+}
+
+func (c *compiledDomains) size() int64 {
+	if c == nil {
+		return 0
+	}
+	return int64(len(c.data) + 4*len(c.offsets))
+}
+
+// mapSize estimates the memory of a set, counting the string headers and the
+// bucket overhead of each entry along with the key.
+func mapSize(set map[string]struct{}) int64 {
+	var size int64
+	for domain := range set {
+		size += int64(len(domain)) + 48
+	}
+	return size
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func isBlocked(domain string) bool {
+	blocker := currentDomainBlocker()
+	return blocker != nil && domain != "" && blocker.Match(domain)
+}
+
+// blockedRejectMode reports whether domain is blocked, along with the reject
+// mode of the rule or the default one.
+func blockedRejectMode(domain string) (int32, bool) {
+	blocker := currentDomainBlocker()
+	if blocker == nil || domain == "" {
+		return 0, false
+	}
+	matched, mode := blocker.match(domain)
+	if mode < 0 {
+		mode = atomic.LoadInt32(&rejectMode)
+	}
+	return mode, matched
+}
+
+// blockedDnsResponse reports whether the message is a query for a blocked
+// domain, along with the reply to be sent back, if any.
+func blockedDnsResponse(message []byte) ([]byte, bool) {
+	if currentDomainBlocker() == nil {
+		return nil, false
+	}
+	query := dns.Msg{}
+	if err := query.Unpack(message); err != nil || query.Response || len(query.Question) == 0 {
+		return nil, false
+	}
+	mode, blocked := blockedRejectMode(query.Question[0].Name)
+	if !blocked {
+		return nil, false
+	}
+	response := rejectDnsResponse(&query, mode)
+	if response == nil {
+		return nil, true
+	}
+	reply, err := response.Pack()
+	if err != nil {
+		return nil, true
+	}
+	return reply, true
+}
@@ -0,0 +1,122 @@
+package libcore
+
+import "testing"
+
+const testHosts = `# comment
+0.0.0.0 ads.example.com tracker.example.net
+127.0.0.1 localhost
+::1 ip6.example.org # trailing comment
+not-an-ip bad.example.com
+`
+
+const testDomainList = `! comment
+# comment
+example.org
+full:exact.example.com
+domain:suffix.example.net
+||adblock.example.com^
+`
+
+var domainBlockerTests = []struct {
+	domain  string
+	blocked bool
+}{
+	{"ads.example.com", true},
+	{"sub.ads.example.com", false},
+	{"tracker.example.net.", true},
+	{"ip6.example.org", true},
+	{"localhost", false},
+	{"bad.example.com", false},
+	{"example.org", true},
+	{"WWW.Example.ORG", true},
+	{"exact.example.com", true},
+	{"sub.exact.example.com", false},
+	{"a.suffix.example.net", true},
+	{"x.adblock.example.com", true},
+	{"example.com", false},
+	{"", false},
+}
+
+func newTestDomainBlocker(t *testing.T) *DomainBlocker {
+	blocker := NewDomainBlocker()
+	if count := blocker.LoadHosts(testHosts); count != 3 {
+		t.Errorf("loaded %d hosts, want 3", count)
+	}
+	if count := blocker.LoadDomainList(testDomainList); count != 4 {
+		t.Errorf("loaded %d rules, want 4", count)
+	}
+	return blocker
+}
+
+func TestDomainBlocker(t *testing.T) {
+	blocker := newTestDomainBlocker(t)
+	if size := blocker.Size(); size != 7 {
+		t.Errorf("size %d, want 7", size)
+	}
+	for _, test := range domainBlockerTests {
+		if blocked := blocker.Match(test.domain); blocked != test.blocked {
+			t.Errorf("%q: got %v, want %v", test.domain, blocked, test.blocked)
+		}
+	}
+	blocker.SetEnabled(false)
+	if blocker.Match("ads.example.com") {
+		t.Error("disabled blocker matched")
+	}
+}
+
+func TestDomainBlockerRejectModes(t *testing.T) {
+	blocker := NewDomainBlocker()
+	count := blocker.LoadDomainList(`drop.example.com $reject=drop
+full:zero.example.com$reject=zero
+plain.example.com
+bad.example.com$reject=unknown
+`)
+	if count != 3 {
+		t.Errorf("loaded %d rules, want 3", count)
+	}
+	tests := []struct {
+		domain  string
+		blocked bool
+		mode    int32
+	}{
+		{"drop.example.com", true, RejectModeDrop},
+		{"www.drop.example.com", true, RejectModeDrop},
+		{"zero.example.com", true, RejectModeZeroAddress},
+		{"a.zero.example.com", false, -1},
+		{"plain.example.com", true, -1},
+		{"bad.example.com", false, -1},
+	}
+	for _, test := range tests {
+		blocked, mode := blocker.match(test.domain)
+		if blocked != test.blocked || mode != test.mode {
+			t.Errorf("%q: got %v %d, want %v %d", test.domain, blocked, mode, test.blocked, test.mode)
+		}
+	}
+}
+
+func TestCompiledDomainBlocker(t *testing.T) {
+	blocker := newTestDomainBlocker(t)
+	blocker.LoadDomainList("drop.example.com $reject=drop")
+	blocker.Compile()
+	if size, stats := blocker.Size(), blocker.Stats(); size != 8 || stats.CompiledEntries != 8 {
+		t.Errorf("size %d, %d compiled, want 8", size, stats.CompiledEntries)
+	}
+	for _, test := range domainBlockerTests {
+		if blocked := blocker.Match(test.domain); blocked != test.blocked {
+			t.Errorf("%q: got %v, want %v", test.domain, blocked, test.blocked)
+		}
+	}
+	if blocked, mode := blocker.match("www.drop.example.com"); !blocked || mode != RejectModeDrop {
+		t.Errorf("compiled reject rule: got %v %d", blocked, mode)
+	}
+
+	// entries loaded after Compile are kept apart until the next one
+	blocker.LoadDomainList("late.example.com\nexample.org")
+	if size := blocker.Size(); size != 10 || !blocker.Match("www.late.example.com") {
+		t.Errorf("late entry: size %d", size)
+	}
+	blocker.Compile()
+	if size := blocker.Size(); size != 9 || !blocker.Match("www.late.example.com") {
+		t.Errorf("recompiled: size %d", size)
+	}
+}
@@ -0,0 +1,143 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"golang.org/x/sys/unix"
+)
+
+// Handling of destinations that can never be reached through a proxy, which
+// some apps still connect to in bulk: 0.0.0.0/8, 240.0.0.0/4 including the
+// broadcast address, multicast and the unspecified IPv6 address.
+const (
+	TunBogonPass int32 = iota
+	TunBogonDrop
+	TunBogonDirect
+)
+
+var bogonNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "240.0.0.0/4", "224.0.0.0/4", "ff00::/8", "::/128"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isBogon(ip net.IP) bool {
+	for _, network := range bogonNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tun2socks) SetBogonFilter(mode int32) error {
+	if mode < TunBogonPass || mode > TunBogonDirect {
+		return fmt.Errorf("invalid bogon filter mode %d", mode)
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.bogonFilter = mode
+	return nil
+}
+
+// BogonCount returns the number of connections and packet flows to bogon
+// destinations dropped or routed directly.
+func (t *Tun2socks) BogonCount() int64 {
+	return atomic.LoadInt64(&t.bogonCount)
+}
+
+// bogonAction returns the filter mode applying to the destination.
+func (t *Tun2socks) bogonAction(dest v2rayNet.Destination) int32 {
+	if t.bogonFilter == TunBogonPass || !dest.Address.Family().IsIP() || !isBogon(dest.Address.IP()) {
+		return TunBogonPass
+	}
+	atomic.AddInt64(&t.bogonCount, 1)
+	return t.bogonFilter
+}
+
+// Handling of UDP broadcast and multicast, sent in bulk by discovery protocols
+// (SSDP, mDNS, LAN game lobbies) that no proxy can deliver. Bogon follows the
+// bogon filter, Relay hands the packets to the proxy like any other flow.
+const (
+	TunBroadcastBogon int32 = iota
+	TunBroadcastDrop
+	TunBroadcastDirect
+	TunBroadcastRelay
+)
+
+var broadcastNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"255.255.255.255/32", "224.0.0.0/4", "ff00::/8"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isBroadcast(ip net.IP) bool {
+	for _, network := range broadcastNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Tun2socks) SetUdpBroadcastMode(mode int32) error {
+	if mode < TunBroadcastBogon || mode > TunBroadcastRelay {
+		return fmt.Errorf("invalid udp broadcast mode %d", mode)
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.broadcastMode = mode
+	return nil
+}
+
+// BroadcastCount returns the number of broadcast and multicast packet flows
+// handled by the broadcast mode.
+func (t *Tun2socks) BroadcastCount() int64 {
+	return atomic.LoadInt64(&t.broadcastCount)
+}
+
+// udpBogonAction is bogonAction with the broadcast mode applied first.
+func (t *Tun2socks) udpBogonAction(dest v2rayNet.Destination) int32 {
+	if t.broadcastMode == TunBroadcastBogon || !dest.Address.Family().IsIP() || !isBroadcast(dest.Address.IP()) {
+		return t.bogonAction(dest)
+	}
+	atomic.AddInt64(&t.broadcastCount, 1)
+	switch t.broadcastMode {
+	case TunBroadcastDrop:
+		return TunBogonDrop
+	case TunBroadcastDirect:
+		return TunBogonDirect
+	default:
+		return TunBogonPass
+	}
+}
+
+// listenBroadcastUDP is listenDirectUDP allowed to send to broadcast addresses.
+func listenBroadcastUDP() (net.PacketConn, error) {
+	options := &socketOptions{}
+	config := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		if err := options.control(network, address, c); err != nil {
+			return err
+		}
+		var innerErr error
+		err := c.Control(func(fd uintptr) {
+			innerErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return innerErr
+	}}
+	return config.ListenPacket(context.Background(), "udp", "")
+}
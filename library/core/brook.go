@@ -0,0 +1,226 @@
+package libcore
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/Dreamacro/clash/transport/vmess"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	brookNonceSize = 12
+	// frames fit the 2048 bytes buffers of brook
+	brookMaxPayload = 2048 - 2 - 16 - 16
+)
+
+var brookHkdfInfo = []byte("brook")
+
+// brookInstance speaks the stream protocol of brook server, wsserver and
+// wssserver: AES-256-GCM frames keyed by HKDF of the password with a nonce
+// sent by each side, the first frame holding a timestamp and the destination.
+type brookInstance struct {
+	*outbound.Base
+	server    string
+	password  []byte
+	tlsConfig *tls.Config
+	websocket *vmess.WebsocketConfig
+}
+
+func (b *brookInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	rawConn, err := dialServer(ctx, "tcp", b.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(rawConn)
+	defer func() {
+		safeConnClose(rawConn, err)
+	}()
+
+	conn := rawConn
+	if b.tlsConfig != nil {
+		tlsConn := tls.Client(conn, b.tlsConfig)
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = tlsConn.SetDeadline(deadline)
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, errors.WithMessage(err, "tls handshake")
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	if b.websocket != nil {
+		if conn, err = vmess.StreamWebsocketConn(conn, b.websocket, nil); err != nil {
+			return nil, errors.WithMessage(err, "websocket handshake")
+		}
+	}
+	if conn, err = newBrookConn(conn, b.password, socks5.ParseAddr(metadata.RemoteAddress())); err != nil {
+		return nil, err
+	}
+	return outbound.NewConn(conn, b), nil
+}
+
+func (b *brookInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported by the brook instance")
+}
+
+func brookCipher(password []byte, nonce []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, password, nonce, brookHkdfInfo), key); err != nil {
+		return nil, err
+	}
+	return aesGcm(key)
+}
+
+type brookConn struct {
+	net.Conn
+	password []byte
+
+	writer     cipher.AEAD
+	writeNonce []byte
+
+	reader    cipher.AEAD
+	readNonce []byte
+	pending   []byte
+}
+
+func newBrookConn(conn net.Conn, password []byte, destination []byte) (*brookConn, error) {
+	nonce := make([]byte, brookNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	writer, err := brookCipher(password, nonce)
+	if err != nil {
+		return nil, err
+	}
+	c := &brookConn{
+		Conn:       conn,
+		password:   password,
+		writer:     writer,
+		writeNonce: append([]byte(nil), nonce...),
+	}
+	// even timestamps mark TCP requests
+	timestamp := time.Now().Unix()
+	if timestamp%2 != 0 {
+		timestamp++
+	}
+	header := make([]byte, 4, 4+len(destination))
+	binary.BigEndian.PutUint32(header, uint32(timestamp))
+	if _, err = conn.Write(append(nonce, c.seal(append(header, destination...))...)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *brookConn) seal(payload []byte) []byte {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(payload)))
+	frame := c.writer.Seal(nil, c.writeNonce, length[:], nil)
+	increaseNonce(c.writeNonce)
+	frame = c.writer.Seal(frame, c.writeNonce, payload, nil)
+	increaseNonce(c.writeNonce)
+	return frame
+}
+
+func (c *brookConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > brookMaxPayload {
+			chunk = chunk[:brookMaxPayload]
+		}
+		if _, err := c.Conn.Write(c.seal(chunk)); err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (c *brookConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		if c.reader == nil {
+			nonce := make([]byte, brookNonceSize)
+			if _, err := io.ReadFull(c.Conn, nonce); err != nil {
+				return 0, err
+			}
+			reader, err := brookCipher(c.password, nonce)
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+			c.readNonce = nonce
+		}
+		length := make([]byte, 2+c.reader.Overhead())
+		if _, err := io.ReadFull(c.Conn, length); err != nil {
+			return 0, err
+		}
+		if _, err := c.reader.Open(length[:0], c.readNonce, length, nil); err != nil {
+			return 0, errors.WithMessage(err, "decrypt length")
+		}
+		increaseNonce(c.readNonce)
+		payload := make([]byte, int(binary.BigEndian.Uint16(length))+c.reader.Overhead())
+		if _, err := io.ReadFull(c.Conn, payload); err != nil {
+			return 0, err
+		}
+		payload, err := c.reader.Open(payload[:0], c.readNonce, payload, nil)
+		if err != nil {
+			return 0, errors.WithMessage(err, "decrypt payload")
+		}
+		increaseNonce(c.readNonce)
+		c.pending = payload
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// NewBrookInstance creates an instance for brook servers: brook server when
+// wsPath is empty, brook wsserver with a websocket path such as "/ws", and
+// brook wssserver when withTls is also set. Only TCP is relayed.
+func NewBrookInstance(socksPort int32, server string, port int32, password string, wsPath string, withTls bool, sni string, skipCertVerify bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password); err != nil {
+		return nil, err
+	}
+	if withTls && wsPath == "" {
+		return nil, errors.New("brook tls requires a websocket path, as with wssserver")
+	}
+	if sni == "" {
+		sni = server
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	out := &brookInstance{
+		Base:     outbound.NewBase("brook", address, clashC.Direct, false),
+		server:   address,
+		password: []byte(password),
+	}
+	if withTls {
+		out.tlsConfig = &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: skipCertVerify,
+		}
+	}
+	if wsPath != "" {
+		out.websocket = &vmess.WebsocketConfig{
+			Host:    sni,
+			Port:    strconv.Itoa(int(port)),
+			Path:    wsPath,
+			Headers: http.Header{"Host": []string{sni}},
+		}
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
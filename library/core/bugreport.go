@@ -0,0 +1,162 @@
+package libcore
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const recentLogSize = 1000
+
+type logRing struct {
+	access sync.Mutex
+	lines  []string
+	next   int
+}
+
+var recentLogs = &logRing{}
+
+func (r *logRing) add(level logrus.Level, message string) {
+	line := fmt.Sprint(time.Now().Format("15:04:05.000"), " [", strings.Title(level.String()), "] ", strings.TrimRight(message, "\n"))
+
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	if len(r.lines) < recentLogSize {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % recentLogSize
+}
+
+func (r *logRing) writeTo(w io.Writer) error {
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	for i := range r.lines {
+		if _, err := io.WriteString(w, r.lines[(r.next+i)%len(r.lines)]+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var redactedKeys = []string{
+	"password", "pass", "user", "username", "psk", "id", "uuid", "auth", "auth_str", "token", "secret", "key", "privatekey", "presharedkey", "publickey", "shortid",
+}
+
+func redactConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			redacted := false
+			for _, secret := range redactedKeys {
+				if strings.EqualFold(key, secret) {
+					redacted = true
+					break
+				}
+			}
+			if redacted {
+				v[key] = "<redacted>"
+			} else {
+				v[key] = redactConfig(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactConfig(item)
+		}
+	}
+	return value
+}
+
+// GenerateBugReportBundle writes version info, the active config with secrets
+// redacted, recent logs and log files into a zip under dir and returns its path.
+// The zip is removed if it can not be completed.
+func GenerateBugReportBundle(dir string, config string) (_ string, err error) {
+	path := filepath.Join(dir, fmt.Sprint("bugreport-", time.Now().Format("20060102-150405"), ".zip"))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", errors.WithMessage(err, "create bug report")
+	}
+	defer func() {
+		_ = file.Close()
+		if err != nil {
+			_ = os.Remove(path)
+		}
+	}()
+
+	archive := zip.NewWriter(file)
+
+	w, err := archive.Create("version.txt")
+	if err != nil {
+		return "", err
+	}
+	_, _ = fmt.Fprintf(w, "xray-core: %s\ngo: %s\nos: %s/%s\ntime: %s\n", GetV2RayVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH, time.Now().Format(time.RFC3339))
+
+	if config != "" {
+		w, err = archive.Create("config.json")
+		if err != nil {
+			return "", err
+		}
+		var content interface{}
+		if err := json.Unmarshal([]byte(config), &content); err != nil {
+			_, _ = fmt.Fprintf(w, "invalid config: %s\n", err.Error())
+		} else {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			_ = encoder.Encode(redactConfig(content))
+		}
+	}
+
+	w, err = archive.Create("recent.log")
+	if err != nil {
+		return "", err
+	}
+	if err = recentLogs.writeTo(w); err != nil {
+		return "", err
+	}
+
+	fileLogAccess.Lock()
+	logger := fileLogger
+	fileLogAccess.Unlock()
+	if logger != nil {
+		logFiles, _ := filepath.Glob(logger.path + "*")
+		for _, logFile := range logFiles {
+			if err = addFileToZip(archive, logFile); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func addFileToZip(archive *zip.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := archive.Create("logs/" + filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
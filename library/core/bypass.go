@@ -0,0 +1,93 @@
+package libcore
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+)
+
+// bypassList holds the destinations that are always dialed directly instead
+// of through the instance.
+type bypassList struct {
+	access  sync.RWMutex
+	domains map[string]struct{}
+	ips     []*net.IPNet
+	direct  *directInstance
+}
+
+// SetBypassList sets the domains (matching subdomains too), IPs and CIDRs, one
+// per line, that bypass this instance, such as banking apps refusing proxies.
+// It returns the number of entries loaded.
+func (s *ClashBasedInstance) SetBypassList(content string) int32 {
+	domains := map[string]struct{}{}
+	var ips []*net.IPNet
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(line); err == nil {
+			ips = append(ips, cidr)
+		} else if ip := net.ParseIP(line); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ips = append(ips, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if domain := normalizeDomain(line); domain != "" {
+			domains[domain] = struct{}{}
+		}
+	}
+
+	s.bypass.access.Lock()
+	defer s.bypass.access.Unlock()
+	s.bypass.domains = domains
+	s.bypass.ips = ips
+	if s.bypass.direct == nil {
+		s.bypass.direct = &directInstance{
+			Base:    outbound.NewBase("DIRECT", "", clashC.Direct, true),
+			options: &socketOptions{},
+		}
+	}
+	return int32(len(domains) + len(ips))
+}
+
+func (b *bypassList) match(metadata *clashC.Metadata) bool {
+	b.access.RLock()
+	defer b.access.RUnlock()
+
+	if metadata.Host != "" && len(b.domains) > 0 {
+		for name := normalizeDomain(metadata.Host); ; {
+			if _, ok := b.domains[name]; ok {
+				return true
+			}
+			index := strings.IndexByte(name, '.')
+			if index < 0 {
+				break
+			}
+			name = name[index+1:]
+		}
+	}
+	if metadata.DstIP != nil {
+		for _, cidr := range b.ips {
+			if cidr.Contains(metadata.DstIP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *bypassList) dial(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	b.access.RLock()
+	direct := b.direct
+	b.access.RUnlock()
+	return direct.DialContext(ctx, metadata)
+}
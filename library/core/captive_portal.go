@@ -0,0 +1,342 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/core"
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/task"
+)
+
+const captivePortalCheckInterval = 5 * time.Second
+
+type captivePortalProbe struct {
+	url  string
+	want func(resp *http.Response, body []byte) bool
+}
+
+var captivePortalProbes = []captivePortalProbe{
+	{"http://connectivitycheck.gstatic.com/generate_204", isNoContent},
+	{"http://www.google.com/generate_204", isNoContent},
+	{"http://captive.apple.com/hotspot-detect.html", func(resp *http.Response, body []byte) bool {
+		return resp.StatusCode == 200 && strings.Contains(string(body), "Success")
+	}},
+}
+
+// captivePortalHosts are the hosts, besides those of the probes, Android and
+// iOS check for a portal.
+var captivePortalHosts = []string{
+	"connectivitycheck.android.com",
+	"clients3.google.com",
+	"www.apple.com",
+}
+
+func isNoContent(resp *http.Response, _ []byte) bool {
+	return resp.StatusCode == 204
+}
+
+type CaptivePortalListener interface {
+	// OnCaptivePortal is called when a portal is detected, with the login page
+	// url if the portal redirected to one, and when the network is open again.
+	OnCaptivePortal(detected bool, loginUrl string)
+}
+
+// captivePortal lets portal traffic bypass the proxy while active, that is
+// HTTP(S) to the gateway, to the connectivity check hosts and to the login
+// page. The addresses of the hosts are those the network DNS server answers,
+// as portals commonly redirect every name to themselves.
+type captivePortal struct {
+	access    sync.Mutex
+	deadline  time.Time
+	dnsServer string
+	done      chan struct{}
+	hosts     map[string]bool
+	allowed   map[string]bool
+}
+
+func newCaptivePortal(deadline time.Time, dnsServer string) *captivePortal {
+	p := &captivePortal{
+		deadline:  deadline,
+		dnsServer: dnsServer,
+		done:      make(chan struct{}),
+		hosts:     map[string]bool{},
+		allowed:   map[string]bool{},
+	}
+	if ip := net.ParseIP(dnsServer); ip != nil {
+		p.allowed[ip.String()] = true
+	}
+	for _, host := range captivePortalHosts {
+		p.hosts[host] = true
+	}
+	for _, probe := range captivePortalProbes {
+		if probeUrl, err := url.Parse(probe.url); err == nil {
+			p.hosts[probeUrl.Hostname()] = true
+		}
+	}
+	return p
+}
+
+// allows reports whether the portal mode is active and HTTP(S) to ip bypasses
+// the proxy.
+func (p *captivePortal) allows(ip net.IP) bool {
+	if p == nil || ip == nil {
+		return false
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	return time.Now().Before(p.deadline) && p.allowed[ip.String()]
+}
+
+// allowHost adds the host of the login page, a name or an address.
+func (p *captivePortal) allowHost(host string) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if ip := net.ParseIP(host); ip != nil {
+		p.allowed[ip.String()] = true
+	} else {
+		p.hosts[normalizeDomain(host)] = true
+	}
+}
+
+// resolveHosts resolves the portal hosts through the network DNS server.
+func (p *captivePortal) resolveHosts() {
+	resolver := &net.Resolver{}
+	if p.dnsServer != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialProtected(ctx, network, net.JoinHostPort(p.dnsServer, "53"))
+			},
+		}
+	}
+	p.access.Lock()
+	hosts := make([]string, 0, len(p.hosts))
+	for host := range p.hosts {
+		hosts = append(hosts, host)
+	}
+	p.access.Unlock()
+
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), captivePortalCheckInterval)
+		addresses, err := resolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			continue
+		}
+		p.access.Lock()
+		for _, address := range addresses {
+			p.allowed[address.IP.String()] = true
+		}
+		p.access.Unlock()
+	}
+}
+
+// learn adds the addresses of a DNS reply for one of the portal hosts.
+func (p *captivePortal) learn(reply []byte) {
+	message := dns.Msg{}
+	if err := message.Unpack(reply); err != nil || len(message.Question) == 0 {
+		return
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	if !p.hosts[normalizeDomain(message.Question[0].Name)] {
+		return
+	}
+	for _, answer := range message.Answer {
+		switch record := answer.(type) {
+		case *dns.A:
+			p.allowed[record.A.String()] = true
+		case *dns.AAAA:
+			p.allowed[record.AAAA.String()] = true
+		}
+	}
+}
+
+func (p *captivePortal) active() bool {
+	if p == nil {
+		return false
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	return time.Now().Before(p.deadline)
+}
+
+func (p *captivePortal) stop() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.deadline = time.Time{}
+	select {
+	case <-p.done:
+	default:
+		close(p.done)
+	}
+}
+
+// SetCaptivePortalMode sends DNS queries, and HTTP(S) traffic to the portal,
+// directly, around the proxy, for up to durationMs milliseconds so the user
+// can log in to a captive portal. The portal is the gateway, the connectivity
+// check hosts and the login page detected. The mode ends early once the
+// network is detected as open. dnsServer is the DNS server of the underlying
+// network, usually the gateway, if empty DNS keeps going through the proxy.
+// durationMs 0 ends the mode.
+func (t *Tun2socks) SetCaptivePortalMode(durationMs int64, dnsServer string, listener CaptivePortalListener) {
+	t.access.Lock()
+	if t.captivePortal != nil {
+		t.captivePortal.stop()
+		t.captivePortal = nil
+	}
+	if durationMs <= 0 {
+		t.access.Unlock()
+		return
+	}
+	portal := newCaptivePortal(time.Now().Add(time.Duration(durationMs)*time.Millisecond), dnsServer)
+	t.captivePortal = portal
+	t.access.Unlock()
+
+	go t.watchCaptivePortal(portal, listener)
+}
+
+func (t *Tun2socks) watchCaptivePortal(portal *captivePortal, listener CaptivePortalListener) {
+	ticker := time.NewTicker(captivePortalCheckInterval)
+	defer ticker.Stop()
+
+	portal.resolveHosts()
+	var detected bool
+	for portal.active() {
+		loginUrl, err := CheckCaptivePortal(int32(captivePortalCheckInterval / time.Millisecond))
+		if err != nil {
+			log.Warnf("[Portal] check failed: %s", err.Error())
+		} else if loginUrl != "" {
+			if parsed, err := url.Parse(loginUrl); err == nil && parsed.Hostname() != "" {
+				portal.allowHost(parsed.Hostname())
+			}
+			if !detected && listener != nil {
+				listener.OnCaptivePortal(true, loginUrl)
+			}
+			detected = true
+		} else {
+			if listener != nil {
+				listener.OnCaptivePortal(false, "")
+			}
+			break
+		}
+		select {
+		case <-portal.done:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	t.access.Lock()
+	if t.captivePortal == portal {
+		t.captivePortal = nil
+	}
+	t.access.Unlock()
+	portal.stop()
+}
+
+// CheckCaptivePortal probes well-known connectivity check endpoints directly,
+// returning the portal login url (or the probe url if the portal did not
+// redirect), or an empty string if the network is open.
+func CheckCaptivePortal(timeoutMs int32) (string, error) {
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       dialProtected,
+			DisableKeepAlives: true,
+		},
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var lastErr error
+	for _, probe := range captivePortalProbes {
+		resp, err := client.Get(probe.url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		_ = resp.Body.Close()
+		if probe.want(resp, body) {
+			return "", nil
+		}
+		if location := resp.Header.Get("Location"); location != "" {
+			if loginUrl, err := resp.Request.URL.Parse(location); err == nil {
+				return loginUrl.String(), nil
+			}
+		}
+		return probe.url, nil
+	}
+	return "", lastErr
+}
+
+// dialProtected dials around the VPN, using the protector when set.
+func dialProtected(ctx context.Context, network string, address string) (net.Conn, error) {
+	if protector == nil {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	destination, err := v2rayNet.ParseDestination(network + ":" + address)
+	if err != nil {
+		return nil, err
+	}
+	return protectedDialer{
+		protector: protector,
+		resolver:  &net.Resolver{PreferGo: false},
+	}.Dial(ctx, nil, destination, nil)
+}
+
+func (t *Tun2socks) relayDirect(conn core.TCPConn, dest v2rayNet.Destination) {
+	destConn, err := dialProtected(context.Background(), "tcp", dest.NetAddr())
+	if err != nil {
+		log.Errorf("[TCP] direct dial %s failed: %s", dest.NetAddr(), err.Error())
+		_ = conn.Close()
+		return
+	}
+	_ = task.Run(context.Background(), func() error {
+		_, _ = io.Copy(conn, destConn)
+		return io.EOF
+	}, func() error {
+		_, _ = io.Copy(destConn, conn)
+		return io.EOF
+	})
+	_ = conn.Close()
+	_ = destConn.Close()
+}
+
+func (t *Tun2socks) captivePortalDNS(packet core.UDPPacket, portal *captivePortal) {
+	defer packet.Drop()
+
+	conn, err := dialProtected(context.Background(), "udp", net.JoinHostPort(portal.dnsServer, "53"))
+	if err != nil {
+		log.Errorf("[Portal] dial dns %s failed: %s", portal.dnsServer, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(packet.Data()); err != nil {
+		return
+	}
+	buf := pool.Get(pool.RelayBufferSize)
+	defer pool.Put(buf)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	portal.learn(buf[:n])
+	_, _ = packet.WriteBack(buf[:n], nil)
+}
@@ -0,0 +1,123 @@
+package libcore
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CertificateInfo describes a certificate of a server chain.
+type CertificateInfo struct {
+	Subject string
+	Issuer  string
+	// comma separated DNS names and IP addresses
+	SANs string
+	// hex SHA-256 of the certificate
+	Fingerprint string
+	// base64 SHA-256 of the public key, stable across renewals with the same key
+	PublicKeyPin string
+	// unix milliseconds
+	NotBefore int64
+	NotAfter  int64
+}
+
+// CertificateChain is the chain sent by a server, leaf first.
+type CertificateChain struct {
+	certificates []*CertificateInfo
+	// whether the chain is valid for the server name with the system roots
+	Trusted           bool
+	VerificationError string
+}
+
+func (c *CertificateChain) Count() int32 {
+	return int32(len(c.certificates))
+}
+
+func (c *CertificateChain) Certificate(index int32) *CertificateInfo {
+	return c.certificates[index]
+}
+
+// Matches reports whether pin, a certificate fingerprint or a public key pin,
+// belongs to the chain. Fingerprints may contain colons and any case.
+func (c *CertificateChain) Matches(pin string) bool {
+	fingerprint := strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+	for _, certificate := range c.certificates {
+		if certificate.Fingerprint == fingerprint || certificate.PublicKeyPin == pin {
+			return true
+		}
+	}
+	return false
+}
+
+func newCertificateInfo(certificate *x509.Certificate) *CertificateInfo {
+	names := append([]string(nil), certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+	fingerprint := sha256.Sum256(certificate.Raw)
+	publicKey := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return &CertificateInfo{
+		Subject:      certificate.Subject.String(),
+		Issuer:       certificate.Issuer.String(),
+		SANs:         strings.Join(names, ","),
+		Fingerprint:  hex.EncodeToString(fingerprint[:]),
+		PublicKeyPin: base64.StdEncoding.EncodeToString(publicKey[:]),
+		NotBefore:    unixMilli(certificate.NotBefore),
+		NotAfter:     unixMilli(certificate.NotAfter),
+	}
+}
+
+// InspectServerCertificate fetches the certificate chain of a TLS server
+// without verifying it, so that nodes used with skipCertVerify can be checked
+// and pinned. The connection is made directly, outside of the VPN.
+func InspectServerCertificate(server string, port int32, sni string, timeoutMs int32) (*CertificateChain, error) {
+	if sni == "" {
+		sni = server
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	rawConn, err := dialProtected(ctx, "tcp", net.JoinHostPort(server, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	defer rawConn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = rawConn.SetDeadline(deadline)
+	}
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+	})
+	if err = conn.Handshake(); err != nil {
+		return nil, errors.WithMessage(err, "tls handshake")
+	}
+
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil, errors.New("no certificate sent by the server")
+	}
+	chain := &CertificateChain{}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates {
+		chain.certificates = append(chain.certificates, newCertificateInfo(certificate))
+		intermediates.AddCert(certificate)
+	}
+	_, err = certificates[0].Verify(x509.VerifyOptions{
+		DNSName:       sni,
+		Intermediates: intermediates,
+	})
+	chain.Trusted = err == nil
+	if err != nil {
+		chain.VerificationError = err.Error()
+	}
+	return chain, nil
+}
@@ -2,8 +2,8 @@ package libcore
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"github.com/Dreamacro/clash/adapter/inbound"
 	"github.com/Dreamacro/clash/adapter/outbound"
 	"github.com/Dreamacro/clash/constant"
 	clashC "github.com/Dreamacro/clash/constant"
@@ -13,16 +13,98 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ClashBasedInstance struct {
-	access    sync.Mutex
-	socksPort int32
-	ctx       chan constant.ConnContext
-	in        *socks.Listener
-	out       clashC.ProxyAdapter
-	started   bool
+	// accessed atomically, keep 64-bit aligned
+	uplink      uint64
+	downlink    uint64
+	udpUplink   uint64
+	udpDownlink uint64
+	tcpSessions uint64
+	udpSessions uint64
+	lastConnId  int64
+
+	access      sync.Mutex
+	socksPort   int32
+	tcpIn       chan constant.ConnContext
+	ctx         context.Context
+	cancel      context.CancelFunc
+	relayCtx    context.Context
+	forceClose  context.CancelFunc
+	in          io.Closer
+	httpIn      net.Listener
+	udpIn       chan *inbound.PacketAdapter
+	udpListener *socksUDPListener
+	udpNat      udpNat
+	out         clashC.ProxyAdapter
+	state       int32
+	blockQuic   int32
+	limiter     *clientLimiter
+
+	serverCache serverCache
+	bypass      bypassList
+	downgrade   downgradeRules
+	auth        authCheck
+	country     countryAssert
+
+	statsAccess sync.Mutex
+	clientStats map[string]*clientStats
+
+	bandwidth      *bandwidthHint
+	throughputDone chan struct{}
+
+	sendBuffer    int
+	receiveBuffer int
+	dialOptions   *socketOptions
+
+	connections  sync.Map
+	relays       sync.WaitGroup
+	activeRelay  int32
+	activeUdp    int32
+	drainTimeout time.Duration
+	idleTimeout  time.Duration
+
+	status    instanceStatus
+	bindError *BindError
+	nodeId    int64
+
+	httpPort     int32
+	httpNodeName string
+	mixed        bool
+
+	speedTest net.Listener
+}
+
+// SetBlockQuic rejects outbound UDP to port 443, so browsers fall back to TCP
+// on nodes with a slow or broken UDP relay.
+func (s *ClashBasedInstance) SetBlockQuic(block bool) {
+	var value int32
+	if block {
+		value = 1
+	}
+	atomic.StoreInt32(&s.blockQuic, value)
+}
+
+func (s *ClashBasedInstance) quicBlocked() bool {
+	return atomic.LoadInt32(&s.blockQuic) != 0
+}
+
+// SetClientLimit limits concurrent connections and new connections per second
+// for each source IP of the inbound (0 for unlimited).
+func (s *ClashBasedInstance) SetClientLimit(maxConns int32, maxRate int32, policy int32) {
+	if maxConns <= 0 && maxRate <= 0 {
+		s.limiter = nil
+		return
+	}
+	s.limiter = newClientLimiter(int(maxConns), int(maxRate), policy)
 }
 
 func (s *ClashBasedInstance) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
@@ -30,148 +112,606 @@ func (s *ClashBasedInstance) DialContext(ctx context.Context, network, address s
 	if err != nil {
 		return nil, err
 	}
-	dest.NetWork = networkForClash(network)
-	return s.out.DialContext(ctx, dest)
+	if dest.NetWork, err = networkForClash(network); err != nil {
+		return nil, err
+	}
+	if s.quicBlocked() && isQuic(dest.NetWork, dest.DstPort) {
+		return nil, errors.New("quic blocked")
+	}
+	if isBlocked(dest.Host) {
+		return nil, errors.New("blocked by domain rule")
+	}
+	ctx, cancel := s.withInstanceContext(ctx)
+	defer cancel()
+	conn, err := s.dialOut(ctx, dest)
+	s.status.dialed(err)
+	return conn, err
+}
+
+// withInstanceContext returns a context cancelled when either ctx is done or
+// the instance is closed.
+func (s *ClashBasedInstance) withInstanceContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func isQuic(network clashC.NetWork, port string) bool {
+	return network == clashC.UDP && port == "443"
 }
 
 func newClashBasedInstance(socksPort int32, out clashC.ProxyAdapter) *ClashBasedInstance {
+	ctx, cancel := context.WithCancel(context.Background())
+	relayCtx, forceClose := context.WithCancel(context.Background())
 	return &ClashBasedInstance{
-		socksPort: socksPort,
-		ctx:       make(chan constant.ConnContext, 100),
-		out:       out,
+		socksPort:   socksPort,
+		tcpIn:       make(chan constant.ConnContext, 100),
+		udpIn:       make(chan *inbound.PacketAdapter, 100),
+		ctx:         ctx,
+		cancel:      cancel,
+		relayCtx:    relayCtx,
+		forceClose:  forceClose,
+		out:         out,
+		status:      instanceStatus{server: out.Addr()},
+		idleTimeout: defaultIdleTimeout,
 	}
 }
 
+const (
+	instanceStateNew int32 = iota
+	instanceStateStarted
+	instanceStateClosed
+)
+
+// Start starts the inbound. Starting a running instance is a no-op, while a
+// closed instance can not be started again.
 func (s *ClashBasedInstance) Start() error {
 	s.access.Lock()
 	defer s.access.Unlock()
 
-	if s.started {
-		return errors.New("already started")
+	switch s.state {
+	case instanceStateStarted:
+		return nil
+	case instanceStateClosed:
+		return errors.New("instance closed")
 	}
 
-	in, err := socks.New(fmt.Sprintf("127.0.0.1:%d", s.socksPort), s.ctx)
+	err := s.listen()
 	if err != nil {
-		return errors.WithMessage(err, "create socks inbound")
+		return err
 	}
-	s.in = in
-	s.started = true
+	s.state = instanceStateStarted
+	s.status.started()
 	go s.loop()
+	go s.udpLoop()
+	go s.assertCountry()
 	return nil
 }
 
+const defaultCloseTimeout = 5 * time.Second
+
 func (s *ClashBasedInstance) Close() error {
+	return s.closeAndWait(defaultCloseTimeout)
+}
+
+// CloseAndWait closes the instance and waits up to timeoutMs milliseconds for
+// in-flight relays to finish once they are forced closed.
+func (s *ClashBasedInstance) CloseAndWait(timeoutMs int32) error {
+	return s.closeAndWait(time.Duration(timeoutMs) * time.Millisecond)
+}
+
+// SetDrainTimeout lets the connections in flight when the instance is closed
+// finish for up to timeoutMs milliseconds before they are forced closed,
+// instead of closing them right away (0, the default).
+func (s *ClashBasedInstance) SetDrainTimeout(timeoutMs int32) {
 	s.access.Lock()
 	defer s.access.Unlock()
+	s.drainTimeout = time.Duration(timeoutMs) * time.Millisecond
+}
+
+func (s *ClashBasedInstance) closeAndWait(timeout time.Duration) error {
+	s.access.Lock()
+	switch s.state {
+	case instanceStateNew:
+		s.state = instanceStateClosed
+		s.cancel()
+		s.forceClose()
+		s.access.Unlock()
+		return nil
+	case instanceStateClosed:
+		s.access.Unlock()
+		return nil
+	}
 
-	if !s.started {
-		return errors.New("not started")
+	// the listener may be gone already, after a failed rebind or killed by
+	// the system, which must not keep the instance from closing
+	if s.in != nil {
+		_ = s.in.Close()
+	}
+	if s.udpListener != nil {
+		_ = s.udpListener.Close()
 	}
+	if s.httpIn != nil {
+		_ = s.httpIn.Close()
+	}
+	s.state = instanceStateClosed
+	s.status.stopped()
+	s.cancel()
+	s.stopThroughputListener()
+	drainTimeout := s.drainTimeout
+	// relays finishing may need the lock, the wait happens without it
+	s.access.Unlock()
 
-	err := s.in.Close()
-	if err != nil {
-		return err
+	done := make(chan struct{})
+	go func() {
+		s.relays.Wait()
+		close(done)
+	}()
+	defer func() {
+		if closer, ok := s.out.(io.Closer); ok {
+			_ = closer.Close()
+		}
+	}()
+	if drainTimeout > 0 {
+		select {
+		case <-done:
+			s.forceClose()
+			return nil
+		case <-time.After(drainTimeout):
+			log.Printf("closing %d relays still running after %s", s.runningRelays(), drainTimeout)
+		}
+	}
+	s.forceClose()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%d relays still running after %s", s.runningRelays(), timeout)
+	}
+}
+
+// runningRelays counts the TCP relays and UDP sessions in flight.
+func (s *ClashBasedInstance) runningRelays() int32 {
+	return atomic.LoadInt32(&s.activeRelay) + atomic.LoadInt32(&s.activeUdp)
+}
+
+func (s *ClashBasedInstance) IsStarted() bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.state == instanceStateStarted
+}
+
+func (s *ClashBasedInstance) IsClosed() bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.state == instanceStateClosed
+}
+
+func (s *ClashBasedInstance) listen() error {
+	var in io.Closer
+	var err error
+	if s.socksPort == 0 {
+		in, err = s.listenFreePort()
+		if err != nil {
+			s.bindError = newBindError(0, err)
+			return s.bindError
+		}
+	} else {
+		if s.mixed {
+			in, err = s.listenInbound(s.listenAddress())
+		} else {
+			in, err = socks.New(s.listenAddress(), s.tcpIn)
+		}
+		if err != nil {
+			s.bindError = newBindError(s.socksPort, err)
+			return s.bindError
+		}
+		if err = s.listenUDP(); err != nil {
+			_ = in.Close()
+			s.bindError = newBindError(s.socksPort, err)
+			return s.bindError
+		}
 	}
-	close(s.ctx)
+	if err = s.listenHttp(); err != nil {
+		_ = in.Close()
+		if s.udpListener != nil {
+			_ = s.udpListener.Close()
+		}
+		s.bindError = newBindError(s.httpPort, err)
+		return s.bindError
+	}
+	s.in = in
+	s.bindError = nil
 	return nil
 }
 
+// listenFreePort binds the inbound to a port assigned by the system, keeping
+// it for the next starts, and retries when its UDP counterpart is taken.
+func (s *ClashBasedInstance) listenFreePort() (net.Listener, error) {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		var listener net.Listener
+		listener, err = s.listenInbound("127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		s.socksPort = int32(listener.Addr().(*net.TCPAddr).Port)
+		if err = s.listenUDP(); err == nil {
+			return listener, nil
+		}
+		_ = listener.Close()
+		s.socksPort = 0
+	}
+	return nil, errors.WithMessage(err, "pick free port")
+}
+
+func (s *ClashBasedInstance) listenAddress() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.socksPort)))
+}
+
+// Port returns the port of the inbound, which is assigned by the system on
+// the first start when the instance was created with port 0.
+func (s *ClashBasedInstance) Port() int32 {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.socksPort
+}
+
+// LocalAddr returns the address of the inbound, empty before it is bound.
+func (s *ClashBasedInstance) LocalAddr() string {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.socksPort == 0 {
+		return ""
+	}
+	return s.listenAddress()
+}
+
+// ActiveRelays returns the number of connections currently being relayed.
+func (s *ClashBasedInstance) ActiveRelays() int32 {
+	return atomic.LoadInt32(&s.activeRelay)
+}
+
 func (s *ClashBasedInstance) loop() {
-	for conn := range s.ctx {
-		conn := conn
+	// the channel is never closed, as the listener may still be handing over
+	// connections after it is closed
+	for {
+		var conn constant.ConnContext
+		select {
+		case <-s.ctx.Done():
+			for {
+				select {
+				case conn = <-s.tcpIn:
+					_ = conn.Conn().Close()
+				default:
+					return
+				}
+			}
+		case conn = <-s.tcpIn:
+		}
 		metadata := conn.Metadata()
-		go func() {
-			ctx := context.Background()
-			remote, err := s.out.DialContext(ctx, metadata)
-			if err != nil {
-				fmt.Printf("Dial error: %s\n", err.Error())
-				return
+		if mode, blocked := blockedRejectMode(metadata.Host); blocked {
+			if httpConn, ok := conn.Conn().(*httpInboundConn); ok {
+				go httpConn.fail(http.StatusForbidden, "The site is blocked by a domain rule.")
+			} else {
+				go rejectConn(conn.Conn(), metadata.DstPort, mode)
 			}
+			continue
+		}
+		if limiter := s.limiter; limiter != nil {
+			client := metadata.SrcIP.String()
+			if !limiter.acquire(client, conn.Conn()) {
+				_ = conn.Conn().Close()
+				continue
+			}
+			s.relays.Add(1)
+			go func() {
+				s.relay(conn, metadata)
+				limiter.release(client, conn.Conn())
+			}()
+			continue
+		}
+		s.relays.Add(1)
+		go s.relay(conn, metadata)
+	}
+}
 
-			_ = task.Run(ctx, func() error {
-				_, _ = io.Copy(remote, conn.Conn())
-				return io.EOF
-			}, func() error {
-				_, _ = io.Copy(conn.Conn(), remote)
-				return io.EOF
-			})
+func (s *ClashBasedInstance) relay(conn constant.ConnContext, metadata *clashC.Metadata) {
+	defer s.relays.Done()
+	atomic.AddInt32(&s.activeRelay, 1)
+	defer atomic.AddInt32(&s.activeRelay, -1)
+	atomic.AddUint64(&s.tcpSessions, 1)
+
+	s.applySocketBuffer(conn.Conn())
+	ctx, cancel := context.WithCancel(s.relayCtx)
+	defer cancel()
 
+	var remote net.Conn
+	remote, err := s.dialOut(ctx, metadata)
+	s.status.dialed(err)
+	if err != nil {
+		if httpConn, ok := conn.Conn().(*httpInboundConn); ok {
+			httpConn.fail(http.StatusBadGateway, "The proxy node failed to connect: "+err.Error())
+		} else {
+			_ = conn.Conn().Close()
+		}
+		fmt.Printf("Dial error: %s\n", err.Error())
+		return
+	}
+	if httpConn, ok := conn.Conn().(*httpInboundConn); ok {
+		if err = httpConn.established(remote); err != nil {
 			_ = remote.Close()
 			_ = conn.Conn().Close()
+			return
+		}
+	}
+
+	idleTimeout := s.idleTimeout
+	lastActive := time.Now().UnixNano()
+	remote = &activityConn{remote, &lastActive}
+	go func(remote net.Conn) {
+		// interrupt the copies when the instance is forced closed or the
+		// connection is idle
+		waitIdle(ctx, &lastActive, idleTimeout)
+		_ = remote.Close()
+		_ = conn.Conn().Close()
+	}(remote)
+
+	if s.checksAuth() {
+		probe := &authConn{Conn: remote}
+		remote = probe
+		start := time.Now()
+		defer func() {
+			s.auth.observe(probe, time.Since(start))
 		}()
 	}
+
+	tracked := s.trackConnection("tcp", metadata, connPair{conn.Conn(), remote})
+	defer s.untrackConnection(tracked)
+	remote = &statsConn{&statsConn{remote, &tracked.uplink, &tracked.downlink}, &s.uplink, &s.downlink}
+	if stats := s.getClientStats(metadata.SrcIP.String()); stats != nil {
+		atomic.AddInt32(&stats.conn, 1)
+		atomic.AddUint32(&stats.connTotal, 1)
+		defer atomic.AddInt32(&stats.conn, -1)
+		remote = &statsConn{remote, &stats.uplink, &stats.downlink}
+	}
+
+	_ = task.Run(ctx, func() error {
+		_, _ = io.Copy(remote, conn.Conn())
+		return io.EOF
+	}, func() error {
+		_, _ = io.Copy(conn.Conn(), remote)
+		return io.EOF
+	})
+
+	_ = remote.Close()
+	_ = conn.Conn().Close()
 }
 
-func addrToMetadata(rawAddress string) (addr *clashC.Metadata, err error) {
+// metadataBuffer holds a Metadata along with the storage of its destination
+// address, so that building one takes a single allocation.
+type metadataBuffer struct {
+	metadata clashC.Metadata
+	ip       [net.IPv6len]byte
+}
+
+// addrToMetadata parses "host:port" into the destination of a connection.
+// IPv4 addresses, the common case, are parsed in place without net.ParseIP.
+func addrToMetadata(rawAddress string) (*clashC.Metadata, error) {
 	host, port, err := net.SplitHostPort(rawAddress)
 	if err != nil {
-		err = fmt.Errorf("addrToMetadata failed: %w", err)
-		return
+		return nil, fmt.Errorf("addrToMetadata failed: %w", err)
 	}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
-		addr = &clashC.Metadata{
-			AddrType: clashC.AtypDomainName,
-			Host:     host,
-			DstIP:    nil,
-			DstPort:  port,
-		}
-		return
-	} else if ip4 := ip.To4(); ip4 != nil {
-		addr = &clashC.Metadata{
-			AddrType: clashC.AtypIPv4,
-			Host:     "",
-			DstIP:    ip4,
-			DstPort:  port,
+	buffer := &metadataBuffer{}
+	metadata := &buffer.metadata
+	metadata.DstPort = port
+	if parseIPv4(host, buffer.ip[:net.IPv4len]) {
+		metadata.AddrType = clashC.AtypIPv4
+		metadata.DstIP = buffer.ip[:net.IPv4len]
+		return metadata, nil
+	}
+	if strings.IndexByte(host, ':') >= 0 {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				metadata.AddrType = clashC.AtypIPv4
+				metadata.DstIP = ip4
+			} else {
+				metadata.AddrType = clashC.AtypIPv6
+				metadata.DstIP = ip
+			}
+			return metadata, nil
 		}
-		return
 	}
+	metadata.AddrType = clashC.AtypDomainName
+	metadata.Host = host
+	return metadata, nil
+}
 
-	addr = &clashC.Metadata{
-		AddrType: clashC.AtypIPv6,
-		Host:     "",
-		DstIP:    ip,
-		DstPort:  port,
+// parseIPv4 parses a dotted decimal IPv4 address into ip, 4 bytes long.
+func parseIPv4(s string, ip []byte) bool {
+	for i := 0; i < net.IPv4len; i++ {
+		if i > 0 {
+			if len(s) == 0 || s[0] != '.' {
+				return false
+			}
+			s = s[1:]
+		}
+		value, digits := 0, 0
+		for digits < len(s) && s[digits] >= '0' && s[digits] <= '9' {
+			value = value*10 + int(s[digits]-'0')
+			digits++
+			if digits > 3 || value > 255 {
+				return false
+			}
+		}
+		if digits == 0 {
+			return false
+		}
+		ip[i] = byte(value)
+		s = s[digits:]
 	}
-	return
+	return len(s) == 0
 }
 
-func networkForClash(network string) clashC.NetWork {
+func networkForClash(network string) (clashC.NetWork, error) {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
-		return clashC.TCP
+		return clashC.TCP, nil
 	case "udp", "udp4", "udp6":
-		return clashC.UDP
+		return clashC.UDP, nil
 	}
-	log.Fatalln("unexpected network name", network)
-	return 0
+	return 0, fmt.Errorf("unexpected network name %s", network)
 }
 
-func NewShadowsocksInstance(socksPort int32, server string, port int32, password string, cipher string, plugin string, pluginOpts string) (*ClashBasedInstance, error) {
+// NewShadowsocksInstance creates a Shadowsocks instance, udp enabling the UDP
+// relay. Plugins other than obfs and v2ray-plugin in websocket mode only relay
+// TCP.
+func NewShadowsocksInstance(socksPort int32, server string, port int32, password string, cipher string, plugin string, pluginOpts string, udp bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password); err != nil {
+		return nil, err
+	}
+	if isShadowsocks2022(cipher) {
+		if plugin != "" {
+			return nil, fmt.Errorf("plugin %s is not supported with %s", plugin, cipher)
+		}
+		out, err := newShadowsocks2022Instance(server, port, password, cipher, udp)
+		if err != nil {
+			return nil, err
+		}
+		return newClashBasedInstance(socksPort, out), nil
+	}
 	if plugin == "obfs-local" || plugin == "simple-obfs" {
 		plugin = "obfs"
 	}
-	opts := map[string]interface{}{}
-	err := json.Unmarshal([]byte(pluginOpts), &opts)
+	opts, err := parsePluginOpts(pluginOpts)
 	if err != nil {
 		return nil, err
 	}
-	out, err := outbound.NewShadowSocks(outbound.ShadowSocksOption{
+	if filepath.IsAbs(plugin) {
+		// a SIP003 plugin binary shipped with the app
+		options := strings.TrimSpace(pluginOpts)
+		if strings.HasPrefix(options, "{") {
+			options = sip003Options(opts)
+		}
+		out, err := newPluginShadowsocks(server, port, password, cipher, plugin, options)
+		if err != nil {
+			return nil, err
+		}
+		return newClashBasedInstance(socksPort, out), nil
+	}
+	var headers map[string]string
+	if plugin == "obfs" || plugin == "v2ray-plugin" {
+		headers = obfsHeaders(opts)
+	}
+	switch plugin {
+	case "obfs":
+		if err = completeObfsOpts(opts); err != nil {
+			return nil, err
+		}
+	case "v2ray-plugin":
+		if err = completeV2rayPluginOpts(opts); err != nil {
+			return nil, err
+		}
+		if opts["mode"] == "quic" {
+			out, err := outbound.NewShadowSocks(outbound.ShadowSocksOption{
+				Server:   server,
+				Port:     int(port),
+				Password: password,
+				Cipher:   cipher,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return newClashBasedInstance(socksPort, &v2rayQuicShadowsocks{
+				ShadowSocks: out,
+				tlsConfig:   newV2rayQuicTLSConfig(opts),
+				options:     &socketOptions{},
+			}), nil
+		}
+	case "restls":
+		// restls is only defined by its reference implementation
+		return nil, errors.New("restls plugin is not supported")
+	case "shadow-tls":
+		config, err := newShadowTlsConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		out, err := outbound.NewShadowSocks(outbound.ShadowSocksOption{
+			Server:   server,
+			Port:     int(port),
+			Password: password,
+			Cipher:   cipher,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newClashBasedInstance(socksPort, &shadowTlsShadowsocks{
+			ShadowSocks: out,
+			config:      config,
+		}), nil
+	case "kcptun":
+		config, err := newKcptunConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		out, err := outbound.NewShadowSocks(outbound.ShadowSocksOption{
+			Server:   server,
+			Port:     int(port),
+			Password: password,
+			Cipher:   cipher,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return newClashBasedInstance(socksPort, &kcptunShadowsocks{
+			ShadowSocks: out,
+			transport: &kcptunTransport{
+				server: net.JoinHostPort(server, strconv.Itoa(int(port))),
+				config: config,
+			},
+		}), nil
+	}
+	option := outbound.ShadowSocksOption{
 		Server:     server,
 		Port:       int(port),
 		Password:   password,
 		Cipher:     cipher,
 		Plugin:     plugin,
 		PluginOpts: opts,
-	})
+		UDP:        udp,
+	}
+	httpObfs := plugin == "obfs" && opts["mode"] == "http" && (headers != nil || isObfsHostTemplate(opts["host"].(string)))
+	if httpObfs {
+		option.Plugin = ""
+		option.PluginOpts = nil
+	}
+	out, err := outbound.NewShadowSocks(option)
 	if err != nil {
 		return nil, err
 	}
+	if httpObfs {
+		host, _ := opts["host"].(string)
+		return newClashBasedInstance(socksPort, &httpObfsShadowsocks{
+			ShadowSocks: out,
+			host:        host,
+			port:        strconv.Itoa(int(port)),
+			headers:     headers,
+		}), nil
+	}
 	return newClashBasedInstance(socksPort, out), nil
 }
 
-func NewShadowsocksRInstance(socksPort int32, server string, port int32, password string, cipher string, obfs string, obfsParam string, protocol string, protocolParam string) (*ClashBasedInstance, error) {
+func NewShadowsocksRInstance(socksPort int32, server string, port int32, password string, cipher string, obfs string, obfsParam string, protocol string, protocolParam string, udp bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password, &protocolParam); err != nil {
+		return nil, err
+	}
 	out, err := outbound.NewShadowSocksR(outbound.ShadowSocksROption{
 		Server:        server,
 		Port:          int(port),
@@ -181,7 +721,7 @@ func NewShadowsocksRInstance(socksPort int32, server string, port int32, passwor
 		ObfsParam:     obfsParam,
 		Protocol:      protocol,
 		ProtocolParam: protocolParam,
-		UDP:           true,
+		UDP:           udp,
 	})
 	if err != nil {
 		return nil, err
@@ -189,7 +729,15 @@ func NewShadowsocksRInstance(socksPort int32, server string, port int32, passwor
 	return newClashBasedInstance(socksPort, out), nil
 }
 
+// NewSnellInstance creates a Snell instance, version being 1 to 3 or 0 for the
+// default version.
 func NewSnellInstance(socksPort int32, server string, port int32, psk string, obfsMode string, obfsHost string, version int32) (*ClashBasedInstance, error) {
+	if version < 0 || version > 3 {
+		return nil, fmt.Errorf("unsupported snell version %d, expected 1 to 3", version)
+	}
+	if err := decryptSecrets(&psk); err != nil {
+		return nil, err
+	}
 	obfs := map[string]interface{}{}
 	obfs["mode"] = obfsMode
 	obfs["host"] = obfsHost
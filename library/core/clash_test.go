@@ -0,0 +1,97 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+)
+
+func TestAddrToMetadata(t *testing.T) {
+	tests := []struct {
+		address  string
+		addrType int
+		host     string
+		ip       net.IP
+		port     string
+	}{
+		{"example.com:443", clashC.AtypDomainName, "example.com", nil, "443"},
+		{"1.2.3.4:80", clashC.AtypIPv4, "", net.IPv4(1, 2, 3, 4), "80"},
+		{"[::ffff:1.2.3.4]:80", clashC.AtypIPv4, "", net.IPv4(1, 2, 3, 4), "80"},
+		{"[2001:db8::1]:53", clashC.AtypIPv6, "", net.ParseIP("2001:db8::1"), "53"},
+		{"1.2.3.256:80", clashC.AtypDomainName, "1.2.3.256", nil, "80"},
+		{"1.2.3:80", clashC.AtypDomainName, "1.2.3", nil, "80"},
+	}
+	for _, test := range tests {
+		metadata, err := addrToMetadata(test.address)
+		if err != nil {
+			t.Errorf("%s: %v", test.address, err)
+			continue
+		}
+		if metadata.AddrType != test.addrType || metadata.Host != test.host || metadata.DstPort != test.port || !metadata.DstIP.Equal(test.ip) {
+			t.Errorf("%s: got %d %q %v %q", test.address, metadata.AddrType, metadata.Host, metadata.DstIP, metadata.DstPort)
+		}
+	}
+	if _, err := addrToMetadata("example.com"); err == nil {
+		t.Error("address without port accepted")
+	}
+}
+
+func BenchmarkAddrToMetadata(b *testing.B) {
+	for _, address := range []string{"example.com:443", "93.184.216.34:443", "[2606:2800:220:1:248:1893:25c8:1946]:443"} {
+		b.Run(address, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := addrToMetadata(address); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestIsQuic(t *testing.T) {
+	tests := []struct {
+		network clashC.NetWork
+		port    string
+		quic    bool
+	}{
+		{clashC.UDP, "443", true},
+		{clashC.UDP, "4433", false},
+		{clashC.UDP, "53", false},
+		{clashC.TCP, "443", false},
+	}
+	for _, test := range tests {
+		if quic := isQuic(test.network, test.port); quic != test.quic {
+			t.Errorf("%s %s: got %v, want %v", test.network, test.port, quic, test.quic)
+		}
+	}
+}
+
+func TestSetBlockQuic(t *testing.T) {
+	instance := newClashBasedInstance(0, outbound.NewDirect())
+	defer instance.Close()
+	tests := []struct {
+		block   bool
+		address string
+		blocked bool
+	}{
+		{true, "1.2.3.4:443", true},
+		{true, "example.com:443", true},
+		{false, "1.2.3.4:443", false},
+	}
+	for _, test := range tests {
+		instance.SetBlockQuic(test.block)
+		if instance.quicBlocked() != test.block {
+			t.Errorf("SetBlockQuic(%v) not applied", test.block)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := instance.DialContext(ctx, "udp", test.address)
+		if blocked := err != nil && err.Error() == "quic blocked"; blocked != test.blocked {
+			t.Errorf("block %v, %s: got %v", test.block, test.address, err)
+		}
+	}
+}
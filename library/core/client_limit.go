@@ -0,0 +1,107 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// ClientLimitRejectNew refuses new connections from a client over its limit.
+	ClientLimitRejectNew int32 = iota
+	// ClientLimitEvictOldest closes the client's oldest connection to make room.
+	ClientLimitEvictOldest
+)
+
+const clientRateWindow = time.Second
+
+type clientState struct {
+	conns       []net.Conn
+	windowStart time.Time
+	windowCount int
+}
+
+type clientLimiter struct {
+	access   sync.Mutex
+	maxConns int
+	maxRate  int
+	policy   int32
+	clients  map[string]*clientState
+	swept    time.Time
+}
+
+func newClientLimiter(maxConns int, maxRate int, policy int32) *clientLimiter {
+	return &clientLimiter{
+		maxConns: maxConns,
+		maxRate:  maxRate,
+		policy:   policy,
+		clients:  map[string]*clientState{},
+	}
+}
+
+// acquire registers conn for the client, returning false if it must be rejected.
+func (l *clientLimiter) acquire(client string, conn net.Conn) bool {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= clientRateWindow {
+		l.sweep(now)
+	}
+	state := l.clients[client]
+	if state == nil {
+		state = &clientState{}
+		l.clients[client] = state
+	}
+
+	if l.maxRate > 0 {
+		if now.Sub(state.windowStart) >= clientRateWindow {
+			state.windowStart = now
+			state.windowCount = 0
+		}
+		if state.windowCount >= l.maxRate {
+			return false
+		}
+		state.windowCount++
+	}
+
+	if l.maxConns > 0 && len(state.conns) >= l.maxConns {
+		if l.policy != ClientLimitEvictOldest {
+			return false
+		}
+		_ = state.conns[0].Close()
+		state.conns = state.conns[1:]
+	}
+	state.conns = append(state.conns, conn)
+	return true
+}
+
+func (l *clientLimiter) release(client string, conn net.Conn) {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	state := l.clients[client]
+	if state == nil {
+		return
+	}
+	for i, c := range state.conns {
+		if c == conn {
+			state.conns = append(state.conns[:i], state.conns[i+1:]...)
+			break
+		}
+	}
+	if len(state.conns) == 0 && time.Since(state.windowStart) >= clientRateWindow {
+		delete(l.clients, client)
+	}
+}
+
+// sweep drops the clients without connections whose rate window has passed,
+// those released within their window or only ever rejected.
+func (l *clientLimiter) sweep(now time.Time) {
+	for client, state := range l.clients {
+		if len(state.conns) == 0 && now.Sub(state.windowStart) >= clientRateWindow {
+			delete(l.clients, client)
+		}
+	}
+	l.swept = now
+}
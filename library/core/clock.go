@@ -0,0 +1,124 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// VMess rejects requests more than 120 seconds off, warn well before that.
+const clockSkewTolerance = 90 * time.Second
+
+const ntpEpochOffset = 2208988800
+
+var ntpServers = []string{"time.android.com:123", "pool.ntp.org:123", "time.cloudflare.com:123"}
+
+var clockCheckUrls = []string{"https://www.google.com/generate_204", "https://www.cloudflare.com/"}
+
+type ClockCheck struct {
+	// SkewMs is positive when the device clock is ahead.
+	SkewMs     int64
+	Source     string
+	Acceptable bool
+}
+
+// CheckClock measures the device clock skew. With a nil instance it asks NTP
+// servers around the tunnel, otherwise it reads the Date header of HTTPS
+// servers through the instance, with second precision.
+func CheckClock(instance *ClashBasedInstance, timeoutMs int32) (*ClockCheck, error) {
+	var skew time.Duration
+	var source string
+	var err error
+	if instance == nil {
+		skew, source, err = ntpSkew(time.Duration(timeoutMs) * time.Millisecond)
+	} else {
+		skew, source, err = httpDateSkew(instance, timeoutMs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ClockCheck{
+		SkewMs:     int64(skew / time.Millisecond),
+		Source:     source,
+		Acceptable: skew < clockSkewTolerance && skew > -clockSkewTolerance,
+	}, nil
+}
+
+func ntpSkew(timeout time.Duration) (time.Duration, string, error) {
+	var lastErr error
+	for _, server := range ntpServers {
+		skew, err := queryNtp(server, timeout)
+		if err == nil {
+			return skew, server, nil
+		}
+		lastErr = errors.WithMessage(err, server)
+	}
+	return 0, "", lastErr
+}
+
+func queryNtp(server string, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := dialProtected(ctx, "udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	request := make([]byte, 48)
+	// LI 0, version 4, client mode
+	request[0] = 0x23
+	sent := time.Now()
+	if _, err = conn.Write(request); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 48)
+	n, err := conn.Read(response)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	if n < 48 || response[0]&0x7 != 4 {
+		return 0, errors.New("invalid ntp response")
+	}
+
+	receiveTime := ntpTime(response[32:40])
+	transmitTime := ntpTime(response[40:48])
+	offset := (receiveTime.Sub(sent) + transmitTime.Sub(received)) / 2
+	return -offset, nil
+}
+
+func ntpTime(data []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(data[:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(data[4:]))
+	return time.Unix(seconds, fraction*int64(time.Second)>>32)
+}
+
+func httpDateSkew(instance *ClashBasedInstance, timeoutMs int32) (time.Duration, string, error) {
+	client := NewHTTPClient(instance, timeoutMs, "", false, false)
+	defer client.Close()
+
+	var lastErr error
+	for _, url := range clockCheckUrls {
+		sent := time.Now()
+		resp, err := client.Do("HEAD", url, "", nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		received := time.Now()
+		date, err := http.ParseTime(resp.Header("Date"))
+		if err != nil {
+			lastErr = fmt.Errorf("%s: no valid date header", url)
+			continue
+		}
+		local := sent.Add(received.Sub(sent) / 2)
+		return local.Sub(date), url, nil
+	}
+	return 0, "", lastErr
+}
@@ -0,0 +1,317 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const (
+	CongestionCubic  = "cubic"
+	CongestionBBR    = "bbr"
+	CongestionBrutal = "brutal"
+)
+
+const (
+	quicInitialDatagramSize     = logging.ByteCount(1252)
+	quicMaxCongestionWindow     = 10000 * quicInitialDatagramSize
+	quicInitialCongestionWindow = 32 * quicInitialDatagramSize
+	quicMinPacingDelay          = time.Millisecond
+	quicMaxBurstPackets         = 10
+)
+
+// congestionConfig is the congestion control of the sessions of a QUIC based
+// outbound. Brutal sends at the up rate of the bandwidth hints whatever the
+// loss, cubic and bbr probe the path.
+type congestionConfig struct {
+	algorithm string
+	bandwidth *bandwidthHint
+}
+
+func newCongestionConfig(algorithm string, bandwidth *bandwidthHint) (*congestionConfig, error) {
+	algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+	switch algorithm {
+	case CongestionCubic, CongestionBBR:
+	case CongestionBrutal:
+		if bandwidth == nil {
+			return nil, errors.New("brutal congestion control requires the up and down bandwidth")
+		}
+	default:
+		return nil, fmt.Errorf("unknown congestion control %q, expected cubic, bbr or brutal", algorithm)
+	}
+	return &congestionConfig{algorithm: algorithm, bandwidth: bandwidth}, nil
+}
+
+// congestionSender is the congestion.SendAlgorithmWithDebugInfos interface of
+// quic-go. The interface is internal, but its methods only use types that the
+// logging package aliases, so the senders below implement it.
+type congestionSender interface {
+	TimeUntilSend(bytesInFlight logging.ByteCount) time.Time
+	HasPacingBudget() bool
+	OnPacketSent(sentTime time.Time, bytesInFlight logging.ByteCount, packetNumber logging.PacketNumber, bytes logging.ByteCount, isRetransmittable bool)
+	CanSend(bytesInFlight logging.ByteCount) bool
+	MaybeExitSlowStart()
+	OnPacketAcked(number logging.PacketNumber, ackedBytes logging.ByteCount, priorInFlight logging.ByteCount, eventTime time.Time)
+	OnPacketLost(number logging.PacketNumber, lostBytes logging.ByteCount, priorInFlight logging.ByteCount)
+	OnRetransmissionTimeout(packetsRetransmitted bool)
+	SetMaxDatagramSize(logging.ByteCount)
+	InSlowStart() bool
+	InRecovery() bool
+	GetCongestionWindow() logging.ByteCount
+}
+
+// newTracer returns the tracer to dial a session with. The congestion control
+// is installed by install once the session is dialed.
+func (c *congestionConfig) newTracer() *congestionTracer {
+	t := &congestionTracer{algorithm: c.algorithm}
+	if c.algorithm == CongestionBrutal {
+		// the rate negotiated for the session
+		t.rate = c.bandwidth.upBytesPerSecond()
+	}
+	return t
+}
+
+// congestionTracer hands a dialed session to its connection tracer, which
+// replaces the sender of quic-go on the run loop of the session, the only
+// goroutine that uses it.
+type congestionTracer struct {
+	nopTracer
+	algorithm  string
+	rate       uint64
+	connection *congestionConnectionTracer
+}
+
+func (t *congestionTracer) TracerForConnection(context.Context, logging.Perspective, logging.ConnectionID) logging.ConnectionTracer {
+	t.connection = &congestionConnectionTracer{tracer: t}
+	return t.connection
+}
+
+func (t *congestionTracer) install(session quic.Session) {
+	if t.connection == nil {
+		return
+	}
+	t.connection.access.Lock()
+	t.connection.session = session
+	t.connection.access.Unlock()
+}
+
+type congestionConnectionTracer struct {
+	nopConnectionTracer
+	tracer  *congestionTracer
+	access  sync.Mutex
+	session quic.Session
+}
+
+func (t *congestionConnectionTracer) SentPacket(*logging.ExtendedHeader, logging.ByteCount, *logging.AckFrame, []logging.Frame) {
+	t.access.Lock()
+	session := t.session
+	t.session = nil
+	t.access.Unlock()
+	if session == nil {
+		return
+	}
+	if err := installCongestionControl(session, t.tracer.algorithm, t.tracer.rate); err != nil {
+		log.Warnf("[QUIC] set %s congestion control failed: %s", t.tracer.algorithm, err.Error())
+	}
+}
+
+// installCongestionControl replaces the sender of the sent packet handler of
+// session. quic-go has no API for it, so the fields are found by reflection,
+// failing if the layout of the pinned version changed.
+func installCongestionControl(session quic.Session, algorithm string, rate uint64) error {
+	value := reflect.ValueOf(session)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return errors.New("unexpected session type")
+	}
+	handler, err := unexportedField(value.Elem(), "sentPacketHandler")
+	if err != nil {
+		return err
+	}
+	if handler.Kind() != reflect.Interface || handler.Elem().Kind() != reflect.Ptr {
+		return errors.New("unexpected sent packet handler type")
+	}
+	handler = handler.Elem().Elem()
+	congestion, err := unexportedField(handler, "congestion")
+	if err != nil {
+		return err
+	}
+	field, err := unexportedField(handler, "rttStats")
+	if err != nil {
+		return err
+	}
+	rttStats, ok := field.Interface().(*logging.RTTStats)
+	if !ok {
+		return errors.New("unexpected rtt stats type")
+	}
+
+	var sender congestionSender
+	switch algorithm {
+	case CongestionCubic:
+		// the sender of quic-go is cubic, in Reno mode
+		if congestion.Kind() != reflect.Interface || congestion.Elem().Kind() != reflect.Ptr {
+			return errors.New("unexpected congestion sender type")
+		}
+		reno, err := unexportedField(congestion.Elem().Elem(), "reno")
+		if err != nil {
+			return err
+		}
+		if reno.Kind() != reflect.Bool {
+			return errors.New("unexpected reno type")
+		}
+		reno.SetBool(false)
+		return nil
+	case CongestionBBR:
+		sender = newBBRSender(rttStats, congestion.Interface().(congestionSender).GetCongestionWindow())
+	case CongestionBrutal:
+		sender = newBrutalSender(rttStats, rate)
+	default:
+		return fmt.Errorf("unknown congestion control %q", algorithm)
+	}
+	if !reflect.TypeOf(sender).AssignableTo(congestion.Type()) {
+		return errors.New("congestion sender interface changed")
+	}
+	congestion.Set(reflect.ValueOf(sender))
+	return nil
+}
+
+func unexportedField(value reflect.Value, name string) (reflect.Value, error) {
+	field := value.FieldByName(name)
+	if !field.IsValid() {
+		return field, fmt.Errorf("field %s not found in %s", name, value.Type())
+	}
+	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem(), nil
+}
+
+// pacer is the token bucket of quic-go, spreading the packets over the RTT
+// at the rate of the sender.
+type pacer struct {
+	budgetAtLastSent logging.ByteCount
+	maxDatagramSize  logging.ByteCount
+	lastSentTime     time.Time
+	rate             func() uint64 // bytes per second
+}
+
+func newPacer(rate func() uint64) *pacer {
+	p := &pacer{
+		maxDatagramSize: quicInitialDatagramSize,
+		rate:            rate,
+	}
+	p.budgetAtLastSent = p.maxBurstSize()
+	return p
+}
+
+func (p *pacer) bytesPerSecond() uint64 {
+	if rate := p.rate(); rate > 0 {
+		return rate
+	}
+	return 1
+}
+
+func (p *pacer) SentPacket(sendTime time.Time, size logging.ByteCount) {
+	budget := p.Budget(sendTime)
+	if size > budget {
+		p.budgetAtLastSent = 0
+	} else {
+		p.budgetAtLastSent = budget - size
+	}
+	p.lastSentTime = sendTime
+}
+
+func (p *pacer) Budget(now time.Time) logging.ByteCount {
+	burst := p.maxBurstSize()
+	if p.lastSentTime.IsZero() {
+		return burst
+	}
+	// in float, as the product overflows an int64 after a long idle time
+	refill := float64(p.bytesPerSecond()) * now.Sub(p.lastSentTime).Seconds()
+	if refill >= float64(burst) {
+		return burst
+	}
+	if budget := p.budgetAtLastSent + logging.ByteCount(refill); budget < burst {
+		return budget
+	}
+	return burst
+}
+
+func (p *pacer) maxBurstSize() logging.ByteCount {
+	burst := logging.ByteCount(float64(p.bytesPerSecond()) * (quicMinPacingDelay + time.Millisecond).Seconds())
+	if min := quicMaxBurstPackets * p.maxDatagramSize; burst < min {
+		return min
+	}
+	return burst
+}
+
+// TimeUntilSend returns when the next packet can be sent, the zero time if it
+// can be sent right away.
+func (p *pacer) TimeUntilSend() time.Time {
+	if p.budgetAtLastSent >= p.maxDatagramSize {
+		return time.Time{}
+	}
+	delay := time.Duration(float64(p.maxDatagramSize-p.budgetAtLastSent) * 1e9 / float64(p.bytesPerSecond()))
+	if delay < quicMinPacingDelay {
+		delay = quicMinPacingDelay
+	}
+	return p.lastSentTime.Add(delay)
+}
+
+func (p *pacer) SetMaxDatagramSize(s logging.ByteCount) {
+	p.maxDatagramSize = s
+}
+
+// nopTracer and nopConnectionTracer implement the logging tracers doing
+// nothing, for the tracers above to override what they need.
+type nopTracer struct{}
+
+func (nopTracer) TracerForConnection(context.Context, logging.Perspective, logging.ConnectionID) logging.ConnectionTracer {
+	return nil
+}
+func (nopTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+func (nopTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+type nopConnectionTracer struct{}
+
+func (nopConnectionTracer) StartedConnection(net.Addr, net.Addr, logging.ConnectionID, logging.ConnectionID) {
+}
+func (nopConnectionTracer) NegotiatedVersion(logging.VersionNumber, []logging.VersionNumber, []logging.VersionNumber) {
+}
+func (nopConnectionTracer) ClosedConnection(error)                                   {}
+func (nopConnectionTracer) SentTransportParameters(*logging.TransportParameters)     {}
+func (nopConnectionTracer) ReceivedTransportParameters(*logging.TransportParameters) {}
+func (nopConnectionTracer) RestoredTransportParameters(*logging.TransportParameters) {}
+func (nopConnectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (nopConnectionTracer) ReceivedRetry(*logging.Header) {}
+func (nopConnectionTracer) ReceivedPacket(*logging.ExtendedHeader, logging.ByteCount, []logging.Frame) {
+}
+func (nopConnectionTracer) SentPacket(*logging.ExtendedHeader, logging.ByteCount, *logging.AckFrame, []logging.Frame) {
+}
+func (nopConnectionTracer) BufferedPacket(logging.PacketType) {}
+func (nopConnectionTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (nopConnectionTracer) UpdatedMetrics(*logging.RTTStats, logging.ByteCount, logging.ByteCount, int) {
+}
+func (nopConnectionTracer) AcknowledgedPacket(logging.EncryptionLevel, logging.PacketNumber) {}
+func (nopConnectionTracer) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+}
+func (nopConnectionTracer) UpdatedCongestionState(logging.CongestionState)                     {}
+func (nopConnectionTracer) UpdatedPTOCount(uint32)                                             {}
+func (nopConnectionTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective)     {}
+func (nopConnectionTracer) UpdatedKey(logging.KeyPhase, bool)                                  {}
+func (nopConnectionTracer) DroppedEncryptionLevel(logging.EncryptionLevel)                     {}
+func (nopConnectionTracer) DroppedKey(logging.KeyPhase)                                        {}
+func (nopConnectionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {}
+func (nopConnectionTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel)        {}
+func (nopConnectionTracer) LossTimerCanceled()                                                 {}
+func (nopConnectionTracer) Close()                                                             {}
+func (nopConnectionTracer) Debug(string, string)                                               {}
@@ -0,0 +1,394 @@
+package libcore
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+const (
+	bbrHighGain          = 2.885
+	bbrDrainGain         = 1 / bbrHighGain
+	bbrCwndGain          = 2
+	bbrBandwidthRounds   = 10
+	bbrMinRTTExpiry      = 10 * time.Second
+	bbrProbeRTTDuration  = 200 * time.Millisecond
+	bbrMinCwndPackets    = 4
+	bbrFullBandwidthGain = 1.25
+	bbrFullBandwidthCnt  = 3
+	bbrDefaultRTT        = 100 * time.Millisecond
+)
+
+var bbrPacingGains = [...]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+// bbrSender is BBRv1: it paces at the bottleneck bandwidth measured from the
+// delivery rate of the acked packets, and keeps a congestion window of twice
+// the bandwidth delay product, probing up and down for bandwidth and draining
+// the queue every ten seconds to measure the minimum RTT.
+type bbrSender struct {
+	rttStats        *logging.RTTStats
+	maxDatagramSize logging.ByteCount
+	pacer           *pacer
+
+	mode       bbrMode
+	pacingGain float64
+	cwndGain   float64
+	cwnd       logging.ByteCount
+
+	// delivery rate sampling
+	packets       map[logging.PacketNumber]bbrPacket
+	delivered     logging.ByteCount
+	deliveredTime time.Time
+	firstSentTime time.Time
+
+	// round trips, a round ends when a packet sent after its start is acked
+	rounds             uint64
+	nextRoundDelivered logging.ByteCount
+	bandwidth          [bbrBandwidthRounds]bbrBandwidthSample
+
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	filledPipe         bool
+	fullBandwidth      uint64
+	fullBandwidthCount int
+
+	cycleIndex int
+	cycleStamp time.Time
+
+	probeRTTDone      time.Time
+	probeRTTRoundDone bool
+	priorCwnd         logging.ByteCount
+}
+
+// bbrPacket is the delivery state when a packet was sent.
+type bbrPacket struct {
+	sentTime      time.Time
+	delivered     logging.ByteCount
+	deliveredTime time.Time
+	firstSentTime time.Time
+}
+
+// bbrBandwidthSample is the max delivery rate measured in a round, in bytes
+// per second.
+type bbrBandwidthSample struct {
+	round     uint64
+	bandwidth uint64
+}
+
+func newBBRSender(rttStats *logging.RTTStats, initialWindow logging.ByteCount) *bbrSender {
+	b := &bbrSender{
+		rttStats:        rttStats,
+		maxDatagramSize: quicInitialDatagramSize,
+		mode:            bbrStartup,
+		pacingGain:      bbrHighGain,
+		cwndGain:        bbrHighGain,
+		cwnd:            initialWindow,
+		packets:         make(map[logging.PacketNumber]bbrPacket),
+	}
+	if b.cwnd < b.minCongestionWindow() {
+		b.cwnd = quicInitialCongestionWindow
+	}
+	b.pacer = newPacer(b.pacingRate)
+	return b
+}
+
+func (b *bbrSender) TimeUntilSend(logging.ByteCount) time.Time {
+	return b.pacer.TimeUntilSend()
+}
+
+func (b *bbrSender) HasPacingBudget() bool {
+	return b.pacer.Budget(time.Now()) >= b.maxDatagramSize
+}
+
+func (b *bbrSender) CanSend(bytesInFlight logging.ByteCount) bool {
+	return bytesInFlight < b.cwnd
+}
+
+func (b *bbrSender) GetCongestionWindow() logging.ByteCount {
+	return b.cwnd
+}
+
+func (b *bbrSender) OnPacketSent(sentTime time.Time, bytesInFlight logging.ByteCount, packetNumber logging.PacketNumber, bytes logging.ByteCount, isRetransmittable bool) {
+	b.pacer.SentPacket(sentTime, bytes)
+	if !isRetransmittable {
+		return
+	}
+	if bytesInFlight == 0 {
+		// restarting from idle, the idle time is not part of the delivery rate
+		b.deliveredTime = sentTime
+		b.firstSentTime = sentTime
+	}
+	b.packets[packetNumber] = bbrPacket{
+		sentTime:      sentTime,
+		delivered:     b.delivered,
+		deliveredTime: b.deliveredTime,
+		firstSentTime: b.firstSentTime,
+	}
+}
+
+func (b *bbrSender) OnPacketAcked(number logging.PacketNumber, ackedBytes logging.ByteCount, priorInFlight logging.ByteCount, eventTime time.Time) {
+	packet, ok := b.packets[number]
+	if !ok {
+		return
+	}
+	delete(b.packets, number)
+	b.delivered += ackedBytes
+	b.deliveredTime = eventTime
+	b.firstSentTime = packet.sentTime
+
+	roundStart := false
+	if packet.delivered >= b.nextRoundDelivered {
+		b.nextRoundDelivered = b.delivered
+		b.rounds++
+		roundStart = true
+	}
+	b.updateBandwidth(packet, eventTime)
+	minRTTExpired := b.updateMinRTT(eventTime)
+
+	inFlight := logging.ByteCount(0)
+	if priorInFlight > ackedBytes {
+		inFlight = priorInFlight - ackedBytes
+	}
+	if roundStart && !b.filledPipe {
+		b.checkFullPipe()
+	}
+	b.updateMode(eventTime, inFlight, roundStart, minRTTExpired)
+	b.updateCongestionWindow(ackedBytes)
+	if roundStart {
+		b.prunePackets(eventTime)
+	}
+}
+
+func (b *bbrSender) OnPacketLost(number logging.PacketNumber, lostBytes logging.ByteCount, _ logging.ByteCount) {
+	delete(b.packets, number)
+	if b.cwnd > lostBytes {
+		b.cwnd -= lostBytes
+	}
+	if min := b.minCongestionWindow(); b.cwnd < min {
+		b.cwnd = min
+	}
+}
+
+func (b *bbrSender) OnRetransmissionTimeout(packetsRetransmitted bool) {
+	if packetsRetransmitted {
+		b.cwnd = b.minCongestionWindow()
+	}
+}
+
+func (b *bbrSender) SetMaxDatagramSize(s logging.ByteCount) {
+	b.maxDatagramSize = s
+	b.pacer.SetMaxDatagramSize(s)
+	if min := b.minCongestionWindow(); b.cwnd < min {
+		b.cwnd = min
+	}
+}
+
+func (b *bbrSender) MaybeExitSlowStart() {}
+
+func (b *bbrSender) InSlowStart() bool {
+	return b.mode == bbrStartup
+}
+
+func (b *bbrSender) InRecovery() bool {
+	return false
+}
+
+func (b *bbrSender) updateBandwidth(packet bbrPacket, now time.Time) {
+	// the longer of the send and ack intervals, so that neither a burst of
+	// sends nor of acks overestimates the rate
+	interval := packet.sentTime.Sub(packet.firstSentTime)
+	if ackElapsed := now.Sub(packet.deliveredTime); ackElapsed > interval {
+		interval = ackElapsed
+	}
+	if interval <= 0 {
+		return
+	}
+	rate := uint64(float64(b.delivered-packet.delivered) / interval.Seconds())
+	sample := &b.bandwidth[b.rounds%bbrBandwidthRounds]
+	if sample.round != b.rounds {
+		*sample = bbrBandwidthSample{round: b.rounds}
+	}
+	if rate > sample.bandwidth {
+		sample.bandwidth = rate
+	}
+}
+
+// maxBandwidth is the max delivery rate of the last rounds.
+func (b *bbrSender) maxBandwidth() uint64 {
+	var bandwidth uint64
+	for _, sample := range b.bandwidth {
+		if sample.round+bbrBandwidthRounds > b.rounds && sample.bandwidth > bandwidth {
+			bandwidth = sample.bandwidth
+		}
+	}
+	return bandwidth
+}
+
+func (b *bbrSender) updateMinRTT(now time.Time) bool {
+	expired := !b.minRTTStamp.IsZero() && now.Sub(b.minRTTStamp) > bbrMinRTTExpiry
+	rtt := b.rttStats.LatestRTT()
+	if rtt > 0 && (b.minRTT == 0 || rtt <= b.minRTT || expired) {
+		b.minRTT = rtt
+		b.minRTTStamp = now
+	}
+	return expired
+}
+
+// checkFullPipe ends the startup once the bandwidth stopped growing by a
+// quarter for three rounds.
+func (b *bbrSender) checkFullPipe() {
+	bandwidth := b.maxBandwidth()
+	if float64(bandwidth) >= float64(b.fullBandwidth)*bbrFullBandwidthGain {
+		b.fullBandwidth = bandwidth
+		b.fullBandwidthCount = 0
+		return
+	}
+	b.fullBandwidthCount++
+	if b.fullBandwidthCount >= bbrFullBandwidthCnt {
+		b.filledPipe = true
+	}
+}
+
+func (b *bbrSender) updateMode(now time.Time, inFlight logging.ByteCount, roundStart, minRTTExpired bool) {
+	switch b.mode {
+	case bbrStartup:
+		if b.filledPipe {
+			b.mode = bbrDrain
+			b.pacingGain = bbrDrainGain
+			b.cwndGain = bbrHighGain
+		}
+	case bbrDrain:
+		if inFlight <= b.bdp(1) {
+			b.enterProbeBW(now)
+		}
+	case bbrProbeBW:
+		b.updateCycle(now, inFlight)
+	case bbrProbeRTT:
+		b.updateProbeRTT(now, inFlight, roundStart)
+		return
+	}
+	if minRTTExpired {
+		b.mode = bbrProbeRTT
+		b.pacingGain = 1
+		b.cwndGain = 1
+		b.priorCwnd = b.cwnd
+		b.probeRTTDone = time.Time{}
+	}
+}
+
+func (b *bbrSender) enterProbeBW(now time.Time) {
+	b.mode = bbrProbeBW
+	b.cwndGain = bbrCwndGain
+	// start at a random phase other than probing up
+	b.cycleIndex = len(bbrPacingGains) - 1 - rand.Intn(len(bbrPacingGains)-1)
+	b.cycleStamp = now
+	b.pacingGain = bbrPacingGains[b.cycleIndex]
+}
+
+func (b *bbrSender) updateCycle(now time.Time, inFlight logging.ByteCount) {
+	next := now.Sub(b.cycleStamp) > b.minRTT
+	if b.pacingGain < 1 && inFlight <= b.bdp(1) {
+		// the queue built by probing up is drained
+		next = true
+	}
+	if next {
+		b.cycleIndex = (b.cycleIndex + 1) % len(bbrPacingGains)
+		b.cycleStamp = now
+		b.pacingGain = bbrPacingGains[b.cycleIndex]
+	}
+}
+
+func (b *bbrSender) updateProbeRTT(now time.Time, inFlight logging.ByteCount, roundStart bool) {
+	if b.probeRTTDone.IsZero() {
+		if inFlight <= b.minCongestionWindow() {
+			b.probeRTTDone = now.Add(bbrProbeRTTDuration)
+			b.probeRTTRoundDone = false
+			b.nextRoundDelivered = b.delivered
+		}
+		return
+	}
+	if roundStart {
+		b.probeRTTRoundDone = true
+	}
+	if b.probeRTTRoundDone && now.After(b.probeRTTDone) {
+		b.minRTTStamp = now
+		if b.cwnd < b.priorCwnd {
+			b.cwnd = b.priorCwnd
+		}
+		if b.filledPipe {
+			b.enterProbeBW(now)
+		} else {
+			b.mode = bbrStartup
+			b.pacingGain = bbrHighGain
+			b.cwndGain = bbrHighGain
+		}
+	}
+}
+
+func (b *bbrSender) updateCongestionWindow(ackedBytes logging.ByteCount) {
+	if b.mode == bbrProbeRTT {
+		b.cwnd = b.minCongestionWindow()
+		return
+	}
+	target := quicInitialCongestionWindow
+	if b.maxBandwidth() > 0 && b.minRTT > 0 {
+		target = b.bdp(b.cwndGain) + 3*b.maxDatagramSize
+	}
+	if b.filledPipe {
+		if b.cwnd+ackedBytes < target {
+			b.cwnd += ackedBytes
+		} else {
+			b.cwnd = target
+		}
+	} else if b.cwnd < target || b.delivered < quicInitialCongestionWindow {
+		b.cwnd += ackedBytes
+	}
+	if min := b.minCongestionWindow(); b.cwnd < min {
+		b.cwnd = min
+	}
+	if b.cwnd > quicMaxCongestionWindow {
+		b.cwnd = quicMaxCongestionWindow
+	}
+}
+
+// prunePackets forgets the packets that were neither acked nor declared lost,
+// such as those of a dropped packet number space.
+func (b *bbrSender) prunePackets(now time.Time) {
+	for number, packet := range b.packets {
+		if now.Sub(packet.sentTime) > bbrMinRTTExpiry {
+			delete(b.packets, number)
+		}
+	}
+}
+
+func (b *bbrSender) bdp(gain float64) logging.ByteCount {
+	return logging.ByteCount(float64(b.maxBandwidth()) * b.minRTT.Seconds() * gain)
+}
+
+func (b *bbrSender) minCongestionWindow() logging.ByteCount {
+	return bbrMinCwndPackets * b.maxDatagramSize
+}
+
+// pacingRate is the bandwidth times the pacing gain, or the initial window
+// over the RTT before the first delivery rate sample.
+func (b *bbrSender) pacingRate() uint64 {
+	if bandwidth := b.maxBandwidth(); bandwidth > 0 {
+		return uint64(float64(bandwidth) * b.pacingGain)
+	}
+	rtt := b.rttStats.SmoothedRTT()
+	if rtt <= 0 {
+		rtt = bbrDefaultRTT
+	}
+	return uint64(float64(b.cwnd) / rtt.Seconds() * bbrHighGain)
+}
@@ -0,0 +1,127 @@
+package libcore
+
+import (
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+const (
+	brutalSlots          = 5
+	brutalMinSampleCount = 50
+	brutalMinAckRate     = 0.8
+	brutalCwndGain       = 2
+)
+
+// brutalSender is the Brutal congestion control of Hysteria: it sends at a
+// fixed rate whatever the loss, raised by the loss rate of the last seconds
+// so that the rate that gets through is the configured one.
+type brutalSender struct {
+	rttStats        *logging.RTTStats
+	rate            uint64 // bytes per second
+	maxDatagramSize logging.ByteCount
+	pacer           *pacer
+
+	slots   [brutalSlots]brutalSlot
+	ackRate float64
+}
+
+// brutalSlot counts the packets acked and lost within a second.
+type brutalSlot struct {
+	second int64
+	acked  uint64
+	lost   uint64
+}
+
+func newBrutalSender(rttStats *logging.RTTStats, rate uint64) *brutalSender {
+	b := &brutalSender{
+		rttStats:        rttStats,
+		rate:            rate,
+		maxDatagramSize: quicInitialDatagramSize,
+		ackRate:         1,
+	}
+	b.pacer = newPacer(func() uint64 {
+		return uint64(float64(b.rate) / b.ackRate)
+	})
+	return b
+}
+
+func (b *brutalSender) TimeUntilSend(logging.ByteCount) time.Time {
+	return b.pacer.TimeUntilSend()
+}
+
+func (b *brutalSender) HasPacingBudget() bool {
+	return b.pacer.Budget(time.Now()) >= b.maxDatagramSize
+}
+
+func (b *brutalSender) CanSend(bytesInFlight logging.ByteCount) bool {
+	return bytesInFlight < b.GetCongestionWindow()
+}
+
+func (b *brutalSender) GetCongestionWindow() logging.ByteCount {
+	rtt := b.rttStats.SmoothedRTT()
+	if latest := b.rttStats.LatestRTT(); latest > rtt {
+		rtt = latest
+	}
+	if rtt <= 0 {
+		return quicInitialCongestionWindow
+	}
+	cwnd := logging.ByteCount(float64(b.rate) * rtt.Seconds() * brutalCwndGain / b.ackRate)
+	if cwnd < b.maxDatagramSize {
+		return b.maxDatagramSize
+	}
+	return cwnd
+}
+
+func (b *brutalSender) OnPacketSent(sentTime time.Time, _ logging.ByteCount, _ logging.PacketNumber, bytes logging.ByteCount, _ bool) {
+	b.pacer.SentPacket(sentTime, bytes)
+}
+
+func (b *brutalSender) OnPacketAcked(_ logging.PacketNumber, _ logging.ByteCount, _ logging.ByteCount, eventTime time.Time) {
+	b.slot(eventTime).acked++
+	b.updateAckRate(eventTime)
+}
+
+func (b *brutalSender) OnPacketLost(logging.PacketNumber, logging.ByteCount, logging.ByteCount) {
+	now := time.Now()
+	b.slot(now).lost++
+	b.updateAckRate(now)
+}
+
+func (b *brutalSender) slot(now time.Time) *brutalSlot {
+	second := now.Unix()
+	slot := &b.slots[second%brutalSlots]
+	if slot.second != second {
+		*slot = brutalSlot{second: second}
+	}
+	return slot
+}
+
+func (b *brutalSender) updateAckRate(now time.Time) {
+	oldest := now.Unix() - brutalSlots + 1
+	var acked, lost uint64
+	for _, slot := range b.slots {
+		if slot.second >= oldest {
+			acked += slot.acked
+			lost += slot.lost
+		}
+	}
+	if acked+lost < brutalMinSampleCount {
+		b.ackRate = 1
+		return
+	}
+	b.ackRate = float64(acked) / float64(acked+lost)
+	if b.ackRate < brutalMinAckRate {
+		b.ackRate = brutalMinAckRate
+	}
+}
+
+func (b *brutalSender) SetMaxDatagramSize(s logging.ByteCount) {
+	b.maxDatagramSize = s
+	b.pacer.SetMaxDatagramSize(s)
+}
+
+func (b *brutalSender) MaybeExitSlowStart()          {}
+func (b *brutalSender) OnRetransmissionTimeout(bool) {}
+func (b *brutalSender) InSlowStart() bool            { return false }
+func (b *brutalSender) InRecovery() bool             { return false }
@@ -0,0 +1,114 @@
+package libcore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+func TestNewCongestionConfig(t *testing.T) {
+	bandwidth, err := newBandwidthHint(10, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		algorithm string
+		bandwidth *bandwidthHint
+		want      string
+	}{
+		{"cubic", nil, CongestionCubic},
+		{" BBR ", nil, CongestionBBR},
+		{"brutal", bandwidth, CongestionBrutal},
+		{"brutal", nil, ""},
+		{"reno", nil, ""},
+		{"", nil, ""},
+	}
+	for _, test := range tests {
+		config, err := newCongestionConfig(test.algorithm, test.bandwidth)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: no error", test.algorithm)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.algorithm, err)
+		} else if config.algorithm != test.want {
+			t.Errorf("%q: got %s, want %s", test.algorithm, config.algorithm, test.want)
+		}
+	}
+	tracer := (&congestionConfig{algorithm: CongestionBrutal, bandwidth: bandwidth}).newTracer()
+	if want := bandwidth.upBytesPerSecond(); tracer.rate != want {
+		t.Errorf("brutal rate %d, want %d", tracer.rate, want)
+	}
+}
+
+func newTestRTTStats(rtt time.Duration) *logging.RTTStats {
+	stats := &logging.RTTStats{}
+	stats.UpdateRTT(rtt, 0, time.Now())
+	return stats
+}
+
+func TestBrutalSender(t *testing.T) {
+	const rate = 1 << 20
+	sender := newBrutalSender(newTestRTTStats(100*time.Millisecond), rate)
+	if cwnd, want := sender.GetCongestionWindow(), logging.ByteCount(rate/5); cwnd != want {
+		t.Errorf("cwnd %d, want %d", cwnd, want)
+	}
+	now := time.Now()
+	for i := 0; i < 90; i++ {
+		sender.OnPacketAcked(logging.PacketNumber(i), 1000, 0, now)
+	}
+	for i := 0; i < 10; i++ {
+		sender.OnPacketLost(logging.PacketNumber(90+i), 1000, 0)
+	}
+	if sender.ackRate != 0.9 {
+		t.Errorf("ack rate %v, want 0.9", sender.ackRate)
+	}
+	for i := 0; i < 100; i++ {
+		sender.OnPacketLost(logging.PacketNumber(100+i), 1000, 0)
+	}
+	if sender.ackRate != brutalMinAckRate {
+		t.Errorf("ack rate %v, want %v", sender.ackRate, brutalMinAckRate)
+	}
+	if sender.InSlowStart() || sender.InRecovery() {
+		t.Error("brutal in slow start or recovery")
+	}
+}
+
+func TestBBRSender(t *testing.T) {
+	const rtt = 50 * time.Millisecond
+	sender := newBBRSender(newTestRTTStats(rtt), quicInitialCongestionWindow)
+	now := time.Now()
+	var number logging.PacketNumber
+	var inFlight logging.ByteCount
+	// rounds of 50 packets sent 1ms apart, each acked one RTT after it was
+	// sent, so the delivery rate stays under 1000 packets per second
+	for round := 0; round < 40; round++ {
+		start := number
+		for i := 0; i < 50; i++ {
+			sender.OnPacketSent(now.Add(time.Duration(i)*time.Millisecond), inFlight, number, 1000, true)
+			number++
+			inFlight += 1000
+		}
+		now = now.Add(rtt)
+		for i := start; i < number; i++ {
+			sender.OnPacketAcked(i, 1000, inFlight, now.Add(time.Duration(i-start)*time.Millisecond))
+			inFlight -= 1000
+		}
+	}
+	if sender.InSlowStart() {
+		t.Error("bbr still in startup")
+	}
+	bandwidth := sender.maxBandwidth()
+	if bandwidth == 0 || bandwidth > 1000000 {
+		t.Errorf("bandwidth %d, want at most 1000000", bandwidth)
+	}
+	if cwnd := sender.GetCongestionWindow(); cwnd < sender.minCongestionWindow() || cwnd > quicMaxCongestionWindow {
+		t.Errorf("cwnd %d out of bounds", cwnd)
+	}
+	if len(sender.packets) != 0 {
+		t.Errorf("%d packets left", len(sender.packets))
+	}
+}
@@ -0,0 +1,111 @@
+package libcore
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+)
+
+// ConnectionInfo describes a connection being relayed by an instance.
+type ConnectionInfo struct {
+	Id int64
+	// "tcp" or "udp"
+	Network     string
+	Source      string
+	Destination string
+	// unix milliseconds
+	StartedAt int64
+	Uplink    int64
+	Downlink  int64
+}
+
+// ConnectionList is a snapshot of the relayed connections, oldest first.
+type ConnectionList struct {
+	connections []*ConnectionInfo
+}
+
+func (l *ConnectionList) Count() int32 {
+	return int32(len(l.connections))
+}
+
+func (l *ConnectionList) Connection(index int32) *ConnectionInfo {
+	return l.connections[index]
+}
+
+type trackedConn struct {
+	uplink   uint64
+	downlink uint64
+
+	id          int64
+	network     string
+	source      string
+	destination string
+	startedAt   time.Time
+	closer      io.Closer
+}
+
+// connPair closes both sides of a relayed TCP connection.
+type connPair struct {
+	local  net.Conn
+	remote net.Conn
+}
+
+func (p connPair) Close() error {
+	_ = p.remote.Close()
+	return p.local.Close()
+}
+
+func (s *ClashBasedInstance) trackConnection(network string, metadata *clashC.Metadata, closer io.Closer) *trackedConn {
+	c := &trackedConn{
+		id:          atomic.AddInt64(&s.lastConnId, 1),
+		network:     network,
+		destination: metadata.RemoteAddress(),
+		startedAt:   time.Now(),
+		closer:      closer,
+	}
+	if metadata.SrcIP != nil {
+		c.source = net.JoinHostPort(metadata.SrcIP.String(), metadata.SrcPort)
+	}
+	s.connections.Store(c.id, c)
+	return c
+}
+
+func (s *ClashBasedInstance) untrackConnection(c *trackedConn) {
+	s.connections.Delete(c.id)
+}
+
+// ListConnections returns the connections currently relayed.
+func (s *ClashBasedInstance) ListConnections() *ConnectionList {
+	list := &ConnectionList{}
+	s.connections.Range(func(_, value interface{}) bool {
+		c := value.(*trackedConn)
+		list.connections = append(list.connections, &ConnectionInfo{
+			Id:          c.id,
+			Network:     c.network,
+			Source:      c.source,
+			Destination: c.destination,
+			StartedAt:   unixMilli(c.startedAt),
+			Uplink:      int64(atomic.LoadUint64(&c.uplink)),
+			Downlink:    int64(atomic.LoadUint64(&c.downlink)),
+		})
+		return true
+	})
+	sort.Slice(list.connections, func(i, j int) bool {
+		return list.connections[i].Id < list.connections[j].Id
+	})
+	return list
+}
+
+// CloseConnection drops the connection with the id of ListConnections.
+func (s *ClashBasedInstance) CloseConnection(id int64) error {
+	value, ok := s.connections.Load(id)
+	if !ok {
+		return errors.Errorf("connection %d not found", id)
+	}
+	return value.(*trackedConn).closer.Close()
+}
@@ -0,0 +1,50 @@
+package libcore
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const countryAssertTimeout = 10000
+
+type CountryListener interface {
+	// OnCountryMismatch is called when the exit country of the instance is not
+	// the expected one, such as when a provider silently reroutes a node.
+	OnCountryMismatch(expected string, actual string, ip string)
+}
+
+type countryAssert struct {
+	access   sync.Mutex
+	expected string
+	listener CountryListener
+}
+
+// SetExpectedCountry makes the instance check its exit country (ISO 3166
+// code) through CheckExitIP once started, reporting mismatches to listener.
+// An empty code disables the check.
+func (s *ClashBasedInstance) SetExpectedCountry(code string, listener CountryListener) {
+	s.country.access.Lock()
+	s.country.expected = strings.ToUpper(strings.TrimSpace(code))
+	s.country.listener = listener
+	s.country.access.Unlock()
+}
+
+func (s *ClashBasedInstance) assertCountry() {
+	s.country.access.Lock()
+	expected, listener := s.country.expected, s.country.listener
+	s.country.access.Unlock()
+	if expected == "" || listener == nil {
+		return
+	}
+
+	info, err := CheckExitIP(s, countryAssertTimeout)
+	if err != nil {
+		log.Warnf("check exit country failed: %s", err.Error())
+		return
+	}
+	if info.CountryCode != "" && info.CountryCode != expected {
+		listener.OnCountryMismatch(expected, info.CountryCode, info.IP)
+	}
+}
@@ -0,0 +1,92 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/Dreamacro/clash/component/dialer"
+	"github.com/Dreamacro/clash/component/resolver"
+)
+
+var dialHookOnce sync.Once
+
+// installDialHooks hooks the sockets created by the Clash dialer, which get
+// the buffer sizes of SetSocketBufferSize. Connections to the server of an
+// instance are dialed by dialServer with the options of the instance instead.
+func installDialHooks() {
+	dialHookOnce.Do(func() {
+		previous := dialer.DialHook
+		dialer.DialHook = func(d *net.Dialer, network string, ip net.IP) error {
+			if previous != nil {
+				if err := previous(d, network, ip); err != nil {
+					return err
+				}
+			}
+			d.Control = withSocketBuffer(d.Control)
+			return nil
+		}
+		previousListen := dialer.ListenPacketHook
+		dialer.ListenPacketHook = func(lc *net.ListenConfig, address string) (string, error) {
+			if previousListen != nil {
+				var err error
+				if address, err = previousListen(lc, address); err != nil {
+					return address, err
+				}
+			}
+			lc.Control = withSocketBuffer(lc.Control)
+			return address, nil
+		}
+	})
+}
+
+// withSocketBuffer applies the buffer sizes of SetSocketBufferSize after
+// control.
+func withSocketBuffer(control func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return c.Control(func(fd uintptr) {
+			setSocketBuffer(int(fd), socketSendBuffer, socketReceiveBuffer)
+		})
+	}
+}
+
+type socketOptionsKey struct{}
+
+// withSocketOptions returns ctx carrying the options applied by dialServer.
+func withSocketOptions(ctx context.Context, options *socketOptions) context.Context {
+	if options == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, socketOptionsKey{}, options)
+}
+
+// dialServer dials the server of an outbound, applying the socket options
+// of the instance the dial comes from, if any, or else going through the
+// Clash dialer.
+func dialServer(ctx context.Context, network, address string) (net.Conn, error) {
+	options, _ := ctx.Value(socketOptionsKey{}).(*socketOptions)
+	if options == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := resolver.ResolveIP(host)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Control: func(network, _ string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			setSocketBuffer(int(fd), socketSendBuffer, socketReceiveBuffer)
+			options.apply(int(fd), network)
+		})
+	}}
+	return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
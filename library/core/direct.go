@@ -0,0 +1,150 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+)
+
+const (
+	IPv6StrategyDefault int32 = iota
+	IPv6StrategyPreferIPv4
+	IPv6StrategyPreferIPv6
+	IPv6StrategyIPv4Only
+	IPv6StrategyIPv6Only
+)
+
+type directInstance struct {
+	*outbound.Base
+	options  *socketOptions
+	strategy int32
+}
+
+func (d *directInstance) socketOptions() *socketOptions {
+	return d.options
+}
+
+func (d *directInstance) resolve(ctx context.Context, metadata *clashC.Metadata) (net.IP, error) {
+	var ips []net.IP
+	if metadata.Host == "" {
+		ips = []net.IP{metadata.DstIP}
+	} else {
+		addresses, err := net.DefaultResolver.LookupIPAddr(ctx, metadata.Host)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			ips = append(ips, address.IP)
+		}
+	}
+
+	var ip4, ip6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if ip4 == nil {
+				ip4 = ip
+			}
+		} else if ip6 == nil {
+			ip6 = ip
+		}
+	}
+
+	switch d.strategy {
+	case IPv6StrategyIPv4Only:
+		ip6 = nil
+		fallthrough
+	case IPv6StrategyPreferIPv4:
+		if ip4 != nil {
+			return ip4, nil
+		}
+		if ip6 != nil {
+			return ip6, nil
+		}
+	case IPv6StrategyIPv6Only:
+		ip4 = nil
+		fallthrough
+	case IPv6StrategyPreferIPv6:
+		if ip6 != nil {
+			return ip6, nil
+		}
+		if ip4 != nil {
+			return ip4, nil
+		}
+	default:
+		if len(ips) > 0 && ips[0] != nil {
+			return ips[0], nil
+		}
+	}
+	return nil, fmt.Errorf("no suitable address for %s", metadata.RemoteAddress())
+}
+
+func (d *directInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	ip, err := d.resolve(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Control: d.options.control}
+	c, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), metadata.DstPort))
+	if err != nil {
+		if ctx.Err() == nil {
+			d.options.interfaceFailed(d.options.currentInterface())
+		}
+		return nil, err
+	}
+	tcpKeepAlive(c)
+	return outbound.NewConn(c, d), nil
+}
+
+func (d *directInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	listenConfig := &net.ListenConfig{Control: d.options.control}
+	pc, err := listenConfig.ListenPacket(context.Background(), "udp", d.options.listenAddress())
+	if err != nil {
+		return nil, err
+	}
+	if udpConn, ok := pc.(*net.UDPConn); ok {
+		pc = newBatchPacketConn(udpConn)
+	}
+	return newPacketConn(pc, d), nil
+}
+
+// packetConn is the clashC.PacketConn of the outbound package of Clash, which
+// does not export its constructor.
+type packetConn struct {
+	net.PacketConn
+	chain clashC.Chain
+}
+
+func newPacketConn(pc net.PacketConn, a clashC.ProxyAdapter) clashC.PacketConn {
+	return &packetConn{pc, []string{a.Name()}}
+}
+
+func (c *packetConn) Chains() clashC.Chain {
+	return c.chain
+}
+
+func (c *packetConn) AppendToChains(a clashC.ProxyAdapter) {
+	c.chain = append(c.chain, a.Name())
+}
+
+// NewDirectInstance creates a direct instance, iface is the interface to bind
+// to or a comma separated list of them in order of preference.
+func NewDirectInstance(socksPort int32, iface string, ipv6Strategy int32) (*ClashBasedInstance, error) {
+	if ipv6Strategy < IPv6StrategyDefault || ipv6Strategy > IPv6StrategyIPv6Only {
+		return nil, errors.New("unknown ipv6 strategy " + strconv.Itoa(int(ipv6Strategy)))
+	}
+	out := &directInstance{
+		Base:     outbound.NewBase("DIRECT", "", clashC.Direct, true),
+		options:  &socketOptions{ifaces: splitList(iface)},
+		strategy: ipv6Strategy,
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
+
+func NewBlockInstance(socksPort int32) (*ClashBasedInstance, error) {
+	return newClashBasedInstance(socksPort, outbound.NewReject()), nil
+}
@@ -0,0 +1,218 @@
+package libcore
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+)
+
+const (
+	dnsCacheMaxEntries  = 4096
+	dnsStaleTTL         = 30
+	dnsStaleMaxAge      = 3 * time.Hour
+	dnsPrefetchInterval = 5 * time.Second
+	dnsPrefetchWindow   = 10 * time.Second
+)
+
+type dnsCacheEntry struct {
+	msg        *dns.Msg
+	storedAt   time.Time
+	expireAt   time.Time
+	refreshing bool
+	// answers served from cache, halved at each prefetch
+	hits   uint32
+	server v2rayNet.Destination
+}
+
+type dnsCache struct {
+	access     sync.Mutex
+	entries    map[string]*dnsCacheEntry
+	minTTL     uint32
+	maxTTL     uint32
+	serveStale bool
+}
+
+func newDnsCache(minTTL uint32, maxTTL uint32, serveStale bool) *dnsCache {
+	return &dnsCache{
+		entries:    map[string]*dnsCacheEntry{},
+		minTTL:     minTTL,
+		maxTTL:     maxTTL,
+		serveStale: serveStale,
+	}
+}
+
+func dnsCacheKey(question dns.Question) string {
+	return strings.ToLower(question.Name) + ":" + strconv.Itoa(int(question.Qtype)) + ":" + strconv.Itoa(int(question.Qclass))
+}
+
+func (c *dnsCache) clampTTL(ttl uint32) uint32 {
+	if c.minTTL > 0 && ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// store caches an upstream response from server, ignoring anything but
+// successful or NXDOMAIN answers.
+func (c *dnsCache) store(message []byte, server v2rayNet.Destination) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(message); err != nil || !msg.Response || len(msg.Question) == 0 {
+		return
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	ttl := uint32(0)
+	for i, rr := range msg.Answer {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if len(msg.Answer) == 0 {
+		ttl = dnsStaleTTL
+	}
+	ttl = c.clampTTL(ttl)
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	if len(c.entries) >= dnsCacheMaxEntries {
+		c.evict(now)
+	}
+	key := dnsCacheKey(msg.Question[0])
+	var hits uint32
+	if previous := c.entries[key]; previous != nil {
+		hits = previous.hits
+	}
+	c.entries[key] = &dnsCacheEntry{
+		msg:      msg,
+		storedAt: now,
+		expireAt: now.Add(time.Duration(ttl) * time.Second),
+		hits:     hits,
+		server:   server,
+	}
+}
+
+func (c *dnsCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expireAt) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) >= dnsCacheMaxEntries {
+		c.entries = map[string]*dnsCacheEntry{}
+	}
+}
+
+// lookup answers the query from cache. A stale answer is returned with
+// refresh set when serve-stale is enabled, and the caller should re-query
+// the upstream in background.
+func (c *dnsCache) lookup(query *dns.Msg) (reply []byte, refresh bool) {
+	if len(query.Question) == 0 {
+		return nil, false
+	}
+	key := dnsCacheKey(query.Question[0])
+	now := time.Now()
+
+	c.access.Lock()
+	entry := c.entries[key]
+	if entry == nil {
+		c.access.Unlock()
+		return nil, false
+	}
+	var ttl uint32
+	if now.Before(entry.expireAt) {
+		ttl = uint32(entry.expireAt.Sub(now) / time.Second)
+		if ttl == 0 {
+			ttl = 1
+		}
+	} else if c.serveStale && now.Sub(entry.expireAt) < dnsStaleMaxAge {
+		ttl = dnsStaleTTL
+		if !entry.refreshing {
+			entry.refreshing = true
+			refresh = true
+		}
+	} else {
+		delete(c.entries, key)
+		c.access.Unlock()
+		return nil, false
+	}
+	entry.hits++
+	msg := entry.msg.Copy()
+	c.access.Unlock()
+
+	msg.Id = query.Id
+	for _, records := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range records {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+	reply, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return reply, refresh
+}
+
+func (c *dnsCache) refreshDone(query *dns.Msg) {
+	c.access.Lock()
+	if entry := c.entries[dnsCacheKey(query.Question[0])]; entry != nil {
+		entry.refreshing = false
+	}
+	c.access.Unlock()
+}
+
+type dnsPrefetchItem struct {
+	query  *dns.Msg
+	server v2rayNet.Destination
+}
+
+// prefetchCandidates returns up to limit of the most hit entries, with at
+// least minHits, expiring within dnsPrefetchWindow, and marks them refreshing.
+func (c *dnsCache) prefetchCandidates(minHits uint32, limit int) []dnsPrefetchItem {
+	now := time.Now()
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	var candidates []*dnsCacheEntry
+	for _, entry := range c.entries {
+		if entry.refreshing || entry.hits < minHits || entry.server.Address == nil {
+			continue
+		}
+		if remaining := entry.expireAt.Sub(now); remaining > 0 && remaining <= dnsPrefetchWindow {
+			candidates = append(candidates, entry)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].hits > candidates[j].hits
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	items := make([]dnsPrefetchItem, 0, len(candidates))
+	for _, entry := range candidates {
+		entry.refreshing = true
+		entry.hits /= 2
+		question := entry.msg.Question[0]
+		query := new(dns.Msg)
+		query.SetQuestion(question.Name, question.Qtype)
+		query.Question[0].Qclass = question.Qclass
+		items = append(items, dnsPrefetchItem{query, entry.server})
+	}
+	return items
+}
@@ -0,0 +1,86 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// dnsPrefetch refreshes the cached answers of the most resolved domains
+// shortly before they expire, with at most budget queries per minute.
+type dnsPrefetch struct {
+	count int64
+
+	minHits uint32
+	budget  int
+	done    chan struct{}
+}
+
+func (p *dnsPrefetch) stop() {
+	if p != nil {
+		close(p.done)
+	}
+}
+
+// SetDnsPrefetch refreshes the DNS cache entries answered at least minHits
+// times before they expire, sending up to budgetPerMinute queries a minute.
+// It requires the DNS cache.
+func (t *Tun2socks) SetDnsPrefetch(enabled bool, minHits int32, budgetPerMinute int32) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.prefetch.stop()
+	t.prefetch = nil
+	if !enabled || budgetPerMinute <= 0 {
+		return
+	}
+	if minHits < 1 {
+		minHits = 1
+	}
+	p := &dnsPrefetch{
+		minHits: uint32(minHits),
+		budget:  int(budgetPerMinute),
+		done:    make(chan struct{}),
+	}
+	t.prefetch = p
+	go t.prefetchLoop(p)
+}
+
+// DnsPrefetchCount returns the number of DNS answers refreshed in advance.
+func (t *Tun2socks) DnsPrefetchCount() int64 {
+	t.access.Lock()
+	p := t.prefetch
+	t.access.Unlock()
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.count)
+}
+
+func (t *Tun2socks) prefetchLoop(p *dnsPrefetch) {
+	ticker := time.NewTicker(dnsPrefetchInterval)
+	defer ticker.Stop()
+	windowStart := time.Now()
+	used := 0
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		cache := t.currentDnsCache()
+		if cache == nil {
+			continue
+		}
+		if time.Since(windowStart) >= time.Minute {
+			windowStart = time.Now()
+			used = 0
+		}
+		if used >= p.budget {
+			continue
+		}
+		for _, item := range cache.prefetchCandidates(p.minHits, p.budget-used) {
+			used++
+			atomic.AddInt64(&p.count, 1)
+			go t.refreshDns(cache, item.query, item.server)
+		}
+	}
+}
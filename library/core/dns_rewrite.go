@@ -0,0 +1,190 @@
+package libcore
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const dnsRewriteTTL = 60
+
+type dnsRewriteRule struct {
+	ips   []net.IP
+	strip map[uint16]struct{}
+}
+
+// DnsRewriter answers matching DNS queries locally, with fixed addresses or
+// empty answers for stripped record types.
+type DnsRewriter struct {
+	access    sync.RWMutex
+	suffix    map[string]*dnsRewriteRule
+	full      map[string]*dnsRewriteRule
+	rewritten int64
+}
+
+func NewDnsRewriter() *DnsRewriter {
+	return &DnsRewriter{
+		suffix: map[string]*dnsRewriteRule{},
+		full:   map[string]*dnsRewriteRule{},
+	}
+}
+
+var dnsRewriter *DnsRewriter
+
+func SetDnsRewriter(rewriter *DnsRewriter) {
+	dnsRewriter = rewriter
+}
+
+// LoadRules adds one rule per line and returns the number of rules loaded. A
+// rule is a domain followed by addresses and "-TYPE" items stripping a record
+// type, such as "example.com 1.2.3.4" or "example.com -AAAA". Domains match
+// their subdomains unless prefixed with "full:".
+func (r *DnsRewriter) LoadRules(content string) int32 {
+	var count int32
+	r.access.Lock()
+	defer r.access.Unlock()
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.IndexByte(line, '#'); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		rules := r.suffix
+		domain := fields[0]
+		if strings.HasPrefix(domain, "full:") {
+			rules = r.full
+			domain = domain[5:]
+		} else {
+			domain = strings.TrimPrefix(domain, "domain:")
+		}
+		if domain = normalizeDomain(domain); domain == "" {
+			continue
+		}
+
+		rule := &dnsRewriteRule{strip: map[uint16]struct{}{}}
+		valid := true
+		for _, item := range fields[1:] {
+			if strings.HasPrefix(item, "-") {
+				recordType, ok := dns.StringToType[strings.ToUpper(item[1:])]
+				if !ok {
+					valid = false
+					break
+				}
+				rule.strip[recordType] = struct{}{}
+				continue
+			}
+			ip := net.ParseIP(item)
+			if ip == nil {
+				valid = false
+				break
+			}
+			rule.ips = append(rule.ips, ip)
+		}
+		if !valid {
+			log.Warnf("[DNS] invalid rewrite rule: %s", line)
+			continue
+		}
+		rules[domain] = rule
+		count++
+	}
+	return count
+}
+
+func (r *DnsRewriter) Clear() {
+	r.access.Lock()
+	r.suffix = map[string]*dnsRewriteRule{}
+	r.full = map[string]*dnsRewriteRule{}
+	r.access.Unlock()
+}
+
+func (r *DnsRewriter) Size() int32 {
+	r.access.RLock()
+	defer r.access.RUnlock()
+	return int32(len(r.suffix) + len(r.full))
+}
+
+func (r *DnsRewriter) RewrittenCount() int64 {
+	return atomic.LoadInt64(&r.rewritten)
+}
+
+func (r *DnsRewriter) match(domain string) *dnsRewriteRule {
+	r.access.RLock()
+	defer r.access.RUnlock()
+	if rule, ok := r.full[domain]; ok {
+		return rule
+	}
+	for name := domain; ; {
+		if rule, ok := r.suffix[name]; ok {
+			return rule
+		}
+		index := strings.IndexByte(name, '.')
+		if index < 0 {
+			return nil
+		}
+		name = name[index+1:]
+	}
+}
+
+// rewrite builds the local answer for the query, or nil if no rule applies.
+func (r *DnsRewriter) rewrite(query *dns.Msg) *dns.Msg {
+	question := query.Question[0]
+	rule := r.match(normalizeDomain(question.Name))
+	if rule == nil {
+		return nil
+	}
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.RecursionAvailable = true
+	if _, stripped := rule.strip[question.Qtype]; stripped {
+		atomic.AddInt64(&r.rewritten, 1)
+		return response
+	}
+	if (question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA) || len(rule.ips) == 0 {
+		return nil
+	}
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: dnsRewriteTTL}
+	for _, ip := range rule.ips {
+		ip4 := ip.To4()
+		switch {
+		case question.Qtype == dns.TypeA && ip4 != nil:
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: ip4})
+		case question.Qtype == dns.TypeAAAA && ip4 == nil:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	// a domain mapped to addresses of the other family only gets an empty answer
+	atomic.AddInt64(&r.rewritten, 1)
+	return response
+}
+
+// rewrittenDnsResponse returns the local reply to the message if it is a query
+// matched by the rewrite rules.
+func rewrittenDnsResponse(message []byte) []byte {
+	rewriter := dnsRewriter
+	if rewriter == nil {
+		return nil
+	}
+	query := dns.Msg{}
+	if err := query.Unpack(message); err != nil || query.Response || len(query.Question) == 0 {
+		return nil
+	}
+	response := rewriter.rewrite(&query)
+	if response == nil {
+		return nil
+	}
+	reply, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return reply
+}
@@ -0,0 +1,71 @@
+package libcore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testDnsRewrites = `# comment
+example.com 1.2.3.4 2001:db8::1
+full:exact.example.org 5.6.7.8 # trailing comment
+domain:noaaaa.example.net -AAAA
+bad.test not-an-ip
+invalid.test -NOTATYPE
+onefield.test
+`
+
+func TestDnsRewriter(t *testing.T) {
+	rewriter := NewDnsRewriter()
+	if count := rewriter.LoadRules(testDnsRewrites); count != 3 {
+		t.Fatalf("loaded %d rules, want 3", count)
+	}
+	tests := []struct {
+		name     string
+		qtype    uint16
+		answered bool
+		answers  []string
+	}{
+		{"www.example.com.", dns.TypeA, true, []string{"1.2.3.4"}},
+		{"Example.COM.", dns.TypeAAAA, true, []string{"2001:db8::1"}},
+		{"example.com.", dns.TypeTXT, false, nil},
+		{"exact.example.org.", dns.TypeA, true, []string{"5.6.7.8"}},
+		{"exact.example.org.", dns.TypeAAAA, true, nil},
+		{"sub.exact.example.org.", dns.TypeA, false, nil},
+		{"noaaaa.example.net.", dns.TypeAAAA, true, nil},
+		{"noaaaa.example.net.", dns.TypeA, false, nil},
+		{"bad.test.", dns.TypeA, false, nil},
+		{"invalid.test.", dns.TypeA, false, nil},
+		{"onefield.test.", dns.TypeA, false, nil},
+	}
+	var rewritten int64
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, test.qtype)
+		response := rewriter.rewrite(query)
+		if (response != nil) != test.answered {
+			t.Errorf("%s %s: answered %v", test.name, dns.TypeToString[test.qtype], response != nil)
+			continue
+		}
+		if response == nil {
+			continue
+		}
+		rewritten++
+		var answers []string
+		for _, answer := range response.Answer {
+			switch record := answer.(type) {
+			case *dns.A:
+				answers = append(answers, record.A.String())
+			case *dns.AAAA:
+				answers = append(answers, record.AAAA.String())
+			}
+		}
+		if response.Id != query.Id || !reflect.DeepEqual(answers, test.answers) {
+			t.Errorf("%s %s: got %v, want %v", test.name, dns.TypeToString[test.qtype], answers, test.answers)
+		}
+	}
+	if count := rewriter.RewrittenCount(); count != rewritten {
+		t.Errorf("rewritten count %d, want %d", count, rewritten)
+	}
+}
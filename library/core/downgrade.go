@@ -0,0 +1,117 @@
+package libcore
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	clashC "github.com/Dreamacro/clash/constant"
+)
+
+const (
+	downgradeTcpOnly uint8 = 1 << iota
+	downgradeNoMux
+)
+
+// dedicatedDialer is implemented by the outbounds sharing a session between
+// connections, to dial one on a session of its own.
+type dedicatedDialer interface {
+	dialDedicated(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error)
+}
+
+type downgradeCidr struct {
+	cidr  *net.IPNet
+	flags uint8
+}
+
+// downgradeRules holds the destinations that misbehave with UDP or with
+// multiplexed connections through the instance.
+type downgradeRules struct {
+	access  sync.RWMutex
+	domains map[string]uint8
+	ips     []downgradeCidr
+}
+
+// SetDowngradeRules sets the per destination protocol downgrades, one per line
+// as "<action>:<domain, IP or CIDR>", domains matching their subdomains too:
+//
+//	tcp-only   drops UDP, so that apps such as QUIC clients fall back to TCP
+//	no-mux     dials on a session of its own instead of a shared one, for the
+//	           outbounds multiplexing or reusing sessions (TUIC, AnyTLS)
+//	no-0rtt    same as no-mux, a dedicated session always does a full handshake
+//
+// It returns the number of rules loaded.
+func (s *ClashBasedInstance) SetDowngradeRules(content string) int32 {
+	domains := map[string]uint8{}
+	var ips []downgradeCidr
+	var count int32
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		index := strings.IndexByte(line, ':')
+		if index < 0 {
+			continue
+		}
+		var flag uint8
+		switch strings.ToLower(strings.TrimSpace(line[:index])) {
+		case "tcp-only":
+			flag = downgradeTcpOnly
+		case "no-mux", "no-0rtt":
+			flag = downgradeNoMux
+		default:
+			continue
+		}
+		target := strings.TrimSpace(line[index+1:])
+		if _, cidr, err := net.ParseCIDR(target); err == nil {
+			ips = append(ips, downgradeCidr{cidr, flag})
+		} else if ip := net.ParseIP(target); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ips = append(ips, downgradeCidr{&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, flag})
+		} else if domain := normalizeDomain(target); domain != "" {
+			domains[domain] |= flag
+		} else {
+			continue
+		}
+		count++
+	}
+
+	s.downgrade.access.Lock()
+	defer s.downgrade.access.Unlock()
+	s.downgrade.domains = domains
+	s.downgrade.ips = ips
+	return count
+}
+
+func (r *downgradeRules) match(metadata *clashC.Metadata) uint8 {
+	r.access.RLock()
+	defer r.access.RUnlock()
+
+	var flags uint8
+	if metadata.Host != "" && len(r.domains) > 0 {
+		for name := normalizeDomain(metadata.Host); ; {
+			flags |= r.domains[name]
+			index := strings.IndexByte(name, '.')
+			if index < 0 {
+				break
+			}
+			name = name[index+1:]
+		}
+	}
+	if metadata.DstIP != nil {
+		for _, rule := range r.ips {
+			if rule.cidr.Contains(metadata.DstIP) {
+				flags |= rule.flags
+			}
+		}
+	}
+	return flags
+}
@@ -0,0 +1,99 @@
+package libcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type ExitIPInfo struct {
+	IP           string
+	CountryCode  string
+	Country      string
+	Organization string
+	Source       string
+}
+
+type exitIPEndpoint struct {
+	url   string
+	parse func(content map[string]interface{}) *ExitIPInfo
+}
+
+func jsonString(content map[string]interface{}, key string) string {
+	value, _ := content[key].(string)
+	return value
+}
+
+var exitIPEndpoints = []exitIPEndpoint{
+	{"https://api.ip.sb/geoip", func(content map[string]interface{}) *ExitIPInfo {
+		return &ExitIPInfo{
+			IP:           jsonString(content, "ip"),
+			CountryCode:  jsonString(content, "country_code"),
+			Country:      jsonString(content, "country"),
+			Organization: jsonString(content, "isp"),
+		}
+	}},
+	{"https://ipinfo.io/json", func(content map[string]interface{}) *ExitIPInfo {
+		return &ExitIPInfo{
+			IP:           jsonString(content, "ip"),
+			CountryCode:  jsonString(content, "country"),
+			Organization: jsonString(content, "org"),
+		}
+	}},
+	{"http://ip-api.com/json", func(content map[string]interface{}) *ExitIPInfo {
+		return &ExitIPInfo{
+			IP:           jsonString(content, "query"),
+			CountryCode:  jsonString(content, "countryCode"),
+			Country:      jsonString(content, "country"),
+			Organization: jsonString(content, "isp"),
+		}
+	}},
+	{"https://api.myip.com", func(content map[string]interface{}) *ExitIPInfo {
+		return &ExitIPInfo{
+			IP:          jsonString(content, "ip"),
+			CountryCode: jsonString(content, "cc"),
+			Country:     jsonString(content, "country"),
+		}
+	}},
+}
+
+// CheckExitIP returns the public IP and location seen through the instance,
+// trying several endpoints in order.
+func CheckExitIP(instance *ClashBasedInstance, timeout int32) (*ExitIPInfo, error) {
+	client := NewHTTPClient(instance, timeout, "", true, false)
+	defer client.Close()
+
+	var failures []string
+	for _, endpoint := range exitIPEndpoints {
+		info, err := queryExitIP(client, endpoint)
+		if err == nil {
+			return info, nil
+		}
+		failures = append(failures, err.Error())
+	}
+	return nil, fmt.Errorf("check exit ip failed: %s", strings.Join(failures, "; "))
+}
+
+func queryExitIP(client *HTTPClient, endpoint exitIPEndpoint) (*ExitIPInfo, error) {
+	resp, err := client.Get(endpoint.url)
+	if err != nil {
+		return nil, errors.WithMessage(err, endpoint.url)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s: unexpected response status: %d", endpoint.url, resp.StatusCode)
+	}
+	var content map[string]interface{}
+	if err = json.Unmarshal(resp.Body, &content); err != nil {
+		return nil, errors.WithMessage(err, endpoint.url)
+	}
+	info := endpoint.parse(content)
+	if net.ParseIP(info.IP) == nil {
+		return nil, fmt.Errorf("%s: invalid ip in response", endpoint.url)
+	}
+	info.CountryCode = strings.ToUpper(info.CountryCode)
+	info.Source = endpoint.url
+	return info, nil
+}
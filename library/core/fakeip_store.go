@@ -0,0 +1,204 @@
+package libcore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	v2rayDns "github.com/xtls/xray-core/features/dns"
+)
+
+const (
+	fakeIpStoreMaxEntries = 8192
+	fakeIpStoreDelay      = 5 * time.Second
+)
+
+type fakeIpEntry struct {
+	Domain string `json:"domain"`
+	// unix milliseconds
+	SeenAt int64 `json:"seenAt"`
+}
+
+// fakeIpStoreData keeps the fake addresses handed out to apps, so that
+// connections to addresses cached from before a restart are still sent to
+// their domain.
+type fakeIpStoreData struct {
+	access  sync.Mutex
+	path    string
+	pools   []*net.IPNet
+	entries map[string]*fakeIpEntry
+	saving  bool
+}
+
+var fakeIpStore = &fakeIpStoreData{entries: map[string]*fakeIpEntry{}}
+
+// SetFakeIpStorePath loads the fake address mappings persisted at path, which
+// is then rewritten shortly after each new mapping. pools is the comma
+// separated list of the fake address ranges of the FakeDNS config, answers
+// outside of them are not recorded.
+func SetFakeIpStorePath(path string, pools string) error {
+	var ranges []*net.IPNet
+	for _, pool := range strings.Split(pools, ",") {
+		pool = strings.TrimSpace(pool)
+		if pool == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(pool)
+		if err != nil {
+			return errors.WithMessage(err, "parse fake ip pool")
+		}
+		ranges = append(ranges, ipNet)
+	}
+	entries := map[string]*fakeIpEntry{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &entries); err != nil {
+			return errors.WithMessage(err, "parse fake ip store")
+		}
+	}
+	fakeIpStore.access.Lock()
+	fakeIpStore.path = path
+	fakeIpStore.pools = ranges
+	fakeIpStore.entries = entries
+	fakeIpStore.access.Unlock()
+	return nil
+}
+
+// ClearFakeIpStore forgets all mappings, for when the pools are changed.
+func ClearFakeIpStore() {
+	fakeIpStore.access.Lock()
+	defer fakeIpStore.access.Unlock()
+	fakeIpStore.entries = map[string]*fakeIpEntry{}
+	fakeIpStore.scheduleSave()
+}
+
+func (s *fakeIpStoreData) enabled() bool {
+	s.access.Lock()
+	defer s.access.Unlock()
+	return s.path != "" && len(s.pools) > 0
+}
+
+func (s *fakeIpStoreData) inPool(ip net.IP) bool {
+	for _, pool := range s.pools {
+		if pool.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// record stores the fake addresses of a DNS response.
+func (s *fakeIpStoreData) record(message []byte) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(message); err != nil || !msg.Response {
+		return
+	}
+	now := unixMilli(time.Now())
+	s.access.Lock()
+	defer s.access.Unlock()
+	changed := false
+	for _, rr := range msg.Answer {
+		var ip net.IP
+		switch answer := rr.(type) {
+		case *dns.A:
+			ip = answer.A
+		case *dns.AAAA:
+			ip = answer.AAAA
+		default:
+			continue
+		}
+		if !s.inPool(ip) {
+			continue
+		}
+		domain := strings.TrimSuffix(strings.ToLower(rr.Header().Name), ".")
+		key := ip.String()
+		if entry := s.entries[key]; entry != nil && entry.Domain == domain {
+			// refresh the age without rewriting the file for every query
+			entry.SeenAt = now
+			continue
+		}
+		s.entries[key] = &fakeIpEntry{Domain: domain, SeenAt: now}
+		changed = true
+	}
+	if changed {
+		s.prune()
+		s.scheduleSave()
+	}
+}
+
+// prune drops the oldest mappings over fakeIpStoreMaxEntries.
+func (s *fakeIpStoreData) prune() {
+	for len(s.entries) > fakeIpStoreMaxEntries {
+		var oldest string
+		var oldestAt int64
+		for key, entry := range s.entries {
+			if oldest == "" || entry.SeenAt < oldestAt {
+				oldest, oldestAt = key, entry.SeenAt
+			}
+		}
+		delete(s.entries, oldest)
+	}
+}
+
+func (s *fakeIpStoreData) lookup(ip net.IP) string {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if entry := s.entries[ip.String()]; entry != nil {
+		return entry.Domain
+	}
+	return ""
+}
+
+func (s *fakeIpStoreData) scheduleSave() {
+	if s.path == "" || s.saving {
+		return
+	}
+	s.saving = true
+	time.AfterFunc(fakeIpStoreDelay, s.save)
+}
+
+func (s *fakeIpStoreData) save() {
+	s.access.Lock()
+	s.saving = false
+	path := s.path
+	content, err := json.Marshal(s.entries)
+	s.access.Unlock()
+	if err != nil {
+		return
+	}
+	temp := path + ".tmp"
+	if err = ioutil.WriteFile(temp, content, 0o644); err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		log.Warnf("save fake ip store failed: %s", err.Error())
+	}
+}
+
+// restoreFakeIp returns the destination with a fake address the running
+// FakeDNS no longer knows replaced by its persisted domain.
+func (t *Tun2socks) restoreFakeIp(dest v2rayNet.Destination) v2rayNet.Destination {
+	if !t.fakedns || !dest.Address.Family().IsIP() || !fakeIpStore.enabled() {
+		return dest
+	}
+	if engine, ok := t.v2ray.core.GetFeature((*v2rayDns.FakeDNSEngine)(nil)).(v2rayDns.FakeDNSEngine); ok {
+		if engine.GetDomainFromFakeDNS(dest.Address) != "" {
+			return dest
+		}
+	}
+	if domain := fakeIpStore.lookup(dest.Address.IP()); domain != "" {
+		dest.Address = v2rayNet.DomainAddress(domain)
+	}
+	return dest
+}
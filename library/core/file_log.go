@@ -0,0 +1,156 @@
+package libcore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const fileLogName = "libcore.log"
+
+type rotatingLogger struct {
+	access   sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	level    logrus.Level
+	file     *os.File
+	size     int64
+}
+
+var (
+	fileLogAccess sync.Mutex
+	fileLogger    *rotatingLogger
+)
+
+// SetFileLog starts writing logs up to the given logrus level (0 panic .. 5 debug)
+// into dir, rotating the file once it grows past maxSize bytes and keeping at
+// most maxFiles files.
+func SetFileLog(dir string, maxSize int64, maxFiles int32, level int32) error {
+	if maxSize <= 0 || maxFiles <= 0 {
+		return errors.New("invalid file log limits")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return errors.WithMessage(err, "create log dir")
+	}
+	logger := &rotatingLogger{
+		path:     filepath.Join(dir, fileLogName),
+		maxSize:  maxSize,
+		maxFiles: int(maxFiles),
+		level:    logrus.Level(level),
+	}
+	if err := logger.open(); err != nil {
+		return err
+	}
+
+	fileLogAccess.Lock()
+	old := fileLogger
+	fileLogger = logger
+	fileLogAccess.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+func CloseFileLog() {
+	fileLogAccess.Lock()
+	old := fileLogger
+	fileLogger = nil
+	fileLogAccess.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+}
+
+// recordLog keeps the message for bug reports and appends it to the file log,
+// if enabled and the level is within the configured threshold.
+func recordLog(level logrus.Level, message string) {
+	recentLogs.add(level, message)
+
+	fileLogAccess.Lock()
+	logger := fileLogger
+	fileLogAccess.Unlock()
+
+	if logger == nil || level > logger.level {
+		return
+	}
+	logger.write(level, message)
+}
+
+func (l *rotatingLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return errors.WithMessage(err, "open log file")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *rotatingLogger) rotate() error {
+	_ = l.file.Close()
+	l.file = nil
+	for i := l.maxFiles - 1; i > 0; i-- {
+		src := l.path
+		if i > 1 {
+			src = fmt.Sprint(l.path, ".", i-1)
+		}
+		_ = os.Rename(src, fmt.Sprint(l.path, ".", i))
+	}
+	if l.maxFiles == 1 {
+		_ = os.Remove(l.path)
+	}
+	return l.open()
+}
+
+func (l *rotatingLogger) write(level logrus.Level, message string) {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	if l.file == nil {
+		return
+	}
+	line := fmt.Sprint(time.Now().Format("2006-01-02 15:04:05.000"), " [", strings.Title(level.String()), "] ", strings.TrimRight(message, "\n"), "\n")
+	if l.size+int64(len(line)) > l.maxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			return
+		}
+	}
+	n, _ := l.file.WriteString(line)
+	l.size += int64(n)
+}
+
+func (l *rotatingLogger) close() {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	if l.file != nil {
+		_ = l.file.Close()
+		l.file = nil
+	}
+}
+
+type fileLogHook struct{}
+
+func (fileLogHook) Levels() []logrus.Level {
+	return levels
+}
+
+func (fileLogHook) Fire(e *logrus.Entry) error {
+	recordLog(e.Level, e.Message)
+	return nil
+}
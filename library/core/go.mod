@@ -4,8 +4,10 @@ go 1.16
 
 require (
 	github.com/Dreamacro/clash v1.6.5
+	github.com/lucas-clemente/quic-go v0.21.2
 	github.com/miekg/dns v1.1.43
 	github.com/pkg/errors v0.9.1
+	github.com/refraction-networking/utls v0.0.0-20201210053706-2179f286686b
 	github.com/sagernet/gomobile v0.0.0-20210822074701-68a55075c7d2
 	github.com/sagernet/libping v0.1.1
 	github.com/sagernet/sagerconnect v0.1.7
@@ -13,7 +15,12 @@ require (
 	github.com/ulikunitz/xz v0.5.10
 	github.com/xjasonlyu/tun2socks v1.18.4-0.20210813034434-85cf694b8fed
 	github.com/xtls/xray-core v1.4.2
+	go.starlark.net v0.0.0-20210312235212-74c10e2c17dc
+	golang.org/x/crypto v0.0.0-20210812204632-0ba0e8f03122
+	golang.org/x/net v0.0.0-20210813160813-60bc85c4be6d
 	golang.org/x/sys v0.0.0-20210823070655-63515b42dcdf
+	golang.zx2c4.com/wireguard v0.0.0-20210805125648-3957e9b9dd19
+	gvisor.dev/gvisor v0.0.0-20210813013607-83f71d012799
 )
 
 replace github.com/Dreamacro/clash v1.6.5 => github.com/ClashDotNetFramework/experimental-clash v1.7.2
@@ -0,0 +1,124 @@
+package libcore
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GroupMembers are the member instances of a group profile, built and tested
+// concurrently.
+type GroupMembers struct {
+	instances []*ClashBasedInstance
+	errors    []string
+	delays    []int32
+}
+
+func (g *GroupMembers) Count() int32 {
+	return int32(len(g.instances))
+}
+
+// Instance returns the member at index, or nil if it could not be built or
+// timed out. A member whose url test failed is still returned, with its error
+// and a delay of 0.
+func (g *GroupMembers) Instance(index int32) *ClashBasedInstance {
+	return g.instances[index]
+}
+
+func (g *GroupMembers) Error(index int32) string {
+	return g.errors[index]
+}
+
+// DelayMs returns the url test delay of the member, 0 if it failed.
+func (g *GroupMembers) DelayMs(index int32) int32 {
+	return g.delays[index]
+}
+
+// Fastest returns the index of the member with the lowest delay, or -1.
+func (g *GroupMembers) Fastest() int32 {
+	fastest := int32(-1)
+	for i, delay := range g.delays {
+		if delay > 0 && (fastest < 0 || delay < g.delays[fastest]) {
+			fastest = int32(i)
+		}
+	}
+	return fastest
+}
+
+func (g *GroupMembers) Close() {
+	for _, instance := range g.instances {
+		if instance != nil {
+			_ = instance.Close()
+		}
+	}
+}
+
+type groupMemberResult struct {
+	index    int
+	instance *ClashBasedInstance
+	delay    int32
+	err      error
+}
+
+// NewGroupMembers builds the members of a group from a JSON array of profiles
+// and, when link is set, runs their first url test, all at once, so that a
+// cold start takes one handshake instead of one per member. Members not ready
+// within timeoutMs are reported as failed.
+func NewGroupMembers(profiles string, link string, timeoutMs int32) (*GroupMembers, error) {
+	var list []profile
+	if err := json.Unmarshal([]byte(profiles), &list); err != nil {
+		return nil, errors.WithMessage(err, "parse profiles")
+	}
+	members := &GroupMembers{
+		instances: make([]*ClashBasedInstance, len(list)),
+		errors:    make([]string, len(list)),
+		delays:    make([]int32, len(list)),
+	}
+
+	results := make(chan groupMemberResult, len(list))
+	for i, p := range list {
+		go func(index int, p profile) {
+			result := groupMemberResult{index: index}
+			defer func() {
+				if r := recover(); r != nil {
+					result.err = errors.Errorf("invalid profile: %v", r)
+				}
+				results <- result
+			}()
+			result.instance, result.err = newProfileInstance(0, p)
+			if result.err == nil && link != "" {
+				result.delay, result.err = UrlTestClashBased(result.instance, link, timeoutMs)
+			}
+		}(i, p)
+	}
+
+	timeout := time.NewTimer(time.Duration(timeoutMs) * time.Millisecond)
+	defer timeout.Stop()
+	for pending := len(list); pending > 0; pending-- {
+		select {
+		case result := <-results:
+			members.instances[result.index] = result.instance
+			members.delays[result.index] = result.delay
+			if result.err != nil {
+				members.errors[result.index] = result.err.Error()
+			}
+		case <-timeout.C:
+			for i, instance := range members.instances {
+				if instance == nil && members.errors[i] == "" {
+					members.errors[i] = "timed out"
+				}
+			}
+			// instances finishing late are not handed out
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if late := <-results; late.instance != nil {
+						_ = late.instance.Close()
+					}
+				}
+			}(pending)
+			return members, nil
+		}
+	}
+	return members, nil
+}
@@ -0,0 +1,80 @@
+package libcore
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ApplyGrpcMutualTLS rewrites a xray config so that outbounds using the gRPC
+// transport (all of them, or only the one matching tag) present the client
+// certificate and verify the server against rootsPem instead of system roots.
+func ApplyGrpcMutualTLS(config string, tag string, cert *ClientCertificate, rootsPem string) (string, error) {
+	var certificates []interface{}
+	if cert != nil {
+		certificate, err := cert.XrayCertificateJson()
+		if err != nil {
+			return "", err
+		}
+		var entry interface{}
+		if err = json.Unmarshal([]byte(certificate), &entry); err != nil {
+			return "", err
+		}
+		certificates = append(certificates, entry)
+	}
+	if rootsPem != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(rootsPem)) {
+			return "", errors.New("no valid root certificate found")
+		}
+		certificates = append(certificates, map[string]interface{}{
+			"usage":       "verify",
+			"certificate": strings.Split(strings.TrimSpace(rootsPem), "\n"),
+		})
+	}
+
+	var content map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &content); err != nil {
+		return "", errors.WithMessage(err, "parse config")
+	}
+	outbounds, _ := content["outbounds"].([]interface{})
+	applied := false
+	for _, item := range outbounds {
+		outbound, ok := item.(map[string]interface{})
+		if !ok || tag != "" && outbound["tag"] != tag {
+			continue
+		}
+		streamSettings, ok := outbound["streamSettings"].(map[string]interface{})
+		if !ok || streamSettings["network"] != "grpc" {
+			continue
+		}
+		securityKey := "tlsSettings"
+		if streamSettings["security"] == "xtls" {
+			securityKey = "xtlsSettings"
+		}
+		tlsSettings, _ := streamSettings[securityKey].(map[string]interface{})
+		if tlsSettings == nil {
+			tlsSettings = map[string]interface{}{}
+			streamSettings[securityKey] = tlsSettings
+		}
+		if streamSettings["security"] == nil || streamSettings["security"] == "none" {
+			streamSettings["security"] = "tls"
+		}
+		existing, _ := tlsSettings["certificates"].([]interface{})
+		tlsSettings["certificates"] = append(existing, certificates...)
+		if rootsPem != "" {
+			tlsSettings["disableSystemRoot"] = true
+		}
+		applied = true
+	}
+	if !applied {
+		return "", errors.New("no grpc outbound found")
+	}
+
+	result, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
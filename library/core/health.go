@@ -0,0 +1,131 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// healthReferenceBits is the size of the page the score estimates the
+	// loading time of, 256 KiB.
+	healthReferenceBits = 256 * 1024 * 8
+	// healthRoundTrips is the number of round trips of a new connection and
+	// its request.
+	healthRoundTrips = 2
+)
+
+// HealthResult is the result of a health check of a node.
+type HealthResult struct {
+	DelayMs int32
+	// 0 when no download was made
+	ThroughputKbps int32
+}
+
+// HealthCheckClashBased runs a url test of the instance and, when downloadLink
+// is set, downloads up to downloadBytes from it with a range request to
+// measure the throughput. Both are recorded in the node metrics.
+func HealthCheckClashBased(instance *ClashBasedInstance, link string, downloadLink string, downloadBytes int32, timeout int32) (*HealthResult, error) {
+	delay, err := UrlTestClashBased(instance, link, timeout)
+	if err != nil {
+		return nil, err
+	}
+	result := &HealthResult{DelayMs: delay}
+	if downloadLink == "" || downloadBytes <= 0 {
+		return result, nil
+	}
+	kbps, err := throughputTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dest, err := addrToMetadata(addr)
+		if err != nil {
+			return nil, err
+		}
+		if dest.NetWork, err = networkForClash(network); err != nil {
+			return nil, err
+		}
+		return instance.out.DialContext(ctx, dest)
+	}, downloadLink, int64(downloadBytes), timeout)
+	if err != nil {
+		return nil, errors.WithMessage(err, "download")
+	}
+	result.ThroughputKbps = kbps
+	if instance.nodeId != 0 {
+		RecordNodeThroughput(instance.nodeId, kbps)
+	}
+	return result, nil
+}
+
+// throughputTest measures the transfer of the response body, leaving out the
+// time to connect and to the first byte.
+func throughputTest(dialContext func(ctx context.Context, network, addr string) (net.Conn, error), link string, size int64, timeout int32) (int32, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext:       dialContext,
+		},
+		Timeout: time.Duration(timeout) * time.Millisecond,
+	}
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return 0, errors.WithMessage(err, "create get request")
+	}
+	req.Header.Set("User-Agent", "curl/7.74.0")
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("unexpected response status: %d", resp.StatusCode)
+	}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, size))
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start)
+	if n == 0 {
+		return 0, errors.New("empty response")
+	}
+	if elapsed < time.Millisecond {
+		elapsed = time.Millisecond
+	}
+	return int32(n * 8 / elapsed.Milliseconds()), nil
+}
+
+// RecordNodeThroughput adds a throughput measure to the metrics of the node.
+func RecordNodeThroughput(nodeId int64, kbps int32) {
+	nodeMetrics.access.Lock()
+	defer nodeMetrics.access.Unlock()
+	metrics := nodeMetrics.metrics[nodeId]
+	if metrics == nil {
+		metrics = &NodeMetrics{}
+		nodeMetrics.metrics[nodeId] = metrics
+	}
+	if metrics.AverageThroughputKbps == 0 {
+		metrics.AverageThroughputKbps = kbps
+	} else {
+		metrics.AverageThroughputKbps += int32(float64(kbps-metrics.AverageThroughputKbps) * nodeMetricsWeight)
+	}
+	metrics.UpdatedAt = unixMilli(time.Now())
+	nodeMetrics.scheduleSave()
+}
+
+// Score ranks nodes, higher being better: the success rate divided by the
+// estimated seconds to load a 256 KiB page, from the latency and, when
+// measured, the throughput. Nodes never tested successfully score 0.
+func (m *NodeMetrics) Score() float64 {
+	if m.AverageLatencyMs == 0 {
+		return 0
+	}
+	seconds := float64(m.AverageLatencyMs) * healthRoundTrips / 1000
+	if m.AverageThroughputKbps > 0 {
+		seconds += float64(healthReferenceBits) / 1000 / float64(m.AverageThroughputKbps)
+	}
+	return m.SuccessRate / seconds
+}
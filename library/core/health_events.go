@@ -0,0 +1,99 @@
+package libcore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Health events, meant to be mirrored by the VpnService: on NetworkLost call
+// setUnderlyingNetworks with an empty array so that the system shows the VPN
+// without connectivity, on NetworkRestored and Reconnected set the underlying
+// network back (null for the default one), and on UpstreamDead report the node
+// as down.
+const (
+	HealthNetworkLost int32 = iota
+	HealthNetworkRestored
+	HealthUpstreamDead
+	HealthReconnected
+)
+
+// consecutive failed dials after which the upstream is considered dead
+const healthDeadFailures = 3
+
+const (
+	healthUp int32 = iota
+	healthNetworkLost
+	healthUpstreamDead
+)
+
+type HealthEvent struct {
+	Type int32
+	// address of the outbound server
+	Server  string
+	Message string
+	// unix milliseconds
+	Time int64
+}
+
+type HealthListener interface {
+	OnHealthEvent(event *HealthEvent)
+}
+
+var healthListener HealthListener
+
+// SetHealthListener sets the listener of the health events of all instances.
+func SetHealthListener(listener HealthListener) {
+	healthListener = listener
+}
+
+// healthTransition updates the health state with a dial result, returning the
+// event of the transition, if any. It must be called with access held.
+func (s *instanceStatus) healthTransition(err error) *HealthEvent {
+	var event int32
+	switch {
+	case err == nil:
+		s.failures = 0
+		switch s.health {
+		case healthNetworkLost:
+			event = HealthNetworkRestored
+		case healthUpstreamDead:
+			event = HealthReconnected
+		default:
+			return nil
+		}
+		s.health = healthUp
+	case errors.Is(err, context.Canceled):
+		return nil
+	case isNetworkUnreachable(err):
+		if s.health == healthNetworkLost {
+			return nil
+		}
+		s.health = healthNetworkLost
+		event = HealthNetworkLost
+	default:
+		s.failures++
+		if s.health != healthUp || s.failures < healthDeadFailures {
+			return nil
+		}
+		s.health = healthUpstreamDead
+		event = HealthUpstreamDead
+	}
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	return &HealthEvent{
+		Type:    event,
+		Server:  s.server,
+		Message: message,
+		Time:    unixMilli(time.Now()),
+	}
+}
+
+func isNetworkUnreachable(err error) bool {
+	// the error may have been flattened into a message by the outbound
+	return errors.Is(err, syscall.ENETUNREACH) || strings.Contains(err.Error(), "network is unreachable")
+}
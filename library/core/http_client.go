@@ -0,0 +1,130 @@
+package libcore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const httpClientMaxBodySize = 16 * 1024 * 1024
+
+// HTTPClient performs requests through an instance, for subscription updates,
+// IP checks and such.
+type HTTPClient struct {
+	client    *http.Client
+	userAgent string
+}
+
+type HTTPResponse struct {
+	StatusCode  int32
+	Url         string
+	ContentType string
+	Headers     string
+	Body        []byte
+
+	header http.Header
+}
+
+func (r *HTTPResponse) Header(name string) string {
+	return r.header.Get(name)
+}
+
+// NewHTTPClient creates a client dialing through instance, or directly if
+// instance is nil.
+func NewHTTPClient(instance *ClashBasedInstance, timeoutMs int32, userAgent string, followRedirects bool, skipCertVerify bool) *HTTPClient {
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	transport := &http.Transport{
+		TLSHandshakeTimeout: timeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: skipCertVerify,
+		},
+		ForceAttemptHTTP2: true,
+	}
+	if instance != nil {
+		transport.DialContext = instance.DialContext
+	} else {
+		transport.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+	if !followRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	if userAgent == "" {
+		userAgent = "curl/7.74.0"
+	}
+	return &HTTPClient{
+		client:    client,
+		userAgent: userAgent,
+	}
+}
+
+func (c *HTTPClient) Get(url string) (*HTTPResponse, error) {
+	return c.Do("GET", url, "", nil)
+}
+
+// Do performs a request, headers are given as "Name: value" lines.
+func (c *HTTPClient) Do(method string, url string, headers string, body []byte) (*HTTPResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), method, url, reader)
+	if err != nil {
+		return nil, errors.WithMessage(err, "create request")
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if headers != "" {
+		mimeHeader, err := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.TrimSpace(headers) + "\r\n\r\n"))).ReadMIMEHeader()
+		if err != nil {
+			return nil, errors.WithMessage(err, "parse headers")
+		}
+		for name, values := range mimeHeader {
+			req.Header[name] = values
+		}
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, httpClientMaxBodySize+1))
+	if err != nil {
+		return nil, errors.WithMessage(err, "read body")
+	}
+	if len(content) > httpClientMaxBodySize {
+		return nil, fmt.Errorf("response body exceeds %d bytes", httpClientMaxBodySize)
+	}
+
+	var responseHeaders strings.Builder
+	_ = resp.Header.Write(&responseHeaders)
+	return &HTTPResponse{
+		StatusCode:  int32(resp.StatusCode),
+		Url:         resp.Request.URL.String(),
+		ContentType: resp.Header.Get("Content-Type"),
+		Headers:     responseHeaders.String(),
+		Body:        content,
+		header:      resp.Header,
+	}, nil
+}
+
+func (c *HTTPClient) Close() {
+	c.client.CloseIdleConnections()
+}
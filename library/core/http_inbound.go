@@ -0,0 +1,190 @@
+package libcore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/inbound"
+	"github.com/Dreamacro/clash/listener/socks"
+	"github.com/Dreamacro/clash/transport/socks4"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const httpInboundHeaderTimeout = 30 * time.Second
+
+const httpErrorPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>%[1]d %[2]s</title></head>
+<body style="font-family:sans-serif;margin:2em">
+<h2>%[3]s could not be loaded</h2>
+<p>%[4]s</p>
+<p style="color:gray">Proxy node: %[5]s</p>
+</body>
+</html>
+`
+
+// SetHttpInbound enables an HTTP proxy inbound on port, next to the SOCKS
+// inbound, from the next Start. Requests that are blocked or fail to connect
+// get a local page naming the reason and nodeName. Port 0 disables it.
+func (s *ClashBasedInstance) SetHttpInbound(port int32, nodeName string) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.httpPort = port
+	s.httpNodeName = nodeName
+}
+
+func (s *ClashBasedInstance) listenHttp() error {
+	if s.httpPort == 0 {
+		return nil
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(s.httpPort))))
+	if err != nil {
+		return err
+	}
+	s.httpIn = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleHttp(conn, s.httpNodeName)
+		}
+	}()
+	return nil
+}
+
+// SetMixedInbound makes the SOCKS inbound also accept HTTP proxy requests,
+// from the next Start, for apps and WebViews that only honor HTTP proxy
+// settings.
+func (s *ClashBasedInstance) SetMixedInbound(enabled bool) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.mixed = enabled
+}
+
+// listenInbound serves SOCKS, and HTTP too in mixed mode, on address.
+func (s *ClashBasedInstance) listenInbound(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleInbound(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// handleInbound tells SOCKS from HTTP by the first byte of the connection.
+func (s *ClashBasedInstance) handleInbound(conn net.Conn) {
+	tcpKeepAlive(conn)
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(httpInboundHeaderTimeout))
+	head, err := reader.Peek(1)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	buffered := &bufferedConn{Conn: conn, reader: reader}
+	switch head[0] {
+	case socks4.Version:
+		socks.HandleSocks4(buffered, s.tcpIn)
+	case socks5.Version:
+		socks.HandleSocks5(buffered, s.tcpIn)
+	default:
+		if s.mixed {
+			s.handleHttp(buffered, s.httpNodeName)
+		} else {
+			_ = conn.Close()
+		}
+	}
+}
+
+// handleHttp reads the request and hands the connection over to the loop,
+// which answers it once the outbound is dialed.
+func (s *ClashBasedInstance) handleHttp(conn net.Conn, nodeName string) {
+	s.applySocketBuffer(conn)
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(httpInboundHeaderTimeout))
+	request, err := http.ReadRequest(reader)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	httpConn := &httpInboundConn{Conn: conn, reader: reader, request: request, nodeName: nodeName}
+	if request.Method != http.MethodConnect && request.URL.Host == "" {
+		httpConn.fail(http.StatusBadRequest, "The request is not a proxy request.")
+		return
+	}
+	select {
+	case s.tcpIn <- inbound.NewHTTPS(request, httpConn):
+	case <-s.ctx.Done():
+		_ = conn.Close()
+	}
+}
+
+// httpInboundConn is a connection of the HTTP inbound whose request is not
+// answered yet.
+type httpInboundConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	request  *http.Request
+	nodeName string
+}
+
+func (c *httpInboundConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// established confirms CONNECT requests or forwards plain requests to remote,
+// closing the connection after the response.
+func (c *httpInboundConn) established(remote net.Conn) error {
+	if c.request.Method == http.MethodConnect {
+		_, err := c.Conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return err
+	}
+	for _, header := range []string{"Proxy-Connection", "Proxy-Authorization", "Keep-Alive"} {
+		c.request.Header.Del(header)
+	}
+	c.request.Close = true
+	return c.request.Write(remote)
+}
+
+// fail answers the request with an error page and closes the connection.
+func (c *httpInboundConn) fail(status int, reason string) {
+	nodeName := c.nodeName
+	if nodeName == "" {
+		nodeName = "unnamed"
+	}
+	page := fmt.Sprintf(httpErrorPage, status, http.StatusText(status),
+		html.EscapeString(c.request.Host), html.EscapeString(reason), html.EscapeString(nodeName))
+	response := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		ContentLength: int64(len(page)),
+		Body:          ioutil.NopCloser(bytes.NewBufferString(page)),
+		Close:         true,
+	}
+	if err := response.Write(c.Conn); err != nil {
+		log.Debugf("[HTTP] write error page failed: %s", err.Error())
+	}
+	_ = c.Conn.Close()
+}
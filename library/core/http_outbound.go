@@ -0,0 +1,23 @@
+package libcore
+
+import (
+	"github.com/Dreamacro/clash/adapter/outbound"
+)
+
+// NewHTTPOutboundInstance creates an instance relaying through an HTTP proxy
+// with CONNECT, over TLS for HTTPS proxies. username and password may be empty.
+func NewHTTPOutboundInstance(socksPort int32, server string, port int32, username string, password string, tls bool, sni string, skipCertVerify bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password); err != nil {
+		return nil, err
+	}
+	out := outbound.NewHttp(outbound.HttpOption{
+		Server:         server,
+		Port:           int(port),
+		UserName:       username,
+		Password:       password,
+		TLS:            tls,
+		SNI:            sni,
+		SkipCertVerify: skipCertVerify,
+	})
+	return newClashBasedInstance(socksPort, out), nil
+}
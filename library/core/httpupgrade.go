@@ -0,0 +1,116 @@
+package libcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/Dreamacro/clash/transport/trojan"
+	"github.com/pkg/errors"
+)
+
+// streamProtocol writes the protocol request of an outbound over an
+// established transport.
+type streamProtocol interface {
+	StreamConn(c net.Conn, metadata *clashC.Metadata) (net.Conn, error)
+}
+
+// httpUpgradeInstance runs a protocol over the httpupgrade transport: a plain
+// HTTP/1.1 Upgrade request, after which the connection carries the protocol
+// directly, without websocket framing.
+type httpUpgradeInstance struct {
+	*outbound.Base
+	server    string
+	tlsConfig *tls.Config
+	host      string
+	path      string
+	protocol  streamProtocol
+}
+
+func (h *httpUpgradeInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	rawConn, err := dialServer(ctx, "tcp", h.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(rawConn)
+	defer func() {
+		safeConnClose(rawConn, err)
+	}()
+
+	conn := rawConn
+	if h.tlsConfig != nil {
+		tlsConn := tls.Client(conn, h.tlsConfig)
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = tlsConn.SetDeadline(deadline)
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			return nil, errors.WithMessage(err, "tls handshake")
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	if conn, err = httpUpgrade(conn, h.host, h.path); err != nil {
+		return nil, err
+	}
+	if conn, err = h.protocol.StreamConn(conn, metadata); err != nil {
+		return nil, err
+	}
+	return outbound.NewConn(conn, h), nil
+}
+
+func (h *httpUpgradeInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported over httpupgrade")
+}
+
+func httpUpgrade(conn net.Conn, host string, path string) (net.Conn, error) {
+	if path == "" {
+		path = "/"
+	}
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nUser-Agent: Go-http-client/1.1\r\n\r\n", path, host)
+	if _, err := io.WriteString(conn, request); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "read upgrade response")
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("upgrade failed: %s", resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// trojanProtocol writes the Trojan request, the TLS layer being part of the
+// transport.
+type trojanProtocol struct {
+	trojan *trojan.Trojan
+}
+
+func (t *trojanProtocol) StreamConn(c net.Conn, metadata *clashC.Metadata) (net.Conn, error) {
+	if err := t.trojan.WriteHeader(c, trojan.CommandTCP, socks5.ParseAddr(metadata.RemoteAddress())); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
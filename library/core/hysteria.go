@@ -0,0 +1,373 @@
+package libcore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	hysteriaProtocolVersion = 3
+	hysteriaDefaultALPN     = "hysteria"
+	hysteriaTimeout         = 10 * time.Second
+	hysteriaSaltLength      = 16
+)
+
+// hysteriaInstance is a Hysteria (v1) client, relaying TCP over streams of a
+// shared QUIC session. Both ends pace their sending with Brutal, the server
+// at the download rate announced in the handshake and the client at the
+// upload rate.
+type hysteriaInstance struct {
+	*outbound.Base
+	server     string
+	tlsConfig  *tls.Config
+	auth       []byte
+	obfs       []byte
+	bandwidth  *bandwidthHint
+	congestion *congestionConfig
+	options    *socketOptions
+
+	access  sync.Mutex
+	session *hysteriaSession
+}
+
+// hysteriaSession is a QUIC session of a Hysteria instance with its socket.
+// A session retired, when the bandwidth changes, takes no new stream and is
+// closed once its last stream is, so that live connections are not cut.
+type hysteriaSession struct {
+	quic.Session
+	conn      *rebindablePacketConn
+	streams   int32
+	retired   int32
+	closeOnce sync.Once
+}
+
+func (s *hysteriaSession) close() {
+	s.closeOnce.Do(func() {
+		_ = s.CloseWithError(0, "")
+		_ = s.conn.Close()
+	})
+}
+
+func (s *hysteriaSession) retire() {
+	atomic.StoreInt32(&s.retired, 1)
+	if atomic.LoadInt32(&s.streams) == 0 {
+		s.close()
+	}
+}
+
+func (s *hysteriaSession) streamClosed() {
+	if atomic.AddInt32(&s.streams, -1) == 0 && atomic.LoadInt32(&s.retired) == 1 {
+		s.close()
+	}
+}
+
+// hysteriaStreamConn is a stream of a hysteriaSession.
+type hysteriaStreamConn struct {
+	*quicStreamConn
+	session   *hysteriaSession
+	closeOnce sync.Once
+}
+
+func (c *hysteriaStreamConn) Close() error {
+	err := c.quicStreamConn.Close()
+	c.closeOnce.Do(c.session.streamClosed)
+	return err
+}
+
+func (h *hysteriaInstance) socketOptions() *socketOptions {
+	return h.options
+}
+
+// getSession returns the current session, counting a stream opened on it,
+// which must be released with streamClosed.
+func (h *hysteriaInstance) getSession(ctx context.Context) (*hysteriaSession, error) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.session != nil {
+		select {
+		case <-h.session.Context().Done():
+			h.closeSession()
+		default:
+			atomic.AddInt32(&h.session.streams, 1)
+			return h.session, nil
+		}
+	}
+
+	serverAddr, err := net.ResolveUDPAddr("udp", h.server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenRebindable(h.options)
+	if err != nil {
+		return nil, err
+	}
+	var packetConn net.PacketConn = conn
+	if h.obfs != nil {
+		packetConn = &xplusPacketConn{PacketConn: conn, key: h.obfs}
+	}
+	tracer := h.congestion.newTracer()
+	session, err := quic.DialContext(ctx, packetConn, serverAddr, h.tlsConfig.ServerName, h.tlsConfig, &quic.Config{
+		KeepAlive:      true,
+		MaxIdleTimeout: 30 * time.Second,
+		Tracer:         tracer,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	tracer.install(session)
+	if err = h.handshake(ctx, session); err != nil {
+		_ = session.CloseWithError(0, "")
+		_ = conn.Close()
+		return nil, err
+	}
+	h.session = &hysteriaSession{Session: session, conn: conn, streams: 1}
+	return h.session, nil
+}
+
+func (h *hysteriaInstance) closeSession() {
+	if h.session != nil {
+		h.session.close()
+		h.session = nil
+	}
+}
+
+// retireSession makes new streams use a new session, negotiating the current
+// rates, while the streams of the former one finish.
+func (h *hysteriaInstance) retireSession() {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.session != nil {
+		h.session.retire()
+		h.session = nil
+	}
+}
+
+func (h *hysteriaInstance) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	h.closeSession()
+	return nil
+}
+
+func (h *hysteriaInstance) handshake(ctx context.Context, session quic.Session) error {
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	_ = stream.SetDeadline(time.Now().Add(hysteriaTimeout))
+
+	hello := make([]byte, 0, 19+len(h.auth))
+	hello = append(hello, hysteriaProtocolVersion)
+	hello = appendUint64(hello, h.bandwidth.upBytesPerSecond())
+	hello = appendUint64(hello, h.bandwidth.downBytesPerSecond())
+	hello = appendUint16(hello, uint16(len(h.auth)))
+	hello = append(hello, h.auth...)
+	if _, err = stream.Write(hello); err != nil {
+		return err
+	}
+
+	// ok, send rate, receive rate, message
+	header := make([]byte, 19)
+	if _, err = io.ReadFull(stream, header); err != nil {
+		return errors.WithMessage(err, "read server hello")
+	}
+	message := make([]byte, binary.BigEndian.Uint16(header[17:]))
+	if _, err = io.ReadFull(stream, message); err != nil {
+		return errors.WithMessage(err, "read server hello")
+	}
+	if header[0] == 0 {
+		return fmt.Errorf("authentication failed: %s", message)
+	}
+	return stream.Close()
+}
+
+func (h *hysteriaInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (_ clashC.Conn, err error) {
+	session, err := h.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			session.streamClosed()
+		}
+	}()
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	host := metadata.Host
+	if host == "" {
+		host = metadata.DstIP.String()
+	}
+	port, _ := strconv.Atoi(metadata.DstPort)
+	request := make([]byte, 0, 5+len(host))
+	// not udp
+	request = append(request, 0)
+	request = appendUint16(request, uint16(len(host)))
+	request = append(request, host...)
+	request = appendUint16(request, uint16(port))
+	if _, err = stream.Write(request); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+
+	// ok, udp session id, message
+	_ = stream.SetReadDeadline(time.Now().Add(hysteriaTimeout))
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(stream, header); err != nil {
+		_ = stream.Close()
+		return nil, errors.WithMessage(err, "read server response")
+	}
+	message := make([]byte, binary.BigEndian.Uint16(header[5:]))
+	if _, err = io.ReadFull(stream, message); err != nil {
+		_ = stream.Close()
+		return nil, errors.WithMessage(err, "read server response")
+	}
+	if header[0] == 0 {
+		_ = stream.Close()
+		return nil, fmt.Errorf("server refused %s: %s", metadata.RemoteAddress(), message)
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	return outbound.NewConn(&hysteriaStreamConn{
+		quicStreamConn: &quicStreamConn{Stream: stream, session: session},
+		session:        session,
+	}, h), nil
+}
+
+func (h *hysteriaInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported by the hysteria instance")
+}
+
+// quicStreamConn adapts a QUIC stream to net.Conn.
+type quicStreamConn struct {
+	quic.Stream
+	session quic.Session
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.session.RemoteAddr()
+}
+
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// xplusPacketConn implements the XPlus obfuscation of Hysteria, XORing each
+// packet with the SHA-256 of the key and a random salt prepended to it.
+type xplusPacketConn struct {
+	net.PacketConn
+	key []byte
+}
+
+func (c *xplusPacketConn) xor(salt []byte, in []byte, out []byte) {
+	key := sha256.Sum256(append(append([]byte(nil), c.key...), salt...))
+	for i, b := range in {
+		out[i] = b ^ key[i%sha256.Size]
+	}
+}
+
+func (c *xplusPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(p)+hysteriaSaltLength)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n <= hysteriaSaltLength {
+			continue
+		}
+		c.xor(buf[:hysteriaSaltLength], buf[hysteriaSaltLength:n], p)
+		return n - hysteriaSaltLength, addr, nil
+	}
+}
+
+func (c *xplusPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	buf := make([]byte, len(p)+hysteriaSaltLength)
+	if _, err := rand.Read(buf[:hysteriaSaltLength]); err != nil {
+		return 0, err
+	}
+	c.xor(buf[:hysteriaSaltLength], p, buf[hysteriaSaltLength:])
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// NewHysteriaInstance creates a Hysteria (v1) instance relaying TCP. obfs is
+// the XPlus obfuscation password, alpn defaults to "hysteria" and the bandwidth
+// can be changed later with SetBandwidthHint.
+func NewHysteriaInstance(socksPort int32, server string, port int32, auth string, obfs string, upMbps int32, downMbps int32, alpn string, sni string, skipCertVerify bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&auth, &obfs); err != nil {
+		return nil, err
+	}
+	bandwidth, err := newBandwidthHint(upMbps, downMbps)
+	if err != nil {
+		return nil, err
+	}
+	congestion, err := newCongestionConfig(CongestionBrutal, bandwidth)
+	if err != nil {
+		return nil, err
+	}
+	protocols := splitList(alpn)
+	if len(protocols) == 0 {
+		protocols = []string{hysteriaDefaultALPN}
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	if sni == "" {
+		sni = server
+	}
+	out := &hysteriaInstance{
+		Base:   outbound.NewBase("hysteria", address, clashC.Direct, false),
+		server: address,
+		tlsConfig: &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: skipCertVerify,
+			NextProtos:         protocols,
+			MinVersion:         tls.VersionTLS13,
+		},
+		auth:       []byte(auth),
+		bandwidth:  bandwidth,
+		congestion: congestion,
+		options:    &socketOptions{},
+	}
+	if obfs != "" {
+		out.obfs = []byte(obfs)
+	}
+	// the rates are negotiated in the handshake
+	bandwidth.onChange = out.retireSession
+	instance := newClashBasedInstance(socksPort, out)
+	instance.bandwidth = bandwidth
+	return instance, nil
+}
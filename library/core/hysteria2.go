@@ -0,0 +1,595 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/lucas-clemente/quic-go/quicvarint"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	hysteria2AuthURL          = "https://hysteria/auth"
+	hysteria2StatusAuthOK     = 233
+	hysteria2FrameTCPRequest  = 0x401
+	hysteria2MaxDatagram      = 1200
+	hysteria2MaxMessageLength = 2048
+	hysteria2MaxPending       = 64
+	hysteria2SaltLength       = 8
+	hysteria2MinObfsLength    = 4
+)
+
+// hysteria2Instance is a Hysteria2 client. The session is authenticated by an
+// HTTP/3 request, then TCP is relayed over its streams and UDP over datagrams.
+// Without bandwidth hints both ends pace with BBR, with them the client sends
+// with Brutal at the lower of its up rate and the receive rate of the server.
+type hysteria2Instance struct {
+	*outbound.Base
+	server    string
+	tlsConfig *tls.Config
+	password  string
+	obfs      []byte
+	bandwidth *bandwidthHint
+	options   *socketOptions
+
+	access  sync.Mutex
+	session *hysteria2Session
+
+	udpAccess   sync.Mutex
+	udpSessions map[uint32]*hysteria2PacketConn
+	nextUDP     uint32
+}
+
+// hysteria2Session is a hysteriaSession that knows whether the server relays
+// UDP.
+type hysteria2Session struct {
+	*hysteriaSession
+	udp bool
+}
+
+func (h *hysteria2Instance) socketOptions() *socketOptions {
+	return h.options
+}
+
+// getSession returns the current session, counting a stream or UDP session
+// opened on it, which must be released with streamClosed.
+func (h *hysteria2Instance) getSession(ctx context.Context) (*hysteria2Session, error) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.session != nil {
+		select {
+		case <-h.session.Context().Done():
+			h.closeSession()
+		default:
+			atomic.AddInt32(&h.session.streams, 1)
+			return h.session, nil
+		}
+	}
+
+	serverAddr, err := net.ResolveUDPAddr("udp", h.server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenRebindable(h.options)
+	if err != nil {
+		return nil, err
+	}
+	var packetConn net.PacketConn = conn
+	if h.obfs != nil {
+		packetConn = &salamanderPacketConn{PacketConn: conn, key: h.obfs}
+	}
+	// the congestion control is known once the server answered
+	tracer := &congestionTracer{}
+	var session quic.EarlySession
+	roundTripper := &http3.RoundTripper{
+		TLSClientConfig: h.tlsConfig,
+		QuicConfig: &quic.Config{
+			Versions:       []quic.VersionNumber{quic.Version1},
+			KeepAlive:      true,
+			MaxIdleTimeout: 30 * time.Second,
+			Tracer:         tracer,
+		},
+		EnableDatagrams: true,
+		Dial: func(_, _ string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlySession, error) {
+			var err error
+			session, err = quic.DialEarlyContext(ctx, packetConn, serverAddr, tlsConfig.ServerName, tlsConfig, config)
+			return session, err
+		},
+	}
+	udp, err := h.authenticate(ctx, roundTripper, tracer)
+	if err != nil {
+		if session != nil {
+			_ = session.CloseWithError(0, "")
+		}
+		_ = conn.Close()
+		return nil, err
+	}
+	tracer.install(session)
+
+	h.session = &hysteria2Session{
+		hysteriaSession: &hysteriaSession{Session: session, conn: conn, streams: 1},
+		udp:             udp,
+	}
+	if udp {
+		go h.receiveDatagrams(session)
+	}
+	return h.session, nil
+}
+
+// authenticate sends the password and the receive rate of the client, and
+// chooses the congestion control from the receive rate of the server. It
+// returns whether the server relays UDP.
+func (h *hysteria2Instance) authenticate(ctx context.Context, roundTripper *http3.RoundTripper, tracer *congestionTracer) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, hysteriaTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, hysteria2AuthURL, nil)
+	if err != nil {
+		return false, err
+	}
+	var receiveRate uint64
+	if h.bandwidth != nil {
+		receiveRate = h.bandwidth.downBytesPerSecond()
+	}
+	request.Header.Set("Hysteria-Auth", h.password)
+	request.Header.Set("Hysteria-CC-RX", strconv.FormatUint(receiveRate, 10))
+	request.Header.Set("Hysteria-Padding", hysteria2Padding(256, 2048))
+	response, err := roundTripper.RoundTrip(request)
+	if err != nil {
+		return false, errors.WithMessage(err, "authenticate")
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != hysteria2StatusAuthOK {
+		return false, fmt.Errorf("authentication failed: status %d", response.StatusCode)
+	}
+
+	// "auto" asks the client to measure the bandwidth itself
+	tracer.algorithm = CongestionBBR
+	if serverRate := response.Header.Get("Hysteria-CC-RX"); h.bandwidth != nil && serverRate != "auto" {
+		sendRate := h.bandwidth.upBytesPerSecond()
+		if rate, _ := strconv.ParseUint(serverRate, 10, 64); rate > 0 && rate < sendRate {
+			sendRate = rate
+		}
+		tracer.algorithm = CongestionBrutal
+		tracer.rate = sendRate
+	}
+	udp, _ := strconv.ParseBool(response.Header.Get("Hysteria-UDP"))
+	return udp, nil
+}
+
+func (h *hysteria2Instance) closeSession() {
+	if h.session != nil {
+		h.session.close()
+		h.session = nil
+	}
+}
+
+// retireSession makes new streams use a new session, negotiating the current
+// rates, while the streams of the former one finish.
+func (h *hysteria2Instance) retireSession() {
+	h.access.Lock()
+	defer h.access.Unlock()
+	if h.session != nil {
+		h.session.retire()
+		h.session = nil
+	}
+}
+
+func (h *hysteria2Instance) Close() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	h.closeSession()
+	return nil
+}
+
+func (h *hysteria2Instance) DialContext(ctx context.Context, metadata *clashC.Metadata) (_ clashC.Conn, err error) {
+	session, err := h.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			session.streamClosed()
+		}
+	}()
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	address := metadata.RemoteAddress()
+	request := &bytes.Buffer{}
+	quicvarint.Write(request, hysteria2FrameTCPRequest)
+	quicvarint.Write(request, uint64(len(address)))
+	request.WriteString(address)
+	padding := hysteria2Padding(64, 512)
+	quicvarint.Write(request, uint64(len(padding)))
+	request.WriteString(padding)
+	if _, err = stream.Write(request.Bytes()); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+
+	// status, message, padding
+	_ = stream.SetReadDeadline(time.Now().Add(hysteriaTimeout))
+	reader := &quicStreamByteReader{Stream: stream}
+	status, err := reader.ReadByte()
+	if err != nil {
+		_ = stream.Close()
+		return nil, errors.WithMessage(err, "read server response")
+	}
+	message, err := reader.readMessage()
+	if err == nil {
+		_, err = reader.readMessage()
+	}
+	if err != nil {
+		_ = stream.Close()
+		return nil, errors.WithMessage(err, "read server response")
+	}
+	if status != 0 {
+		_ = stream.Close()
+		return nil, fmt.Errorf("server refused %s: %s", address, message)
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	return outbound.NewConn(&hysteriaStreamConn{
+		quicStreamConn: &quicStreamConn{Stream: stream, session: session},
+		session:        session.hysteriaSession,
+	}, h), nil
+}
+
+// quicStreamByteReader reads the varints of a stream without buffering past
+// them.
+type quicStreamByteReader struct {
+	quic.Stream
+}
+
+func (r *quicStreamByteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Stream, b[:])
+	return b[0], err
+}
+
+// readMessage reads a string prefixed by its varint length.
+func (r *quicStreamByteReader) readMessage() ([]byte, error) {
+	length, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > hysteria2MaxMessageLength {
+		return nil, fmt.Errorf("message too long: %d", length)
+	}
+	message := make([]byte, length)
+	_, err = io.ReadFull(r.Stream, message)
+	return message, err
+}
+
+func (h *hysteria2Instance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	session, err := h.getSession(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if !session.udp {
+		session.streamClosed()
+		return nil, errors.New("udp is disabled by the hysteria2 server")
+	}
+	conn := &hysteria2PacketConn{
+		instance:  h,
+		session:   session,
+		incoming:  make(chan hysteria2Fragment, hysteria2MaxPending),
+		fragments: map[uint16][]hysteria2Fragment{},
+		closed:    make(chan struct{}),
+	}
+
+	h.udpAccess.Lock()
+	for {
+		h.nextUDP++
+		if _, used := h.udpSessions[h.nextUDP]; !used {
+			break
+		}
+	}
+	conn.sessionID = h.nextUDP
+	h.udpSessions[conn.sessionID] = conn
+	h.udpAccess.Unlock()
+	return newPacketConn(conn, h), nil
+}
+
+// receiveDatagrams dispatches the UDP messages of session to their UDP
+// sessions.
+func (h *hysteria2Instance) receiveDatagrams(session quic.Session) {
+	for {
+		message, err := session.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		if len(message) < 8 {
+			continue
+		}
+		sessionID := binary.BigEndian.Uint32(message)
+		fragment := hysteria2Fragment{
+			packetID: binary.BigEndian.Uint16(message[4:]),
+			index:    message[6],
+			total:    message[7],
+		}
+		reader := bytes.NewReader(message[8:])
+		length, err := quicvarint.Read(reader)
+		if err != nil || length > uint64(reader.Len()) || fragment.total == 0 || fragment.index >= fragment.total {
+			continue
+		}
+		rest := message[len(message)-reader.Len():]
+		fragment.data = rest[length:]
+		if fragment.addr, err = net.ResolveUDPAddr("udp", string(rest[:length])); err != nil {
+			continue
+		}
+
+		h.udpAccess.Lock()
+		conn := h.udpSessions[sessionID]
+		h.udpAccess.Unlock()
+		if conn != nil {
+			conn.receive(fragment)
+		}
+	}
+}
+
+type hysteria2Fragment struct {
+	packetID uint16
+	index    uint8
+	total    uint8
+	addr     net.Addr
+	data     []byte
+}
+
+// hysteria2PacketConn is a UDP session, identified by its sessionID.
+type hysteria2PacketConn struct {
+	packetID uint32
+
+	instance  *hysteria2Instance
+	session   *hysteria2Session
+	sessionID uint32
+
+	incoming       chan hysteria2Fragment
+	fragmentAccess sync.Mutex
+	fragments      map[uint16][]hysteria2Fragment
+	deadline       atomic.Value
+	closed         chan struct{}
+	closeOnce      sync.Once
+}
+
+// receive reassembles fragmented packets, each fragment carrying the address.
+func (c *hysteria2PacketConn) receive(packet hysteria2Fragment) {
+	if packet.total > 1 {
+		c.fragmentAccess.Lock()
+		defer c.fragmentAccess.Unlock()
+		fragments := c.fragments[packet.packetID]
+		if fragments == nil {
+			if len(c.fragments) >= hysteria2MaxPending {
+				// lost fragments never complete
+				c.fragments = map[uint16][]hysteria2Fragment{}
+			}
+			fragments = make([]hysteria2Fragment, packet.total)
+		} else if len(fragments) != int(packet.total) {
+			delete(c.fragments, packet.packetID)
+			return
+		}
+		fragments[packet.index] = packet
+		c.fragments[packet.packetID] = fragments
+		var data []byte
+		for _, fragment := range fragments {
+			if fragment.data == nil {
+				return
+			}
+			data = append(data, fragment.data...)
+		}
+		delete(c.fragments, packet.packetID)
+		packet.data = data
+	}
+	select {
+	case c.incoming <- packet:
+	case <-c.closed:
+	default:
+		// drop when the reader is too slow
+	}
+}
+
+func (c *hysteria2PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if deadline, ok := c.deadline.Load().(time.Time); ok && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.incoming:
+		return copy(p, packet.data), packet.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.session.Context().Done():
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, errors.New("i/o timeout")
+	}
+}
+
+func (c *hysteria2PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	address := addr.String()
+	header := &bytes.Buffer{}
+	_ = binary.Write(header, binary.BigEndian, c.sessionID)
+	_ = binary.Write(header, binary.BigEndian, uint16(atomic.AddUint32(&c.packetID, 1)))
+	// fragment index and count
+	header.Write([]byte{0, 1})
+	quicvarint.Write(header, uint64(len(address)))
+	header.WriteString(address)
+
+	chunkSize := hysteria2MaxDatagram - header.Len()
+	total := (len(p) + chunkSize - 1) / chunkSize
+	if total == 0 {
+		total = 1
+	}
+	if total > 0xff {
+		return 0, fmt.Errorf("packet too large: %d", len(p))
+	}
+	data := p
+	for index := 0; index < total; index++ {
+		chunk := data
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		data = data[len(chunk):]
+		message := make([]byte, 0, header.Len()+len(chunk))
+		message = append(message, header.Bytes()...)
+		message[6], message[7] = uint8(index), uint8(total)
+		if err := c.session.SendMessage(append(message, chunk...)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *hysteria2PacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.instance.udpAccess.Lock()
+		delete(c.instance.udpSessions, c.sessionID)
+		c.instance.udpAccess.Unlock()
+		// the server expires the idle UDP session
+		c.session.streamClosed()
+	})
+	return nil
+}
+
+func (c *hysteria2PacketConn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *hysteria2PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *hysteria2PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Store(t)
+	return nil
+}
+
+func (c *hysteria2PacketConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+// salamanderPacketConn implements the Salamander obfuscation of Hysteria2,
+// XORing each packet with the BLAKE2b-256 of the key and a random salt
+// prepended to it.
+type salamanderPacketConn struct {
+	net.PacketConn
+	key []byte
+}
+
+func (c *salamanderPacketConn) xor(salt []byte, in []byte, out []byte) {
+	key := blake2b.Sum256(append(append([]byte(nil), c.key...), salt...))
+	for i, b := range in {
+		out[i] = b ^ key[i%blake2b.Size256]
+	}
+}
+
+func (c *salamanderPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(p)+hysteria2SaltLength)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		if n <= hysteria2SaltLength {
+			continue
+		}
+		c.xor(buf[:hysteria2SaltLength], buf[hysteria2SaltLength:n], p)
+		return n - hysteria2SaltLength, addr, nil
+	}
+}
+
+func (c *salamanderPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	buf := make([]byte, len(p)+hysteria2SaltLength)
+	if _, err := rand.Read(buf[:hysteria2SaltLength]); err != nil {
+		return 0, err
+	}
+	c.xor(buf[:hysteria2SaltLength], p, buf[hysteria2SaltLength:])
+	if _, err := c.PacketConn.WriteTo(buf, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// hysteria2Padding returns a random string of min to max-1 characters, hiding
+// the length of the frames it is appended to.
+func hysteria2Padding(min int, max int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	length := min
+	if n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min))); err == nil {
+		length += int(n.Int64())
+	}
+	padding := make([]byte, length)
+	_, _ = rand.Read(padding)
+	for i, b := range padding {
+		padding[i] = letters[int(b)%len(letters)]
+	}
+	return string(padding)
+}
+
+// NewHysteria2Instance creates a Hysteria2 instance relaying TCP and UDP,
+// authenticated by password. obfsPassword enables the Salamander obfuscation.
+// Without bandwidth hints (both zero) the congestion control is BBR, with them
+// Brutal, and they can be changed later with SetBandwidthHint.
+func NewHysteria2Instance(socksPort int32, server string, port int32, password string, obfsPassword string, upMbps int32, downMbps int32, sni string, skipCertVerify bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password, &obfsPassword); err != nil {
+		return nil, err
+	}
+	var bandwidth *bandwidthHint
+	if upMbps != 0 || downMbps != 0 {
+		var err error
+		if bandwidth, err = newBandwidthHint(upMbps, downMbps); err != nil {
+			return nil, err
+		}
+	}
+	if obfsPassword != "" && len(obfsPassword) < hysteria2MinObfsLength {
+		return nil, fmt.Errorf("obfs password must be at least %d bytes", hysteria2MinObfsLength)
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	if sni == "" {
+		sni = server
+	}
+	out := &hysteria2Instance{
+		Base:   outbound.NewBase("hysteria2", address, clashC.Direct, true),
+		server: address,
+		tlsConfig: &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: skipCertVerify,
+			MinVersion:         tls.VersionTLS13,
+		},
+		password:    password,
+		bandwidth:   bandwidth,
+		options:     &socketOptions{},
+		udpSessions: map[uint32]*hysteria2PacketConn{},
+	}
+	if obfsPassword != "" {
+		out.obfs = []byte(obfsPassword)
+	}
+	instance := newClashBasedInstance(socksPort, out)
+	if bandwidth != nil {
+		// the rates are negotiated in the handshake
+		bandwidth.onChange = out.retireSession
+		instance.bandwidth = bandwidth
+	}
+	return instance, nil
+}
@@ -0,0 +1,84 @@
+package libcore
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestSalamanderPacketConn(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := &salamanderPacketConn{PacketConn: listener, key: []byte("obfs password")}
+	conn := &salamanderPacketConn{PacketConn: client, key: []byte("obfs password")}
+
+	message := []byte("hysteria2 salamander")
+	if _, err = conn.WriteTo(message, listener.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], message) {
+		t.Errorf("got %q, want %q", buf[:n], message)
+	}
+
+	// a packet that is not obfuscated does not read as plain text
+	if _, err = server.PacketConn.WriteTo(message, addr); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(message)-hysteria2SaltLength || bytes.Equal(buf[:n], message[hysteria2SaltLength:]) {
+		t.Errorf("raw packet read as %q", buf[:n])
+	}
+}
+
+func TestHysteria2Reassembly(t *testing.T) {
+	conn := &hysteria2PacketConn{
+		incoming:  make(chan hysteria2Fragment, hysteria2MaxPending),
+		fragments: map[uint16][]hysteria2Fragment{},
+		closed:    make(chan struct{}),
+	}
+	conn.receive(hysteria2Fragment{packetID: 1, index: 1, total: 3, data: []byte("lo, ")})
+	conn.receive(hysteria2Fragment{packetID: 2, index: 0, total: 1, data: []byte("whole")})
+	conn.receive(hysteria2Fragment{packetID: 1, index: 0, total: 3, data: []byte("hel")})
+	// a fragment count that does not match drops the packet
+	conn.receive(hysteria2Fragment{packetID: 3, index: 0, total: 2, data: []byte("x")})
+	conn.receive(hysteria2Fragment{packetID: 3, index: 1, total: 4, data: []byte("y")})
+	conn.receive(hysteria2Fragment{packetID: 1, index: 2, total: 3, data: []byte("world")})
+
+	for _, want := range []string{"whole", "hello, world"} {
+		select {
+		case packet := <-conn.incoming:
+			if string(packet.data) != want {
+				t.Errorf("got %q, want %q", packet.data, want)
+			}
+		default:
+			t.Fatalf("missing %q", want)
+		}
+	}
+	if len(conn.incoming) != 0 || len(conn.fragments) != 0 {
+		t.Errorf("%d packets, %d partial packets left", len(conn.incoming), len(conn.fragments))
+	}
+}
+
+func TestHysteria2Padding(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if padding := hysteria2Padding(64, 512); len(padding) < 64 || len(padding) >= 512 {
+			t.Fatalf("padding length %d, want 64-511", len(padding))
+		}
+	}
+}
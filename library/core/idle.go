@@ -0,0 +1,68 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// relays are closed after 5 minutes without traffic by default, the
+// connection idle policy of Xray, so that connections left dead by a network
+// change on mobile are not copied forever
+const defaultIdleTimeout = 5 * time.Minute
+
+// SetIdleTimeout closes the TCP relays without traffic in either direction for
+// the given seconds, 0 never closing them. UDP sessions always expire after a
+// minute of silence.
+func (s *ClashBasedInstance) SetIdleTimeout(seconds int32) {
+	if seconds < 0 {
+		seconds = 0
+	}
+	s.idleTimeout = time.Duration(seconds) * time.Second
+}
+
+// activityConn records the time of the last read or write.
+type activityConn struct {
+	net.Conn
+	// unix nanoseconds
+	lastActive *int64
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activityConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// waitIdle returns once ctx is done or lastActive is older than timeout.
+func waitIdle(ctx context.Context, lastActive *int64, timeout time.Duration) {
+	if timeout <= 0 {
+		<-ctx.Done()
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(lastActive)))
+		if idle >= timeout {
+			return
+		}
+		timer.Reset(timeout - idle)
+	}
+}
@@ -0,0 +1,150 @@
+package libcore
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	interfaceCheckInterval = 3 * time.Second
+	interfaceFailedBackoff = 30 * time.Second
+)
+
+// currentInterface returns the first interface of the preference list that is
+// up with an address and did not recently fail, or the first one if none is.
+func (o *socketOptions) currentInterface() string {
+	o.access.Lock()
+	defer o.access.Unlock()
+
+	if len(o.ifaces) <= 1 {
+		if len(o.ifaces) == 0 {
+			return ""
+		}
+		return o.ifaces[0]
+	}
+	if time.Since(o.ifaceChecked) < interfaceCheckInterval {
+		return o.ifaceActive
+	}
+
+	active := o.ifaces[0]
+	for _, name := range o.ifaces {
+		if failedAt, failed := o.ifaceFailed[name]; failed && time.Since(failedAt) < interfaceFailedBackoff {
+			continue
+		}
+		if interfaceUsable(name) {
+			active = name
+			break
+		}
+	}
+	o.ifaceActive = active
+	o.ifaceChecked = time.Now()
+	return active
+}
+
+// interfaceFailed moves on to the next interface after a failed dial.
+func (o *socketOptions) interfaceFailed(name string) {
+	if name == "" {
+		return
+	}
+	o.access.Lock()
+	defer o.access.Unlock()
+	if len(o.ifaces) <= 1 {
+		return
+	}
+	if o.ifaceFailed == nil {
+		o.ifaceFailed = map[string]time.Time{}
+	}
+	o.ifaceFailed[name] = time.Now()
+	o.ifaceChecked = time.Time{}
+}
+
+// listenAddress is the address UDP sockets listen on, the IPv4 or else the
+// IPv6 address of the current interface, if any.
+func (o *socketOptions) listenAddress() string {
+	iface := o.currentInterface()
+	if iface == "" {
+		return ""
+	}
+	ip, err := interfaceAddress(iface, false)
+	if err != nil {
+		if ip, err = interfaceAddress(iface, true); err != nil {
+			return ""
+		}
+	}
+	return net.JoinHostPort(ip.String(), "0")
+}
+
+// interfaceAddress returns an address of the interface for sockets to bind
+// to, preferring global addresses over link-local ones.
+func interfaceAddress(name string, ipv6 bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "interface %s", name)
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.WithMessagef(err, "interface %s", name)
+	}
+	var linkLocal net.IP
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if !ipNet.IP.IsLinkLocalUnicast() {
+			return ipNet.IP, nil
+		}
+		if linkLocal == nil {
+			linkLocal = ipNet.IP
+		}
+	}
+	if linkLocal != nil && !ipv6 {
+		return linkLocal, nil
+	}
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+	return nil, errors.Errorf("interface %s has no %s address", name, family)
+}
+
+func sockaddr(ip net.IP) unix.Sockaddr {
+	if ip4 := ip.To4(); ip4 != nil {
+		address := &unix.SockaddrInet4{}
+		copy(address.Addr[:], ip4)
+		return address
+	}
+	address := &unix.SockaddrInet6{}
+	copy(address.Addr[:], ip.To16())
+	return address
+}
+
+func interfaceUsable(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil || iface.Flags&net.FlagUp == 0 {
+		return false
+	}
+	addresses, err := iface.Addrs()
+	return err == nil && len(addresses) > 0
+}
+
+// SetInterfaces sets the interfaces the outbound binds to, as a comma separated
+// list in order of preference (e.g. "eth0,wlan0,rmnet0"). The first one that
+// is up is used, failing over to the next when it goes down or dials through
+// it fail. An empty list uses the default route.
+func (s *ClashBasedInstance) SetInterfaces(list string) error {
+	configurable, ok := s.out.(socketConfigurable)
+	if !ok {
+		return errors.New("binding interfaces is not supported by this outbound")
+	}
+	options := configurable.socketOptions()
+	options.access.Lock()
+	options.ifaces = splitList(list)
+	options.ifaceChecked = time.Time{}
+	options.ifaceFailed = nil
+	options.access.Unlock()
+	return nil
+}
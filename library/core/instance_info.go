@@ -0,0 +1,82 @@
+package libcore
+
+import (
+	"sync"
+	"time"
+)
+
+type InstanceInfo struct {
+	// unix milliseconds, 0 if never happened
+	StartedAt    int64
+	LastDialAt   int64
+	LastErrorAt  int64
+	Uptime       int64
+	LastError    string
+	ActiveRelays int32
+	AuthFailure  int32
+}
+
+type instanceStatus struct {
+	access      sync.Mutex
+	startedAt   time.Time
+	lastDialAt  time.Time
+	lastErrorAt time.Time
+	lastError   string
+
+	server   string
+	health   int32
+	failures int32
+}
+
+func (s *instanceStatus) started() {
+	s.access.Lock()
+	s.startedAt = time.Now()
+	s.access.Unlock()
+}
+
+func (s *instanceStatus) stopped() {
+	s.access.Lock()
+	s.startedAt = time.Time{}
+	s.access.Unlock()
+}
+
+// dialed records the result of an outbound dial.
+func (s *instanceStatus) dialed(err error) {
+	s.access.Lock()
+	if err == nil {
+		s.lastDialAt = time.Now()
+	} else {
+		s.lastErrorAt = time.Now()
+		s.lastError = err.Error()
+	}
+	event := s.healthTransition(err)
+	s.access.Unlock()
+	if listener := healthListener; event != nil && listener != nil {
+		listener.OnHealthEvent(event)
+	}
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (s *ClashBasedInstance) InstanceInfo() *InstanceInfo {
+	s.status.access.Lock()
+	defer s.status.access.Unlock()
+
+	info := &InstanceInfo{
+		StartedAt:    unixMilli(s.status.startedAt),
+		LastDialAt:   unixMilli(s.status.lastDialAt),
+		LastErrorAt:  unixMilli(s.status.lastErrorAt),
+		LastError:    s.status.lastError,
+		ActiveRelays: s.ActiveRelays(),
+		AuthFailure:  s.AuthFailure(),
+	}
+	if !s.status.startedAt.IsZero() {
+		info.Uptime = time.Since(s.status.startedAt).Milliseconds()
+	}
+	return info
+}
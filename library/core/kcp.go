@@ -0,0 +1,530 @@
+package libcore
+
+import (
+	"encoding/binary"
+)
+
+// KCP ARQ, following ikcp and the kcp-go variant used by kcptun.
+
+const (
+	kcpRtoNoDelay    = 30
+	kcpRtoMin        = 100
+	kcpRtoDefault    = 200
+	kcpRtoMax        = 60000
+	kcpCmdPush       = 81
+	kcpCmdAck        = 82
+	kcpCmdWindowAsk  = 83
+	kcpCmdWindowTell = 84
+	kcpAskSend       = 1
+	kcpAskTell       = 2
+	kcpOverhead      = 24
+	kcpThreshInit    = 2
+	kcpThreshMin     = 2
+	kcpProbeInit     = 7000
+	kcpProbeLimit    = 120000
+	kcpDeadLink      = 20
+)
+
+type kcpSegment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	rto      uint32
+	xmit     uint32
+	resendts uint32
+	fastack  uint32
+	data     []byte
+}
+
+func (seg *kcpSegment) encode(b []byte) []byte {
+	var header [kcpOverhead]byte
+	binary.LittleEndian.PutUint32(header[0:], seg.conv)
+	header[4] = seg.cmd
+	header[5] = seg.frg
+	binary.LittleEndian.PutUint16(header[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(header[8:], seg.ts)
+	binary.LittleEndian.PutUint32(header[12:], seg.sn)
+	binary.LittleEndian.PutUint32(header[16:], seg.una)
+	binary.LittleEndian.PutUint32(header[20:], uint32(len(seg.data)))
+	return append(append(b, header[:]...), seg.data...)
+}
+
+type kcpAck struct {
+	sn uint32
+	ts uint32
+}
+
+// kcpControl is a KCP control block in stream mode. It is not safe for
+// concurrent use.
+type kcpControl struct {
+	conv, mtu, mss uint32
+	dead           bool
+
+	sndUna, sndNxt, rcvNxt uint32
+	ssthresh               uint32
+	rxRttVar, rxSrtt       int32
+	rxRto, rxMinRto        uint32
+	sndWnd, rcvWnd, rmtWnd uint32
+	cwnd, probe, incr      uint32
+	current, interval      uint32
+	tsProbe, probeWait     uint32
+	nodelay                uint32
+	fastResend             uint32
+	noCwnd                 bool
+
+	sndQueue []*kcpSegment
+	rcvQueue []*kcpSegment
+	sndBuf   []*kcpSegment
+	rcvBuf   []*kcpSegment
+	ackList  []kcpAck
+
+	output func(packet []byte)
+}
+
+func newKcpControl(conv uint32, mtu uint32, output func(packet []byte)) *kcpControl {
+	return &kcpControl{
+		conv:     conv,
+		mtu:      mtu,
+		mss:      mtu - kcpOverhead,
+		sndWnd:   32,
+		rcvWnd:   128,
+		rmtWnd:   128,
+		rxRto:    kcpRtoDefault,
+		rxMinRto: kcpRtoMin,
+		interval: 100,
+		ssthresh: kcpThreshInit,
+		output:   output,
+	}
+}
+
+func (k *kcpControl) setNoDelay(nodelay uint32, interval uint32, resend uint32, noCwnd bool) {
+	k.nodelay = nodelay
+	if nodelay != 0 {
+		k.rxMinRto = kcpRtoNoDelay
+	} else {
+		k.rxMinRto = kcpRtoMin
+	}
+	if interval < 10 {
+		interval = 10
+	} else if interval > 5000 {
+		interval = 5000
+	}
+	k.interval = interval
+	k.fastResend = resend
+	k.noCwnd = noCwnd
+}
+
+func (k *kcpControl) setWindowSize(sndWnd uint32, rcvWnd uint32) {
+	if sndWnd > 0 {
+		k.sndWnd = sndWnd
+	}
+	if rcvWnd > 0 {
+		k.rcvWnd = rcvWnd
+	}
+}
+
+// pending returns the number of segments waiting to be sent or acknowledged.
+func (k *kcpControl) pending() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+// recv moves the received data into b and returns its length, or 0 when
+// nothing is ready.
+func (k *kcpControl) recv(b []byte) int {
+	fastRecover := uint32(len(k.rcvQueue)) >= k.rcvWnd
+	n, count := 0, 0
+	for _, seg := range k.rcvQueue {
+		copied := copy(b[n:], seg.data)
+		n += copied
+		if copied < len(seg.data) {
+			seg.data = seg.data[copied:]
+			break
+		}
+		count++
+	}
+	k.rcvQueue = k.rcvQueue[count:]
+	k.moveReceived()
+	if fastRecover && uint32(len(k.rcvQueue)) < k.rcvWnd {
+		k.probe |= kcpAskTell
+	}
+	return n
+}
+
+func (k *kcpControl) moveReceived() {
+	count := 0
+	for _, seg := range k.rcvBuf {
+		if seg.sn != k.rcvNxt || uint32(len(k.rcvQueue)) >= k.rcvWnd {
+			break
+		}
+		k.rcvQueue = append(k.rcvQueue, seg)
+		k.rcvNxt++
+		count++
+	}
+	k.rcvBuf = k.rcvBuf[count:]
+}
+
+func (k *kcpControl) send(b []byte) {
+	if n := len(k.sndQueue); n > 0 {
+		last := k.sndQueue[n-1]
+		if capacity := int(k.mss) - len(last.data); capacity > 0 {
+			if capacity > len(b) {
+				capacity = len(b)
+			}
+			last.data = append(last.data, b[:capacity]...)
+			b = b[capacity:]
+		}
+	}
+	for len(b) > 0 {
+		size := len(b)
+		if size > int(k.mss) {
+			size = int(k.mss)
+		}
+		data := make([]byte, size, k.mss)
+		copy(data, b)
+		k.sndQueue = append(k.sndQueue, &kcpSegment{data: data})
+		b = b[size:]
+	}
+}
+
+func (k *kcpControl) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttVar = rtt / 2
+	} else {
+		delta := rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttVar = (3*k.rxRttVar + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	variance := uint32(4 * k.rxRttVar)
+	if variance < k.interval {
+		variance = k.interval
+	}
+	rto := uint32(k.rxSrtt) + variance
+	if rto < k.rxMinRto {
+		rto = k.rxMinRto
+	} else if rto > kcpRtoMax {
+		rto = kcpRtoMax
+	}
+	k.rxRto = rto
+}
+
+func (k *kcpControl) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *kcpControl) parseAck(sn uint32) {
+	if timeDiff(sn, k.sndUna) < 0 || timeDiff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range k.sndBuf {
+		if seg.sn == sn {
+			k.sndBuf = append(k.sndBuf[:i], k.sndBuf[i+1:]...)
+			return
+		}
+		if timeDiff(sn, seg.sn) < 0 {
+			return
+		}
+	}
+}
+
+func (k *kcpControl) parseFastAck(sn uint32) {
+	if timeDiff(sn, k.sndUna) < 0 || timeDiff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for _, seg := range k.sndBuf {
+		if timeDiff(sn, seg.sn) < 0 {
+			return
+		}
+		if sn != seg.sn {
+			seg.fastack++
+		}
+	}
+}
+
+func (k *kcpControl) parseUna(una uint32) {
+	count := 0
+	for _, seg := range k.sndBuf {
+		if timeDiff(una, seg.sn) <= 0 {
+			break
+		}
+		count++
+	}
+	k.sndBuf = k.sndBuf[count:]
+}
+
+func (k *kcpControl) parseData(newSeg *kcpSegment) {
+	sn := newSeg.sn
+	if timeDiff(sn, k.rcvNxt+k.rcvWnd) >= 0 || timeDiff(sn, k.rcvNxt) < 0 {
+		return
+	}
+	index := len(k.rcvBuf)
+	for index > 0 {
+		seg := k.rcvBuf[index-1]
+		if seg.sn == sn {
+			return
+		}
+		if timeDiff(sn, seg.sn) > 0 {
+			break
+		}
+		index--
+	}
+	k.rcvBuf = append(k.rcvBuf, nil)
+	copy(k.rcvBuf[index+1:], k.rcvBuf[index:])
+	k.rcvBuf[index] = newSeg
+	k.moveReceived()
+}
+
+// input processes a packet received from the peer at current, returning
+// false if it is malformed or of another conversation.
+func (k *kcpControl) input(data []byte, current uint32) bool {
+	k.current = current
+	prevUna := k.sndUna
+	var maxAck uint32
+	ackReceived := false
+	for len(data) >= kcpOverhead {
+		seg := &kcpSegment{
+			conv: binary.LittleEndian.Uint32(data),
+			cmd:  data[4],
+			frg:  data[5],
+			wnd:  binary.LittleEndian.Uint16(data[6:]),
+			ts:   binary.LittleEndian.Uint32(data[8:]),
+			sn:   binary.LittleEndian.Uint32(data[12:]),
+			una:  binary.LittleEndian.Uint32(data[16:]),
+		}
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[kcpOverhead:]
+		if uint32(len(data)) < length || seg.conv != k.conv {
+			return false
+		}
+		k.rmtWnd = uint32(seg.wnd)
+		k.parseUna(seg.una)
+		k.shrinkBuf()
+		switch seg.cmd {
+		case kcpCmdAck:
+			if rtt := timeDiff(k.current, seg.ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(seg.sn)
+			k.shrinkBuf()
+			if !ackReceived || timeDiff(seg.sn, maxAck) > 0 {
+				ackReceived = true
+				maxAck = seg.sn
+			}
+		case kcpCmdPush:
+			if timeDiff(seg.sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.ackList = append(k.ackList, kcpAck{seg.sn, seg.ts})
+				if timeDiff(seg.sn, k.rcvNxt) >= 0 {
+					seg.data = append([]byte(nil), data[:length]...)
+					k.parseData(seg)
+				}
+			}
+		case kcpCmdWindowAsk:
+			k.probe |= kcpAskTell
+		case kcpCmdWindowTell:
+		default:
+			return false
+		}
+		data = data[length:]
+	}
+	if ackReceived {
+		k.parseFastAck(maxAck)
+	}
+
+	if timeDiff(k.sndUna, prevUna) > 0 && k.cwnd < k.rmtWnd {
+		mss := k.mss
+		if k.cwnd < k.ssthresh {
+			k.cwnd++
+			k.incr += mss
+		} else {
+			if k.incr < mss {
+				k.incr = mss
+			}
+			k.incr += (mss*mss)/k.incr + mss/16
+			if (k.cwnd+1)*mss <= k.incr {
+				k.cwnd = (k.incr + mss - 1) / mss
+			}
+		}
+		if k.cwnd > k.rmtWnd {
+			k.cwnd = k.rmtWnd
+			k.incr = k.rmtWnd * mss
+		}
+	}
+	return true
+}
+
+func (k *kcpControl) unusedWindow() uint16 {
+	if uint32(len(k.rcvQueue)) < k.rcvWnd {
+		return uint16(k.rcvWnd - uint32(len(k.rcvQueue)))
+	}
+	return 0
+}
+
+// flush sends the pending acknowledgements, probes and segments at current,
+// in milliseconds.
+func (k *kcpControl) flush(current uint32, ackOnly bool) {
+	k.current = current
+	buffer := make([]byte, 0, k.mtu)
+	write := func(size int) {
+		if len(buffer)+size > int(k.mtu) {
+			k.output(buffer)
+			buffer = make([]byte, 0, k.mtu)
+		}
+	}
+
+	seg := &kcpSegment{conv: k.conv, cmd: kcpCmdAck, wnd: k.unusedWindow(), una: k.rcvNxt}
+	for _, ack := range k.ackList {
+		write(kcpOverhead)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		buffer = seg.encode(buffer)
+	}
+	k.ackList = k.ackList[:0]
+	if ackOnly {
+		if len(buffer) > 0 {
+			k.output(buffer)
+		}
+		return
+	}
+
+	if k.rmtWnd == 0 {
+		if k.probeWait == 0 {
+			k.probeWait = kcpProbeInit
+			k.tsProbe = current + k.probeWait
+		} else if timeDiff(current, k.tsProbe) >= 0 {
+			if k.probeWait < kcpProbeInit {
+				k.probeWait = kcpProbeInit
+			}
+			k.probeWait += k.probeWait / 2
+			if k.probeWait > kcpProbeLimit {
+				k.probeWait = kcpProbeLimit
+			}
+			k.tsProbe = current + k.probeWait
+			k.probe |= kcpAskSend
+		}
+	} else {
+		k.tsProbe = 0
+		k.probeWait = 0
+	}
+	seg.sn, seg.ts = 0, 0
+	if k.probe&kcpAskSend != 0 {
+		seg.cmd = kcpCmdWindowAsk
+		write(kcpOverhead)
+		buffer = seg.encode(buffer)
+	}
+	if k.probe&kcpAskTell != 0 {
+		seg.cmd = kcpCmdWindowTell
+		write(kcpOverhead)
+		buffer = seg.encode(buffer)
+	}
+	k.probe = 0
+
+	cwnd := k.sndWnd
+	if k.rmtWnd < cwnd {
+		cwnd = k.rmtWnd
+	}
+	if !k.noCwnd && k.cwnd < cwnd {
+		cwnd = k.cwnd
+	}
+	for timeDiff(k.sndNxt, k.sndUna+cwnd) < 0 && len(k.sndQueue) > 0 {
+		newSeg := k.sndQueue[0]
+		k.sndQueue = k.sndQueue[1:]
+		newSeg.conv = k.conv
+		newSeg.cmd = kcpCmdPush
+		newSeg.sn = k.sndNxt
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, newSeg)
+	}
+
+	resent := k.fastResend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+	var rtoMin uint32
+	if k.nodelay == 0 {
+		rtoMin = k.rxRto >> 3
+	}
+	lost, change := false, false
+	for _, segment := range k.sndBuf {
+		needSend := false
+		switch {
+		case segment.xmit == 0:
+			needSend = true
+			segment.rto = k.rxRto
+			segment.resendts = current + segment.rto + rtoMin
+		case timeDiff(current, segment.resendts) >= 0:
+			needSend = true
+			if k.nodelay == 0 {
+				if segment.rto > k.rxRto {
+					segment.rto += segment.rto
+				} else {
+					segment.rto += k.rxRto
+				}
+			} else if k.nodelay < 2 {
+				segment.rto += segment.rto / 2
+			} else {
+				segment.rto += k.rxRto / 2
+			}
+			segment.resendts = current + segment.rto
+			lost = true
+		case segment.fastack >= resent:
+			needSend = true
+			segment.fastack = 0
+			segment.resendts = current + segment.rto
+			change = true
+		}
+		if !needSend {
+			continue
+		}
+		segment.xmit++
+		segment.ts = current
+		segment.wnd = seg.wnd
+		segment.una = k.rcvNxt
+		write(kcpOverhead + len(segment.data))
+		buffer = segment.encode(buffer)
+		if segment.xmit >= kcpDeadLink {
+			k.dead = true
+		}
+	}
+	if len(buffer) > 0 {
+		k.output(buffer)
+	}
+
+	if change {
+		inflight := k.sndNxt - k.sndUna
+		k.ssthresh = inflight / 2
+		if k.ssthresh < kcpThreshMin {
+			k.ssthresh = kcpThreshMin
+		}
+		k.cwnd = k.ssthresh + resent
+		k.incr = k.cwnd * k.mss
+	}
+	if lost {
+		k.ssthresh = cwnd / 2
+		if k.ssthresh < kcpThreshMin {
+			k.ssthresh = kcpThreshMin
+		}
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+	if k.cwnd < 1 {
+		k.cwnd = 1
+		k.incr = k.mss
+	}
+}
+
+func timeDiff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
@@ -0,0 +1,712 @@
+package libcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	"github.com/Dreamacro/clash/component/dialer"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/cast5"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/salsa20"
+	"golang.org/x/crypto/tea"
+	"golang.org/x/crypto/twofish"
+	"golang.org/x/crypto/xtea"
+)
+
+// kcptun client: smux streams over KCP over UDP, with the packet encryption,
+// forward error correction headers and snappy compression of kcp-go and
+// kcptun. Parity shards are not generated, and those of the server are
+// ignored, so lost packets are recovered by retransmission only.
+
+const (
+	kcptunSalt        = "kcp-go"
+	kcptunXorSalt     = "sH3CIVoF#rWLtJo6"
+	kcptunDefaultKey  = "it's a secrect"
+	kcptunMtuLimit    = 1500
+	kcptunNonceSize   = 16
+	kcptunCryptHeader = kcptunNonceSize + 4
+	kcptunFecHeader   = 6
+	kcptunFecData     = 0xf1
+)
+
+var kcptunInitialVector = []byte{167, 115, 79, 156, 18, 172, 27, 1, 164, 21, 242, 193, 252, 120, 230, 107}
+
+type kcptunCrypt interface {
+	encrypt(dst, src []byte)
+	decrypt(dst, src []byte)
+}
+
+// kcptunBlockCrypt encrypts packets in CFB mode with a fixed IV, the packets
+// starting with a random nonce.
+type kcptunBlockCrypt struct {
+	block cipher.Block
+}
+
+func (c kcptunBlockCrypt) encrypt(dst, src []byte) {
+	cipher.NewCFBEncrypter(c.block, kcptunInitialVector[:c.block.BlockSize()]).XORKeyStream(dst, src)
+}
+
+func (c kcptunBlockCrypt) decrypt(dst, src []byte) {
+	cipher.NewCFBDecrypter(c.block, kcptunInitialVector[:c.block.BlockSize()]).XORKeyStream(dst, src)
+}
+
+type kcptunSalsa20Crypt struct {
+	key [32]byte
+}
+
+func (c *kcptunSalsa20Crypt) encrypt(dst, src []byte) {
+	salsa20.XORKeyStream(dst[8:], src[8:], src[:8], &c.key)
+	copy(dst[:8], src[:8])
+}
+
+func (c *kcptunSalsa20Crypt) decrypt(dst, src []byte) {
+	c.encrypt(dst, src)
+}
+
+type kcptunXorCrypt struct {
+	table []byte
+}
+
+func (c kcptunXorCrypt) encrypt(dst, src []byte) {
+	for i := 0; i < len(src) && i < len(c.table); i++ {
+		dst[i] = src[i] ^ c.table[i]
+	}
+}
+
+func (c kcptunXorCrypt) decrypt(dst, src []byte) {
+	c.encrypt(dst, src)
+}
+
+type kcptunNoneCrypt struct{}
+
+func (kcptunNoneCrypt) encrypt(dst, src []byte) {
+	copy(dst, src)
+}
+
+func (kcptunNoneCrypt) decrypt(dst, src []byte) {
+	copy(dst, src)
+}
+
+// newKcptunCrypt returns the packet encryption of kcptun, nil for "null" which
+// also drops the nonce and checksum header.
+func newKcptunCrypt(method string, key string) (kcptunCrypt, error) {
+	pass := pbkdf2.Key([]byte(key), []byte(kcptunSalt), 4096, 32, sha1.New)
+	var block cipher.Block
+	var err error
+	switch method {
+	case "null":
+		return nil, nil
+	case "none":
+		return kcptunNoneCrypt{}, nil
+	case "xor":
+		return kcptunXorCrypt{pbkdf2.Key(pass, []byte(kcptunXorSalt), 32, kcptunMtuLimit, sha1.New)}, nil
+	case "salsa20":
+		c := &kcptunSalsa20Crypt{}
+		copy(c.key[:], pass)
+		return c, nil
+	case "aes", "":
+		block, err = aes.NewCipher(pass)
+	case "aes-128":
+		block, err = aes.NewCipher(pass[:16])
+	case "aes-192":
+		block, err = aes.NewCipher(pass[:24])
+	case "blowfish":
+		block, err = blowfish.NewCipher(pass)
+	case "twofish":
+		block, err = twofish.NewCipher(pass)
+	case "cast5":
+		block, err = cast5.NewCipher(pass[:16])
+	case "3des":
+		block, err = des.NewTripleDESCipher(pass[:24])
+	case "tea":
+		block, err = tea.NewCipherWithRounds(pass[:16], 16)
+	case "xtea":
+		block, err = xtea.NewCipher(pass[:16])
+	default:
+		return nil, fmt.Errorf("unsupported kcptun crypt %q", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kcptunBlockCrypt{block}, nil
+}
+
+type kcptunConfig struct {
+	crypt        kcptunCrypt
+	mtu          int
+	sndWnd       int
+	rcvWnd       int
+	dataShards   int
+	parityShards int
+	noDelay      int
+	interval     int
+	resend       int
+	noCongestion bool
+	ackNoDelay   bool
+	compress     bool
+	keepAlive    time.Duration
+}
+
+func pluginString(opts map[string]interface{}, name string, defaultValue string) string {
+	if value, ok := opts[name]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+	return defaultValue
+}
+
+func pluginInt(opts map[string]interface{}, name string, defaultValue int) (int, error) {
+	switch value := opts[name].(type) {
+	case nil:
+		return defaultValue, nil
+	case float64:
+		return int(value), nil
+	case string:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid plugin option %s=%q", name, value)
+		}
+		return number, nil
+	default:
+		return 0, fmt.Errorf("invalid plugin option %s=%v", name, value)
+	}
+}
+
+// newKcptunConfig reads the options of the kcptun client, with its defaults.
+func newKcptunConfig(opts map[string]interface{}) (*kcptunConfig, error) {
+	config := &kcptunConfig{}
+	var err error
+	if config.crypt, err = newKcptunCrypt(pluginString(opts, "crypt", "aes"), pluginString(opts, "key", kcptunDefaultKey)); err != nil {
+		return nil, err
+	}
+	for _, option := range []struct {
+		name         string
+		value        *int
+		defaultValue int
+	}{
+		{"mtu", &config.mtu, 1350},
+		{"sndwnd", &config.sndWnd, 128},
+		{"rcvwnd", &config.rcvWnd, 512},
+		{"datashard", &config.dataShards, 10},
+		{"parityshard", &config.parityShards, 3},
+		{"nodelay", &config.noDelay, 0},
+		{"interval", &config.interval, 30},
+		{"resend", &config.resend, 2},
+	} {
+		if *option.value, err = pluginInt(opts, option.name, option.defaultValue); err != nil {
+			return nil, err
+		}
+	}
+	version, err := pluginInt(opts, "smuxver", 1)
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported kcptun smuxver %d, only version 1 is supported", version)
+	}
+	noCongestion, err := pluginInt(opts, "nc", 1)
+	if err != nil {
+		return nil, err
+	}
+	config.noCongestion = noCongestion != 0
+	keepAlive, err := pluginInt(opts, "keepalive", 10)
+	if err != nil {
+		return nil, err
+	}
+	if keepAlive <= 0 {
+		keepAlive = 10
+	}
+	config.keepAlive = time.Duration(keepAlive) * time.Second
+
+	switch mode := pluginString(opts, "mode", "fast"); mode {
+	case "normal":
+		config.noDelay, config.interval, config.resend, config.noCongestion = 0, 40, 2, true
+	case "fast":
+		config.noDelay, config.interval, config.resend, config.noCongestion = 0, 30, 2, true
+	case "fast2":
+		config.noDelay, config.interval, config.resend, config.noCongestion = 1, 20, 2, true
+	case "fast3":
+		config.noDelay, config.interval, config.resend, config.noCongestion = 1, 10, 2, true
+	case "manual":
+	default:
+		return nil, fmt.Errorf("unsupported kcptun mode %q", mode)
+	}
+	if _, ok := opts["acknodelay"]; ok {
+		config.ackNoDelay = pluginFlag(opts["acknodelay"])
+	}
+	config.compress = true
+	if _, ok := opts["nocomp"]; ok {
+		config.compress = !pluginFlag(opts["nocomp"])
+	}
+	if config.mtu > kcptunMtuLimit || config.mtu < 100 {
+		return nil, fmt.Errorf("invalid kcptun mtu %d", config.mtu)
+	}
+	if config.dataShards < 0 || config.parityShards < 0 {
+		return nil, errors.New("invalid kcptun shard count")
+	}
+	return config, nil
+}
+
+func (c *kcptunConfig) fec() bool {
+	return c.dataShards > 0 && c.parityShards > 0
+}
+
+func (c *kcptunConfig) headerSize() int {
+	size := 0
+	if c.crypt != nil {
+		size += kcptunCryptHeader
+	}
+	if c.fec() {
+		size += kcptunFecHeader + 2
+	}
+	return size
+}
+
+// kcpSession is a KCP conversation with the server over its own UDP socket.
+type kcpSession struct {
+	config *kcptunConfig
+	conn   net.PacketConn
+	remote net.Addr
+	start  time.Time
+
+	access     sync.Mutex
+	kcp        *kcpControl
+	seqID      uint32
+	shardIndex int
+
+	readable  chan struct{}
+	writable  chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newKcpSession(config *kcptunConfig, server string) (*kcpSession, error) {
+	remote, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	var conv [4]byte
+	if _, err = rand.Read(conv[:]); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	s := &kcpSession{
+		config:   config,
+		conn:     conn,
+		remote:   remote,
+		start:    time.Now(),
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	s.kcp = newKcpControl(binary.LittleEndian.Uint32(conv[:]), uint32(config.mtu-config.headerSize()), s.output)
+	s.kcp.setNoDelay(uint32(config.noDelay), uint32(config.interval), uint32(config.resend), config.noCongestion)
+	s.kcp.setWindowSize(uint32(config.sndWnd), uint32(config.rcvWnd))
+	go s.readLoop()
+	go s.updateLoop()
+	return s, nil
+}
+
+func (s *kcpSession) now() uint32 {
+	return uint32(time.Since(s.start).Milliseconds())
+}
+
+func notifyChannel(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// output sends a KCP packet, called with the session locked.
+func (s *kcpSession) output(packet []byte) {
+	header := s.config.headerSize()
+	buf := make([]byte, header+len(packet))
+	copy(buf[header:], packet)
+	if s.config.fec() {
+		fec := buf[header-kcptunFecHeader-2:]
+		binary.LittleEndian.PutUint32(fec, s.seqID)
+		binary.LittleEndian.PutUint16(fec[4:], kcptunFecData)
+		binary.LittleEndian.PutUint16(fec[6:], uint16(len(packet)+2))
+		// the sequence ids of the parity shards of the group are left unused
+		shardSize := uint32(s.config.dataShards + s.config.parityShards)
+		paws := 0xffffffff / shardSize * shardSize
+		s.seqID = (s.seqID + 1) % paws
+		if s.shardIndex++; s.shardIndex == s.config.dataShards {
+			s.seqID = (s.seqID + uint32(s.config.parityShards)) % paws
+			s.shardIndex = 0
+		}
+	}
+	if s.config.crypt != nil {
+		_, _ = rand.Read(buf[:kcptunNonceSize])
+		binary.LittleEndian.PutUint32(buf[kcptunNonceSize:], crc32.ChecksumIEEE(buf[kcptunCryptHeader:]))
+		s.config.crypt.encrypt(buf, buf)
+	}
+	_, _ = s.conn.WriteTo(buf, s.remote)
+}
+
+func (s *kcpSession) readLoop() {
+	defer s.Close()
+	buf := make([]byte, kcptunMtuLimit)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet := buf[:n]
+		if s.config.crypt != nil {
+			if len(packet) < kcptunCryptHeader {
+				continue
+			}
+			s.config.crypt.decrypt(packet, packet)
+			if crc32.ChecksumIEEE(packet[kcptunCryptHeader:]) != binary.LittleEndian.Uint32(packet[kcptunNonceSize:]) {
+				continue
+			}
+			packet = packet[kcptunCryptHeader:]
+		}
+		if s.config.fec() {
+			if len(packet) < kcptunFecHeader+2 || binary.LittleEndian.Uint16(packet[4:]) != kcptunFecData {
+				continue
+			}
+			size := int(binary.LittleEndian.Uint16(packet[6:]))
+			if size < 2 || kcptunFecHeader+size > len(packet) {
+				continue
+			}
+			packet = packet[kcptunFecHeader+2 : kcptunFecHeader+size]
+		}
+
+		s.access.Lock()
+		if s.kcp.input(packet, s.now()) && s.config.ackNoDelay {
+			s.kcp.flush(s.now(), true)
+		}
+		s.access.Unlock()
+		notifyChannel(s.readable)
+		notifyChannel(s.writable)
+	}
+}
+
+func (s *kcpSession) updateLoop() {
+	ticker := time.NewTicker(time.Duration(s.kcp.interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+		s.access.Lock()
+		s.kcp.flush(s.now(), false)
+		dead := s.kcp.dead
+		s.access.Unlock()
+		if dead {
+			_ = s.Close()
+			return
+		}
+		notifyChannel(s.writable)
+	}
+}
+
+func (s *kcpSession) Read(b []byte) (int, error) {
+	for {
+		s.access.Lock()
+		n := s.kcp.recv(b)
+		s.access.Unlock()
+		if n > 0 {
+			return n, nil
+		}
+		select {
+		case <-s.readable:
+		case <-s.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+func (s *kcpSession) Write(b []byte) (int, error) {
+	for {
+		select {
+		case <-s.closed:
+			return 0, io.ErrClosedPipe
+		default:
+		}
+		s.access.Lock()
+		if s.kcp.pending() < 2*int(s.kcp.sndWnd) {
+			s.kcp.send(b)
+			s.kcp.flush(s.now(), false)
+			s.access.Unlock()
+			return len(b), nil
+		}
+		s.access.Unlock()
+		select {
+		case <-s.writable:
+		case <-s.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+func (s *kcpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		_ = s.conn.Close()
+	})
+	return nil
+}
+
+func (s *kcpSession) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *kcpSession) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *kcpSession) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (s *kcpSession) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (s *kcpSession) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// snappyConn is the snappy framing format used by kcptun unless nocomp is
+// set. Written data is sent in uncompressed chunks, which every decoder
+// accepts.
+type snappyConn struct {
+	net.Conn
+	reader      *bufio.Reader
+	pending     []byte
+	wroteHeader bool
+}
+
+const (
+	snappyChunkCompressed   = 0x00
+	snappyChunkUncompressed = 0x01
+	snappyChunkPadding      = 0xfe
+	snappyChunkStream       = 0xff
+	snappyMaxChunk          = 65536
+	snappyStreamIdentifier  = "\xff\x06\x00\x00sNaPpY"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func snappyChecksum(b []byte) uint32 {
+	c := crc32.Checksum(b, castagnoliTable)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+func (c *snappyConn) Write(b []byte) (int, error) {
+	var out []byte
+	if !c.wroteHeader {
+		out = append(out, snappyStreamIdentifier...)
+		c.wroteHeader = true
+	}
+	for remaining := b; len(remaining) > 0; {
+		chunk := remaining
+		if len(chunk) > snappyMaxChunk {
+			chunk = chunk[:snappyMaxChunk]
+		}
+		length := len(chunk) + 4
+		out = append(out, snappyChunkUncompressed, byte(length), byte(length>>8), byte(length>>16))
+		var checksum [4]byte
+		binary.LittleEndian.PutUint32(checksum[:], snappyChecksum(chunk))
+		out = append(append(out, checksum[:]...), chunk...)
+		remaining = remaining[len(chunk):]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *snappyConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return 0, err
+		}
+		body := make([]byte, int(header[1])|int(header[2])<<8|int(header[3])<<16)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			return 0, err
+		}
+		switch chunkType := header[0]; {
+		case chunkType == snappyChunkCompressed || chunkType == snappyChunkUncompressed:
+			if len(body) < 4 {
+				return 0, errors.New("snappy: corrupt chunk")
+			}
+			data := body[4:]
+			if chunkType == snappyChunkCompressed {
+				var err error
+				if data, err = snappyDecode(data); err != nil {
+					return 0, err
+				}
+			}
+			if snappyChecksum(data) != binary.LittleEndian.Uint32(body) {
+				return 0, errors.New("snappy: checksum mismatch")
+			}
+			c.pending = data
+		case chunkType == snappyChunkStream || chunkType == snappyChunkPadding || chunkType >= 0x80:
+		default:
+			return 0, fmt.Errorf("snappy: unsupported chunk type %d", chunkType)
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// snappyDecode decodes a snappy block.
+func snappyDecode(src []byte) ([]byte, error) {
+	corrupt := errors.New("snappy: corrupt input")
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > snappyMaxChunk {
+		return nil, corrupt
+	}
+	dst := make([]byte, 0, length)
+	for s := n; s < len(src); {
+		tag := src[s]
+		var copyLength, offset int
+		switch tag & 3 {
+		case 0:
+			literal := int(tag >> 2)
+			s++
+			if literal >= 60 {
+				size := literal - 59
+				if s+size > len(src) {
+					return nil, corrupt
+				}
+				literal = 0
+				for i := size - 1; i >= 0; i-- {
+					literal = literal<<8 | int(src[s+i])
+				}
+				s += size
+			}
+			literal++
+			if literal > len(src)-s {
+				return nil, corrupt
+			}
+			dst = append(dst, src[s:s+literal]...)
+			s += literal
+			continue
+		case 1:
+			if s+2 > len(src) {
+				return nil, corrupt
+			}
+			copyLength = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+		case 2:
+			if s+3 > len(src) {
+				return nil, corrupt
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 3:
+			if s+5 > len(src) {
+				return nil, corrupt
+			}
+			copyLength = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+copyLength > int(length) {
+			return nil, corrupt
+		}
+		for i := 0; i < copyLength; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(length) {
+		return nil, corrupt
+	}
+	return dst, nil
+}
+
+// kcptunTransport keeps one smux session to the kcptun server, opened again
+// once it dies.
+type kcptunTransport struct {
+	server string
+	config *kcptunConfig
+
+	access  sync.Mutex
+	session *smuxSession
+}
+
+func (t *kcptunTransport) openStream(ctx context.Context) (net.Conn, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.session == nil || t.session.isClosed() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		kcpConn, err := newKcpSession(t.config, t.server)
+		if err != nil {
+			return nil, err
+		}
+		var conn net.Conn = kcpConn
+		if t.config.compress {
+			conn = &snappyConn{Conn: kcpConn, reader: bufio.NewReader(kcpConn)}
+		}
+		t.session = newSmuxSession(conn, t.config.keepAlive)
+	}
+	return t.session.openStream()
+}
+
+func (t *kcptunTransport) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.session != nil {
+		_ = t.session.Close()
+		t.session = nil
+	}
+	return nil
+}
+
+// kcptunShadowsocks is a Shadowsocks instance whose connections are streams
+// of a kcptun session. kcptun only relays TCP.
+type kcptunShadowsocks struct {
+	*outbound.ShadowSocks
+	transport *kcptunTransport
+}
+
+func (s *kcptunShadowsocks) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	stream, err := s.transport.openStream(ctx)
+	if err != nil {
+		return nil, errors.WithMessage(err, "kcptun")
+	}
+	sc, err := s.ShadowSocks.StreamConn(stream, metadata)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	return outbound.NewConn(sc, s), nil
+}
+
+func (s *kcptunShadowsocks) Close() error {
+	return s.transport.Close()
+}
@@ -0,0 +1,155 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const (
+	killswitchCheckInterval = 3 * time.Second
+	killswitchProbeTimeout  = 5000
+)
+
+type KillswitchListener interface {
+	// OnKillswitchChanged is called when every outbound is down and traffic is
+	// blackholed, and with offline false once one is back.
+	OnKillswitchChanged(offline bool)
+}
+
+// killswitch blackholes the TUN traffic, including the direct routes, while
+// every watched outbound is down, instead of letting it fail over to direct.
+type killswitch struct {
+	offline int32
+
+	access    sync.Mutex
+	outbounds []*ClashBasedInstance
+	probeLink string
+	listener  KillswitchListener
+	done      chan struct{}
+}
+
+func (k *killswitch) blocking() bool {
+	return k != nil && atomic.LoadInt32(&k.offline) == 1
+}
+
+func (k *killswitch) stop() {
+	if k != nil {
+		close(k.done)
+	}
+}
+
+// SetKillswitch enables the killswitch mode, watching the outbounds added
+// with AddKillswitchOutbound. An outbound is down when its last dial failed;
+// while all are down traffic is dropped and they are probed with probeLink,
+// without which only dials made by the app can bring them back. The captive
+// portal mode still goes through.
+func (t *Tun2socks) SetKillswitch(enabled bool, probeLink string, listener KillswitchListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.killswitch != nil {
+		t.killswitch.stop()
+		t.killswitch = nil
+	}
+	if !enabled {
+		return
+	}
+	k := &killswitch{
+		probeLink: probeLink,
+		listener:  listener,
+		done:      make(chan struct{}),
+	}
+	t.killswitch = k
+	go k.watch()
+}
+
+func (t *Tun2socks) AddKillswitchOutbound(instance *ClashBasedInstance) {
+	t.access.Lock()
+	k := t.killswitch
+	t.access.Unlock()
+	if k == nil {
+		return
+	}
+	k.access.Lock()
+	k.outbounds = append(k.outbounds, instance)
+	k.access.Unlock()
+}
+
+// IsOffline reports whether the killswitch is blackholing traffic.
+func (t *Tun2socks) IsOffline() bool {
+	return t.killswitch.blocking()
+}
+
+func (k *killswitch) watch() {
+	ticker := time.NewTicker(killswitchCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-ticker.C:
+		}
+		k.check()
+	}
+}
+
+func (k *killswitch) check() {
+	k.access.Lock()
+	outbounds := append([]*ClashBasedInstance(nil), k.outbounds...)
+	k.access.Unlock()
+	if len(outbounds) == 0 {
+		return
+	}
+
+	up := anyOutboundUp(outbounds)
+	if !up && k.probeLink != "" {
+		var wait sync.WaitGroup
+		for _, instance := range outbounds {
+			if instance.IsClosed() {
+				continue
+			}
+			wait.Add(1)
+			go func(instance *ClashBasedInstance) {
+				defer wait.Done()
+				_, err := UrlTestClashBased(instance, k.probeLink, killswitchProbeTimeout)
+				instance.status.dialed(err)
+			}(instance)
+		}
+		wait.Wait()
+		up = anyOutboundUp(outbounds)
+	}
+
+	var offline int32
+	if !up {
+		offline = 1
+	}
+	if atomic.SwapInt32(&k.offline, offline) != offline {
+		if up {
+			log.Infof("[Killswitch] outbound back, traffic resumed")
+		} else {
+			log.Warnf("[Killswitch] all outbounds down, blocking traffic")
+		}
+		if k.listener != nil {
+			k.listener.OnKillswitchChanged(!up)
+		}
+	}
+}
+
+// anyOutboundUp reports whether an outbound is open and its last dial, if
+// any, succeeded.
+func anyOutboundUp(outbounds []*ClashBasedInstance) bool {
+	for _, instance := range outbounds {
+		if instance.IsClosed() {
+			continue
+		}
+		instance.status.access.Lock()
+		up := !instance.status.lastDialAt.Before(instance.status.lastErrorAt)
+		instance.status.access.Unlock()
+		if up {
+			return true
+		}
+	}
+	return false
+}
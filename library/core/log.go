@@ -79,6 +79,7 @@ type v2rayLogWriter struct {
 }
 
 func (w *v2rayLogWriter) Write(s string) error {
+	recordLog(logrus.DebugLevel, s)
 	str := C.CString(s)
 	C.__android_log_write(C.ANDROID_LOG_DEBUG, tagV2Ray, str)
 	C.free(unsafe.Pointer(str))
@@ -92,6 +93,7 @@ func (w *v2rayLogWriter) Close() error {
 type stdLogWriter struct{}
 
 func (stdLogWriter) Write(p []byte) (n int, err error) {
+	recordLog(logrus.InfoLevel, string(p))
 	str := C.CString(string(p))
 	C.__android_log_write(C.ANDROID_LOG_INFO, tag, str)
 	C.free(unsafe.Pointer(str))
@@ -103,6 +105,7 @@ func initLog() {
 	log.SetFlags(log.Flags() &^ log.LstdFlags)
 	logrus.SetFormatter(&androidFormatter{})
 	logrus.AddHook(&androidHook{})
+	logrus.AddHook(fileLogHook{})
 
 	_ = appLog.RegisterHandlerCreator(appLog.LogType_Console, func(lt appLog.LogType,
 		options appLog.HandlerCreatorOptions) (commonLog.Handler, error) {
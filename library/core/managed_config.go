@@ -0,0 +1,145 @@
+package libcore
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	managedConfigTimeout     = 30 * 1000
+	managedConfigMinInterval = 300
+)
+
+// managedDocument is a signed management document: payload is the base64 of
+// a managedPayload, signature the base64 ed25519 signature of the decoded
+// payload.
+type managedDocument struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type managedPayload struct {
+	Version        int64             `json:"version"`
+	Profiles       []json.RawMessage `json:"profiles"`
+	Routing        json.RawMessage   `json:"routing"`
+	BlockedDomains string            `json:"blockedDomains"`
+	DnsRewrites    string            `json:"dnsRewrites"`
+	// seconds
+	UpdateInterval int32 `json:"updateInterval"`
+}
+
+// ManagedConfig is the verified content of a management document distributed
+// by an organization.
+type ManagedConfig struct {
+	Version int64
+	// JSON array of the mandatory profiles, in the format of ValidateProfiles
+	Profiles string
+	// JSON object of the routing policy, applied by the app
+	Routing string
+	// seconds until the document should be fetched again
+	UpdateInterval int32
+
+	blockedDomains string
+	dnsRewrites    string
+}
+
+// FetchManagedConfig downloads the management document at url, through
+// instance or directly if nil, and verifies it with ParseManagedConfig.
+func FetchManagedConfig(url string, publicKey string, currentVersion int64, instance *ClashBasedInstance) (*ManagedConfig, error) {
+	client := NewHTTPClient(instance, managedConfigTimeout, "", true, false)
+	defer client.Close()
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, errors.WithMessage(err, "fetch managed config")
+	}
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("fetch managed config: status %d", response.StatusCode)
+	}
+	return ParseManagedConfig(response.Body, publicKey, currentVersion)
+}
+
+// ParseManagedConfig checks the signature of a management document against
+// the base64 ed25519 publicKey and validates every profile. Documents not
+// newer than currentVersion are rejected, so that an old signed document
+// cannot be replayed.
+func ParseManagedConfig(content []byte, publicKey string, currentVersion int64) (*ManagedConfig, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid managed config public key")
+	}
+	var document managedDocument
+	if err = json.Unmarshal(content, &document); err != nil {
+		return nil, errors.WithMessage(err, "parse managed config")
+	}
+	payload, err := base64.StdEncoding.DecodeString(document.Payload)
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode managed config payload")
+	}
+	signature, err := base64.StdEncoding.DecodeString(document.Signature)
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode managed config signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), payload, signature) {
+		return nil, errors.New("managed config signature mismatch")
+	}
+
+	var managed managedPayload
+	if err = json.Unmarshal(payload, &managed); err != nil {
+		return nil, errors.WithMessage(err, "parse managed config payload")
+	}
+	if managed.Version <= currentVersion {
+		return nil, fmt.Errorf("managed config version %d is not newer than %d", managed.Version, currentVersion)
+	}
+	if managed.UpdateInterval < managedConfigMinInterval {
+		managed.UpdateInterval = managedConfigMinInterval
+	}
+	if managed.Profiles == nil {
+		managed.Profiles = []json.RawMessage{}
+	}
+	profiles, err := json.Marshal(managed.Profiles)
+	if err != nil {
+		return nil, err
+	}
+	results, err := ValidateProfiles(string(profiles))
+	if err != nil {
+		return nil, err
+	}
+	var messages []string
+	_ = json.Unmarshal([]byte(results), &messages)
+	for index, message := range messages {
+		if message != "" {
+			return nil, fmt.Errorf("managed profile %d: %s", index, message)
+		}
+	}
+	routing := "{}"
+	if len(managed.Routing) > 0 && string(managed.Routing) != "null" {
+		routing = string(managed.Routing)
+	}
+	return &ManagedConfig{
+		Version:        managed.Version,
+		Profiles:       string(profiles),
+		Routing:        routing,
+		UpdateInterval: managed.UpdateInterval,
+		blockedDomains: managed.BlockedDomains,
+		dnsRewrites:    managed.DnsRewrites,
+	}, nil
+}
+
+// Apply replaces the domain blocker and DNS rewrite rules of libcore with
+// those of the document, when it has any.
+func (c *ManagedConfig) Apply() {
+	if c.blockedDomains != "" {
+		blocker := NewDomainBlocker()
+		blocker.LoadDomainList(c.blockedDomains)
+		SetDomainBlocker(blocker)
+	}
+	if c.dnsRewrites != "" {
+		rewriter := NewDnsRewriter()
+		rewriter.LoadRules(c.dnsRewrites)
+		SetDnsRewriter(rewriter)
+	}
+}
@@ -0,0 +1,71 @@
+package libcore
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func signManagedConfig(t *testing.T, key ed25519.PrivateKey, payload string) []byte {
+	content, err := json.Marshal(managedDocument{
+		Payload:   base64.StdEncoding.EncodeToString([]byte(payload)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(payload))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestParseManagedConfig(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(public)
+	payload := `{"version":2,"profiles":[{"type":"socks5","server":"1.2.3.4","port":1080}],"updateInterval":60}`
+
+	managed, err := ParseManagedConfig(signManagedConfig(t, private, payload), publicKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if managed.Version != 2 || managed.Routing != "{}" || managed.UpdateInterval != managedConfigMinInterval {
+		t.Errorf("got version %d, routing %s, interval %d", managed.Version, managed.Routing, managed.UpdateInterval)
+	}
+
+	tampered := signManagedConfig(t, private, payload)
+	var document managedDocument
+	if err = json.Unmarshal(tampered, &document); err != nil {
+		t.Fatal(err)
+	}
+	document.Payload = base64.StdEncoding.EncodeToString([]byte(`{"version":3}`))
+	if tampered, err = json.Marshal(document); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		content   []byte
+		publicKey string
+		version   int64
+	}{
+		{"other key", signManagedConfig(t, otherPrivate, payload), publicKey, 1},
+		{"tampered payload", tampered, publicKey, 1},
+		{"replayed", signManagedConfig(t, private, payload), publicKey, 2},
+		{"invalid public key", signManagedConfig(t, private, payload), "AAAA", 1},
+		{"invalid profile", signManagedConfig(t, private, `{"version":2,"profiles":[{"type":"unknown"}]}`), publicKey, 1},
+		{"not json", []byte("not json"), publicKey, 1},
+		{"invalid signature", []byte(`{"payload":"e30=","signature":"!"}`), publicKey, 1},
+	}
+	for _, test := range tests {
+		if _, err := ParseManagedConfig(test.content, test.publicKey, test.version); err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
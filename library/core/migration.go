@@ -0,0 +1,141 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+// rebindablePacketConn is the UDP socket under QUIC based outbounds. Rebinding
+// swaps in a new socket on the current network while the QUIC connection on
+// top keeps its state, so the server sees a migration instead of a new
+// handshake.
+type rebindablePacketConn struct {
+	access  sync.RWMutex
+	conn    net.PacketConn
+	options *socketOptions
+	closed  bool
+}
+
+var (
+	rebindableAccess sync.Mutex
+	rebindableConns  = map[*rebindablePacketConn]struct{}{}
+)
+
+func listenRebindable(options *socketOptions) (*rebindablePacketConn, error) {
+	if options == nil {
+		options = &socketOptions{}
+	}
+	c := &rebindablePacketConn{options: options}
+	conn, err := c.listen()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	rebindableAccess.Lock()
+	rebindableConns[c] = struct{}{}
+	rebindableAccess.Unlock()
+	return c, nil
+}
+
+func (c *rebindablePacketConn) listen() (net.PacketConn, error) {
+	config := net.ListenConfig{Control: c.options.control}
+	conn, err := config.ListenPacket(context.Background(), "udp", c.options.listenAddress())
+	if err != nil {
+		return nil, err
+	}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		return newBatchPacketConn(udpConn), nil
+	}
+	return conn, nil
+}
+
+func (c *rebindablePacketConn) current() net.PacketConn {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	return c.conn
+}
+
+func (c *rebindablePacketConn) rebind() error {
+	conn, err := c.listen()
+	if err != nil {
+		return err
+	}
+	c.access.Lock()
+	if c.closed {
+		c.access.Unlock()
+		return conn.Close()
+	}
+	old := c.conn
+	c.conn = conn
+	c.access.Unlock()
+	return old.Close()
+}
+
+func (c *rebindablePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn := c.current()
+		n, addr, err := conn.ReadFrom(p)
+		if err == nil {
+			return n, addr, nil
+		}
+		c.access.RLock()
+		swapped := c.conn != conn && !c.closed
+		c.access.RUnlock()
+		if !swapped {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *rebindablePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.current().WriteTo(p, addr)
+}
+
+func (c *rebindablePacketConn) Close() error {
+	rebindableAccess.Lock()
+	delete(rebindableConns, c)
+	rebindableAccess.Unlock()
+
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+func (c *rebindablePacketConn) LocalAddr() net.Addr {
+	return c.current().LocalAddr()
+}
+
+func (c *rebindablePacketConn) SetDeadline(t time.Time) error {
+	return c.current().SetDeadline(t)
+}
+
+func (c *rebindablePacketConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *rebindablePacketConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
+
+// NotifyNetworkChanged rebinds the UDP sockets of QUIC based outbounds to the
+// new default network, call it from the ConnectivityManager network callback.
+func NotifyNetworkChanged() {
+	rebindableAccess.Lock()
+	conns := make([]*rebindablePacketConn, 0, len(rebindableConns))
+	for c := range rebindableConns {
+		conns = append(conns, c)
+	}
+	rebindableAccess.Unlock()
+
+	for _, c := range conns {
+		if err := c.rebind(); err != nil {
+			log.Warnf("rebind udp socket failed: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mtuProbeMin     = 576
+	mtuProbeMax     = 1500
+	mtuProbeRetries = 2
+	// IPv4 and UDP headers
+	mtuProbeOverhead = 28
+)
+
+var tcpMaxSegment int
+
+// SetTcpMss clamps the MSS of outbound TCP connections, for networks such as
+// PPPoE or some carriers that silently drop full sized packets. 0 keeps the
+// system default. The MSS option of the SYN packets crossing the TUN is
+// clamped as well.
+func SetTcpMss(mss int32) {
+	tcpMaxSegment = int(mss)
+}
+
+func setTcpMss(fd int) {
+	if mss := tcpMaxSegment; mss > 0 {
+		_ = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss)
+	}
+}
+
+// mssClampDevice clamps the MSS of the TCP SYN packets read from and written
+// to the TUN.
+type mssClampDevice struct {
+	io.ReadWriter
+}
+
+func (d mssClampDevice) Read(p []byte) (int, error) {
+	n, err := d.ReadWriter.Read(p)
+	if n > 0 {
+		clampTcpMss(p[:n])
+	}
+	return n, err
+}
+
+func (d mssClampDevice) Write(p []byte) (int, error) {
+	clampTcpMss(p)
+	return d.ReadWriter.Write(p)
+}
+
+// clampTcpMss lowers the MSS option of a TCP SYN in an IP packet to the
+// configured one, updating the TCP checksum.
+func clampTcpMss(packet []byte) {
+	mss := tcpMaxSegment
+	if mss <= 0 || len(packet) < 1 {
+		return
+	}
+	var tcp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 || packet[9] != unix.IPPROTO_TCP || binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0 {
+			return
+		}
+		headerLength := int(packet[0]&0x0f) * 4
+		if headerLength < 20 || len(packet) < headerLength {
+			return
+		}
+		tcp = packet[headerLength:]
+	case 6:
+		// extension headers are not walked, SYNs rarely carry any
+		if len(packet) < 40 || packet[6] != unix.IPPROTO_TCP {
+			return
+		}
+		tcp = packet[40:]
+	default:
+		return
+	}
+	if len(tcp) < 20 || tcp[13]&0x02 == 0 {
+		return
+	}
+	optionsEnd := int(tcp[12]>>4) * 4
+	if optionsEnd > len(tcp) {
+		return
+	}
+	for i := 20; i < optionsEnd; {
+		kind := tcp[i]
+		if kind == 0 {
+			return
+		}
+		if kind == 1 {
+			i++
+			continue
+		}
+		if i+1 >= optionsEnd || tcp[i+1] < 2 {
+			return
+		}
+		length := int(tcp[i+1])
+		if kind == 2 && length == 4 && i+4 <= optionsEnd {
+			old := binary.BigEndian.Uint16(tcp[i+2:])
+			if int(old) <= mss {
+				return
+			}
+			binary.BigEndian.PutUint16(tcp[i+2:], uint16(mss))
+			oldWord, newWord := old, uint16(mss)
+			if (i+2)%2 == 1 {
+				// a word at an odd offset adds up byte swapped
+				oldWord, newWord = oldWord<<8|oldWord>>8, newWord<<8|newWord>>8
+			}
+			checksum := binary.BigEndian.Uint16(tcp[16:])
+			binary.BigEndian.PutUint16(tcp[16:], updateChecksum(checksum, oldWord, newWord))
+			return
+		}
+		i += length
+	}
+}
+
+// updateChecksum adjusts an internet checksum for a 16 bit word changed from
+// previous to replacement, as in RFC 1624.
+func updateChecksum(checksum uint16, previous uint16, replacement uint16) uint16 {
+	sum := uint32(^checksum) + uint32(^previous) + uint32(replacement)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// ProbePathMtu finds the largest IPv4 packet reaching server ("host:port", a
+// DNS server answering UDP queries) without fragmentation, by sending padded
+// queries with the don't fragment bit set. The result can be used as the TUN
+// MTU or to size the packets of UDP based instances.
+func ProbePathMtu(server string, timeoutMs int32) (int32, error) {
+	options := &socketOptions{}
+	dialer := &net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		if err := options.control(network, address, c); err != nil {
+			return err
+		}
+		var innerErr error
+		err := c.Control(func(fd uintptr) {
+			innerErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		})
+		if err != nil {
+			return err
+		}
+		return innerErr
+	}}
+	conn, err := dialer.DialContext(context.Background(), "udp4", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if !probeMtu(conn, mtuProbeMin, timeout) {
+		return 0, errors.New("server did not answer the minimum sized probe")
+	}
+	low, high := mtuProbeMin, mtuProbeMax
+	for low < high {
+		size := (low + high + 1) / 2
+		if probeMtu(conn, size, timeout) {
+			low = size
+		} else {
+			high = size - 1
+		}
+	}
+	return int32(low), nil
+}
+
+func probeMtu(conn net.Conn, size int, timeout time.Duration) bool {
+	query, err := paddedDnsQuery(size - mtuProbeOverhead)
+	if err != nil {
+		return false
+	}
+	buf := make([]byte, 4096)
+	for i := 0; i < mtuProbeRetries; i++ {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		if _, err = conn.Write(query.packed); err != nil {
+			// EMSGSIZE, larger than a path MTU already known to the kernel
+			return false
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			response := dns.Msg{}
+			if response.Unpack(buf[:n]) == nil && response.Id == query.id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type mtuProbeQuery struct {
+	id     uint16
+	packed []byte
+}
+
+// paddedDnsQuery builds a query of exactly length bytes using EDNS padding.
+func paddedDnsQuery(length int) (*mtuProbeQuery, error) {
+	message := new(dns.Msg)
+	message.SetQuestion(".", dns.TypeNS)
+	message.SetEdns0(4096, false)
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// the padding option has a 4 byte header
+	padding := length - len(packed) - 4
+	if padding < 0 {
+		return nil, errors.New("probe size too small")
+	}
+	opt := message.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+	packed, err = message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return &mtuProbeQuery{id: message.Id, packed: packed}, nil
+}
@@ -0,0 +1,279 @@
+package libcore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+const (
+	naivePaddingFrames  = 8
+	naiveMaxPadding     = 255
+	naivePaddingHeader  = 3
+	naiveMaxPayload     = 0xffff
+	naivePaddingCharset = "!#$()+<>?@[]^`{}"
+)
+
+// naiveInstance is a NaiveProxy client: HTTP/2 CONNECT requests over a TLS
+// session with the handshake of Chrome.
+type naiveInstance struct {
+	*outbound.Base
+	server        string
+	sni           string
+	authorization string
+	transport     *http2.Transport
+
+	access sync.Mutex
+	conn   *http2.ClientConn
+}
+
+func (n *naiveInstance) getClientConn(ctx context.Context) (*http2.ClientConn, error) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	if n.conn != nil && n.conn.CanTakeNewRequest() {
+		return n.conn, nil
+	}
+
+	rawConn, err := dialServer(ctx, "tcp", n.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(rawConn)
+	conn := utls.UClient(rawConn, &utls.Config{ServerName: n.sni}, utls.HelloChrome_Auto)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err = conn.Handshake(); err != nil {
+		_ = rawConn.Close()
+		return nil, errors.WithMessage(err, "tls handshake")
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+		_ = conn.Close()
+		return nil, fmt.Errorf("server negotiated %q instead of h2", protocol)
+	}
+	clientConn, err := n.transport.NewClientConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if n.conn != nil {
+		_ = n.conn.Close()
+	}
+	n.conn = clientConn
+	return clientConn, nil
+}
+
+func (n *naiveInstance) Close() error {
+	n.access.Lock()
+	defer n.access.Unlock()
+	if n.conn != nil {
+		_ = n.conn.Close()
+		n.conn = nil
+	}
+	return nil
+}
+
+// naivePadding is the random value of the padding header, made of characters
+// without a short Huffman code so that the header length is kept.
+func naivePadding() string {
+	length, _ := rand.Int(rand.Reader, big.NewInt(17))
+	padding := make([]byte, 16+length.Int64())
+	for i := range padding {
+		index, _ := rand.Int(rand.Reader, big.NewInt(int64(len(naivePaddingCharset))))
+		padding[i] = naivePaddingCharset[index.Int64()]
+	}
+	return string(padding)
+}
+
+func (n *naiveInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	clientConn, err := n.getClientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	destination := metadata.RemoteAddress()
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: destination},
+		Host:   destination,
+		Header: http.Header{},
+		Body:   reader,
+	}
+	request.Header.Set("Padding", naivePadding())
+	if n.authorization != "" {
+		request.Header.Set("Proxy-Authorization", n.authorization)
+	}
+	response, err := clientConn.RoundTrip(request.WithContext(context.Background()))
+	if err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = writer.Close()
+		_ = response.Body.Close()
+		return nil, fmt.Errorf("naive connect %s: %s", destination, response.Status)
+	}
+	conn := &naiveConn{
+		reader: response.Body,
+		writer: writer,
+		local:  &net.TCPAddr{},
+		remote: &net.TCPAddr{},
+	}
+	if response.Header.Get("Padding") != "" {
+		conn.readPadding = naivePaddingFrames
+		conn.writePadding = naivePaddingFrames
+	}
+	return outbound.NewConn(conn, n), nil
+}
+
+func (n *naiveInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported by the naive instance")
+}
+
+// naiveConn is a CONNECT tunnel. When the server supports it, the first frames
+// in each direction carry their payload length and random padding.
+type naiveConn struct {
+	reader io.ReadCloser
+	writer *io.PipeWriter
+	local  net.Addr
+	remote net.Addr
+
+	// remaining padded frames, pending payload and padding bytes
+	readPadding  int
+	pending      int
+	skip         int
+	writePadding int
+}
+
+func (c *naiveConn) Read(b []byte) (int, error) {
+	for c.pending == 0 && c.readPadding > 0 {
+		var header [naivePaddingHeader]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return 0, err
+		}
+		c.pending = int(binary.BigEndian.Uint16(header[:]))
+		c.skip = int(header[2])
+		c.readPadding--
+		if c.pending == 0 {
+			if err := c.discardPadding(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if c.pending == 0 {
+		return c.reader.Read(b)
+	}
+	if len(b) > c.pending {
+		b = b[:c.pending]
+	}
+	n, err := c.reader.Read(b)
+	c.pending -= n
+	if c.pending == 0 && err == nil {
+		err = c.discardPadding()
+	}
+	return n, err
+}
+
+// discardPadding skips the padding following the payload of a frame.
+func (c *naiveConn) discardPadding() error {
+	if c.skip == 0 {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, c.reader, int64(c.skip))
+	c.skip = 0
+	return err
+}
+
+func (c *naiveConn) Write(b []byte) (int, error) {
+	if c.writePadding == 0 {
+		return c.writer.Write(b)
+	}
+	written := 0
+	for len(b) > 0 && c.writePadding > 0 {
+		chunk := b
+		if len(chunk) > naiveMaxPayload {
+			chunk = chunk[:naiveMaxPayload]
+		}
+		padding, _ := rand.Int(rand.Reader, big.NewInt(naiveMaxPadding+1))
+		frame := make([]byte, naivePaddingHeader, naivePaddingHeader+len(chunk)+int(padding.Int64()))
+		binary.BigEndian.PutUint16(frame, uint16(len(chunk)))
+		frame[2] = byte(padding.Int64())
+		frame = append(frame, chunk...)
+		frame = append(frame, make([]byte, padding.Int64())...)
+		if _, err := c.writer.Write(frame); err != nil {
+			return written, err
+		}
+		c.writePadding--
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	if len(b) == 0 {
+		return written, nil
+	}
+	n, err := c.writer.Write(b)
+	return written + n, err
+}
+
+func (c *naiveConn) Close() error {
+	_ = c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *naiveConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *naiveConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *naiveConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *naiveConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *naiveConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// NewNaiveProxyInstance creates a NaiveProxy instance for https servers, the
+// TLS handshake mimicking Chrome. username and password may be empty.
+func NewNaiveProxyInstance(socksPort int32, server string, port int32, username string, password string, sni string) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password); err != nil {
+		return nil, err
+	}
+	if sni == "" {
+		sni = server
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	out := &naiveInstance{
+		Base:      outbound.NewBase("naive", address, clashC.Http, false),
+		server:    address,
+		sni:       sni,
+		transport: &http2.Transport{},
+	}
+	if username != "" || password != "" {
+		out.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
@@ -0,0 +1,164 @@
+package libcore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const (
+	// nodeMetricsWeight is the weight of a new result in the rolling averages.
+	nodeMetricsWeight = 0.2
+	nodeMetricsDelay  = 5 * time.Second
+)
+
+// NodeMetrics is the history of the tests of a node.
+type NodeMetrics struct {
+	// rolling success rate, from 0 to 1
+	SuccessRate float64 `json:"successRate"`
+	// rolling latency of the successful tests
+	AverageLatencyMs int32 `json:"averageLatencyMs"`
+	// rolling throughput of the health check downloads, 0 if never measured
+	AverageThroughputKbps int32 `json:"averageThroughputKbps,omitempty"`
+	Samples               int32 `json:"samples"`
+	// unix milliseconds
+	UpdatedAt int64 `json:"updatedAt"`
+}
+
+type nodeMetricsStore struct {
+	access  sync.Mutex
+	path    string
+	metrics map[int64]*NodeMetrics
+	saving  bool
+}
+
+var nodeMetrics = &nodeMetricsStore{metrics: map[int64]*NodeMetrics{}}
+
+// SetNodeMetricsPath loads the metrics persisted at path, which is then
+// rewritten shortly after each new result.
+func SetNodeMetricsPath(path string) error {
+	metrics := map[int64]*NodeMetrics{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(content) > 0 {
+		if err = json.Unmarshal(content, &metrics); err != nil {
+			return errors.WithMessage(err, "parse node metrics")
+		}
+	}
+	nodeMetrics.access.Lock()
+	nodeMetrics.path = path
+	nodeMetrics.metrics = metrics
+	nodeMetrics.access.Unlock()
+	return nil
+}
+
+// RecordNodeResult adds the result of a test or connection of the node.
+func RecordNodeResult(nodeId int64, latencyMs int32, success bool) {
+	nodeMetrics.access.Lock()
+	defer nodeMetrics.access.Unlock()
+
+	metrics := nodeMetrics.metrics[nodeId]
+	result := 0.0
+	if success {
+		result = 1
+	}
+	if metrics == nil {
+		metrics = &NodeMetrics{SuccessRate: result}
+		if success {
+			metrics.AverageLatencyMs = latencyMs
+		}
+		nodeMetrics.metrics[nodeId] = metrics
+	} else {
+		metrics.SuccessRate += (result - metrics.SuccessRate) * nodeMetricsWeight
+		if success {
+			if metrics.AverageLatencyMs == 0 {
+				metrics.AverageLatencyMs = latencyMs
+			} else {
+				metrics.AverageLatencyMs += int32(float64(latencyMs-metrics.AverageLatencyMs) * nodeMetricsWeight)
+			}
+		}
+	}
+	metrics.Samples++
+	metrics.UpdatedAt = unixMilli(time.Now())
+	nodeMetrics.scheduleSave()
+}
+
+// GetNodeMetrics returns the metrics of the node, or nil if it was never tested.
+func GetNodeMetrics(nodeId int64) *NodeMetrics {
+	nodeMetrics.access.Lock()
+	defer nodeMetrics.access.Unlock()
+	if metrics := nodeMetrics.metrics[nodeId]; metrics != nil {
+		copied := *metrics
+		return &copied
+	}
+	return nil
+}
+
+// NodeMetricsList returns the metrics of all nodes as a JSON object keyed by
+// node id, to be merged into the profile list.
+func NodeMetricsList() (string, error) {
+	nodeMetrics.access.Lock()
+	defer nodeMetrics.access.Unlock()
+	content, err := json.Marshal(nodeMetrics.metrics)
+	return string(content), err
+}
+
+// RemoveNodeMetrics forgets the history of a deleted node.
+func RemoveNodeMetrics(nodeId int64) {
+	nodeMetrics.access.Lock()
+	defer nodeMetrics.access.Unlock()
+	if _, ok := nodeMetrics.metrics[nodeId]; ok {
+		delete(nodeMetrics.metrics, nodeId)
+		nodeMetrics.scheduleSave()
+	}
+}
+
+func (s *nodeMetricsStore) scheduleSave() {
+	if s.path == "" || s.saving {
+		return
+	}
+	s.saving = true
+	time.AfterFunc(nodeMetricsDelay, s.save)
+}
+
+func (s *nodeMetricsStore) save() {
+	s.access.Lock()
+	s.saving = false
+	path := s.path
+	content, err := json.Marshal(s.metrics)
+	s.access.Unlock()
+	if err != nil {
+		return
+	}
+	// replace the file at once, so that a crash never leaves it truncated
+	temp := path + ".tmp"
+	if err = ioutil.WriteFile(temp, content, 0o644); err == nil {
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		log.Warnf("save node metrics failed: %s", err.Error())
+	}
+}
+
+// SetNodeId makes the url tests of the instance recorded in the metrics of
+// the node.
+func (s *ClashBasedInstance) SetNodeId(nodeId int64) {
+	s.nodeId = nodeId
+}
+
+func (s *ClashBasedInstance) recordUrlTest(latencyMs int32, err error) {
+	if s.nodeId == 0 {
+		return
+	}
+	if err != nil {
+		log.Debugf("node %d url test failed: %s", s.nodeId, err.Error())
+	}
+	RecordNodeResult(s.nodeId, latencyMs, err == nil)
+}
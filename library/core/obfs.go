@@ -0,0 +1,275 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	"github.com/Dreamacro/clash/common/pool"
+	clashC "github.com/Dreamacro/clash/constant"
+)
+
+// httpObfsConn implements the simple-obfs http mode, with support for extra
+// request headers which the clash implementation lacks.
+type httpObfsConn struct {
+	net.Conn
+	host          string
+	port          string
+	headers       map[string]string
+	buf           []byte
+	offset        int
+	firstRequest  bool
+	firstResponse bool
+}
+
+func newHttpObfsConn(conn net.Conn, host string, port string, headers map[string]string) net.Conn {
+	return &httpObfsConn{
+		Conn:          conn,
+		host:          host,
+		port:          port,
+		headers:       headers,
+		firstRequest:  true,
+		firstResponse: true,
+	}
+}
+
+func (c *httpObfsConn) Read(b []byte) (int, error) {
+	if c.buf != nil {
+		n := copy(b, c.buf[c.offset:])
+		c.offset += n
+		if c.offset == len(c.buf) {
+			_ = pool.Put(c.buf)
+			c.buf = nil
+		}
+		return n, nil
+	}
+
+	if c.firstResponse {
+		buf := pool.Get(pool.RelayBufferSize)
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			_ = pool.Put(buf)
+			return 0, err
+		}
+		index := bytes.Index(buf[:n], []byte("\r\n\r\n"))
+		if index == -1 {
+			_ = pool.Put(buf)
+			return 0, io.EOF
+		}
+		c.firstResponse = false
+		length := n - (index + 4)
+		n = copy(b, buf[index+4:n])
+		if length > n {
+			c.buf = buf[:index+4+length]
+			c.offset = index + 4 + n
+		} else {
+			_ = pool.Put(buf)
+		}
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *httpObfsConn) Write(b []byte) (int, error) {
+	if !c.firstRequest {
+		return c.Conn.Write(b)
+	}
+
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	host := expandObfsHost(c.host)
+	if c.port != "80" {
+		host = net.JoinHostPort(host, c.port)
+	}
+
+	request := &bytes.Buffer{}
+	_, _ = fmt.Fprintf(request, "GET / HTTP/1.1\r\nHost: %s\r\n", host)
+	header := http.Header{}
+	header.Set("User-Agent", "curl/7.74.0")
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	for name, value := range c.headers {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		header.Set(name, value)
+	}
+	header.Set("Content-Length", fmt.Sprint(len(b)))
+	_ = header.Write(request)
+	request.WriteString("\r\n")
+	request.Write(b)
+
+	if _, err := c.Conn.Write(request.Bytes()); err != nil {
+		return 0, err
+	}
+	c.firstRequest = false
+	return len(b), nil
+}
+
+type httpObfsShadowsocks struct {
+	*outbound.ShadowSocks
+	host    string
+	port    string
+	headers map[string]string
+}
+
+func (s *httpObfsShadowsocks) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	c, err := dialServer(ctx, "tcp", s.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("%s connect error: %w", s.Addr(), err)
+	}
+	tcpKeepAlive(c)
+
+	sc, err := s.ShadowSocks.StreamConn(newHttpObfsConn(c, s.host, s.port, s.headers), metadata)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return outbound.NewConn(sc, s), nil
+}
+
+// obfsHeaders extracts the "headers" plugin option, with "Host" acting as host override.
+func obfsHeaders(opts map[string]interface{}) map[string]string {
+	raw, ok := opts["headers"].(map[string]interface{})
+	if !ok || len(raw) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(raw))
+	for name, value := range raw {
+		headers[name] = fmt.Sprint(value)
+		if strings.EqualFold(name, "Host") {
+			opts["host"] = headers[name]
+		}
+	}
+	return headers
+}
+
+const defaultObfsHost = "cloudfront.net"
+
+var obfsHostPattern = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9_{}]([a-zA-Z0-9_{}-]*[a-zA-Z0-9_{}])?\.)*[a-zA-Z0-9_{}]([a-zA-Z0-9_{}-]*[a-zA-Z0-9_{}])?$`)
+
+// completeObfsOpts validates the simple-obfs options, filling in the default
+// host when none is given. The SIP003 names obfs and obfs-host are accepted.
+func completeObfsOpts(opts map[string]interface{}) error {
+	// names used by simple-obfs in SIP003 strings
+	if _, ok := opts["mode"]; !ok {
+		if mode, ok := opts["obfs"]; ok {
+			opts["mode"] = mode
+		}
+	}
+	if _, ok := opts["host"]; !ok {
+		if host, ok := opts["obfs-host"]; ok {
+			opts["host"] = host
+		}
+	}
+	mode, _ := opts["mode"].(string)
+	if mode != "http" && mode != "tls" {
+		return fmt.Errorf("unsupported obfs mode %q, expected http or tls", mode)
+	}
+	host, _ := opts["host"].(string)
+	host = strings.TrimSpace(host)
+	if host == "" {
+		host = defaultObfsHost
+	}
+	if strings.Contains(host, "://") || strings.ContainsAny(host, "/ ") {
+		return fmt.Errorf("invalid obfs host %q, expected a bare domain", host)
+	}
+	if !obfsHostPattern.MatchString(host) || strings.Count(host, "{") != strings.Count(host, "{random}") {
+		return fmt.Errorf("invalid obfs host %q", host)
+	}
+	if mode == "tls" || !isObfsHostTemplate(host) {
+		host = expandObfsHost(host)
+	}
+	opts["host"] = host
+	return nil
+}
+
+// isObfsHostTemplate reports whether the host contains a "*." prefix or
+// "{random}" placeholder, which are expanded to a random label per connection.
+func isObfsHostTemplate(host string) bool {
+	return strings.HasPrefix(host, "*.") || strings.Contains(host, "{random}")
+}
+
+func expandObfsHost(host string) string {
+	if strings.HasPrefix(host, "*.") {
+		host = "{random}" + host[1:]
+	}
+	for strings.Contains(host, "{random}") {
+		host = strings.Replace(host, "{random}", randomLabel(8), 1)
+	}
+	return host
+}
+
+func randomLabel(length int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	buf := make([]byte, length)
+	_, _ = rand.Read(buf)
+	for i := range buf {
+		buf[i] = letters[int(buf[i])%len(letters)]
+	}
+	return string(buf)
+}
+
+const defaultV2rayPluginHost = "cloudfront.com"
+
+// completeV2rayPluginOpts maps v2ray-plugin options, as found in SIP003
+// strings where flags such as "tls" have empty values, onto the options of the
+// clash implementation of the websocket mode, also used by the quic mode.
+func completeV2rayPluginOpts(opts map[string]interface{}) error {
+	mode, _ := opts["mode"].(string)
+	switch mode {
+	case "", "websocket", "ws":
+		opts["mode"] = "websocket"
+	case "quic":
+	default:
+		return fmt.Errorf("unsupported v2ray-plugin mode %q", mode)
+	}
+	for _, name := range []string{"tls", "mux", "skip-cert-verify"} {
+		if value, ok := opts[name]; ok {
+			opts[name] = pluginFlag(value)
+		}
+	}
+	if allowInsecure, ok := opts["allowInsecure"]; ok {
+		opts["skip-cert-verify"] = pluginFlag(allowInsecure)
+	}
+	if host, _ := opts["host"].(string); strings.TrimSpace(host) == "" {
+		opts["host"] = defaultV2rayPluginHost
+	}
+	if path, _ := opts["path"].(string); path == "" {
+		opts["path"] = "/"
+	} else if !strings.HasPrefix(path, "/") {
+		opts["path"] = "/" + path
+	}
+	return nil
+}
+
+// pluginFlag reads a boolean plugin option, where an empty value sets the flag
+// and numbers are enabled when positive.
+func pluginFlag(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case float64:
+		return value > 0
+	case string:
+		if value == "" {
+			return true
+		}
+		if number, err := strconv.Atoi(value); err == nil {
+			return number > 0
+		}
+		enabled, _ := strconv.ParseBool(value)
+		return enabled
+	}
+	return value != nil
+}
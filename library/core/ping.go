@@ -0,0 +1,118 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type PingHop struct {
+	Name    string
+	Address string
+	// average of the successful probes, -1 if all failed
+	LatencyMs int32
+	Sent      int32
+	Received  int32
+	Error     string
+}
+
+type PingResult struct {
+	hops []*PingHop
+}
+
+func (r *PingResult) HopCount() int32 {
+	return int32(len(r.hops))
+}
+
+// Hop returns the hop at index, nil if out of range.
+func (r *PingResult) Hop(index int32) *PingHop {
+	if index < 0 || int(index) >= len(r.hops) {
+		return nil
+	}
+	return r.hops[index]
+}
+
+// PingHost measures the latency to host, hop by hop: the device to the server
+// of the instance, then the server to host, derived from TCP connects to port
+// through the instance since ICMP can not be proxied. With a nil instance the
+// host is pinged directly, over ICMP when possible.
+func PingHost(instance *ClashBasedInstance, host string, port int32, count int32, timeoutMs int32) (*PingResult, error) {
+	if count <= 0 {
+		count = 1
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	result := &PingResult{}
+
+	if instance == nil {
+		hop := pingHop("host", host, count, func() (time.Duration, error) {
+			ms, err := IcmpPing(host, timeoutMs)
+			if err == nil {
+				return time.Duration(ms) * time.Millisecond, nil
+			}
+			return tcpPing(timeout, target, dialProtected)
+		})
+		result.hops = append(result.hops, hop)
+		return result, nil
+	}
+
+	server := instance.out.Addr()
+	var serverHop *PingHop
+	if server != "" {
+		serverHop = pingHop("server", server, count, func() (time.Duration, error) {
+			return tcpPing(timeout, server, dialProtected)
+		})
+		result.hops = append(result.hops, serverHop)
+	}
+
+	hop := pingHop("host", target, count, func() (time.Duration, error) {
+		return tcpPing(timeout, target, instance.DialContext)
+	})
+	if serverHop != nil && serverHop.LatencyMs > 0 && hop.LatencyMs > 0 {
+		// a proxied connect costs the round trip to the server on top
+		hop.LatencyMs -= serverHop.LatencyMs
+		if hop.LatencyMs < 0 {
+			hop.LatencyMs = 0
+		}
+	}
+	result.hops = append(result.hops, hop)
+	if hop.Received == 0 {
+		return result, errors.New(hop.Error)
+	}
+	return result, nil
+}
+
+func pingHop(name string, address string, count int32, probe func() (time.Duration, error)) *PingHop {
+	hop := &PingHop{Name: name, Address: address, LatencyMs: -1}
+	var total time.Duration
+	for i := int32(0); i < count; i++ {
+		hop.Sent++
+		latency, err := probe()
+		if err != nil {
+			hop.Error = err.Error()
+			continue
+		}
+		hop.Received++
+		total += latency
+	}
+	if hop.Received > 0 {
+		hop.LatencyMs = int32((total / time.Duration(hop.Received)).Milliseconds())
+	}
+	return hop
+}
+
+func tcpPing(timeout time.Duration, address string, dial func(ctx context.Context, network, address string) (net.Conn, error)) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	_ = conn.Close()
+	return latency, nil
+}
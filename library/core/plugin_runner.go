@@ -0,0 +1,318 @@
+package libcore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	"github.com/Dreamacro/clash/component/dialer"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const (
+	pluginStartTimeout  = 5 * time.Second
+	pluginStartAttempts = 3
+)
+
+var (
+	pluginWorkingDir string
+	pluginVpnMode    bool
+)
+
+// SetPluginWorkingDir sets the directory external plugins run in. In VPN
+// mode plugins get the -V flag and protect their sockets through the
+// protect_path socket of that directory, as with shadowsocks-android.
+func SetPluginWorkingDir(dir string, vpnMode bool) {
+	pluginWorkingDir = dir
+	pluginVpnMode = vpnMode
+}
+
+// sip003Options encodes plugin options as a SIP003 string, options with empty
+// or true values being written as flags.
+func sip003Options(opts map[string]interface{}) string {
+	var names []string
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var items []string
+	escaper := strings.NewReplacer(`\`, `\\`, `=`, `\=`, `;`, `\;`)
+	for _, name := range names {
+		value := opts[name]
+		if value == nil || value == true || value == "" {
+			items = append(items, escaper.Replace(name))
+			continue
+		}
+		items = append(items, escaper.Replace(name)+"="+escaper.Replace(fmt.Sprint(value)))
+	}
+	return strings.Join(items, ";")
+}
+
+// parsePluginOpts reads plugin options given either as a SIP003 string such as
+// "obfs=http;obfs-host=example.com" or as a JSON object. Options without a
+// value are set to the empty string, as flags.
+func parsePluginOpts(pluginOpts string) (map[string]interface{}, error) {
+	opts := map[string]interface{}{}
+	pluginOpts = strings.TrimSpace(pluginOpts)
+	if strings.HasPrefix(pluginOpts, "{") {
+		if err := json.Unmarshal([]byte(pluginOpts), &opts); err != nil {
+			return nil, errors.WithMessage(err, "parse plugin options")
+		}
+		return opts, nil
+	}
+	var name, value strings.Builder
+	current := &name
+	hasValue := false
+	escaped := false
+	flush := func() error {
+		if name.Len() == 0 {
+			if hasValue {
+				return fmt.Errorf("invalid plugin options %q: empty option name", pluginOpts)
+			}
+			return nil
+		}
+		opts[strings.TrimSpace(name.String())] = value.String()
+		name.Reset()
+		value.Reset()
+		current = &name
+		hasValue = false
+		return nil
+	}
+	for _, c := range pluginOpts {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '=' && !hasValue:
+			current = &value
+			hasValue = true
+		case c == ';':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("invalid plugin options %q: trailing backslash", pluginOpts)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// pluginProcess runs a SIP003 plugin binary listening on a local port and
+// relaying to the server.
+type pluginProcess struct {
+	path    string
+	options string
+	remote  string
+
+	access sync.Mutex
+	local  string
+	cmd    *exec.Cmd
+	exited chan struct{}
+	closed bool
+}
+
+// ensureStarted starts the plugin unless it is running, and returns the local
+// address it accepts connections on. SIP003 hands the plugin a port number,
+// so a port is bound and released right before the plugin starts, and another
+// one is picked should the plugin fail to listen on it.
+func (p *pluginProcess) ensureStarted(ctx context.Context) (string, error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.closed {
+		return "", errors.New("plugin closed")
+	}
+	if p.exited != nil {
+		select {
+		case <-p.exited:
+		default:
+			return p.local, nil
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt < pluginStartAttempts && ctx.Err() == nil; attempt++ {
+		if err = p.start(ctx); err == nil {
+			return p.local, nil
+		}
+		log.Warnf("[Plugin] %s", err.Error())
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return "", err
+}
+
+// start runs the plugin on a free local port and waits for it to listen.
+func (p *pluginProcess) start(ctx context.Context) error {
+	host, port, err := net.SplitHostPort(p.remote)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.WithMessage(err, "bind plugin port")
+	}
+	local := listener.Addr().String()
+	localPort := listener.Addr().(*net.TCPAddr).Port
+	var args []string
+	if pluginVpnMode {
+		args = append(args, "-V")
+	}
+	cmd := exec.Command(p.path, args...)
+	cmd.Dir = pluginWorkingDir
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+host,
+		"SS_REMOTE_PORT="+port,
+		"SS_LOCAL_HOST=127.0.0.1",
+		"SS_LOCAL_PORT="+strconv.Itoa(localPort),
+		"SS_PLUGIN_OPTIONS="+p.options,
+	)
+	output, err := cmd.StderrPipe()
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	cmd.Stdout = cmd.Stderr
+	_ = listener.Close()
+	if err = cmd.Start(); err != nil {
+		return errors.WithMessage(err, "start plugin")
+	}
+	exited := make(chan struct{})
+	name := filepath.Base(p.path)
+	go p.logOutput(name, output)
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			log.Warnf("[Plugin] %s exited: %s", name, err.Error())
+		}
+		close(exited)
+	}()
+	p.local = local
+	p.cmd = cmd
+	p.exited = exited
+
+	ctx, cancel := context.WithTimeout(ctx, pluginStartTimeout)
+	defer cancel()
+	for {
+		conn, err := net.DialTimeout("tcp", local, 100*time.Millisecond)
+		if err == nil {
+			_ = conn.Close()
+			return nil
+		}
+		select {
+		case <-exited:
+			return fmt.Errorf("plugin %s exited on start", name)
+		case <-ctx.Done():
+			_ = cmd.Process.Kill()
+			<-exited
+			return fmt.Errorf("plugin %s did not listen on %s", name, local)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func (p *pluginProcess) logOutput(name string, output io.Reader) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		log.Debugf("[Plugin] %s: %s", name, scanner.Text())
+	}
+}
+
+func (p *pluginProcess) Close() error {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.closed = true
+	if p.cmd == nil {
+		return nil
+	}
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+	_ = p.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-p.exited:
+	case <-time.After(time.Second):
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+	return nil
+}
+
+// pluginShadowsocks is a Shadowsocks instance connecting through an external
+// plugin, started on the first connection and again whenever it exits. Plugins
+// only relay TCP.
+type pluginShadowsocks struct {
+	*outbound.ShadowSocks
+	plugin *pluginProcess
+}
+
+func (s *pluginShadowsocks) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	local, err := s.plugin.ensureStarted(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialer.DialContext(ctx, "tcp", local)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(c)
+	conn, err := s.ShadowSocks.StreamConn(c, metadata)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return outbound.NewConn(conn, s), nil
+}
+
+func (s *pluginShadowsocks) Close() error {
+	return s.plugin.Close()
+}
+
+// newPluginShadowsocks creates a Shadowsocks instance using the SIP003 plugin
+// binary at path, connections going to the local port of the plugin.
+func newPluginShadowsocks(server string, port int32, password string, cipher string, path string, options string) (*pluginShadowsocks, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.WithMessage(err, "plugin binary")
+	}
+	out, err := outbound.NewShadowSocks(outbound.ShadowSocksOption{
+		Server:   server,
+		Port:     int(port),
+		Password: password,
+		Cipher:   cipher,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pluginShadowsocks{
+		ShadowSocks: out,
+		plugin: &pluginProcess{
+			path:    path,
+			options: options,
+			remote:  net.JoinHostPort(server, strconv.Itoa(int(port))),
+		},
+	}, nil
+}
@@ -0,0 +1,51 @@
+package libcore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePluginOpts(t *testing.T) {
+	tests := []struct {
+		opts string
+		want map[string]interface{}
+	}{
+		{"", map[string]interface{}{}},
+		{"obfs=http;obfs-host=example.com", map[string]interface{}{"obfs": "http", "obfs-host": "example.com"}},
+		{"tls;host=example.com;", map[string]interface{}{"tls": "", "host": "example.com"}},
+		{`path=/a\;b;key=x\=y`, map[string]interface{}{"path": "/a;b", "key": "x=y"}},
+		{"a=b=c", map[string]interface{}{"a": "b=c"}},
+		{`{"mode":"websocket","mux":4}`, map[string]interface{}{"mode": "websocket", "mux": float64(4)}},
+	}
+	for _, test := range tests {
+		opts, err := parsePluginOpts(test.opts)
+		if err != nil {
+			t.Errorf("%q: %v", test.opts, err)
+			continue
+		}
+		if !reflect.DeepEqual(opts, test.want) {
+			t.Errorf("%q: got %v, want %v", test.opts, opts, test.want)
+		}
+	}
+	for _, opts := range []string{"=value", `host=example.com\`, `{"mode":`} {
+		if _, err := parsePluginOpts(opts); err == nil {
+			t.Errorf("%q accepted", opts)
+		}
+	}
+}
+
+func TestSip003Options(t *testing.T) {
+	opts := map[string]interface{}{"path": "/a;b", "tls": true, "mux": float64(4), "host": ""}
+	encoded := sip003Options(opts)
+	if want := `host;mux=4;path=/a\;b;tls`; encoded != want {
+		t.Fatalf("got %q, want %q", encoded, want)
+	}
+	decoded, err := parsePluginOpts(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"path": "/a;b", "tls": "", "mux": "4", "host": ""}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("got %v, want %v", decoded, want)
+	}
+}
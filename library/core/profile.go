@@ -0,0 +1,231 @@
+package libcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const validateConcurrency = 8
+
+// profile is a JSON profile object, with its protocol in the "type" field and
+// the other fields named after the parameters of the instance constructors.
+type profile map[string]interface{}
+
+func (p profile) string(key string) string {
+	value, _ := p[key].(string)
+	return value
+}
+
+func (p profile) int32(key string) int32 {
+	value, _ := p[key].(float64)
+	return int32(value)
+}
+
+func (p profile) bool(key string) bool {
+	value, _ := p[key].(bool)
+	return value
+}
+
+// boolOr is bool with a default for when the key is missing.
+func (p profile) boolOr(key string, defaultValue bool) bool {
+	if value, ok := p[key].(bool); ok {
+		return value
+	}
+	return defaultValue
+}
+
+// profileConstructors builds a ClashBasedInstance from a profile, by type.
+var profileConstructors = map[string]func(socksPort int32, p profile) (*ClashBasedInstance, error){
+	"shadowsocks": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		pluginOpts := p.string("pluginOpts")
+		if pluginOpts == "" {
+			pluginOpts = "{}"
+		}
+		return NewShadowsocksInstance(socksPort, p.string("server"), p.int32("port"), p.string("password"), p.string("cipher"), p.string("plugin"), pluginOpts, p.boolOr("udp", false))
+	},
+	"shadowsocksr": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewShadowsocksRInstance(socksPort, p.string("server"), p.int32("port"), p.string("password"), p.string("cipher"), p.string("obfs"), p.string("obfsParam"), p.string("protocol"), p.string("protocolParam"), p.boolOr("udp", true))
+	},
+	"snell": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewSnellInstance(socksPort, p.string("server"), p.int32("port"), p.string("psk"), p.string("obfsMode"), p.string("obfsHost"), p.int32("version"))
+	},
+	"socks4": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewSocks4To5Instance(socksPort, p.string("server"), p.int32("port"), p.string("username"), p.bool("socks4a"))
+	},
+	"trojan": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewTrojanInstance(socksPort, p.string("server"), p.int32("port"), p.string("password"), p.string("sni"), p.bool("skipCertVerify"), p.string("alpn"), p.string("network"), p.string("wsPath"), p.string("wsHost"), p.string("grpcServiceName"), p.string("clientCert"), p.string("clientKey"))
+	},
+	"trojan-go": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewTrojanGoInstance(socksPort, p.string("server"), p.int32("port"), p.string("password"), p.string("sni"), p.bool("skipCertVerify"), p.string("wsPath"), p.string("wsHost"), p.string("ssMethod"), p.string("ssPassword"))
+	},
+	"vmess": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewVMessInstance(socksPort, p.string("server"), p.int32("port"), p.string("uuid"), p.int32("alterId"), p.string("security"), p.string("network"), p.bool("tls"), p.string("sni"), p.bool("skipCertVerify"), p.string("path"), p.string("host"), p.string("grpcServiceName"))
+	},
+	"hysteria": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewHysteriaInstance(socksPort, p.string("server"), p.int32("port"), p.string("auth"), p.string("obfs"), p.int32("upMbps"), p.int32("downMbps"), p.string("alpn"), p.string("sni"), p.bool("skipCertVerify"))
+	},
+	"hysteria2": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewHysteria2Instance(socksPort, p.string("server"), p.int32("port"), p.string("password"), p.string("obfsPassword"), p.int32("upMbps"), p.int32("downMbps"), p.string("sni"), p.bool("skipCertVerify"))
+	},
+	"vless": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewVLESSInstance(socksPort, p.string("server"), p.int32("port"), p.string("uuid"), p.string("flow"), p.string("security"), p.string("sni"), p.bool("skipCertVerify"), p.string("network"), p.string("path"), p.string("host"), p.string("serviceName"), p.string("clientCert"), p.string("clientKey"))
+	},
+	"tuic": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewTUICInstance(socksPort, p.string("server"), p.int32("port"), p.string("uuid"), p.string("password"), p.string("congestion"), p.string("udpRelayMode"), p.string("alpn"), p.string("sni"), p.bool("skipCertVerify"))
+	},
+	"wireguard": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewWireGuardInstance(socksPort, p.string("localAddress"), p.string("privateKey"), p.string("peerPublicKey"), p.string("presharedKey"), p.string("endpoint"), p.string("allowedIPs"), p.int32("mtu"), p.int32("persistentKeepalive"))
+	},
+	"anytls": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewAnyTLSInstance(socksPort, p.string("server"), p.int32("port"), p.string("password"), p.string("sni"), p.bool("skipCertVerify"), p.string("paddingScheme"))
+	},
+	"ssh": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewSSHInstance(socksPort, p.string("server"), p.int32("port"), p.string("user"), p.string("password"), p.string("privateKey"), p.string("privateKeyPassphrase"), p.string("hostKeys"))
+	},
+	"naive": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewNaiveProxyInstance(socksPort, p.string("server"), p.int32("port"), p.string("username"), p.string("password"), p.string("sni"))
+	},
+	"brook": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewBrookInstance(socksPort, p.string("server"), p.int32("port"), p.string("password"), p.string("wsPath"), p.bool("tls"), p.string("sni"), p.bool("skipCertVerify"))
+	},
+	"http": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewHTTPOutboundInstance(socksPort, p.string("server"), p.int32("port"), p.string("username"), p.string("password"), p.bool("tls"), p.string("sni"), p.bool("skipCertVerify"))
+	},
+	"socks5": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewSocksOutboundInstance(socksPort, p.string("server"), p.int32("port"), p.string("username"), p.string("password"), p.bool("udp"))
+	},
+	"direct": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewDirectInstance(socksPort, p.string("iface"), p.int32("ipv6Strategy"))
+	},
+	"block": func(socksPort int32, p profile) (*ClashBasedInstance, error) {
+		return NewBlockInstance(socksPort)
+	},
+}
+
+// xrayProfileConfigs builds the Xray config of profiles run by a V2RayInstance.
+var xrayProfileConfigs = map[string]func(p profile) (string, error){
+	"v2ray": func(p profile) (string, error) {
+		return p.string("config"), nil
+	},
+}
+
+func newProfileInstance(socksPort int32, p profile) (*ClashBasedInstance, error) {
+	profileType := p.string("type")
+	constructor, ok := profileConstructors[profileType]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile type %q", profileType)
+	}
+	return constructor(socksPort, p)
+}
+
+// validateProfile builds the profile without starting it. Profiles of type
+// "v2ray" hold a V2Ray JSON config in the "config" field.
+func validateProfile(p profile) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid profile: %v", r)
+		}
+	}()
+	if configOf, ok := xrayProfileConfigs[p.string("type")]; ok {
+		config, err := configOf(p)
+		if err != nil {
+			return err
+		}
+		return NewV2rayInstance().LoadConfig(config, true)
+	}
+	instance, err := newProfileInstance(0, p)
+	if err != nil {
+		return err
+	}
+	return instance.Close()
+}
+
+// ValidateProfiles builds every profile of a JSON array in parallel, without
+// starting any listener, and returns a JSON array of the error messages, empty
+// for valid profiles, in the same order.
+func ValidateProfiles(profiles string) (string, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(profiles), &list); err != nil {
+		return "", errors.WithMessage(err, "parse profiles")
+	}
+
+	results := make([]string, len(list))
+	indexes := make(chan int)
+	var wait sync.WaitGroup
+	for i := 0; i < validateConcurrency && i < len(list); i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for index := range indexes {
+				var p profile
+				if err := json.Unmarshal(list[index], &p); err != nil {
+					results[index] = err.Error()
+					continue
+				}
+				if err := validateProfile(p); err != nil {
+					results[index] = err.Error()
+				}
+			}
+		}()
+	}
+	for i := range list {
+		indexes <- i
+	}
+	close(indexes)
+	wait.Wait()
+
+	content, err := json.Marshal(results)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// sniProfileTypes are the profile types with a TLS server name in "sni".
+var sniProfileTypes = map[string]bool{
+	"trojan": true, "trojan-go": true, "vmess": true, "vless": true, "hysteria": true, "hysteria2": true, "tuic": true,
+	"anytls": true, "naive": true, "brook": true, "http": true,
+}
+
+// CloneProfile returns the JSON profile base with the fields of the JSON object
+// overrides replaced, null removing a field, such as another port, SNI or
+// server. When the server is changed, as for another entry IP of a CDN fronted
+// node, the former server domain is kept as the SNI if none was set. The
+// clone is validated before being returned.
+func CloneProfile(base string, overrides string) (string, error) {
+	var p, changes profile
+	if err := json.Unmarshal([]byte(base), &p); err != nil {
+		return "", errors.WithMessage(err, "parse base profile")
+	}
+	if err := json.Unmarshal([]byte(overrides), &changes); err != nil {
+		return "", errors.WithMessage(err, "parse overrides")
+	}
+	if profileType, ok := changes["type"]; ok && profileType != p["type"] {
+		return "", errors.New("the profile type cannot be overridden")
+	}
+	server := p.string("server")
+	if _, ok := changes["server"]; ok && sniProfileTypes[p.string("type")] && p.string("sni") == "" && server != "" && net.ParseIP(server) == nil {
+		if _, ok = changes["sni"]; !ok {
+			changes["sni"] = server
+		}
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(p, key)
+		} else {
+			p[key] = value
+		}
+	}
+	if err := validateProfile(p); err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,66 @@
+package libcore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCloneProfile(t *testing.T) {
+	tests := []struct {
+		base      string
+		overrides string
+		want      map[string]interface{}
+	}{
+		{
+			`{"type":"http","server":"cdn.example.com","port":443,"tls":true}`,
+			`{"server":"1.2.3.4"}`,
+			map[string]interface{}{"type": "http", "server": "1.2.3.4", "port": float64(443), "tls": true, "sni": "cdn.example.com"},
+		},
+		{
+			`{"type":"http","server":"cdn.example.com","port":443,"sni":"front.example.com"}`,
+			`{"server":"1.2.3.4","port":8443}`,
+			map[string]interface{}{"type": "http", "server": "1.2.3.4", "port": float64(8443), "sni": "front.example.com"},
+		},
+		{
+			`{"type":"http","server":"cdn.example.com","port":443}`,
+			`{"server":"1.2.3.4","sni":null}`,
+			map[string]interface{}{"type": "http", "server": "1.2.3.4", "port": float64(443)},
+		},
+		{
+			`{"type":"http","server":"5.6.7.8","port":443}`,
+			`{"server":"1.2.3.4"}`,
+			map[string]interface{}{"type": "http", "server": "1.2.3.4", "port": float64(443)},
+		},
+		{
+			`{"type":"socks5","server":"proxy.example.com","port":1080,"username":"user"}`,
+			`{"server":"1.2.3.4","username":null}`,
+			map[string]interface{}{"type": "socks5", "server": "1.2.3.4", "port": float64(1080)},
+		},
+	}
+	for _, test := range tests {
+		clone, err := CloneProfile(test.base, test.overrides)
+		if err != nil {
+			t.Errorf("%s + %s: %v", test.base, test.overrides, err)
+			continue
+		}
+		var got map[string]interface{}
+		if err = json.Unmarshal([]byte(clone), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s + %s: got %s", test.base, test.overrides, clone)
+		}
+	}
+
+	for _, test := range []struct{ base, overrides string }{
+		{`{"type":"http","server":"1.2.3.4","port":80}`, `{"type":"socks5"}`},
+		{`{"type":"http","server":"1.2.3.4","port":80}`, `not json`},
+		{`not json`, `{}`},
+		{`{"type":"unknown"}`, `{}`},
+	} {
+		if _, err := CloneProfile(test.base, test.overrides); err == nil {
+			t.Errorf("%s + %s: accepted", test.base, test.overrides)
+		}
+	}
+}
@@ -16,9 +16,12 @@ type Protector interface {
 	Protect(fd int32) bool
 }
 
-func SetProtector(protector Protector) {
+var protector Protector
+
+func SetProtector(p Protector) {
+	protector = p
 	internet.UseAlternativeSystemDialer(protectedDialer{
-		protector: protector,
+		protector: p,
 		resolver:  &net.Resolver{PreferGo: false},
 	})
 }
@@ -74,6 +77,10 @@ func (dialer protectedDialer) Dial(ctx context.Context, source net.Address, dest
 	if !dialer.protector.Protect(int32(fd)) {
 		return nil, errors.New("protect failed")
 	}
+	setSocketBuffer(fd, socketSendBuffer, socketReceiveBuffer)
+	if destination.Network == net.Network_TCP {
+		setTcpMss(fd)
+	}
 
 	socketAddress := &unix.SockaddrInet6{
 		Port: portNum,
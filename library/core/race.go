@@ -0,0 +1,77 @@
+package libcore
+
+import (
+	"context"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+)
+
+// raceInstance dials every member concurrently and keeps the first connection
+// established, closing the others.
+type raceInstance struct {
+	*outbound.Base
+	members []clashC.ProxyAdapter
+}
+
+type raceResult struct {
+	conn clashC.Conn
+	err  error
+}
+
+func (r *raceInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan raceResult, len(r.members))
+	for _, member := range r.members {
+		member := member
+		go func() {
+			conn, err := member.DialContext(ctx, metadata)
+			results <- raceResult{conn, err}
+		}()
+	}
+
+	var lastErr error
+	for i := range r.members {
+		result := <-results
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		cancel()
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if loser := <-results; loser.conn != nil {
+					_ = loser.conn.Close()
+				}
+			}
+		}(len(r.members) - i - 1)
+		return result.conn, nil
+	}
+	cancel()
+	return nil, errors.WithMessage(lastErr, "all members failed")
+}
+
+func (r *raceInstance) DialUDP(metadata *clashC.Metadata) (clashC.PacketConn, error) {
+	for _, member := range r.members {
+		if member.SupportUDP() {
+			return member.DialUDP(metadata)
+		}
+	}
+	return nil, errors.New("no member supports udp")
+}
+
+// NewRaceInstance creates an experimental group dialing each connection through
+// both members at once, trading bandwidth for lower tail latency on unstable
+// nodes. UDP goes through the first member supporting it. The members do not
+// need to be started.
+func NewRaceInstance(socksPort int32, first *ClashBasedInstance, second *ClashBasedInstance) (*ClashBasedInstance, error) {
+	if first == nil || second == nil {
+		return nil, errors.New("race group needs two members")
+	}
+	out := &raceInstance{
+		Base:    outbound.NewBase("race", "", clashC.Direct, first.out.SupportUDP() || second.out.SupportUDP()),
+		members: []clashC.ProxyAdapter{first.out, second.out},
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
@@ -0,0 +1,82 @@
+package libcore
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// RejectModeReset resets rejected connections and answers DNS with NXDOMAIN.
+	RejectModeReset int32 = iota
+	// RejectModeDrop silently discards rejected traffic.
+	RejectModeDrop
+	// RejectModeHttp returns a 403 page for plaintext HTTP, other connections are reset.
+	RejectModeHttp
+	// RejectModeZeroAddress answers DNS with 0.0.0.0 / ::, connections are reset.
+	RejectModeZeroAddress
+)
+
+// rejectDropTimeout bounds how long a dropped connection is held open.
+const rejectDropTimeout = 30 * time.Second
+
+var rejectMode = RejectModeReset
+
+// SetRejectMode sets the mode of the blocking rules without one of their own.
+func SetRejectMode(mode int32) {
+	atomic.StoreInt32(&rejectMode, mode)
+}
+
+const rejectHttpResponse = "HTTP/1.1 403 Forbidden\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Length: 9\r\n" +
+	"Connection: close\r\n" +
+	"\r\n" +
+	"Forbidden"
+
+// rejectConn closes a rejected connection according to mode. In drop mode it
+// blocks until the peer gives up, or for up to rejectDropTimeout.
+func rejectConn(conn net.Conn, port string, mode int32) {
+	switch mode {
+	case RejectModeDrop:
+		_ = conn.SetReadDeadline(time.Now().Add(rejectDropTimeout))
+		_, _ = io.Copy(io.Discard, conn)
+	case RejectModeHttp:
+		if port == "80" {
+			_, _ = conn.Write([]byte(rejectHttpResponse))
+			break
+		}
+		fallthrough
+	default:
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.SetLinger(0)
+		}
+	}
+	_ = conn.Close()
+}
+
+// rejectDnsResponse builds the reply for a query rejected in mode, or nil if
+// the query should be dropped.
+func rejectDnsResponse(query *dns.Msg, mode int32) *dns.Msg {
+	response := new(dns.Msg)
+	switch mode {
+	case RejectModeDrop:
+		return nil
+	case RejectModeZeroAddress:
+		response.SetReply(query)
+		question := query.Question[0]
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch question.Qtype {
+		case dns.TypeA:
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: net.IPv6zero})
+		}
+	default:
+		response.SetRcode(query, dns.RcodeNameError)
+	}
+	return response
+}
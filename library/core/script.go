@@ -0,0 +1,136 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+	"go.starlark.net/starlark"
+)
+
+const scriptMaxSteps = 100000
+
+// scriptInstance picks the outbound of each connection by calling the route
+// function of a Starlark script with the connection metadata.
+type scriptInstance struct {
+	*outbound.Base
+	route     starlark.Callable
+	socksPort int32
+
+	access  sync.RWMutex
+	members map[string]clashC.ProxyAdapter
+}
+
+// NewScriptInstance creates an instance routing with a Starlark script, which
+// must define route(conn) returning the name of an outbound added with
+// AddScriptOutbound, "DIRECT" or "REJECT". conn is a dict with the domain, ip,
+// port, network ("tcp" or "udp"), source and uid (-1 if unknown) of the
+// connection.
+func NewScriptInstance(socksPort int32, script string) (*ClashBasedInstance, error) {
+	thread := &starlark.Thread{Name: "load"}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	globals, err := starlark.ExecFile(thread, "route.star", script, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "load script")
+	}
+	globals.Freeze()
+	route, ok := globals["route"].(starlark.Callable)
+	if !ok {
+		return nil, errors.New("script does not define a route function")
+	}
+
+	out := &scriptInstance{
+		Base:      outbound.NewBase("script", "", clashC.Direct, true),
+		route:     route,
+		socksPort: socksPort,
+		members: map[string]clashC.ProxyAdapter{
+			"DIRECT": &directInstance{
+				Base:    outbound.NewBase("DIRECT", "", clashC.Direct, true),
+				options: &socketOptions{},
+			},
+			"REJECT": outbound.NewReject(),
+		},
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
+
+// AddScriptOutbound makes member available to the script under name. The
+// member does not need to be started.
+func (s *ClashBasedInstance) AddScriptOutbound(name string, member *ClashBasedInstance) error {
+	script, ok := s.out.(*scriptInstance)
+	if !ok {
+		return errors.New("not a script instance")
+	}
+	script.access.Lock()
+	script.members[name] = member.out
+	script.access.Unlock()
+	return nil
+}
+
+func (r *scriptInstance) pick(metadata *clashC.Metadata) (clashC.ProxyAdapter, error) {
+	uid := int32(-1)
+	if dumper := uidDumper; dumper != nil && metadata.SrcIP != nil {
+		srcPort, _ := strconv.Atoi(metadata.SrcPort)
+		if u, err := dumper.DumpUid(metadata.SrcIP.To4() == nil, metadata.NetWork == clashC.UDP, metadata.SrcIP.String(), int32(srcPort), "127.0.0.1", r.socksPort); err == nil {
+			uid = u
+		}
+	}
+	port, _ := strconv.Atoi(metadata.DstPort)
+	var ip, source string
+	if metadata.DstIP != nil {
+		ip = metadata.DstIP.String()
+	}
+	if metadata.SrcIP != nil {
+		source = metadata.SrcIP.String()
+	}
+
+	conn := starlark.NewDict(6)
+	_ = conn.SetKey(starlark.String("domain"), starlark.String(metadata.Host))
+	_ = conn.SetKey(starlark.String("ip"), starlark.String(ip))
+	_ = conn.SetKey(starlark.String("port"), starlark.MakeInt(port))
+	_ = conn.SetKey(starlark.String("network"), starlark.String(metadata.NetWork.String()))
+	_ = conn.SetKey(starlark.String("source"), starlark.String(source))
+	_ = conn.SetKey(starlark.String("uid"), starlark.MakeInt(int(uid)))
+
+	thread := &starlark.Thread{Name: "route"}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	result, err := starlark.Call(thread, r.route, starlark.Tuple{conn}, nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "run script")
+	}
+	name, ok := starlark.AsString(result)
+	if !ok {
+		return nil, fmt.Errorf("script returned %s instead of an outbound name", result.Type())
+	}
+
+	r.access.RLock()
+	defer r.access.RUnlock()
+	member, ok := r.members[name]
+	if !ok {
+		return nil, fmt.Errorf("script returned unknown outbound %s", name)
+	}
+	return member, nil
+}
+
+func (r *scriptInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	member, err := r.pick(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return member.DialContext(ctx, metadata)
+}
+
+func (r *scriptInstance) DialUDP(metadata *clashC.Metadata) (clashC.PacketConn, error) {
+	member, err := r.pick(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if !member.SupportUDP() {
+		return nil, fmt.Errorf("outbound %s does not support udp", member.Name())
+	}
+	return member.DialUDP(metadata)
+}
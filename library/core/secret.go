@@ -0,0 +1,98 @@
+package libcore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const secretPrefix = "enc:v1:"
+
+var (
+	secretAccess  sync.RWMutex
+	secretKey     []byte
+	secretPattern = regexp.MustCompile(`enc:v1:[A-Za-z0-9_-]+`)
+)
+
+// SetSecretKey sets the 256-bit key, provided by the Android Keystore layer,
+// used to encrypt and decrypt profile secrets.
+func SetSecretKey(key []byte) error {
+	if len(key) != 32 {
+		return errors.New("secret key must be 32 bytes")
+	}
+	secretAccess.Lock()
+	secretKey = append([]byte(nil), key...)
+	secretAccess.Unlock()
+	return nil
+}
+
+func EncryptSecret(plaintext string) (string, error) {
+	secretAccess.RLock()
+	key := secretKey
+	secretAccess.RUnlock()
+	if key == nil {
+		return "", errors.New("secret key not set")
+	}
+	sealed, err := aesGcmSeal(key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret decrypts a value returned by EncryptSecret, other values are
+// returned unchanged.
+func DecryptSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	secretAccess.RLock()
+	key := secretKey
+	secretAccess.RUnlock()
+	if key == nil {
+		return "", errors.New("secret key not set")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value[len(secretPrefix):])
+	if err != nil {
+		return "", errors.WithMessage(err, "decode secret")
+	}
+	plaintext, err := aesGcmOpen(key, sealed)
+	if err != nil {
+		return "", errors.New("decrypt secret failed, the key may have changed")
+	}
+	return string(plaintext), nil
+}
+
+// decryptSecrets decrypts each value in place.
+func decryptSecrets(values ...*string) error {
+	for _, value := range values {
+		plaintext, err := DecryptSecret(*value)
+		if err != nil {
+			return err
+		}
+		*value = plaintext
+	}
+	return nil
+}
+
+// decryptConfigSecrets replaces encrypted secrets embedded in a JSON config.
+func decryptConfigSecrets(config string) (string, error) {
+	if !strings.Contains(config, secretPrefix) {
+		return config, nil
+	}
+	var decryptErr error
+	config = secretPattern.ReplaceAllStringFunc(config, func(value string) string {
+		plaintext, err := DecryptSecret(value)
+		if err != nil {
+			decryptErr = err
+			return value
+		}
+		escaped, _ := json.Marshal(plaintext)
+		return string(escaped[1 : len(escaped)-1])
+	})
+	return config, decryptErr
+}
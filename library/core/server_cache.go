@@ -0,0 +1,240 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+)
+
+const serverResolveTimeout = 5 * time.Second
+
+// serverCache pins the server domain of an instance to the address that last
+// worked, so reconnects skip DNS. Only the outbounds whose connection to the
+// server can be dialed here, see pinnableProtocol, are pinned, others resolve
+// the domain themselves.
+type serverCache struct {
+	access   sync.Mutex
+	ip       net.IP
+	excluded []*net.IPNet
+}
+
+const serverExcludedRetries = 3
+
+// SetExcludedServerIPs sets the comma separated addresses or CIDR ranges the
+// server domain must never be connected to, such as blocked CDN addresses. A
+// resolution returning only excluded addresses is retried for another one.
+func (s *ClashBasedInstance) SetExcludedServerIPs(list string) error {
+	var excluded []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return errors.New("invalid ip " + item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			excluded = append(excluded, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return errors.WithMessage(err, "parse excluded ip")
+		}
+		excluded = append(excluded, ipNet)
+	}
+	s.serverCache.access.Lock()
+	s.serverCache.excluded = excluded
+	if s.serverCache.ip != nil && isExcludedIP(excluded, s.serverCache.ip) {
+		s.serverCache.ip = nil
+	}
+	s.serverCache.access.Unlock()
+	return nil
+}
+
+func isExcludedIP(excluded []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range excluded {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCachedServerIP restores the server address persisted from a previous run,
+// it is tried first and replaced by a fresh resolution if dialing fails.
+func (s *ClashBasedInstance) SetCachedServerIP(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return errors.New("invalid ip " + ip)
+	}
+	s.serverCache.access.Lock()
+	s.serverCache.ip = parsed
+	s.serverCache.access.Unlock()
+	return nil
+}
+
+// CachedServerIP returns the server address that last worked, for persisting
+// across restarts, or an empty string.
+func (s *ClashBasedInstance) CachedServerIP() string {
+	s.serverCache.access.Lock()
+	defer s.serverCache.access.Unlock()
+	if s.serverCache.ip == nil {
+		return ""
+	}
+	return s.serverCache.ip.String()
+}
+
+func (s *ClashBasedInstance) serverDomain() string {
+	host, _, err := net.SplitHostPort(s.out.Addr())
+	if err != nil || host == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+func resolveServer(domain string, excluded []*net.IPNet) (net.IP, error) {
+	for attempt := 0; ; attempt++ {
+		ip, err := resolveServerOnce(domain, excluded)
+		if err != errServerExcluded || attempt == serverExcludedRetries-1 {
+			return ip, err
+		}
+		time.Sleep(time.Duration(attempt+1) * 200 * time.Millisecond)
+	}
+}
+
+var errServerExcluded = errors.New("all server addresses are excluded")
+
+func resolveServerOnce(domain string, excluded []*net.IPNet) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverResolveTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("no address for " + domain)
+	}
+	var allowed []net.IP
+	for _, address := range addresses {
+		if !isExcludedIP(excluded, address.IP) {
+			allowed = append(allowed, address.IP)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errServerExcluded
+	}
+	for _, ip := range allowed {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return allowed[0], nil
+}
+
+// pinnableProtocol returns the protocol of the outbounds running over a single
+// TCP connection to the server, which can be dialed to a pinned address.
+// Wrappers embedding them are excluded, their connections being different.
+func pinnableProtocol(out clashC.ProxyAdapter) streamProtocol {
+	switch out.(type) {
+	case *outbound.ShadowSocks, *outbound.ShadowSocksR, *outbound.Snell, *outbound.Socks5, *outbound.Http, *outbound.Trojan, *outbound.Vmess, *socks4To5Instance:
+		return out.(streamProtocol)
+	}
+	return nil
+}
+
+// dialPinned dials the outbound over a connection to ip, in place of the
+// server domain.
+func (s *ClashBasedInstance) dialPinned(ctx context.Context, protocol streamProtocol, metadata *clashC.Metadata, ip net.IP) (clashC.Conn, error) {
+	_, port, err := net.SplitHostPort(s.out.Addr())
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialServer(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(c)
+	conn, err := protocol.StreamConn(c, metadata)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return outbound.NewConn(conn, s.out), nil
+}
+
+// dialOut dials through the outbound, unless the destination is in the bypass
+// list, trying the cached server address first and falling back to a fresh
+// resolution. Destinations of the no-mux downgrade rules get their own session.
+// Connections to the server get the socket options of the instance.
+func (s *ClashBasedInstance) dialOut(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	if s.bypass.match(metadata) {
+		return s.bypass.dial(ctx, metadata)
+	}
+	s.access.Lock()
+	ctx = withSocketOptions(ctx, s.dialOptions)
+	s.access.Unlock()
+	dial := s.out.DialContext
+	if s.downgrade.match(metadata)&downgradeNoMux != 0 {
+		if dedicated, ok := s.out.(dedicatedDialer); ok {
+			dial = dedicated.dialDedicated
+		}
+	}
+	domain := s.serverDomain()
+	s.serverCache.access.Lock()
+	cached := s.serverCache.ip
+	excluded := s.serverCache.excluded
+	s.serverCache.access.Unlock()
+	protocol := pinnableProtocol(s.out)
+	if domain == "" {
+		host, _, err := net.SplitHostPort(s.out.Addr())
+		ip := net.ParseIP(host)
+		if err == nil && isExcludedIP(excluded, ip) {
+			return nil, errors.New("server address " + host + " is excluded")
+		}
+		if protocol != nil && ip != nil {
+			// the Clash adapter would dial without the socket options
+			return s.dialPinned(ctx, protocol, metadata, ip)
+		}
+		return dial(ctx, metadata)
+	}
+	if protocol == nil {
+		return dial(ctx, metadata)
+	}
+
+	var cachedErr error
+	if cached != nil {
+		conn, err := s.dialPinned(ctx, protocol, metadata, cached)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+		cachedErr = err
+	}
+
+	fresh, err := resolveServer(domain, excluded)
+	if err != nil {
+		return nil, errors.WithMessage(err, "resolve server")
+	}
+	if cached != nil && fresh.Equal(cached) {
+		return nil, cachedErr
+	}
+	conn, err := s.dialPinned(ctx, protocol, metadata, fresh)
+	if err != nil {
+		return nil, err
+	}
+	s.serverCache.access.Lock()
+	s.serverCache.ip = fresh
+	s.serverCache.access.Unlock()
+	return conn, nil
+}
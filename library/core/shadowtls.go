@@ -0,0 +1,380 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+	utls "github.com/refraction-networking/utls"
+)
+
+// Client of shadow-tls, which hides a connection behind a TLS handshake
+// relayed to a real server. Version 1 only relays the handshake, version 2
+// authenticates the connection with a hash of the handshake and version 3
+// authenticates the handshake itself and every record.
+
+const (
+	shadowTlsHeaderSize       = 5
+	shadowTlsRandomSize       = 32
+	shadowTlsSessionIDSize    = 32
+	shadowTlsHmacSize         = 4
+	shadowTlsHmacHeaderSize   = shadowTlsHeaderSize + shadowTlsHmacSize
+	shadowTlsMaxRecordSize    = 16384
+	shadowTlsHandshakeTimeout = 10 * time.Second
+
+	// offsets in the handshake messages, without record header
+	shadowTlsServerRandomIndex = 1 + 3 + 2
+	shadowTlsSessionIDIndex    = 1 + 3 + 2 + shadowTlsRandomSize + 1
+
+	tlsRecordAlert           = 21
+	tlsRecordHandshake       = 22
+	tlsRecordApplicationData = 23
+	tlsHandshakeServerHello  = 2
+)
+
+type shadowTlsConfig struct {
+	version  int
+	password string
+	host     string
+}
+
+// newShadowTlsConfig reads the shadow-tls plugin options: host, the domain of
+// the handshake server, password and version, 3 by default.
+func newShadowTlsConfig(opts map[string]interface{}) (*shadowTlsConfig, error) {
+	version, err := pluginInt(opts, "version", 3)
+	if err != nil {
+		return nil, err
+	}
+	config := &shadowTlsConfig{
+		version:  version,
+		password: pluginString(opts, "password", ""),
+		host:     pluginString(opts, "host", ""),
+	}
+	if config.host == "" {
+		return nil, errors.New("missing shadow-tls handshake host")
+	}
+	switch version {
+	case 1:
+	case 2, 3:
+		if config.password == "" {
+			return nil, fmt.Errorf("missing shadow-tls v%d password", version)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported shadow-tls version %d, expected 1 to 3", version)
+	}
+	return config, nil
+}
+
+func (c *shadowTlsConfig) client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, shadowTlsHandshakeTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	switch c.version {
+	case 1:
+		if err := c.handshake(conn, false); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case 2:
+		hashConn := &shadowTlsHashConn{Conn: conn, hmac: hmac.New(sha1.New, []byte(c.password))}
+		if err := c.handshake(hashConn, false); err != nil {
+			return nil, err
+		}
+		return &shadowTlsV2Conn{Conn: conn, hash: hashConn.hmac.Sum(nil)[:8]}, nil
+	default:
+		wrapper := &shadowTlsStreamWrapper{Conn: conn, password: c.password}
+		if err := c.handshake(wrapper, true); err != nil {
+			return nil, err
+		}
+		if !wrapper.authorized {
+			return nil, errors.New("shadow-tls handshake not authorized, traffic hijacked or TLS 1.3 not supported by the handshake server")
+		}
+		return &shadowTlsVerifiedConn{
+			Conn:       conn,
+			hmacAdd:    shadowTlsHmac(c.password, wrapper.serverRandom, "C"),
+			hmacVerify: shadowTlsHmac(c.password, wrapper.serverRandom, "S"),
+			hmacIgnore: wrapper.readHmac,
+		}, nil
+	}
+}
+
+// handshake runs the TLS handshake with the handshake server, signing the
+// session id of the hello for version 3.
+func (c *shadowTlsConfig) handshake(conn net.Conn, signSessionID bool) error {
+	tlsConn := utls.UClient(conn, &utls.Config{ServerName: c.host}, utls.HelloChrome_Auto)
+	if signSessionID {
+		if err := tlsConn.BuildHandshakeState(); err != nil {
+			return err
+		}
+		hello := tlsConn.HandshakeState.Hello
+		if len(hello.Raw) < shadowTlsSessionIDIndex+shadowTlsSessionIDSize || len(hello.SessionId) != shadowTlsSessionIDSize {
+			return errors.New("unexpected client hello")
+		}
+		sessionID := make([]byte, shadowTlsSessionIDSize)
+		_, _ = rand.Read(sessionID[:shadowTlsSessionIDSize-shadowTlsHmacSize])
+		copy(hello.Raw[shadowTlsSessionIDIndex:], sessionID)
+		mac := hmac.New(sha1.New, []byte(c.password))
+		mac.Write(hello.Raw)
+		copy(sessionID[shadowTlsSessionIDSize-shadowTlsHmacSize:], mac.Sum(nil)[:shadowTlsHmacSize])
+		copy(hello.Raw[shadowTlsSessionIDIndex:], sessionID)
+		hello.SessionId = sessionID
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return errors.WithMessage(err, "shadow-tls handshake")
+	}
+	return nil
+}
+
+func shadowTlsHmac(password string, serverRandom []byte, label string) hash.Hash {
+	mac := hmac.New(sha1.New, []byte(password))
+	mac.Write(serverRandom)
+	mac.Write([]byte(label))
+	return mac
+}
+
+// shadowTlsHashConn hashes what the server sends during the v2 handshake.
+type shadowTlsHashConn struct {
+	net.Conn
+	hmac hash.Hash
+}
+
+func (c *shadowTlsHashConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.hmac.Write(b[:n])
+	return n, err
+}
+
+func writeTlsRecords(conn net.Conn, prefix []byte, b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 || prefix != nil {
+		chunk := b
+		if len(chunk) > shadowTlsMaxRecordSize-len(prefix) {
+			chunk = chunk[:shadowTlsMaxRecordSize-len(prefix)]
+		}
+		record := make([]byte, shadowTlsHeaderSize, shadowTlsHeaderSize+len(prefix)+len(chunk))
+		record[0], record[1], record[2] = tlsRecordApplicationData, 3, 3
+		binary.BigEndian.PutUint16(record[3:], uint16(len(prefix)+len(chunk)))
+		record = append(append(record, prefix...), chunk...)
+		if _, err := conn.Write(record); err != nil {
+			return written, err
+		}
+		prefix = nil
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// readTlsRecord reads a whole record, header included.
+func readTlsRecord(conn net.Conn) ([]byte, error) {
+	header := make([]byte, shadowTlsHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	record := make([]byte, shadowTlsHeaderSize+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(conn, record[shadowTlsHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// shadowTlsV2Conn frames data as application data records, the first one
+// prefixed with the hash of the handshake.
+type shadowTlsV2Conn struct {
+	net.Conn
+	hash    []byte
+	pending []byte
+}
+
+func (c *shadowTlsV2Conn) Write(b []byte) (int, error) {
+	prefix := c.hash
+	c.hash = nil
+	return writeTlsRecords(c.Conn, prefix, b)
+}
+
+func (c *shadowTlsV2Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		record, err := readTlsRecord(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		switch record[0] {
+		case tlsRecordApplicationData:
+			c.pending = record[shadowTlsHeaderSize:]
+		case tlsRecordAlert:
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("unexpected TLS record type %d", record[0])
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// shadowTlsStreamWrapper checks the v3 handshake: the server signs the
+// application data records of the handshake server with the server random,
+// and masks them so that a client without the password fails.
+type shadowTlsStreamWrapper struct {
+	net.Conn
+	password     string
+	pending      []byte
+	serverRandom []byte
+	readHmac     hash.Hash
+	readKey      []byte
+	authorized   bool
+}
+
+func (w *shadowTlsStreamWrapper) Read(b []byte) (int, error) {
+	if len(w.pending) == 0 {
+		record, err := readTlsRecord(w.Conn)
+		if err != nil {
+			return 0, err
+		}
+		switch record[0] {
+		case tlsRecordHandshake:
+			if len(record) > shadowTlsHeaderSize+shadowTlsServerRandomIndex+shadowTlsRandomSize && record[shadowTlsHeaderSize] == tlsHandshakeServerHello {
+				index := shadowTlsHeaderSize + shadowTlsServerRandomIndex
+				w.serverRandom = append([]byte(nil), record[index:index+shadowTlsRandomSize]...)
+				w.readHmac = hmac.New(sha1.New, []byte(w.password))
+				w.readHmac.Write(w.serverRandom)
+				key := sha256.Sum256(append([]byte(w.password), w.serverRandom...))
+				w.readKey = key[:]
+			}
+		case tlsRecordApplicationData:
+			w.authorized = false
+			if len(record) > shadowTlsHmacHeaderSize && w.readHmac != nil {
+				w.readHmac.Write(record[shadowTlsHmacHeaderSize:])
+				if hmac.Equal(w.readHmac.Sum(nil)[:shadowTlsHmacSize], record[shadowTlsHeaderSize:shadowTlsHmacHeaderSize]) {
+					data := record[shadowTlsHmacHeaderSize:]
+					for i := range data {
+						data[i] ^= w.readKey[i%len(w.readKey)]
+					}
+					// restore the record of the handshake server
+					copy(record[shadowTlsHmacSize:], record[:shadowTlsHeaderSize])
+					record = record[shadowTlsHmacSize:]
+					binary.BigEndian.PutUint16(record[3:], uint16(len(data)))
+					w.authorized = true
+				}
+			}
+		}
+		w.pending = record
+	}
+	n := copy(b, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+// shadowTlsVerifiedConn frames data as application data records signed with
+// a chained HMAC in both directions. Records still signed as in the handshake
+// are late records of the handshake server, such as session tickets, and are
+// skipped.
+type shadowTlsVerifiedConn struct {
+	net.Conn
+	hmacAdd    hash.Hash
+	hmacVerify hash.Hash
+	hmacIgnore hash.Hash
+	pending    []byte
+}
+
+func shadowTlsVerify(record []byte, mac hash.Hash, chain bool) bool {
+	if record[1] != 3 || record[2] != 3 || len(record) < shadowTlsHmacHeaderSize {
+		return false
+	}
+	mac.Write(record[shadowTlsHmacHeaderSize:])
+	sum := mac.Sum(nil)[:shadowTlsHmacSize]
+	if chain {
+		mac.Write(sum)
+	}
+	return bytes.Equal(record[shadowTlsHeaderSize:shadowTlsHmacHeaderSize], sum)
+}
+
+func (c *shadowTlsVerifiedConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		record, err := readTlsRecord(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		switch record[0] {
+		case tlsRecordApplicationData:
+		case tlsRecordAlert:
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("unexpected TLS record type %d", record[0])
+		}
+		if c.hmacIgnore != nil {
+			if shadowTlsVerify(record, c.hmacIgnore, false) {
+				continue
+			}
+			c.hmacIgnore = nil
+		}
+		if !shadowTlsVerify(record, c.hmacVerify, true) {
+			return 0, errors.New("shadow-tls record verification failed")
+		}
+		c.pending = record[shadowTlsHmacHeaderSize:]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *shadowTlsVerifiedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > shadowTlsMaxRecordSize-shadowTlsHmacSize {
+			chunk = chunk[:shadowTlsMaxRecordSize-shadowTlsHmacSize]
+		}
+		c.hmacAdd.Write(chunk)
+		sum := c.hmacAdd.Sum(nil)[:shadowTlsHmacSize]
+		c.hmacAdd.Write(sum)
+		if _, err := writeTlsRecords(c.Conn, sum, chunk); err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// shadowTlsShadowsocks is a Shadowsocks instance behind a shadow-tls server,
+// which only relays TCP.
+type shadowTlsShadowsocks struct {
+	*outbound.ShadowSocks
+	config *shadowTlsConfig
+}
+
+func (s *shadowTlsShadowsocks) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	c, err := dialServer(ctx, "tcp", s.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("%s connect error: %w", s.Addr(), err)
+	}
+	tcpKeepAlive(c)
+	conn, err := s.config.client(ctx, c)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	sc, err := s.ShadowSocks.StreamConn(conn, metadata)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return outbound.NewConn(sc, s), nil
+}
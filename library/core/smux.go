@@ -0,0 +1,319 @@
+package libcore
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client side of smux version 1, the stream multiplexer of kcptun.
+
+const (
+	smuxVersion          = 1
+	smuxCmdSyn           = 0
+	smuxCmdFin           = 1
+	smuxCmdPush          = 2
+	smuxCmdNop           = 3
+	smuxHeaderSize       = 8
+	smuxMaxFrameSize     = 32768
+	smuxMaxReceiveBuffer = 4 * 1024 * 1024
+	smuxKeepAliveTimeout = 30 * time.Second
+)
+
+var errSmuxClosed = errors.New("smux session closed")
+
+type smuxSession struct {
+	conn              net.Conn
+	keepAliveInterval time.Duration
+
+	writeAccess sync.Mutex
+
+	access   sync.Mutex
+	streams  map[uint32]*smuxStream
+	nextID   uint32
+	buffered int
+	drained  chan struct{}
+	received bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSmuxSession(conn net.Conn, keepAliveInterval time.Duration) *smuxSession {
+	s := &smuxSession{
+		conn:              conn,
+		keepAliveInterval: keepAliveInterval,
+		streams:           map[uint32]*smuxStream{},
+		nextID:            1,
+		drained:           make(chan struct{}, 1),
+		closed:            make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+func (s *smuxSession) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *smuxSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		_ = s.conn.Close()
+		s.access.Lock()
+		for _, stream := range s.streams {
+			stream.notify()
+		}
+		s.access.Unlock()
+	})
+	return nil
+}
+
+func (s *smuxSession) writeFrame(cmd byte, id uint32, data []byte) error {
+	frame := make([]byte, smuxHeaderSize+len(data))
+	frame[0] = smuxVersion
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	copy(frame[smuxHeaderSize:], data)
+
+	s.writeAccess.Lock()
+	defer s.writeAccess.Unlock()
+	if s.isClosed() {
+		return errSmuxClosed
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		_ = s.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *smuxSession) openStream() (*smuxStream, error) {
+	s.access.Lock()
+	id := s.nextID
+	s.nextID += 2
+	stream := &smuxStream{
+		id:       id,
+		session:  s,
+		readable: make(chan struct{}, 1),
+	}
+	s.streams[id] = stream
+	s.access.Unlock()
+
+	if err := s.writeFrame(smuxCmdSyn, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *smuxSession) removeStream(id uint32) {
+	s.access.Lock()
+	delete(s.streams, id)
+	s.access.Unlock()
+}
+
+// release returns consumed bytes to the receive buffer shared by the streams.
+func (s *smuxSession) release(n int) {
+	s.access.Lock()
+	s.buffered -= n
+	s.access.Unlock()
+	select {
+	case s.drained <- struct{}{}:
+	default:
+	}
+}
+
+func (s *smuxSession) recvLoop() {
+	defer s.Close()
+	header := make([]byte, smuxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		if header[0] != smuxVersion {
+			return
+		}
+		data := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return
+		}
+		id := binary.LittleEndian.Uint32(header[4:])
+
+		s.access.Lock()
+		s.received = true
+		stream := s.streams[id]
+		switch header[1] {
+		case smuxCmdPush:
+			if stream != nil && len(data) > 0 {
+				s.buffered += len(data)
+				stream.push(data)
+			}
+		case smuxCmdFin:
+			if stream != nil {
+				stream.finish()
+			}
+		}
+		full := s.buffered > smuxMaxReceiveBuffer
+		s.access.Unlock()
+
+		for full {
+			select {
+			case <-s.drained:
+			case <-s.closed:
+				return
+			}
+			s.access.Lock()
+			full = s.buffered > smuxMaxReceiveBuffer
+			s.access.Unlock()
+		}
+	}
+}
+
+// keepAlive sends NOP frames and closes the session once nothing is received
+// for smuxKeepAliveTimeout.
+func (s *smuxSession) keepAlive() {
+	ping := time.NewTicker(s.keepAliveInterval)
+	timeout := time.NewTicker(smuxKeepAliveTimeout)
+	defer ping.Stop()
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ping.C:
+			_ = s.writeFrame(smuxCmdNop, 0, nil)
+		case <-timeout.C:
+			s.access.Lock()
+			received := s.received
+			s.received = false
+			s.access.Unlock()
+			if !received {
+				_ = s.Close()
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+type smuxStream struct {
+	id       uint32
+	session  *smuxSession
+	readable chan struct{}
+
+	// guarded by the session
+	buffers  [][]byte
+	finished bool
+
+	closeOnce sync.Once
+}
+
+func (s *smuxStream) notify() {
+	select {
+	case s.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (s *smuxStream) push(data []byte) {
+	s.buffers = append(s.buffers, data)
+	s.notify()
+}
+
+func (s *smuxStream) finish() {
+	s.finished = true
+	s.notify()
+}
+
+func (s *smuxStream) Read(b []byte) (int, error) {
+	for {
+		session := s.session
+		session.access.Lock()
+		if len(s.buffers) > 0 {
+			n := copy(b, s.buffers[0])
+			if n < len(s.buffers[0]) {
+				s.buffers[0] = s.buffers[0][n:]
+			} else {
+				s.buffers = s.buffers[1:]
+			}
+			session.access.Unlock()
+			session.release(n)
+			return n, nil
+		}
+		finished := s.finished
+		session.access.Unlock()
+		if finished {
+			return 0, io.EOF
+		}
+		if session.isClosed() {
+			return 0, errSmuxClosed
+		}
+		<-s.readable
+	}
+}
+
+func (s *smuxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		frame := b
+		if len(frame) > smuxMaxFrameSize {
+			frame = frame[:smuxMaxFrameSize]
+		}
+		if err := s.session.writeFrame(smuxCmdPush, s.id, frame); err != nil {
+			return written, err
+		}
+		b = b[len(frame):]
+		written += len(frame)
+	}
+	return written, nil
+}
+
+func (s *smuxStream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.session.writeFrame(smuxCmdFin, s.id, nil)
+		s.session.removeStream(s.id)
+		s.session.access.Lock()
+		released := 0
+		for _, buffer := range s.buffers {
+			released += len(buffer)
+		}
+		s.buffers = nil
+		s.finished = true
+		s.session.access.Unlock()
+		s.session.release(released)
+		s.notify()
+	})
+	return err
+}
+
+func (s *smuxStream) LocalAddr() net.Addr {
+	return s.session.conn.LocalAddr()
+}
+
+func (s *smuxStream) RemoteAddr() net.Addr {
+	return s.session.conn.RemoteAddr()
+}
+
+func (s *smuxStream) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (s *smuxStream) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (s *smuxStream) SetWriteDeadline(time.Time) error {
+	return nil
+}
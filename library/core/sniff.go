@@ -0,0 +1,65 @@
+package libcore
+
+import (
+	"net"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/log"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/common/protocol/http"
+	"github.com/xtls/xray-core/common/protocol/tls"
+)
+
+const (
+	sniffTimeout    = 300 * time.Millisecond
+	sniffBufferSize = 2048
+)
+
+type SniffListener interface {
+	// OnSniffed reports the domain sniffed from a connection, protocol being
+	// "tls" or "http".
+	OnSniffed(uid int32, destination string, protocol string, domain string)
+}
+
+// SetSniffOnly makes sniffing record the sniffed domains, reported to the
+// listener and logged in debug mode, instead of overriding the destination
+// used for routing. It only applies when sniffing is enabled.
+func (t *Tun2socks) SetSniffOnly(enabled bool, listener SniffListener) {
+	t.access.Lock()
+	t.sniffOnly = enabled
+	t.sniffListener = listener
+	t.access.Unlock()
+}
+
+// sniffMetadata reads the first bytes sent by the client, to be written to the
+// outbound once dialed, and reports the domain found in them.
+func (t *Tun2socks) sniffMetadata(conn net.Conn, uid uint16, dest v2rayNet.Destination) []byte {
+	buf := make([]byte, sniffBufferSize)
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	n, _ := conn.Read(buf)
+	_ = conn.SetReadDeadline(time.Time{})
+	payload := buf[:n]
+	if n == 0 {
+		return nil
+	}
+
+	var protocol, domain string
+	if header, err := tls.SniffTLS(payload); err == nil {
+		protocol, domain = header.Protocol(), header.Domain()
+	} else if header, err := http.SniffHTTP(payload); err == nil {
+		protocol, domain = header.Protocol(), header.Domain()
+	}
+	if domain == "" {
+		return payload
+	}
+	if t.debug {
+		log.Infof("[TCP] %s sniffed %s (%s)", dest.NetAddr(), domain, protocol)
+	}
+	t.access.Lock()
+	listener := t.sniffListener
+	t.access.Unlock()
+	if listener != nil {
+		listener.OnSniffed(int32(uid), dest.NetAddr(), protocol, domain)
+	}
+	return payload
+}
@@ -0,0 +1,191 @@
+package libcore
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tcpBrutalParams   = 23301
+	tcpBrutalCwndGain = 20
+)
+
+type tcpBrutalParamsValue struct {
+	rate     uint64
+	cwndGain uint32
+}
+
+// socketOptions are applied to the sockets created by outbounds implemented in
+// libcore, before they connect.
+type socketOptions struct {
+	access        sync.RWMutex
+	brutalRate    uint64
+	sendBuffer    int
+	receiveBuffer int
+
+	// interfaces in order of preference
+	ifaces       []string
+	ifaceActive  string
+	ifaceChecked time.Time
+	ifaceFailed  map[string]time.Time
+}
+
+// socketConfigurable is implemented by outbounds which dial through socketOptions.
+type socketConfigurable interface {
+	socketOptions() *socketOptions
+}
+
+var brutalWarning sync.Once
+
+// control binds TCP sockets to the address of the current interface, as
+// SO_BINDTODEVICE needs CAP_NET_RAW. UDP sockets are bound by listening on
+// listenAddress.
+func (o *socketOptions) control(network, _ string, c syscall.RawConn) error {
+	var local unix.Sockaddr
+	if iface := o.currentInterface(); iface != "" && strings.HasPrefix(network, "tcp") {
+		ip, err := interfaceAddress(iface, network == "tcp6")
+		if err != nil {
+			return err
+		}
+		local = sockaddr(ip)
+	}
+	var innerErr error
+	err := c.Control(func(fd uintptr) {
+		if local != nil {
+			if innerErr = unix.Bind(int(fd), local); innerErr != nil {
+				innerErr = errors.WithMessage(innerErr, "bind to interface address")
+				return
+			}
+		}
+		if p := protector; p != nil && !p.Protect(int32(fd)) {
+			innerErr = errors.New("protect failed")
+			return
+		}
+		o.apply(int(fd), network)
+	})
+	if err != nil {
+		return err
+	}
+	return innerErr
+}
+
+// apply sets the buffer sizes, MSS and congestion control of a socket.
+func (o *socketOptions) apply(fd int, network string) {
+	o.access.RLock()
+	brutalRate := o.brutalRate
+	sendBuffer, receiveBuffer := o.sendBuffer, o.receiveBuffer
+	o.access.RUnlock()
+
+	setSocketBuffer(fd, sendBuffer, receiveBuffer)
+	isTcp := network == "tcp" || network == "tcp4" || network == "tcp6"
+	if isTcp {
+		setTcpMss(fd)
+	}
+	if brutalRate > 0 && isTcp {
+		if err := setTcpBrutal(fd, brutalRate); err != nil {
+			brutalWarning.Do(func() {
+				log.Warnf("tcp brutal unavailable, falling back to system congestion control: %s", err.Error())
+			})
+		}
+	}
+}
+
+var socketSendBuffer, socketReceiveBuffer int
+
+// SetSocketBufferSize sets SO_SNDBUF/SO_RCVBUF in bytes for sockets of the
+// V2Ray outbounds and the sockets the Clash outbounds create without
+// instance options, UDP ones included. 0 keeps the system default.
+func SetSocketBufferSize(sendBuffer int32, receiveBuffer int32) {
+	socketSendBuffer = int(sendBuffer)
+	socketReceiveBuffer = int(receiveBuffer)
+	installDialHooks()
+}
+
+func setSocketBuffer(fd int, sendBuffer int, receiveBuffer int) {
+	if sendBuffer > 0 {
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, sendBuffer)
+	}
+	if receiveBuffer > 0 {
+		_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, receiveBuffer)
+	}
+}
+
+func setTcpBrutal(fd int, rate uint64) error {
+	if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, "brutal"); err != nil {
+		return errors.WithMessage(err, "set congestion control")
+	}
+	params := tcpBrutalParamsValue{
+		rate:     rate,
+		cwndGain: tcpBrutalCwndGain,
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.IPPROTO_TCP, tcpBrutalParams, uintptr(unsafe.Pointer(&params)), unsafe.Sizeof(params), 0)
+	if errno != 0 {
+		_ = unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, "cubic")
+		return errors.WithMessage(errno, "set brutal params")
+	}
+	return nil
+}
+
+// SetTcpBrutal enables TCP Brutal with the given send rate on new connections
+// of the outbound, or disables it if mbps is 0. Connections fall back to the
+// system congestion control where the kernel module is not available.
+func (s *ClashBasedInstance) SetTcpBrutal(mbps int32) error {
+	if mbps < 0 {
+		return errors.New("invalid bandwidth")
+	}
+	options := s.socketOptions()
+	options.access.Lock()
+	options.brutalRate = uint64(mbps) * 1000 * 1000 / 8
+	options.access.Unlock()
+	return nil
+}
+
+// socketOptions returns the options of the outbound sockets, those of the
+// outbound itself if it dials through socketOptions, or otherwise options
+// applied by dialServer to the connections dialOut makes to the server.
+func (s *ClashBasedInstance) socketOptions() *socketOptions {
+	if configurable, ok := s.out.(socketConfigurable); ok {
+		return configurable.socketOptions()
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.dialOptions == nil {
+		s.dialOptions = &socketOptions{}
+	}
+	return s.dialOptions
+}
+
+// SetSocketBuffer sets SO_SNDBUF/SO_RCVBUF in bytes for connections accepted
+// by the inbound, its UDP socket from the next Start, and the sockets of the
+// outbound. UDP sockets of the Clash outbounds are not bound to a server
+// when created and keep the sizes of SetSocketBufferSize.
+func (s *ClashBasedInstance) SetSocketBuffer(sendBuffer int32, receiveBuffer int32) {
+	s.sendBuffer = int(sendBuffer)
+	s.receiveBuffer = int(receiveBuffer)
+	options := s.socketOptions()
+	options.access.Lock()
+	options.sendBuffer = int(sendBuffer)
+	options.receiveBuffer = int(receiveBuffer)
+	options.access.Unlock()
+}
+
+func (s *ClashBasedInstance) applySocketBuffer(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if s.sendBuffer > 0 {
+		_ = tcpConn.SetWriteBuffer(s.sendBuffer)
+	}
+	if s.receiveBuffer > 0 {
+		_ = tcpConn.SetReadBuffer(s.receiveBuffer)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"github.com/Dreamacro/clash/adapter/outbound"
-	"github.com/Dreamacro/clash/component/dialer"
 	clashC "github.com/Dreamacro/clash/constant"
 	"github.com/xjasonlyu/tun2socks/log"
 	"github.com/xjasonlyu/tun2socks/transport/socks4"
@@ -36,7 +35,7 @@ func (s *socks4To5Instance) StreamConn(c net.Conn, metadata *clashC.Metadata) (n
 }
 
 func (s *socks4To5Instance) DialContext(ctx context.Context, metadata *clashC.Metadata) (_ clashC.Conn, err error) {
-	c, err := dialer.DialContext(ctx, "tcp", s.Addr())
+	c, err := dialServer(ctx, "tcp", s.Addr())
 	if err != nil {
 		return nil, fmt.Errorf("%s connect error: %w", s.Addr(), err)
 	}
@@ -66,6 +65,9 @@ func safeConnClose(c net.Conn, err error) {
 }
 
 func NewSocks4To5Instance(socksPort int32, serverAddress string, serverPort int32, username string, socks4a bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&username); err != nil {
+		return nil, err
+	}
 	addr := net.JoinHostPort(serverAddress, strconv.Itoa(int(serverPort)))
 	out := &socks4To5Instance{
 		Base:     outbound.NewBase("", addr, -1, false),
@@ -0,0 +1,21 @@
+package libcore
+
+import (
+	"github.com/Dreamacro/clash/adapter/outbound"
+)
+
+// NewSocksOutboundInstance creates an instance relaying TCP and UDP through a
+// SOCKS5 server. username and password may be empty.
+func NewSocksOutboundInstance(socksPort int32, server string, port int32, username string, password string, udp bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password); err != nil {
+		return nil, err
+	}
+	out := outbound.NewSocks5(outbound.Socks5Option{
+		Server:   server,
+		Port:     int(port),
+		UserName: username,
+		Password: password,
+		UDP:      udp,
+	})
+	return newClashBasedInstance(socksPort, out), nil
+}
@@ -0,0 +1,103 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+// StartSpeedTestServer listens on 127.0.0.1:port, 0 picking a free port, and
+// passes everything through the instance to target, so that the throughput
+// of the node can be measured with standard tools. A host:port target, such as
+// an iperf3 server, is forwarded as raw TCP; an http or https URL is served as
+// plain HTTP, the request path being appended to it. Returns the port.
+func (s *ClashBasedInstance) StartSpeedTestServer(port int32, target string) (int32, error) {
+	var handler http.Handler
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		targetUrl, err := url.Parse(target)
+		if err != nil {
+			return 0, errors.WithMessage(err, "parse target")
+		}
+		proxy := httputil.NewSingleHostReverseProxy(targetUrl)
+		proxy.Transport = &http.Transport{
+			DialContext:       s.DialContext,
+			ForceAttemptHTTP2: true,
+		}
+		director := proxy.Director
+		proxy.Director = func(request *http.Request) {
+			director(request)
+			request.Host = targetUrl.Host
+		}
+		handler = proxy
+	} else if _, _, err := net.SplitHostPort(target); err != nil {
+		return 0, errors.WithMessage(err, "parse target")
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		return 0, newBindError(port, err)
+	}
+	s.access.Lock()
+	if s.speedTest != nil {
+		_ = s.speedTest.Close()
+	}
+	s.speedTest = listener
+	s.access.Unlock()
+	go func() {
+		<-s.ctx.Done()
+		_ = listener.Close()
+	}()
+
+	if handler != nil {
+		go func() {
+			_ = http.Serve(listener, handler)
+		}()
+	} else {
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go s.forwardSpeedTest(conn, target)
+			}
+		}()
+	}
+	return int32(listener.Addr().(*net.TCPAddr).Port), nil
+}
+
+func (s *ClashBasedInstance) StopSpeedTestServer() {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.speedTest != nil {
+		_ = s.speedTest.Close()
+		s.speedTest = nil
+	}
+}
+
+func (s *ClashBasedInstance) forwardSpeedTest(conn net.Conn, target string) {
+	defer conn.Close()
+	remote, err := s.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		log.Warnf("[SpeedTest] dial %s failed: %s", target, err.Error())
+		return
+	}
+	defer remote.Close()
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(remote, conn)
+		_ = remote.Close()
+		close(done)
+	}()
+	_, _ = io.Copy(conn, remote)
+	_ = conn.Close()
+	<-done
+}
@@ -0,0 +1,362 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+)
+
+const (
+	XHTTPModeAuto      = "auto"
+	XHTTPModePacketUp  = "packet-up"
+	XHTTPModeStreamUp  = "stream-up"
+	XHTTPModeStreamOne = "stream-one"
+)
+
+const (
+	xhttpMaxPostBytes    = 1000000
+	xhttpDefaultPadding  = "100-1000"
+	xhttpResponseTimeout = 10 * time.Second
+)
+
+type xhttpOptions struct {
+	mode       string
+	paddingMin int
+	paddingMax int
+}
+
+// splitHTTPInstance runs a protocol over the xhttp (splithttp) transport: the
+// downlink is the body of a GET response and the uplink is sent in POST
+// requests, one per write in packet-up mode or a streamed body otherwise.
+type splitHTTPInstance struct {
+	*outbound.Base
+	client   *http.Client
+	scheme   string
+	host     string
+	path     string
+	http2    bool
+	protocol streamProtocol
+
+	access  sync.RWMutex
+	options xhttpOptions
+}
+
+func newSplitHTTPInstance(base *outbound.Base, server string, tlsConfig *tls.Config, host string, path string, protocol streamProtocol) *splitHTTPInstance {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := dialServer(ctx, "tcp", server)
+			if err == nil {
+				tcpKeepAlive(conn)
+			}
+			return conn, err
+		},
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	s := &splitHTTPInstance{
+		Base:     base,
+		client:   &http.Client{Transport: transport},
+		scheme:   "http",
+		host:     host,
+		path:     "/" + strings.Trim(path, "/"),
+		protocol: protocol,
+	}
+	if tlsConfig != nil {
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		transport.TLSClientConfig = tlsConfig
+		transport.ForceAttemptHTTP2 = true
+		s.scheme = "https"
+		s.http2 = true
+	}
+	s.options, _ = parseXHTTPOptions(XHTTPModeAuto, xhttpDefaultPadding)
+	return s
+}
+
+func parseXHTTPOptions(mode string, paddingBytes string) (xhttpOptions, error) {
+	options := xhttpOptions{mode: mode}
+	switch mode {
+	case "":
+		options.mode = XHTTPModeAuto
+	case XHTTPModeAuto, XHTTPModePacketUp, XHTTPModeStreamUp, XHTTPModeStreamOne:
+	default:
+		return options, fmt.Errorf("unknown xhttp mode %q", mode)
+	}
+	if paddingBytes == "" {
+		paddingBytes = xhttpDefaultPadding
+	}
+	bounds := strings.SplitN(paddingBytes, "-", 2)
+	var err error
+	if options.paddingMin, err = strconv.Atoi(strings.TrimSpace(bounds[0])); err != nil {
+		return options, fmt.Errorf("invalid padding %q", paddingBytes)
+	}
+	options.paddingMax = options.paddingMin
+	if len(bounds) == 2 {
+		if options.paddingMax, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return options, fmt.Errorf("invalid padding %q", paddingBytes)
+		}
+	}
+	if options.paddingMin < 0 || options.paddingMax < options.paddingMin {
+		return options, fmt.Errorf("invalid padding %q", paddingBytes)
+	}
+	return options, nil
+}
+
+func (s *splitHTTPInstance) currentOptions() xhttpOptions {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return s.options
+}
+
+// SetXHTTPOptions changes the upload mode ("auto", "packet-up", "stream-up" or
+// "stream-one") and the padding length range, such as "100-1000", of an xhttp
+// instance. The streamed modes require HTTP/2, so TLS.
+func (s *ClashBasedInstance) SetXHTTPOptions(mode string, paddingBytes string) error {
+	out, ok := s.out.(*splitHTTPInstance)
+	if !ok {
+		return errors.New("xhttp options are not supported by this instance")
+	}
+	options, err := parseXHTTPOptions(mode, paddingBytes)
+	if err != nil {
+		return err
+	}
+	if (options.mode == XHTTPModeStreamUp || options.mode == XHTTPModeStreamOne) && !out.http2 {
+		return fmt.Errorf("xhttp mode %s requires tls", options.mode)
+	}
+	out.access.Lock()
+	out.options = options
+	out.access.Unlock()
+	return nil
+}
+
+func (s *splitHTTPInstance) newRequest(ctx context.Context, method string, path string, body io.Reader, options xhttpOptions) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, s.scheme+"://"+s.host+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Host = s.host
+	// the padding hides the request lengths, servers read it from the referer
+	padding := options.paddingMin
+	if options.paddingMax > options.paddingMin {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(options.paddingMax-options.paddingMin+1)))
+		padding += int(n.Int64())
+	}
+	request.Header.Set("Referer", s.scheme+"://"+s.host+path+"?x_padding="+strings.Repeat("0", padding))
+	return request, nil
+}
+
+func (s *splitHTTPInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	options := s.currentOptions()
+	mode := options.mode
+	if mode == XHTTPModeAuto {
+		mode = XHTTPModePacketUp
+		if s.http2 {
+			mode = XHTTPModeStreamUp
+		}
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	sessionPath := s.path + "/" + hex.EncodeToString(id)
+
+	connCtx, cancel := context.WithCancel(context.Background())
+	conn := &splitHTTPConn{
+		instance:    s,
+		ctx:         connCtx,
+		cancel:      cancel,
+		sessionPath: sessionPath,
+		options:     options,
+		download:    make(chan struct{}),
+	}
+	var err error
+	switch mode {
+	case XHTTPModeStreamOne:
+		reader, writer := io.Pipe()
+		conn.upload = writer
+		conn.startRequest(http.MethodPost, sessionPath, reader)
+	case XHTTPModeStreamUp:
+		reader, writer := io.Pipe()
+		conn.upload = writer
+		conn.startRequest(http.MethodGet, sessionPath, nil)
+		go conn.streamUpload(reader)
+	default:
+		conn.startRequest(http.MethodGet, sessionPath, nil)
+	}
+
+	var c net.Conn = conn
+	if c, err = s.protocol.StreamConn(c, metadata); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return outbound.NewConn(c, s), nil
+}
+
+func (s *splitHTTPInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported over xhttp")
+}
+
+// splitHTTPConn is a single xhttp session.
+type splitHTTPConn struct {
+	instance    *splitHTTPInstance
+	ctx         context.Context
+	cancel      context.CancelFunc
+	sessionPath string
+	options     xhttpOptions
+
+	// download is closed once the response is received
+	download    chan struct{}
+	body        io.ReadCloser
+	downloadErr error
+
+	upload    *io.PipeWriter
+	writeLock sync.Mutex
+	sequence  int
+	closeOnce sync.Once
+}
+
+func (c *splitHTTPConn) startRequest(method string, path string, body io.Reader) {
+	go func() {
+		defer close(c.download)
+		request, err := c.instance.newRequest(c.ctx, method, path, body, c.options)
+		if err != nil {
+			c.downloadErr = err
+			return
+		}
+		response, err := c.instance.client.Do(request)
+		if err != nil {
+			c.downloadErr = err
+			return
+		}
+		if response.StatusCode != http.StatusOK {
+			_ = response.Body.Close()
+			c.downloadErr = fmt.Errorf("xhttp download failed: %s", response.Status)
+			return
+		}
+		c.body = response.Body
+	}()
+}
+
+func (c *splitHTTPConn) streamUpload(body io.Reader) {
+	request, err := c.instance.newRequest(c.ctx, http.MethodPost, c.sessionPath, body, c.options)
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	response, err := c.instance.client.Do(request)
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	_ = response.Body.Close()
+}
+
+func (c *splitHTTPConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.download:
+	case <-c.ctx.Done():
+		return 0, net.ErrClosed
+	}
+	if c.downloadErr != nil {
+		return 0, c.downloadErr
+	}
+	return c.body.Read(b)
+}
+
+func (c *splitHTTPConn) Write(b []byte) (int, error) {
+	if c.upload != nil {
+		return c.upload.Write(b)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > xhttpMaxPostBytes {
+			chunk = chunk[:xhttpMaxPostBytes]
+		}
+		if err := c.post(chunk); err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// post sends a packet-up request, numbered so that the server reorders them.
+func (c *splitHTTPConn) post(chunk []byte) error {
+	ctx, cancel := context.WithTimeout(c.ctx, xhttpResponseTimeout)
+	defer cancel()
+	path := c.sessionPath + "/" + strconv.Itoa(c.sequence)
+	request, err := c.instance.newRequest(ctx, http.MethodPost, path, bytes.NewReader(chunk), c.options)
+	if err != nil {
+		return err
+	}
+	response, err := c.instance.client.Do(request)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("xhttp upload failed: %s", response.Status)
+	}
+	c.sequence++
+	return nil
+}
+
+func (c *splitHTTPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		if c.upload != nil {
+			_ = c.upload.Close()
+		}
+		go func() {
+			<-c.download
+			if c.body != nil {
+				_ = c.body.Close()
+			}
+		}()
+	})
+	return nil
+}
+
+func (c *splitHTTPConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *splitHTTPConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *splitHTTPConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *splitHTTPConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *splitHTTPConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,457 @@
+package libcore
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	"github.com/Dreamacro/clash/component/dialer"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	ss2022SessionSubkey  = "shadowsocks 2022 session subkey"
+	ss2022IdentitySubkey = "shadowsocks 2022 identity subkey"
+	ss2022MaxPayload     = 0xffff
+	ss2022MaxPadding     = 900
+	ss2022TimeWindow     = 30 * time.Second
+	ss2022TypeClient     = 0
+	ss2022TypeServer     = 1
+)
+
+var ss2022Ciphers = []string{
+	"2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm",
+	"2022-blake3-chacha20-poly1305",
+}
+
+func isShadowsocks2022(cipher string) bool {
+	return strings.HasPrefix(strings.ToLower(cipher), "2022-")
+}
+
+// shadowsocks2022Instance is a Shadowsocks 2022 (SIP022) client. Identity keys
+// of relays (SIP023 extensible identity headers) precede the user key.
+type shadowsocks2022Instance struct {
+	*outbound.Base
+	server string
+	chacha bool
+	aead   func(key []byte) (cipher.AEAD, error)
+	key    []byte
+	// identity keys and the truncated hashes of the keys following them
+	identityKeys   [][]byte
+	identityHashes [][]byte
+}
+
+// newShadowsocks2022Instance parses password as base64 keys separated by
+// colons, the last one being the user key.
+func newShadowsocks2022Instance(server string, port int32, password string, method string, udp bool) (*shadowsocks2022Instance, error) {
+	instance := &shadowsocks2022Instance{}
+	var keySize int
+	switch strings.ToLower(method) {
+	case "2022-blake3-aes-128-gcm":
+		keySize, instance.aead = 16, aesGcm
+	case "2022-blake3-aes-256-gcm":
+		keySize, instance.aead = 32, aesGcm
+	case "2022-blake3-chacha20-poly1305":
+		keySize, instance.aead, instance.chacha = chacha20poly1305.KeySize, chacha20poly1305.New, true
+	default:
+		return nil, fmt.Errorf("unsupported shadowsocks 2022 cipher %s, expected one of %s", method, strings.Join(ss2022Ciphers, ", "))
+	}
+
+	var keys [][]byte
+	for index, item := range strings.Split(password, ":") {
+		key, err := base64.StdEncoding.DecodeString(item)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "decode key %d of the password", index+1)
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("%s requires %d byte keys, key %d of the password has %d bytes", method, keySize, index+1, len(key))
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) > 1 && instance.chacha {
+		return nil, fmt.Errorf("%s does not support identity headers, use a single key", method)
+	}
+	instance.key = keys[len(keys)-1]
+	instance.identityKeys = keys[:len(keys)-1]
+	for _, next := range keys[1:] {
+		instance.identityHashes = append(instance.identityHashes, blake3Sum256(next)[:aes.BlockSize])
+	}
+
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	instance.server = address
+	instance.Base = outbound.NewBase("shadowsocks-2022", address, clashC.Shadowsocks, udp)
+	return instance, nil
+}
+
+func (s *shadowsocks2022Instance) sessionCipher(salt []byte) (cipher.AEAD, error) {
+	material := make([]byte, 0, len(s.key)+len(salt))
+	material = append(append(material, s.key...), salt...)
+	return s.aead(blake3DeriveKey(ss2022SessionSubkey, material, len(s.key)))
+}
+
+func ss2022Timestamp() []byte {
+	return appendUint64(nil, uint64(time.Now().Unix()))
+}
+
+func ss2022CheckTimestamp(timestamp uint64) error {
+	diff := time.Since(time.Unix(int64(timestamp), 0))
+	if diff > ss2022TimeWindow || diff < -ss2022TimeWindow {
+		return fmt.Errorf("server time differs by %s, check the system clock", diff.Round(time.Second))
+	}
+	return nil
+}
+
+func ss2022Padding() ([]byte, error) {
+	length, err := rand.Int(rand.Reader, big.NewInt(ss2022MaxPadding))
+	if err != nil {
+		return nil, err
+	}
+	padding := make([]byte, length.Int64()+1)
+	_, err = rand.Read(padding)
+	return padding, err
+}
+
+func (s *shadowsocks2022Instance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	conn, err := dialServer(ctx, "tcp", s.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(conn)
+	ssConn, err := s.handshake(conn, socks5.ParseAddr(metadata.RemoteAddress()))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return outbound.NewConn(ssConn, s), nil
+}
+
+// handshake sends the request header with padding right away, so that
+// protocols where the server speaks first work.
+func (s *shadowsocks2022Instance) handshake(conn net.Conn, destination socks5.Addr) (*ss2022Conn, error) {
+	salt := make([]byte, len(s.key))
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	writer, err := s.sessionCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	request := append([]byte(nil), salt...)
+	for index, identityKey := range s.identityKeys {
+		material := append(append([]byte(nil), identityKey...), salt...)
+		block, err := aes.NewCipher(blake3DeriveKey(ss2022IdentitySubkey, material, len(identityKey)))
+		if err != nil {
+			return nil, err
+		}
+		header := make([]byte, aes.BlockSize)
+		block.Encrypt(header, s.identityHashes[index])
+		request = append(request, header...)
+	}
+
+	padding, err := ss2022Padding()
+	if err != nil {
+		return nil, err
+	}
+	variable := append([]byte(nil), destination...)
+	variable = appendUint16(variable, uint16(len(padding)))
+	variable = append(variable, padding...)
+	fixed := append([]byte{ss2022TypeClient}, ss2022Timestamp()...)
+	fixed = appendUint16(fixed, uint16(len(variable)))
+
+	c := &ss2022Conn{
+		Conn:        conn,
+		instance:    s,
+		requestSalt: salt,
+		writer:      writer,
+		writeNonce:  make([]byte, writer.NonceSize()),
+	}
+	request = c.seal(request, fixed)
+	request = c.seal(request, variable)
+	if _, err = conn.Write(request); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *shadowsocks2022Instance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", s.server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	pc := &ss2022PacketConn{
+		PacketConn: conn,
+		instance:   s,
+		server:     serverAddr,
+	}
+	var sessionID [8]byte
+	if _, err = rand.Read(sessionID[:]); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	pc.sessionID = binary.BigEndian.Uint64(sessionID[:])
+	if !s.chacha {
+		if pc.writer, err = s.sessionCipher(sessionID[:]); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return newPacketConn(pc, s), nil
+}
+
+type ss2022Conn struct {
+	net.Conn
+	instance    *shadowsocks2022Instance
+	requestSalt []byte
+
+	writer     cipher.AEAD
+	writeNonce []byte
+
+	reader    cipher.AEAD
+	readNonce []byte
+	pending   []byte
+}
+
+func (c *ss2022Conn) seal(dst []byte, plaintext []byte) []byte {
+	dst = c.writer.Seal(dst, c.writeNonce, plaintext, nil)
+	increaseNonce(c.writeNonce)
+	return dst
+}
+
+func (c *ss2022Conn) open(size int) ([]byte, error) {
+	buf := make([]byte, size+c.reader.Overhead())
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.reader.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	increaseNonce(c.readNonce)
+	return plaintext, nil
+}
+
+func (c *ss2022Conn) Write(b []byte) (int, error) {
+	var out []byte
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > ss2022MaxPayload {
+			chunk = chunk[:ss2022MaxPayload]
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(chunk)))
+		out = c.seal(out, length[:])
+		out = c.seal(out, chunk)
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// readResponseHeader checks the response header, which must answer the
+// request salt, and returns the initial payload.
+func (c *ss2022Conn) readResponseHeader() ([]byte, error) {
+	salt := make([]byte, len(c.instance.key))
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return nil, err
+	}
+	reader, err := c.instance.sessionCipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	c.reader = reader
+	c.readNonce = make([]byte, reader.NonceSize())
+
+	header, err := c.open(1 + 8 + len(salt) + 2)
+	if err != nil {
+		return nil, errors.WithMessage(err, "decrypt response header, check the key")
+	}
+	if header[0] != ss2022TypeServer {
+		return nil, fmt.Errorf("unexpected response header type %d", header[0])
+	}
+	if err = ss2022CheckTimestamp(binary.BigEndian.Uint64(header[1:])); err != nil {
+		return nil, err
+	}
+	if string(header[9:9+len(salt)]) != string(c.requestSalt) {
+		return nil, errors.New("response header does not match the request")
+	}
+	return c.open(int(binary.BigEndian.Uint16(header[9+len(salt):])))
+}
+
+func (c *ss2022Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var err error
+		if c.reader == nil {
+			c.pending, err = c.readResponseHeader()
+		} else {
+			var length []byte
+			if length, err = c.open(2); err == nil {
+				c.pending, err = c.open(int(binary.BigEndian.Uint16(length)))
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// ss2022PacketConn is a UDP session. With AES ciphers packets start with a
+// block encrypted header of session and packet ids, followed by the body
+// sealed with the session subkey. With ChaCha20 the whole packet is sealed by
+// XChaCha20-Poly1305 with the user key.
+type ss2022PacketConn struct {
+	packetID uint64
+	net.PacketConn
+	instance  *shadowsocks2022Instance
+	server    net.Addr
+	sessionID uint64
+	writer    cipher.AEAD
+
+	// cipher of the last server session
+	serverSessionID uint64
+	reader          cipher.AEAD
+}
+
+func (c *ss2022PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	s := c.instance
+	header := appendUint64(nil, c.sessionID)
+	header = appendUint64(header, atomic.AddUint64(&c.packetID, 1)-1)
+	body := append([]byte{ss2022TypeClient}, ss2022Timestamp()...)
+	body = appendUint16(body, 0)
+	body = append(body, socks5.ParseAddrToSocksAddr(addr)...)
+	body = append(body, b...)
+
+	var packet []byte
+	if s.chacha {
+		aead, err := chacha20poly1305.NewX(s.key)
+		if err != nil {
+			return 0, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err = rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		packet = aead.Seal(nonce, nonce, append(header, body...), nil)
+	} else {
+		packetKey := s.key
+		if len(s.identityKeys) > 0 {
+			packetKey = s.identityKeys[0]
+		}
+		block, err := aes.NewCipher(packetKey)
+		if err != nil {
+			return 0, err
+		}
+		packet = make([]byte, aes.BlockSize, aes.BlockSize*(1+len(s.identityKeys))+len(body)+c.writer.Overhead())
+		block.Encrypt(packet, header)
+		for index, identityKey := range s.identityKeys {
+			identityBlock, err := aes.NewCipher(identityKey)
+			if err != nil {
+				return 0, err
+			}
+			identity := make([]byte, aes.BlockSize)
+			for i := range identity {
+				identity[i] = s.identityHashes[index][i] ^ header[i]
+			}
+			identityBlock.Encrypt(identity, identity)
+			packet = append(packet, identity...)
+		}
+		packet = c.writer.Seal(packet, header[4:16], body, nil)
+	}
+	if _, err := c.PacketConn.WriteTo(packet, c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// open decrypts a server packet into its header of session and packet ids
+// followed by the body.
+func (c *ss2022PacketConn) open(packet []byte) ([]byte, error) {
+	s := c.instance
+	if s.chacha {
+		aead, err := chacha20poly1305.NewX(s.key)
+		if err != nil {
+			return nil, err
+		}
+		if len(packet) < aead.NonceSize()+aead.Overhead() {
+			return nil, errors.New("packet too short")
+		}
+		nonce := packet[:aead.NonceSize()]
+		return aead.Open(nil, nonce, packet[len(nonce):], nil)
+	}
+
+	if len(packet) < aes.BlockSize {
+		return nil, errors.New("packet too short")
+	}
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, aes.BlockSize)
+	block.Decrypt(header, packet[:aes.BlockSize])
+	sessionID := binary.BigEndian.Uint64(header)
+	if c.reader == nil || sessionID != c.serverSessionID {
+		reader, err := s.sessionCipher(header[:8])
+		if err != nil {
+			return nil, err
+		}
+		c.reader, c.serverSessionID = reader, sessionID
+	}
+	return c.reader.Open(header, header[4:16], packet[aes.BlockSize:], nil)
+}
+
+func (c *ss2022PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+256)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		packet, err := c.open(buf[:n])
+		if err != nil {
+			continue
+		}
+		// session id, packet id, type, timestamp, client session id and padding length
+		if len(packet) < 16+1+8+8+2 || packet[16] != ss2022TypeServer {
+			continue
+		}
+		if ss2022CheckTimestamp(binary.BigEndian.Uint64(packet[17:])) != nil || binary.BigEndian.Uint64(packet[25:]) != c.sessionID {
+			continue
+		}
+		offset := 35 + int(binary.BigEndian.Uint16(packet[33:]))
+		if offset > len(packet) {
+			continue
+		}
+		packet = packet[offset:]
+		addr := socks5.SplitAddr(packet)
+		if addr == nil {
+			continue
+		}
+		return copy(b, packet[len(addr):]), addr.UDPAddr(), nil
+	}
+}
@@ -0,0 +1,177 @@
+package libcore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const aeadMaxPayload = 0x3FFF
+
+// aeadCipher is a Shadowsocks AEAD cipher, used as an extra encryption layer
+// by protocols such as trojan-go.
+type aeadCipher struct {
+	key  []byte
+	aead func(key []byte) (cipher.AEAD, error)
+}
+
+func newAeadCipher(method string, password string) (*aeadCipher, error) {
+	var keySize int
+	var aead func(key []byte) (cipher.AEAD, error)
+	switch strings.ToLower(method) {
+	case "aes-128-gcm":
+		keySize, aead = 16, aesGcm
+	case "aes-256-gcm", "":
+		keySize, aead = 32, aesGcm
+	case "chacha20-ietf-poly1305", "chacha20-poly1305":
+		keySize, aead = chacha20poly1305.KeySize, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("unsupported aead method %s", method)
+	}
+	return &aeadCipher{key: evpBytesToKey(password, keySize), aead: aead}, nil
+}
+
+func aesGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func evpBytesToKey(password string, keySize int) []byte {
+	var key, prev []byte
+	for len(key) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+func (c *aeadCipher) subkey(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.aead(subkey)
+}
+
+func (c *aeadCipher) streamConn(conn net.Conn) net.Conn {
+	return &aeadConn{Conn: conn, cipher: c}
+}
+
+type aeadConn struct {
+	net.Conn
+	cipher *aeadCipher
+
+	writer     cipher.AEAD
+	writeNonce []byte
+
+	reader    cipher.AEAD
+	readNonce []byte
+	pending   []byte
+}
+
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *aeadConn) Write(b []byte) (int, error) {
+	var out []byte
+	if c.writer == nil {
+		salt := make([]byte, len(c.cipher.key))
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		writer, err := c.cipher.subkey(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writer = writer
+		c.writeNonce = make([]byte, writer.NonceSize())
+		out = salt
+	}
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > aeadMaxPayload {
+			chunk = chunk[:aeadMaxPayload]
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(chunk)))
+		out = c.writer.Seal(out, c.writeNonce, length[:], nil)
+		increaseNonce(c.writeNonce)
+		out = c.writer.Seal(out, c.writeNonce, chunk, nil)
+		increaseNonce(c.writeNonce)
+		b = b[len(chunk):]
+		written += len(chunk)
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+func (c *aeadConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.reader == nil {
+		salt := make([]byte, len(c.cipher.key))
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return 0, err
+		}
+		reader, err := c.cipher.subkey(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.reader = reader
+		c.readNonce = make([]byte, reader.NonceSize())
+	}
+
+	overhead := c.reader.Overhead()
+	buf := make([]byte, 2+overhead)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	length, err := c.reader.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increaseNonce(c.readNonce)
+
+	buf = make([]byte, int(binary.BigEndian.Uint16(length)&aeadMaxPayload)+overhead)
+	if _, err = io.ReadFull(c.Conn, buf); err != nil {
+		return 0, err
+	}
+	payload, err := c.reader.Open(buf[:0], c.readNonce, buf, nil)
+	if err != nil {
+		return 0, err
+	}
+	increaseNonce(c.readNonce)
+
+	n := copy(b, payload)
+	c.pending = payload[n:]
+	return n, nil
+}
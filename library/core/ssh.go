@@ -0,0 +1,154 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const sshTimeout = 10 * time.Second
+
+// sshInstance forwards connections through direct-tcpip channels of a shared
+// SSH client.
+type sshInstance struct {
+	*outbound.Base
+	server string
+	config *ssh.ClientConfig
+
+	access sync.Mutex
+	client *ssh.Client
+}
+
+func (s *sshInstance) getClient(ctx context.Context) (*ssh.Client, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	conn, err := dialServer(ctx, "tcp", s.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(conn)
+	_ = conn.SetDeadline(time.Now().Add(sshTimeout))
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, s.server, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(clientConn, channels, requests)
+	s.client = client
+	go func() {
+		_ = client.Wait()
+		s.access.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.access.Unlock()
+	}()
+	return client, nil
+}
+
+func (s *sshInstance) Close() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.client != nil {
+		_ = s.client.Close()
+		s.client = nil
+	}
+	return nil
+}
+
+func (s *sshInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	client, err := s.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial("tcp", metadata.RemoteAddress())
+	if err != nil {
+		return nil, err
+	}
+	return outbound.NewConn(conn, s), nil
+}
+
+func (s *sshInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported by the ssh instance")
+}
+
+// NewSSHInstance creates an SSH tunnel instance. Either password or privateKey
+// (PEM, optionally encrypted with privateKeyPassphrase) authenticates the user.
+// hostKeys holds the accepted server keys in authorized_keys format, one per
+// line; when empty any host key is accepted.
+func NewSSHInstance(socksPort int32, server string, port int32, user string, password string, privateKey string, privateKeyPassphrase string, hostKeys string) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password, &privateKey, &privateKeyPassphrase); err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:    user,
+		Timeout: sshTimeout,
+	}
+	if privateKey != "" {
+		var signer ssh.Signer
+		var err error
+		if privateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(privateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+		}
+		if err != nil {
+			return nil, errors.WithMessage(err, "parse private key")
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+	if len(config.Auth) == 0 {
+		return nil, errors.New("ssh requires a password or a private key")
+	}
+
+	var keys []ssh.PublicKey
+	for _, line := range strings.Split(hostKeys, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, errors.WithMessage(err, "parse host key")
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		log.Warnf("[SSH] no host key for %s, the server is not verified", server)
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		config.HostKeyCallback = func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			marshaled := string(key.Marshal())
+			for _, known := range keys {
+				if string(known.Marshal()) == marshaled {
+					return nil
+				}
+			}
+			return errors.Errorf("unknown host key %s %s", key.Type(), ssh.FingerprintSHA256(key))
+		}
+	}
+
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	out := &sshInstance{
+		Base:   outbound.NewBase("ssh", address, clashC.Direct, false),
+		server: address,
+		config: config,
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
@@ -143,3 +143,131 @@ func (c statsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	}
 	return
 }
+
+type ClientStats struct {
+	Address   string
+	Conn      int32
+	ConnTotal int32
+
+	Uplink        int64
+	Downlink      int64
+	UplinkTotal   int64
+	DownlinkTotal int64
+}
+
+type clientStats struct {
+	conn      int32
+	connTotal uint32
+
+	uplink        uint64
+	downlink      uint64
+	uplinkTotal   uint64
+	downlinkTotal uint64
+}
+
+type ClientTrafficListener interface {
+	UpdateClientStats(t *ClientStats)
+}
+
+// SetClientTrafficStats enables per source address traffic accounting on the inbound.
+func (s *ClashBasedInstance) SetClientTrafficStats(enabled bool) {
+	s.statsAccess.Lock()
+	defer s.statsAccess.Unlock()
+
+	if enabled && s.clientStats == nil {
+		s.clientStats = map[string]*clientStats{}
+	} else if !enabled {
+		s.clientStats = nil
+	}
+}
+
+func (s *ClashBasedInstance) getClientStats(address string) *clientStats {
+	s.statsAccess.Lock()
+	defer s.statsAccess.Unlock()
+
+	if s.clientStats == nil {
+		return nil
+	}
+	stats := s.clientStats[address]
+	if stats == nil {
+		stats = &clientStats{}
+		s.clientStats[address] = stats
+	}
+	return stats
+}
+
+func (s *ClashBasedInstance) ResetClientTraffics() {
+	s.statsAccess.Lock()
+	defer s.statsAccess.Unlock()
+
+	for address, stat := range s.clientStats {
+		atomic.StoreUint64(&stat.uplink, 0)
+		atomic.StoreUint64(&stat.downlink, 0)
+		atomic.StoreUint64(&stat.uplinkTotal, 0)
+		atomic.StoreUint64(&stat.downlinkTotal, 0)
+		if atomic.LoadInt32(&stat.conn) == 0 {
+			delete(s.clientStats, address)
+		}
+	}
+}
+
+func (s *ClashBasedInstance) ReadClientTraffics(listener ClientTrafficListener) error {
+	var stats []*ClientStats
+	s.statsAccess.Lock()
+	for address, stat := range s.clientStats {
+		export := &ClientStats{
+			Address:   address,
+			Conn:      atomic.LoadInt32(&stat.conn),
+			ConnTotal: int32(atomic.LoadUint32(&stat.connTotal)),
+		}
+
+		uplink := atomic.SwapUint64(&stat.uplink, 0)
+		uplinkTotal := atomic.AddUint64(&stat.uplinkTotal, uplink)
+		export.Uplink = int64(uplink)
+		export.UplinkTotal = int64(uplinkTotal)
+
+		downlink := atomic.SwapUint64(&stat.downlink, 0)
+		downlinkTotal := atomic.AddUint64(&stat.downlinkTotal, downlink)
+		export.Downlink = int64(downlink)
+		export.DownlinkTotal = int64(downlinkTotal)
+
+		stats = append(stats, export)
+	}
+	s.statsAccess.Unlock()
+
+	for _, stat := range stats {
+		listener.UpdateClientStats(stat)
+	}
+
+	return nil
+}
+
+// TrafficStats is the traffic of an instance since its creation, split by
+// transport.
+type TrafficStats struct {
+	TcpUplink   int64
+	TcpDownlink int64
+	UdpUplink   int64
+	UdpDownlink int64
+	// sessions since creation and currently open, a UDP session being the
+	// packets of one client address until idle
+	TcpSessions int64
+	UdpSessions int64
+	ActiveTcp   int32
+	ActiveUdp   int32
+}
+
+func (s *ClashBasedInstance) TrafficStats() *TrafficStats {
+	udpUplink := atomic.LoadUint64(&s.udpUplink)
+	udpDownlink := atomic.LoadUint64(&s.udpDownlink)
+	return &TrafficStats{
+		TcpUplink:   int64(atomic.LoadUint64(&s.uplink) - udpUplink),
+		TcpDownlink: int64(atomic.LoadUint64(&s.downlink) - udpDownlink),
+		UdpUplink:   int64(udpUplink),
+		UdpDownlink: int64(udpDownlink),
+		TcpSessions: int64(atomic.LoadUint64(&s.tcpSessions)),
+		UdpSessions: int64(atomic.LoadUint64(&s.udpSessions)),
+		ActiveTcp:   atomic.LoadInt32(&s.activeRelay),
+		ActiveUdp:   atomic.LoadInt32(&s.activeUdp),
+	}
+}
@@ -0,0 +1,84 @@
+package libcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StreamConn wraps a connection dialed through an instance for use from Java.
+type StreamConn struct {
+	conn net.Conn
+}
+
+// Dial connects to address ("host:port") through the instance, without going
+// through the local SOCKS inbound.
+func (s *ClashBasedInstance) Dial(network string, address string, timeoutMs int32) (*StreamConn, error) {
+	ctx := context.Background()
+	if timeoutMs > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+	conn, err := s.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamConn{conn: conn}, nil
+}
+
+// Read reads up to maxLength bytes, returning an empty array at end of stream.
+func (c *StreamConn) Read(maxLength int32) ([]byte, error) {
+	if maxLength <= 0 {
+		return nil, errors.New("maxLength must be positive")
+	}
+	buf := make([]byte, maxLength)
+	n, err := c.conn.Read(buf)
+	if err == io.EOF {
+		return buf[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (c *StreamConn) Write(b []byte) (int32, error) {
+	n, err := c.conn.Write(b)
+	return int32(n), err
+}
+
+func deadline(timeoutMs int64) time.Time {
+	if timeoutMs <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+}
+
+// SetTimeout sets read and write deadlines timeoutMs milliseconds from now, 0 clears them.
+func (c *StreamConn) SetTimeout(timeoutMs int64) error {
+	return c.conn.SetDeadline(deadline(timeoutMs))
+}
+
+func (c *StreamConn) SetReadTimeout(timeoutMs int64) error {
+	return c.conn.SetReadDeadline(deadline(timeoutMs))
+}
+
+func (c *StreamConn) SetWriteTimeout(timeoutMs int64) error {
+	return c.conn.SetWriteDeadline(deadline(timeoutMs))
+}
+
+func (c *StreamConn) LocalAddress() string {
+	return c.conn.LocalAddr().String()
+}
+
+func (c *StreamConn) RemoteAddress() string {
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *StreamConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,36 @@
+package libcore
+
+import "encoding/binary"
+
+const (
+	StunModeDefault int32 = iota
+	// StunModeProxy tags STUN flows with the "stun-in" inbound tag, so that
+	// routing can pin them to the proxy instead of a direct outbound.
+	StunModeProxy
+	StunModeBlock
+)
+
+const stunMagicCookie = 0x2112A442
+
+type StunListener interface {
+	OnStunRequest(uid int32, destination string, blocked bool)
+}
+
+// SetStunGuard controls STUN traffic, which WebRTC uses to discover the public
+// address, reporting each detected request to listener.
+func (t *Tun2socks) SetStunGuard(mode int32, listener StunListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.stunMode = mode
+	t.stunListener = listener
+}
+
+func isStunPacket(data []byte) bool {
+	if len(data) < 20 || data[0]&0xC0 != 0 {
+		return false
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return false
+	}
+	return int(binary.BigEndian.Uint16(data[2:4]))+20 <= len(data)
+}
@@ -0,0 +1,147 @@
+package libcore
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const templateMaxProfiles = 1024
+
+var templateVariable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandProfileTemplate expands a JSON profile referencing variables as
+// "${name}" into concrete profiles, returned as a JSON array. variables is a
+// JSON object: plain values are substituted as is, arrays and port ranges
+// ({"from": 8000, "to": 8010}) produce one profile per value, for every
+// combination. A string holding only a placeholder takes the type of the
+// value, so "${port}" becomes a number.
+func ExpandProfileTemplate(template string, variables string) (string, error) {
+	var profile interface{}
+	if err := json.Unmarshal([]byte(template), &profile); err != nil {
+		return "", errors.WithMessage(err, "parse template")
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(variables), &raw); err != nil {
+		return "", errors.WithMessage(err, "parse variables")
+	}
+
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	choices := make([][]interface{}, len(names))
+	total := 1
+	for i, name := range names {
+		values, err := templateValues(raw[name])
+		if err != nil {
+			return "", errors.WithMessagef(err, "variable %s", name)
+		}
+		choices[i] = values
+		total *= len(values)
+		if total > templateMaxProfiles {
+			return "", fmt.Errorf("template expands to more than %d profiles", templateMaxProfiles)
+		}
+	}
+
+	profiles := make([]interface{}, 0, total)
+	binding := map[string]interface{}{}
+	for n := 0; n < total; n++ {
+		index := n
+		for i := len(names) - 1; i >= 0; i-- {
+			binding[names[i]] = choices[i][index%len(choices[i])]
+			index /= len(choices[i])
+		}
+		expanded, err := expandTemplateValue(profile, binding)
+		if err != nil {
+			return "", err
+		}
+		profiles = append(profiles, expanded)
+	}
+
+	content, err := json.Marshal(profiles)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func templateValues(value interface{}) ([]interface{}, error) {
+	switch value := value.(type) {
+	case []interface{}:
+		if len(value) == 0 {
+			return nil, errors.New("empty list")
+		}
+		return value, nil
+	case map[string]interface{}:
+		from, fromOk := value["from"].(float64)
+		to, toOk := value["to"].(float64)
+		if !fromOk || !toOk || from > to {
+			return nil, errors.New("invalid range")
+		}
+		if to-from >= templateMaxProfiles {
+			return nil, errors.New("range too large")
+		}
+		var values []interface{}
+		for i := from; i <= to; i++ {
+			values = append(values, i)
+		}
+		return values, nil
+	}
+	return []interface{}{value}, nil
+}
+
+func expandTemplateValue(value interface{}, binding map[string]interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		if match := templateVariable.FindStringSubmatch(value); match != nil && match[0] == value {
+			bound, ok := binding[match[1]]
+			if !ok {
+				return nil, fmt.Errorf("undefined variable %s", match[1])
+			}
+			return bound, nil
+		}
+		var undefined string
+		expanded := templateVariable.ReplaceAllStringFunc(value, func(placeholder string) string {
+			name := placeholder[2 : len(placeholder)-1]
+			bound, ok := binding[name]
+			if !ok {
+				undefined = name
+				return placeholder
+			}
+			if s, isString := bound.(string); isString {
+				return s
+			}
+			content, _ := json.Marshal(bound)
+			return string(content)
+		})
+		if undefined != "" {
+			return nil, fmt.Errorf("undefined variable %s", undefined)
+		}
+		return expanded, nil
+	case []interface{}:
+		expanded := make([]interface{}, len(value))
+		for i, item := range value {
+			var err error
+			if expanded[i], err = expandTemplateValue(item, binding); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	case map[string]interface{}:
+		expanded := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			var err error
+			if expanded[key], err = expandTemplateValue(item, binding); err != nil {
+				return nil, err
+			}
+		}
+		return expanded, nil
+	}
+	return value, nil
+}
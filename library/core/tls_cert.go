@@ -0,0 +1,100 @@
+package libcore
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pkcs12"
+)
+
+type ClientCertificate struct {
+	CertificatePem string
+	KeyPem         string
+}
+
+// ParsePKCS12 converts a PKCS#12 blob into PEM encoded certificate chain and key.
+func ParsePKCS12(data []byte, password string) (*ClientCertificate, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode pkcs12")
+	}
+	var certificate, key strings.Builder
+	for _, block := range blocks {
+		block.Headers = nil
+		if block.Type == "CERTIFICATE" {
+			_ = pem.Encode(&certificate, block)
+		} else if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			_ = pem.Encode(&key, block)
+		}
+	}
+	cert := &ClientCertificate{
+		CertificatePem: certificate.String(),
+		KeyPem:         key.String(),
+	}
+	if _, err = cert.load(); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func NewClientCertificate(certificatePem string, keyPem string) (*ClientCertificate, error) {
+	cert := &ClientCertificate{
+		CertificatePem: certificatePem,
+		KeyPem:         keyPem,
+	}
+	if _, err := cert.load(); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func (c *ClientCertificate) load() (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair([]byte(c.CertificatePem), []byte(c.KeyPem))
+	if err != nil {
+		return cert, errors.WithMessage(err, "load client certificate")
+	}
+	return cert, nil
+}
+
+// XrayCertificateJson returns the certificate as an entry of xray's
+// tlsSettings.certificates, for outbounds configured through V2RayInstance.
+func (c *ClientCertificate) XrayCertificateJson() (string, error) {
+	content, err := json.Marshal(c.xrayCertificate())
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func (c *ClientCertificate) xrayCertificate() map[string]interface{} {
+	return map[string]interface{}{
+		"usage":       "encipherment",
+		"certificate": strings.Split(strings.TrimSpace(c.CertificatePem), "\n"),
+		"key":         strings.Split(strings.TrimSpace(c.KeyPem), "\n"),
+	}
+}
+
+// clientCertificate loads the optional client certificate of an instance,
+// nil when both certificatePem and keyPem are empty.
+func clientCertificate(certificatePem string, keyPem string) (*ClientCertificate, error) {
+	if certificatePem == "" && keyPem == "" {
+		return nil, nil
+	}
+	return NewClientCertificate(certificatePem, keyPem)
+}
+
+// clientTLSConfig applies the optional client certificate to a tls config.
+func clientTLSConfig(config *tls.Config, cert *ClientCertificate) (*tls.Config, error) {
+	if cert == nil {
+		return config, nil
+	}
+	certificate, err := cert.load()
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{certificate}
+	return config, nil
+}
@@ -0,0 +1,183 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/Dreamacro/clash/transport/trojan"
+	"github.com/pkg/errors"
+)
+
+// splitList splits a comma separated parameter, ignoring empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// NewTrojanInstance creates a Trojan instance. network is "tcp" (or empty),
+// "ws", "grpc", "httpupgrade" or "xhttp" (using wsPath and wsHost), alpn is
+// comma separated. clientCert and clientKey are the optional PEM encoded
+// client certificate chain and key, for servers requiring mutual TLS, not
+// supported over ws and grpc.
+func NewTrojanInstance(socksPort int32, server string, port int32, password string, sni string, skipCertVerify bool, alpn string, network string, wsPath string, wsHost string, grpcServiceName string, clientCert string, clientKey string) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password); err != nil {
+		return nil, err
+	}
+	cert, err := clientCertificate(clientCert, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	option := outbound.TrojanOption{
+		Server:         server,
+		Port:           int(port),
+		Password:       password,
+		SNI:            sni,
+		SkipCertVerify: skipCertVerify,
+		ALPN:           splitList(alpn),
+		UDP:            true,
+	}
+	if cert != nil && (network == "ws" || network == "grpc") {
+		return nil, fmt.Errorf("client certificate is not supported over %s", network)
+	}
+	switch network {
+	case "", "tcp":
+		if cert != nil {
+			return newTrojanTransportInstance(socksPort, "tcp", option, cert, "", "")
+		}
+	case "ws":
+		// the Trojan adapter of Clash has no websocket transport, which is the
+		// one of trojan-go without its Shadowsocks layer
+		if wsPath == "" {
+			wsPath = "/"
+		}
+		return NewTrojanGoInstance(socksPort, server, port, password, sni, skipCertVerify, wsPath, wsHost, "", "")
+	case "grpc":
+		option.Network = "grpc"
+		option.GrpcOpts = outbound.GrpcOptions{GrpcServiceName: grpcServiceName}
+	case "httpupgrade", "xhttp", "splithttp":
+		return newTrojanTransportInstance(socksPort, network, option, cert, wsPath, wsHost)
+	default:
+		return nil, fmt.Errorf("unsupported trojan network %s", network)
+	}
+	out, err := outbound.NewTrojan(option)
+	if err != nil {
+		return nil, err
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
+
+// newTrojanTransportInstance runs Trojan over the transports implemented here,
+// inside their TLS layer, or directly over TLS for "tcp".
+func newTrojanTransportInstance(socksPort int32, network string, option outbound.TrojanOption, cert *ClientCertificate, path string, host string) (*ClashBasedInstance, error) {
+	address := net.JoinHostPort(option.Server, strconv.Itoa(option.Port))
+	sni := option.SNI
+	if sni == "" {
+		sni = option.Server
+	}
+	if host == "" {
+		host = sni
+	}
+	base := outbound.NewBase("trojan", address, clashC.Trojan, false)
+	tlsConfig, err := clientTLSConfig(&tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: option.SkipCertVerify,
+		NextProtos:         option.ALPN,
+	}, cert)
+	if err != nil {
+		return nil, err
+	}
+	protocol := &trojanProtocol{trojan: trojan.New(&trojan.Option{
+		Password:       option.Password,
+		ServerName:     sni,
+		SkipCertVerify: option.SkipCertVerify,
+	})}
+	switch network {
+	case "tcp":
+		return newClashBasedInstance(socksPort, &trojanTLSInstance{
+			Base:      outbound.NewBase("trojan", address, clashC.Trojan, true),
+			server:    address,
+			tlsConfig: tlsConfig,
+			protocol:  protocol,
+		}), nil
+	case "httpupgrade":
+		return newClashBasedInstance(socksPort, &httpUpgradeInstance{
+			Base:      base,
+			server:    address,
+			tlsConfig: tlsConfig,
+			host:      host,
+			path:      path,
+			protocol:  protocol,
+		}), nil
+	}
+	return newClashBasedInstance(socksPort, newSplitHTTPInstance(base, address, tlsConfig, host, path, protocol)), nil
+}
+
+// trojanTLSInstance runs Trojan over a TLS connection configured here, for
+// the options the Clash adapter does not take, such as client certificates.
+type trojanTLSInstance struct {
+	*outbound.Base
+	server    string
+	tlsConfig *tls.Config
+	protocol  *trojanProtocol
+}
+
+func (t *trojanTLSInstance) dialTLS(ctx context.Context) (conn net.Conn, err error) {
+	rawConn, err := dialServer(ctx, "tcp", t.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(rawConn)
+	defer func() {
+		safeConnClose(rawConn, err)
+	}()
+
+	tlsConn := tls.Client(rawConn, t.tlsConfig)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tlsConn.SetDeadline(deadline)
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		return nil, errors.WithMessage(err, "tls handshake")
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (t *trojanTLSInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	conn, err := t.dialTLS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trojanConn, err := t.protocol.StreamConn(conn, metadata)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return outbound.NewConn(trojanConn, t), nil
+}
+
+func (t *trojanTLSInstance) DialUDP(metadata *clashC.Metadata) (clashC.PacketConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clashC.DefaultTCPTimeout)
+	defer cancel()
+	conn, err := t.dialTLS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.protocol.trojan.WriteHeader(conn, trojan.CommandUDP, socks5.ParseAddr(metadata.RemoteAddress())); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return newPacketConn(t.protocol.trojan.PacketConn(conn), t), nil
+}
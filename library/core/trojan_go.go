@@ -0,0 +1,100 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/Dreamacro/clash/transport/trojan"
+	"github.com/Dreamacro/clash/transport/vmess"
+	"github.com/pkg/errors"
+)
+
+// trojanGoInstance speaks the trojan-go layering: TLS, then optionally a
+// websocket and a Shadowsocks AEAD layer, then the Trojan request.
+type trojanGoInstance struct {
+	*outbound.Base
+	server    string
+	trojan    *trojan.Trojan
+	websocket *vmess.WebsocketConfig
+	aead      *aeadCipher
+}
+
+func (t *trojanGoInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	rawConn, err := dialServer(ctx, "tcp", t.server)
+	if err != nil {
+		return nil, err
+	}
+	tcpKeepAlive(rawConn)
+	defer func() {
+		safeConnClose(rawConn, err)
+	}()
+
+	conn, err := t.trojan.StreamConn(rawConn)
+	if err != nil {
+		return nil, errors.WithMessage(err, "tls handshake")
+	}
+	if t.websocket != nil {
+		conn, err = vmess.StreamWebsocketConn(conn, t.websocket, nil)
+		if err != nil {
+			return nil, errors.WithMessage(err, "websocket handshake")
+		}
+	}
+	if t.aead != nil {
+		conn = t.aead.streamConn(conn)
+	}
+	err = t.trojan.WriteHeader(conn, trojan.CommandTCP, socks5.ParseAddr(metadata.RemoteAddress()))
+	if err != nil {
+		return nil, err
+	}
+	return outbound.NewConn(conn, t), nil
+}
+
+func (t *trojanGoInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported by the trojan-go instance")
+}
+
+// NewTrojanGoInstance creates an instance for trojan-go servers, which may
+// require a websocket (wsPath not empty) and a Shadowsocks AEAD layer (ssMethod
+// not empty, such as "aes-128-gcm") that plain Trojan clients do not speak.
+func NewTrojanGoInstance(socksPort int32, server string, port int32, password string, sni string, skipCertVerify bool, wsPath string, wsHost string, ssMethod string, ssPassword string) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&password, &ssPassword); err != nil {
+		return nil, err
+	}
+	if sni == "" {
+		sni = server
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	out := &trojanGoInstance{
+		Base:   outbound.NewBase("trojan-go", address, clashC.Trojan, false),
+		server: address,
+		trojan: trojan.New(&trojan.Option{
+			Password:       password,
+			ServerName:     sni,
+			SkipCertVerify: skipCertVerify,
+		}),
+	}
+	if wsPath != "" {
+		if wsHost == "" {
+			wsHost = sni
+		}
+		out.websocket = &vmess.WebsocketConfig{
+			Host:    wsHost,
+			Port:    strconv.Itoa(int(port)),
+			Path:    wsPath,
+			Headers: http.Header{"Host": []string{wsHost}},
+		}
+	}
+	if ssMethod != "" {
+		aead, err := newAeadCipher(ssMethod, ssPassword)
+		if err != nil {
+			return nil, err
+		}
+		out.aead = aead
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
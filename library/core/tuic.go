@@ -0,0 +1,600 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const (
+	TuicUdpNative = "native"
+	TuicUdpQuic   = "quic"
+)
+
+const (
+	tuicVersion           = 5
+	tuicDefaultALPN       = "h3"
+	tuicHeartbeat         = 10 * time.Second
+	tuicMaxDatagram       = 1200
+	tuicPacketHeaderSize  = 10
+	tuicMaxPendingPackets = 64
+	tuicAddressNone       = 0xff
+	tuicAddressDomain     = 0x00
+	tuicAddressIPv4       = 0x01
+	tuicAddressIPv6       = 0x02
+	tuicCommandAuth       = 0x00
+	tuicCommandConnect    = 0x01
+	tuicCommandPacket     = 0x02
+	tuicCommandDissociate = 0x03
+	tuicCommandHeartbeat  = 0x04
+)
+
+// tuicInstance is a TUIC v5 client. TCP is relayed over bidirectional streams,
+// UDP over datagrams (native mode) or unidirectional streams (quic mode).
+type tuicInstance struct {
+	*outbound.Base
+	server       string
+	tlsConfig    *tls.Config
+	uuid         []byte
+	password     []byte
+	udpRelayMode string
+	congestion   *congestionConfig
+	options      *socketOptions
+
+	access  sync.Mutex
+	session quic.Session
+	conn    *rebindablePacketConn
+
+	assocAccess  sync.Mutex
+	associations map[uint16]*tuicPacketConn
+	nextAssoc    uint16
+}
+
+func (t *tuicInstance) socketOptions() *socketOptions {
+	return t.options
+}
+
+func (t *tuicInstance) getSession(ctx context.Context) (quic.Session, error) {
+	t.access.Lock()
+	defer t.access.Unlock()
+	if t.session != nil {
+		select {
+		case <-t.session.Context().Done():
+			t.closeSession()
+		default:
+			return t.session, nil
+		}
+	}
+
+	session, conn, err := t.dialSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.session = session
+	t.conn = conn
+	go t.receiveStreams(session)
+	if t.udpRelayMode == TuicUdpNative {
+		go t.receiveDatagrams(session)
+		go t.heartbeat(session)
+	}
+	return session, nil
+}
+
+func (t *tuicInstance) dialSession(ctx context.Context) (quic.Session, *rebindablePacketConn, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp", t.server)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := listenRebindable(t.options)
+	if err != nil {
+		return nil, nil, err
+	}
+	tracer := t.congestion.newTracer()
+	session, err := quic.DialContext(ctx, conn, serverAddr, t.tlsConfig.ServerName, t.tlsConfig, &quic.Config{
+		KeepAlive:       true,
+		MaxIdleTimeout:  30 * time.Second,
+		EnableDatagrams: t.udpRelayMode == TuicUdpNative,
+		Tracer:          tracer,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	tracer.install(session)
+	if err = t.authenticate(session); err != nil {
+		_ = session.CloseWithError(0, "")
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return session, conn, nil
+}
+
+func (t *tuicInstance) closeSession() {
+	if t.session != nil {
+		_ = t.session.CloseWithError(0, "")
+		t.session = nil
+	}
+	if t.conn != nil {
+		_ = t.conn.Close()
+		t.conn = nil
+	}
+}
+
+func (t *tuicInstance) Close() error {
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.closeSession()
+	return nil
+}
+
+// authenticate sends the uuid and a token exported from the TLS session,
+// keyed by the uuid and the password.
+func (t *tuicInstance) authenticate(session quic.Session) error {
+	state := session.ConnectionState().TLS
+	token, err := state.ExportKeyingMaterial(string(t.uuid), t.password, 32)
+	if err != nil {
+		return errors.WithMessage(err, "export token")
+	}
+	stream, err := session.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	request := make([]byte, 0, 2+len(t.uuid)+len(token))
+	request = append(request, tuicVersion, tuicCommandAuth)
+	request = append(request, t.uuid...)
+	request = append(request, token...)
+	if _, err = stream.Write(request); err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+func (t *tuicInstance) heartbeat(session quic.Session) {
+	ticker := time.NewTicker(tuicHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.Context().Done():
+			return
+		case <-ticker.C:
+			if err := session.SendMessage([]byte{tuicVersion, tuicCommandHeartbeat}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (t *tuicInstance) receiveDatagrams(session quic.Session) {
+	for {
+		message, err := session.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		t.handlePacket(message)
+	}
+}
+
+func (t *tuicInstance) receiveStreams(session quic.Session) {
+	for {
+		stream, err := session.AcceptUniStream(session.Context())
+		if err != nil {
+			return
+		}
+		go func() {
+			message, err := ioutil.ReadAll(io.LimitReader(stream, 0xffff+tuicPacketHeaderSize+260))
+			if err != nil {
+				return
+			}
+			t.handlePacket(message)
+		}()
+	}
+}
+
+func (t *tuicInstance) handlePacket(message []byte) {
+	if len(message) < tuicPacketHeaderSize || message[0] != tuicVersion || message[1] != tuicCommandPacket {
+		return
+	}
+	assocID := binary.BigEndian.Uint16(message[2:])
+	packet := tuicFragment{
+		packetID: binary.BigEndian.Uint16(message[4:]),
+		total:    message[6],
+		index:    message[7],
+	}
+	size := int(binary.BigEndian.Uint16(message[8:]))
+	addr, data, err := tuicReadAddress(message[tuicPacketHeaderSize:])
+	if err != nil || len(data) < size || packet.total == 0 || packet.index >= packet.total {
+		return
+	}
+	packet.addr = addr
+	packet.data = data[:size]
+
+	t.assocAccess.Lock()
+	conn := t.associations[assocID]
+	t.assocAccess.Unlock()
+	if conn != nil {
+		conn.receive(packet)
+	}
+}
+
+func (t *tuicInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	session, err := t.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.connect(ctx, session, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return outbound.NewConn(conn, t), nil
+}
+
+// dialDedicated relays the connection over a QUIC session of its own, closed
+// along with it.
+func (t *tuicInstance) dialDedicated(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	session, packetConn, err := t.dialSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.connect(ctx, session, metadata)
+	if err != nil {
+		_ = session.CloseWithError(0, "")
+		_ = packetConn.Close()
+		return nil, err
+	}
+	return outbound.NewConn(&tuicDedicatedConn{conn, packetConn}, t), nil
+}
+
+func (t *tuicInstance) connect(ctx context.Context, session quic.Session, metadata *clashC.Metadata) (*quicStreamConn, error) {
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(metadata.DstPort)
+	host := metadata.Host
+	if host == "" {
+		host = metadata.DstIP.String()
+	}
+	request := tuicAppendAddress([]byte{tuicVersion, tuicCommandConnect}, host, uint16(port))
+	if _, err = stream.Write(request); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	return &quicStreamConn{Stream: stream, session: session}, nil
+}
+
+type tuicDedicatedConn struct {
+	*quicStreamConn
+	packetConn net.PacketConn
+}
+
+func (c *tuicDedicatedConn) Close() error {
+	err := c.quicStreamConn.Close()
+	_ = c.session.CloseWithError(0, "")
+	_ = c.packetConn.Close()
+	return err
+}
+
+func (t *tuicInstance) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	session, err := t.getSession(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	conn := &tuicPacketConn{
+		instance:  t,
+		session:   session,
+		incoming:  make(chan tuicFragment, 64),
+		fragments: map[uint16][]tuicFragment{},
+		closed:    make(chan struct{}),
+	}
+
+	t.assocAccess.Lock()
+	for {
+		t.nextAssoc++
+		if _, used := t.associations[t.nextAssoc]; !used {
+			break
+		}
+	}
+	conn.assocID = t.nextAssoc
+	t.associations[conn.assocID] = conn
+	t.assocAccess.Unlock()
+	return newPacketConn(conn, t), nil
+}
+
+type tuicFragment struct {
+	packetID uint16
+	total    uint8
+	index    uint8
+	addr     net.Addr
+	data     []byte
+}
+
+// tuicPacketConn is a UDP association, identified by its assocID.
+type tuicPacketConn struct {
+	packetID uint32
+
+	instance *tuicInstance
+	session  quic.Session
+	assocID  uint16
+
+	incoming       chan tuicFragment
+	fragmentAccess sync.Mutex
+	fragments      map[uint16][]tuicFragment
+	deadline       atomic.Value
+	closed         chan struct{}
+	closeOnce      sync.Once
+}
+
+// receive reassembles fragmented packets, the address being only carried by
+// the first fragment.
+func (c *tuicPacketConn) receive(packet tuicFragment) {
+	if packet.total > 1 {
+		c.fragmentAccess.Lock()
+		defer c.fragmentAccess.Unlock()
+		fragments := c.fragments[packet.packetID]
+		if fragments == nil {
+			if len(c.fragments) >= tuicMaxPendingPackets {
+				// lost fragments never complete
+				c.fragments = map[uint16][]tuicFragment{}
+			}
+			fragments = make([]tuicFragment, packet.total)
+		} else if len(fragments) != int(packet.total) {
+			delete(c.fragments, packet.packetID)
+			return
+		}
+		fragments[packet.index] = packet
+		c.fragments[packet.packetID] = fragments
+		var data []byte
+		for _, fragment := range fragments {
+			if fragment.data == nil {
+				return
+			}
+			data = append(data, fragment.data...)
+		}
+		delete(c.fragments, packet.packetID)
+		packet.addr = fragments[0].addr
+		packet.data = data
+	}
+	if packet.addr == nil {
+		return
+	}
+	select {
+	case c.incoming <- packet:
+	case <-c.closed:
+	default:
+		// drop when the reader is too slow
+	}
+}
+
+func (c *tuicPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if deadline, ok := c.deadline.Load().(time.Time); ok && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.incoming:
+		return copy(p, packet.data), packet.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.session.Context().Done():
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, errors.New("i/o timeout")
+	}
+}
+
+func (c *tuicPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	packetID := uint16(atomic.AddUint32(&c.packetID, 1))
+	address := tuicAppendAddress(nil, host, uint16(port))
+
+	if c.instance.udpRelayMode != TuicUdpNative {
+		stream, err := c.session.OpenUniStream()
+		if err != nil {
+			return 0, err
+		}
+		if _, err = stream.Write(c.packetHeader(packetID, 1, 0, p, address)); err != nil {
+			return 0, err
+		}
+		return len(p), stream.Close()
+	}
+
+	// only the first fragment carries the address
+	chunkSize := tuicMaxDatagram - tuicPacketHeaderSize - len(address)
+	total := (len(p) + chunkSize - 1) / chunkSize
+	if total == 0 {
+		total = 1
+	}
+	if total > 0xff {
+		return 0, fmt.Errorf("packet too large: %d", len(p))
+	}
+	data := p
+	for index := 0; index < total; index++ {
+		chunk := data
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		data = data[len(chunk):]
+		if err := c.session.SendMessage(c.packetHeader(packetID, uint8(total), uint8(index), chunk, address)); err != nil {
+			return 0, err
+		}
+		address = []byte{tuicAddressNone}
+	}
+	return len(p), nil
+}
+
+func (c *tuicPacketConn) packetHeader(packetID uint16, total uint8, index uint8, data []byte, address []byte) []byte {
+	packet := make([]byte, 0, tuicPacketHeaderSize+len(address)+len(data))
+	packet = append(packet, tuicVersion, tuicCommandPacket)
+	packet = appendUint16(packet, c.assocID)
+	packet = appendUint16(packet, packetID)
+	packet = append(packet, total, index)
+	packet = appendUint16(packet, uint16(len(data)))
+	packet = append(packet, address...)
+	return append(packet, data...)
+}
+
+func (c *tuicPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.instance.assocAccess.Lock()
+		delete(c.instance.associations, c.assocID)
+		c.instance.assocAccess.Unlock()
+
+		stream, err := c.session.OpenUniStream()
+		if err != nil {
+			return
+		}
+		dissociate := appendUint16([]byte{tuicVersion, tuicCommandDissociate}, c.assocID)
+		if _, err = stream.Write(dissociate); err != nil {
+			log.Debugf("[TUIC] dissociate %d failed: %s", c.assocID, err.Error())
+		}
+		_ = stream.Close()
+	})
+	return nil
+}
+
+func (c *tuicPacketConn) LocalAddr() net.Addr {
+	return c.session.LocalAddr()
+}
+
+func (c *tuicPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *tuicPacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Store(t)
+	return nil
+}
+
+func (c *tuicPacketConn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+func tuicAppendAddress(b []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, tuicAddressIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, tuicAddressIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		b = append(b, tuicAddressDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return appendUint16(b, port)
+}
+
+// tuicReadAddress returns the address, nil for none, and the remaining bytes.
+func tuicReadAddress(b []byte) (net.Addr, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	var host string
+	switch b[0] {
+	case tuicAddressNone:
+		return nil, b[1:], nil
+	case tuicAddressIPv4:
+		if len(b) < 1+net.IPv4len+2 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		host, b = net.IP(b[1:1+net.IPv4len]).String(), b[1+net.IPv4len:]
+	case tuicAddressIPv6:
+		if len(b) < 1+net.IPv6len+2 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		host, b = net.IP(b[1:1+net.IPv6len]).String(), b[1+net.IPv6len:]
+	case tuicAddressDomain:
+		if len(b) < 2 || len(b) < 2+int(b[1])+2 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		host, b = string(b[2:2+int(b[1])]), b[2+int(b[1]):]
+	default:
+		return nil, nil, fmt.Errorf("unknown address type %d", b[0])
+	}
+	port := binary.BigEndian.Uint16(b)
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: int(port)}, b[2:], nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, b[2:], nil
+}
+
+// NewTUICInstance creates a TUIC v5 instance. udpRelayMode is "native" (the
+// default, QUIC datagrams) or "quic" (a stream per packet), alpn defaults to
+// "h3". congestion is cubic (the default) or bbr; brutal needs bandwidth hints,
+// which TUIC does not have.
+func NewTUICInstance(socksPort int32, server string, port int32, uuid string, password string, congestion string, udpRelayMode string, alpn string, sni string, skipCertVerify bool) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&uuid, &password); err != nil {
+		return nil, err
+	}
+	id, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil || len(id) != 16 {
+		return nil, fmt.Errorf("invalid uuid %q", uuid)
+	}
+	if congestion == "" {
+		congestion = CongestionCubic
+	}
+	congestionControl, err := newCongestionConfig(congestion, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch udpRelayMode {
+	case "":
+		udpRelayMode = TuicUdpNative
+	case TuicUdpNative, TuicUdpQuic:
+	default:
+		return nil, fmt.Errorf("unknown udp relay mode %q, expected native or quic", udpRelayMode)
+	}
+	protocols := splitList(alpn)
+	if len(protocols) == 0 {
+		protocols = []string{tuicDefaultALPN}
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	if sni == "" {
+		sni = server
+	}
+	out := &tuicInstance{
+		Base:   outbound.NewBase("tuic", address, clashC.Direct, true),
+		server: address,
+		tlsConfig: &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: skipCertVerify,
+			NextProtos:         protocols,
+			MinVersion:         tls.VersionTLS13,
+		},
+		uuid:         id,
+		password:     []byte(password),
+		udpRelayMode: udpRelayMode,
+		congestion:   congestionControl,
+		options:      &socketOptions{},
+		associations: map[uint16]*tuicPacketConn{},
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
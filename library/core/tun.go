@@ -3,7 +3,6 @@ package libcore
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/Dreamacro/clash/common/pool"
 	"github.com/miekg/dns"
 	"github.com/xjasonlyu/tun2socks/core"
@@ -17,13 +16,15 @@ import (
 	"io"
 	"net"
 	"os"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type Tun2socks struct {
+	bogonCount     int64
+	broadcastCount int64
+
 	access    sync.Mutex
 	stack     *stack.Stack
 	device    *rwbased.Endpoint
@@ -33,7 +34,21 @@ type Tun2socks struct {
 	udpTable  *natTable
 	fakedns   bool
 	sniffing  bool
+	sniffOnly bool
 	debug     bool
+	blockQuic int32
+	// *dnsCache, nil when disabled
+	dnsCache atomic.Value
+	prefetch *dnsPrefetch
+
+	captivePortal *captivePortal
+	killswitch    *killswitch
+	stunMode      int32
+	stunListener  StunListener
+	sniffListener SniffListener
+	ipv6Route     int32
+	bogonFilter   int32
+	broadcastMode int32
 
 	dumpUid      bool
 	trafficStats bool
@@ -94,7 +109,7 @@ func NewTun2socks(fd int32, mtu int32, v2ray *V2RayInstance, router string, hija
 		tun.appStats = map[uint16]*appStats{}
 	}
 
-	d, err := rwbased.New(file, uint32(mtu))
+	d, err := rwbased.New(mssClampDevice{file}, uint32(mtu))
 	if err != nil {
 		return nil, err
 	}
@@ -113,46 +128,87 @@ func NewTun2socks(fd int32, mtu int32, v2ray *V2RayInstance, router string, hija
 	return tun, nil
 }
 
+// SetBlockQuic drops UDP packets to port 443 so that QUIC clients fall back to TCP.
+func (t *Tun2socks) SetBlockQuic(block bool) {
+	var value int32
+	if block {
+		value = 1
+	}
+	atomic.StoreInt32(&t.blockQuic, value)
+}
+
+// SetDnsCache enables caching of hijacked DNS answers, with TTLs clamped to
+// [minTTL, maxTTL] seconds (0 means unlimited).
+func (t *Tun2socks) SetDnsCache(enabled bool, minTTL int32, maxTTL int32, serveStale bool) {
+	var cache *dnsCache
+	if enabled {
+		cache = newDnsCache(uint32(minTTL), uint32(maxTTL), serveStale)
+	}
+	t.dnsCache.Store(cache)
+}
+
+func (t *Tun2socks) currentDnsCache() *dnsCache {
+	cache, _ := t.dnsCache.Load().(*dnsCache)
+	return cache
+}
+
 func (t *Tun2socks) Close() {
 	t.access.Lock()
 	defer t.access.Unlock()
 
 	net.DefaultResolver.Dial = nil
+	if t.captivePortal != nil {
+		t.captivePortal.stop()
+	}
+	t.killswitch.stop()
+	t.killswitch = nil
+	t.prefetch.stop()
+	t.prefetch = nil
 	t.stack.Close()
 }
 
 func (t *Tun2socks) Add(conn core.TCPConn) {
 	id := conn.ID()
 
-	la := fmt.Sprintf("tcp:%s", net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort))))
-	src, err := v2rayNet.ParseDestination(la)
-	if err != nil {
-		log.Errorf("[TCP] parse source address %s failed: %s", la, err.Error())
-		return
-	}
-	if src.Address.Family().IsDomain() {
-		log.Errorf("[TCP] conn with domain src %s received: %s", la, err.Error())
-		return
+	src := v2rayNet.TCPDestination(endpointAddress(string(id.RemoteAddress)), v2rayNet.Port(id.RemotePort))
+	dest := v2rayNet.TCPDestination(endpointAddress(string(id.LocalAddress)), v2rayNet.Port(id.LocalPort))
+
+	inbound := &session.Inbound{
+		Source: src,
+		Tag:    "socks",
 	}
-	da := fmt.Sprintf("tcp:%s", net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort))))
-	dest, err := v2rayNet.ParseDestination(da)
-	if err != nil {
-		log.Errorf("[TCP] parse destination address %s failed: %s", da, err.Error())
+
+	if t.killswitch.blocking() && !t.captivePortal.active() {
+		_ = conn.Close()
 		return
 	}
-	if dest.Address.Family().IsDomain() {
-		log.Errorf("[TCP] conn with domain destination %s received: %s", da, err.Error())
-		return
+
+	if dest.Address.Family().IsIPv6() {
+		switch t.ipv6Route {
+		case TunIPv6Block:
+			_ = conn.Close()
+			return
+		case TunIPv6Direct:
+			t.relayDirect(conn, dest)
+			return
+		}
 	}
 
-	inbound := &session.Inbound{
-		Source: src,
-		Tag:    "socks",
+	switch t.bogonAction(dest) {
+	case TunBogonDrop:
+		_ = conn.Close()
+		return
+	case TunBogonDirect:
+		t.relayDirect(conn, dest)
+		return
 	}
 
 	isDns := dest.Address.String() == t.router || dest.Port == 53
 	if isDns {
 		inbound.Tag = "dns-in"
+	} else if (dest.Port == 80 || dest.Port == 443) && t.captivePortal.allows(dest.Address.IP()) {
+		t.relayDirect(conn, dest)
+		return
 	}
 
 	var uid uint16
@@ -191,12 +247,23 @@ func (t *Tun2socks) Add(conn core.TCPConn) {
 
 	ctx := session.ContextWithInbound(context.Background(), inbound)
 
+	if !isDns {
+		dest = t.restoreFakeIp(dest)
+	}
+
+	var payload []byte
 	if !isDns && t.sniffing {
 		req := session.SniffingRequest{
 			Enabled:      true,
 			MetadataOnly: false,
 		}
-		if !t.fakedns {
+		if t.sniffOnly {
+			// fake addresses still have to be resolved back
+			if t.fakedns {
+				req.OverrideDestinationForProtocol = []string{"fakedns"}
+			}
+			payload = t.sniffMetadata(conn, uid, dest)
+		} else if !t.fakedns {
 			req.OverrideDestinationForProtocol = []string{"http", "tls"}
 		} else {
 			req.OverrideDestinationForProtocol = []string{"fakedns", "http", "tls"}
@@ -213,6 +280,14 @@ func (t *Tun2socks) Add(conn core.TCPConn) {
 		return
 	}
 
+	if len(payload) > 0 {
+		if _, err = destConn.Write(payload); err != nil {
+			_ = conn.Close()
+			_ = destConn.Close()
+			return
+		}
+	}
+
 	if t.trafficStats && !self && !isDns {
 
 		t.access.Lock()
@@ -256,27 +331,66 @@ func (t *Tun2socks) AddPacket(packet core.UDPPacket) {
 
 func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 	id := packet.ID()
-	la := fmt.Sprintf("udp:%s", net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort))))
-	src, err := v2rayNet.ParseDestination(la)
-	if err != nil {
-		log.Errorf("[UDP] parse source address %s failed: %s", la, err.Error())
+	src := v2rayNet.UDPDestination(endpointAddress(string(id.RemoteAddress)), v2rayNet.Port(id.RemotePort))
+	dest := v2rayNet.UDPDestination(endpointAddress(string(id.LocalAddress)), v2rayNet.Port(id.LocalPort))
+	if atomic.LoadInt32(&t.blockQuic) != 0 && dest.Port == 443 {
+		packet.Drop()
 		return
 	}
-	if src.Address.Family().IsDomain() {
-		log.Errorf("[UDP] conn with domain src %s received: %s", la, err.Error())
+	if t.killswitch.blocking() && !t.captivePortal.active() {
+		packet.Drop()
 		return
 	}
-	da := fmt.Sprintf("udp:%s", net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort))))
-	dest, err := v2rayNet.ParseDestination(da)
-	if err != nil {
-		log.Errorf("[UDP] parse destination address %s failed: %s", da, err.Error())
+	if t.ipv6Route == TunIPv6Block && dest.Address.Family().IsIPv6() {
+		packet.Drop()
 		return
 	}
-	if dest.Address.Family().IsDomain() {
-		log.Errorf("[UDP] conn with domain destination %s received: %s", da, err.Error())
+	bogon := t.udpBogonAction(dest)
+	if bogon == TunBogonDrop {
+		packet.Drop()
 		return
 	}
 
+	if dest.Address.String() == t.router || dest.Port == 53 || t.hijackDns {
+		if reply := t.blockedAAAAResponse(packet.Data()); reply != nil {
+			_, _ = packet.WriteBack(reply, nil)
+			packet.Drop()
+			return
+		}
+		if portal := t.captivePortal; portal.active() && portal.dnsServer != "" {
+			query := dns.Msg{}
+			if err := query.Unpack(packet.Data()); err == nil && !query.Response {
+				t.captivePortalDNS(packet, portal)
+				return
+			}
+		}
+		if reply, blocked := blockedDnsResponse(packet.Data()); blocked {
+			if reply != nil {
+				_, _ = packet.WriteBack(reply, nil)
+			}
+			packet.Drop()
+			return
+		}
+		if reply := rewrittenDnsResponse(packet.Data()); reply != nil {
+			_, _ = packet.WriteBack(reply, nil)
+			packet.Drop()
+			return
+		}
+		if cache := t.currentDnsCache(); cache != nil {
+			query := dns.Msg{}
+			if err := query.Unpack(packet.Data()); err == nil && !query.Response {
+				if reply, refresh := cache.lookup(&query); reply != nil {
+					_, _ = packet.WriteBack(reply, nil)
+					packet.Drop()
+					if refresh {
+						go t.refreshDns(cache, &query, dest)
+					}
+					return
+				}
+			}
+		}
+	}
+
 	natKey := src.NetAddr()
 
 	sendTo := func(drop bool) bool {
@@ -378,6 +492,18 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 
 	}
 
+	if t.stunMode != StunModeDefault && !isDns && isStunPacket(packet.Data()) {
+		blocked := t.stunMode == StunModeBlock
+		if listener := t.stunListener; listener != nil {
+			listener.OnStunRequest(int32(uid), dest.NetAddr(), blocked)
+		}
+		if blocked {
+			packet.Drop()
+			return
+		}
+		inbound.Tag = "stun-in"
+	}
+
 	ctx := session.ContextWithInbound(context.Background(), inbound)
 
 	if !isDns && t.sniffing {
@@ -385,7 +511,11 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 			Enabled:      true,
 			MetadataOnly: false,
 		}
-		if !t.fakedns {
+		if t.sniffOnly {
+			if t.fakedns {
+				req.OverrideDestinationForProtocol = []string{"fakedns"}
+			}
+		} else if !t.fakedns {
 			req.OverrideDestinationForProtocol = []string{"http", "tls"}
 		} else {
 			req.OverrideDestinationForProtocol = []string{"fakedns", "http", "tls"}
@@ -395,7 +525,15 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 		})
 	}
 
-	conn, err := v2rayCore.DialUDP(ctx, t.v2ray.core)
+	var conn net.PacketConn
+	var err error
+	if bogon == TunBogonDirect && isBroadcast(dstIp) {
+		conn, err = listenBroadcastUDP()
+	} else if bogon == TunBogonDirect || t.ipv6Route == TunIPv6Direct && dest.Address.Family().IsIPv6() {
+		conn, err = listenDirectUDP()
+	} else {
+		conn, err = v2rayCore.DialUDP(ctx, t.v2ray.core)
+	}
 
 	if err != nil {
 		log.Errorf("[UDP] dial failed: %s", err.Error())
@@ -438,6 +576,12 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 		}
 		if isDns {
 			addr = nil
+			if cache := t.currentDnsCache(); cache != nil {
+				cache.store(buf[:n], dest)
+			}
+			if t.fakedns && fakeIpStore.enabled() {
+				fakeIpStore.record(buf[:n])
+			}
 		}
 		_, err = packet.WriteBack(buf[:n], addr)
 		if err != nil {
@@ -453,6 +597,39 @@ func (t *Tun2socks) addPacket(packet core.UDPPacket) {
 	t.udpTable.Delete(natKey)
 }
 
+func (t *Tun2socks) refreshDns(cache *dnsCache, query *dns.Msg, dest v2rayNet.Destination) {
+	defer cache.refreshDone(query)
+
+	message, err := query.Pack()
+	if err != nil {
+		return
+	}
+	conn, err := v2rayCore.DialUDP(session.ContextWithInbound(context.Background(), &session.Inbound{
+		Tag: "dns-in",
+	}), t.v2ray.core)
+	if err != nil {
+		log.Warnf("[DNS] refresh %s failed: %s", query.Question[0].Name, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.WriteTo(message, &net.UDPAddr{IP: dest.Address.IP(), Port: int(dest.Port)})
+	if err != nil {
+		log.Warnf("[DNS] refresh %s failed: %s", query.Question[0].Name, err.Error())
+		return
+	}
+
+	buf := pool.Get(pool.RelayBufferSize)
+	defer pool.Put(buf)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		log.Warnf("[DNS] refresh %s failed: %s", query.Question[0].Name, err.Error())
+		return
+	}
+	cache.store(buf[:n], dest)
+}
+
 func (t *Tun2socks) dialDNS(ctx context.Context, _, _ string) (net.Conn, error) {
 	return v2rayCore.Dial(session.ContextWithInbound(ctx, &session.Inbound{
 		Tag: "dns-in",
@@ -463,6 +640,12 @@ func (t *Tun2socks) dialDNS(ctx context.Context, _, _ string) (net.Conn, error)
 	})
 }
 
+// endpointAddress converts a raw 4 or 16 byte address from the stack without
+// formatting it into a string and parsing it back.
+func endpointAddress(address string) v2rayNet.Address {
+	return v2rayNet.IPAddress([]byte(address))
+}
+
 type natTable struct {
 	mapping sync.Map
 }
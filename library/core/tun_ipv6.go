@@ -0,0 +1,55 @@
+package libcore
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// IPv6 handling in the TUN. Capture and Block expect the VpnService to route
+// ::/0 into the TUN, so that IPv6 cannot leak around it, Direct expects it not
+// to and only handles IPv6 flows that reach the TUN anyway.
+const (
+	TunIPv6Capture int32 = iota
+	TunIPv6Block
+	TunIPv6Direct
+)
+
+func (t *Tun2socks) SetIPv6Route(mode int32) error {
+	if mode < TunIPv6Capture || mode > TunIPv6Direct {
+		return fmt.Errorf("invalid ipv6 route mode %d", mode)
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	t.ipv6Route = mode
+	return nil
+}
+
+// blockedAAAAResponse returns an empty answer for AAAA queries while IPv6 is
+// blocked, so that clients do not try IPv6 first.
+func (t *Tun2socks) blockedAAAAResponse(message []byte) []byte {
+	if t.ipv6Route != TunIPv6Block {
+		return nil
+	}
+	query := dns.Msg{}
+	if err := query.Unpack(message); err != nil || query.Response || len(query.Question) == 0 {
+		return nil
+	}
+	if query.Question[0].Qtype != dns.TypeAAAA {
+		return nil
+	}
+	response := new(dns.Msg)
+	response.SetReply(&query)
+	reply, err := response.Pack()
+	if err != nil {
+		return nil
+	}
+	return reply
+}
+
+func listenDirectUDP() (net.PacketConn, error) {
+	config := net.ListenConfig{Control: (&socketOptions{}).control}
+	return config.ListenPacket(context.Background(), "udp", "")
+}
@@ -0,0 +1,279 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+
+	"github.com/Dreamacro/clash/common/pool"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const udpBatchSize = 16
+
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// offloadBufferPool holds the buffers large enough for a coalesced GRO read
+// or a GSO send.
+var offloadBufferPool = sync.Pool{New: func() interface{} {
+	return make([]byte, 65535)
+}}
+
+// batchPacketConn reads with recvmmsg and serves the packets one at a time,
+// so a burst of QUIC packets costs a single syscall instead of one per packet.
+// The read buffers are taken from a pool on the first read, so that sockets
+// never read from hold no memory.
+type batchPacketConn struct {
+	*net.UDPConn
+	batch batchConn
+
+	readAccess sync.Mutex
+	messages   []ipv4.Message
+	index      int
+	count      int
+
+	// GRO may coalesce several datagrams into one message
+	gro           bool
+	segmentOffset int
+	closed        bool
+}
+
+func newBatchPacketConn(conn *net.UDPConn) *batchPacketConn {
+	return &batchPacketConn{
+		UDPConn: conn,
+		batch:   newBatchConn(conn),
+		gro:     enableUdpGro(conn),
+	}
+}
+
+func (c *batchPacketConn) allocate() {
+	c.messages = make([]ipv4.Message, udpBatchSize)
+	for i := range c.messages {
+		if c.gro {
+			c.messages[i].Buffers = [][]byte{offloadBufferPool.Get().([]byte)}
+			c.messages[i].OOB = make([]byte, unix.CmsgSpace(4))
+		} else {
+			c.messages[i].Buffers = [][]byte{pool.Get(pool.RelayBufferSize)}
+		}
+	}
+}
+
+func (c *batchPacketConn) release() {
+	for i := range c.messages {
+		if c.gro {
+			offloadBufferPool.Put(c.messages[i].Buffers[0])
+		} else {
+			_ = pool.Put(c.messages[i].Buffers[0])
+		}
+	}
+	c.messages = nil
+	c.index, c.count = 0, 0
+}
+
+func (c *batchPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+
+	if c.closed {
+		return 0, nil, net.ErrClosed
+	}
+	if c.messages == nil {
+		c.allocate()
+	}
+	if c.index >= c.count {
+		n, err := c.batch.ReadBatch(c.messages, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.index, c.count = 0, n
+		c.segmentOffset = 0
+	}
+	message := &c.messages[c.index]
+	data := message.Buffers[0][:message.N]
+	if c.gro {
+		if segmentSize := groSegmentSize(message.OOB[:message.NN]); segmentSize > 0 && segmentSize < len(data) {
+			end := c.segmentOffset + segmentSize
+			if end > len(data) {
+				end = len(data)
+			}
+			n := copy(p, data[c.segmentOffset:end])
+			c.segmentOffset = end
+			if c.segmentOffset >= len(data) {
+				c.index++
+				c.segmentOffset = 0
+			}
+			return n, message.Addr, nil
+		}
+	}
+	c.index++
+	return copy(p, data), message.Addr, nil
+}
+
+func (c *batchPacketConn) Close() error {
+	err := c.UDPConn.Close()
+	c.readAccess.Lock()
+	c.closed = true
+	if c.messages != nil {
+		c.release()
+	}
+	c.readAccess.Unlock()
+	return err
+}
+
+// batchWrite is a packet queued on a batchWriter, buffer is returned to the
+// pool once written.
+type batchWrite struct {
+	buffer []byte
+	addr   net.Addr
+}
+
+// batchWriter writes the queued packets with sendmmsg from a single
+// goroutine, so the packets queued while a batch is written share the next
+// syscall. With GSO, the packets of a batch to the same address are sent as
+// the segments of a single message.
+type batchWriter struct {
+	conn      *net.UDPConn
+	batch     batchConn
+	queue     chan batchWrite
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// only used by loop
+	gso      bool
+	messages []ipv4.Message
+	runs     [][]batchWrite
+}
+
+func newBatchWriter(conn *net.UDPConn) *batchWriter {
+	w := &batchWriter{
+		conn:     conn,
+		batch:    newBatchConn(conn),
+		queue:    make(chan batchWrite, udpBatchSize*4),
+		done:     make(chan struct{}),
+		gso:      udpOffloadEnabled && UdpOffloadSupported(),
+		messages: make([]ipv4.Message, udpBatchSize),
+		runs:     make([][]batchWrite, 0, udpBatchSize),
+	}
+	for i := range w.messages {
+		w.messages[i].Buffers = make([][]byte, 1)
+		w.messages[i].OOB = make([]byte, 0, unix.CmsgSpace(2))
+	}
+	go w.loop()
+	return w
+}
+
+// write queues buffer, taken from the pool, to be sent to addr. The packet is
+// dropped when the queue is full, as it would be by a full socket buffer.
+func (w *batchWriter) write(buffer []byte, addr net.Addr) error {
+	select {
+	case <-w.done:
+		_ = pool.Put(buffer)
+		return net.ErrClosed
+	default:
+	}
+	select {
+	case w.queue <- batchWrite{buffer, addr}:
+	default:
+		_ = pool.Put(buffer)
+	}
+	return nil
+}
+
+func (w *batchWriter) loop() {
+	writes := make([]batchWrite, 0, udpBatchSize)
+	for {
+		select {
+		case write := <-w.queue:
+			writes = append(writes[:0], write)
+		case <-w.done:
+			return
+		}
+	queue:
+		for len(writes) < udpBatchSize {
+			select {
+			case write := <-w.queue:
+				writes = append(writes, write)
+			default:
+				break queue
+			}
+		}
+		w.flush(writes)
+	}
+}
+
+func (w *batchWriter) flush(writes []batchWrite) {
+	messages := w.messages[:0]
+	runs := w.runs[:0]
+	for i := 0; i < len(writes); {
+		end := i + 1
+		if w.gso {
+			end = gsoRunEnd(writes, i)
+		}
+		message := w.messages[len(messages)]
+		message.Addr = writes[i].addr
+		message.OOB = message.OOB[:0]
+		if end-i > 1 {
+			buffer := offloadBufferPool.Get().([]byte)[:0]
+			for _, write := range writes[i:end] {
+				buffer = append(buffer, write.buffer...)
+			}
+			message.Buffers[0] = buffer
+			message.OOB = appendGsoControlMessage(message.OOB, len(writes[i].buffer))
+		} else {
+			message.Buffers[0] = writes[i].buffer
+		}
+		messages = append(messages, message)
+		runs = append(runs, writes[i:end])
+		i = end
+	}
+
+	for len(messages) > 0 {
+		n, err := w.batch.WriteBatch(messages, 0)
+		if err == nil && n > 0 {
+			messages, runs = messages[n:], runs[n:]
+			continue
+		}
+		// the messages before the refused one were sent
+		if n > 0 {
+			messages, runs = messages[n:], runs[n:]
+		}
+		if len(messages[0].OOB) > 0 {
+			// the kernel, or the route, does not take UDP_SEGMENT: send the
+			// segments one by one, and stop using GSO on this socket
+			w.gso = false
+			for _, write := range runs[0] {
+				_, _ = w.conn.WriteTo(write.buffer, write.addr)
+			}
+		}
+		messages, runs = messages[1:], runs[1:]
+	}
+
+	for i := range w.messages {
+		if len(w.messages[i].OOB) > 0 {
+			offloadBufferPool.Put(w.messages[i].Buffers[0][:cap(w.messages[i].Buffers[0])])
+			w.messages[i].OOB = w.messages[i].OOB[:0]
+		}
+		w.messages[i].Buffers[0] = nil
+		w.messages[i].Addr = nil
+	}
+	for _, write := range writes {
+		_ = pool.Put(write.buffer)
+	}
+}
+
+func (w *batchWriter) close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+}
@@ -0,0 +1,119 @@
+package libcore
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/Dreamacro/clash/adapter/inbound"
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/Dreamacro/clash/common/sockopt"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/transport/socks5"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+// socksUDPListener is the SOCKS UDP inbound. Unlike the one of Clash it reads
+// the client packets with recvmmsg and writes the replies with sendmmsg.
+type socksUDPListener struct {
+	conn   *batchPacketConn
+	writer *batchWriter
+	closed int32
+}
+
+func listenSocksUDP(address string, in chan<- *inbound.PacketAdapter) (*socksUDPListener, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	udpConn := pc.(*net.UDPConn)
+	if err = sockopt.UDPReuseaddr(udpConn); err != nil {
+		log.Warnf("[UDP] reuse address %s failed: %s", address, err.Error())
+	}
+	l := &socksUDPListener{
+		conn:   newBatchPacketConn(udpConn),
+		writer: newBatchWriter(udpConn),
+	}
+	go l.loop(in)
+	return l, nil
+}
+
+func (l *socksUDPListener) loop(in chan<- *inbound.PacketAdapter) {
+	for {
+		buf := pool.Get(pool.RelayBufferSize)
+		n, from, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			_ = pool.Put(buf)
+			if atomic.LoadInt32(&l.closed) != 0 {
+				return
+			}
+			continue
+		}
+		target, payload, err := socks5.DecodeUDPPacket(buf[:n])
+		if err != nil {
+			_ = pool.Put(buf)
+			continue
+		}
+		packet := inbound.NewPacket(target, &socksUDPPacket{
+			listener: l,
+			from:     from,
+			payload:  payload,
+			buf:      buf,
+		}, clashC.SOCKS5)
+		select {
+		case in <- packet:
+		default:
+			packet.Drop()
+		}
+	}
+}
+
+// UDPConn returns the socket of the inbound.
+func (l *socksUDPListener) UDPConn() *net.UDPConn {
+	return l.conn.UDPConn
+}
+
+func (l *socksUDPListener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	l.writer.close()
+	return l.conn.Close()
+}
+
+// socksUDPPacket is a client packet of a socksUDPListener.
+type socksUDPPacket struct {
+	listener *socksUDPListener
+	from     net.Addr
+	payload  []byte
+	buf      []byte
+}
+
+func (p *socksUDPPacket) Data() []byte {
+	return p.payload
+}
+
+// WriteBack queues a reply from addr on the writer of the listener.
+func (p *socksUDPPacket) WriteBack(b []byte, addr net.Addr) (int, error) {
+	socksAddr := socks5.ParseAddrToSocksAddr(addr)
+	if socksAddr == nil {
+		return 0, errors.New("invalid reply address")
+	}
+	length := 3 + len(socksAddr) + len(b)
+	if length > 65535 {
+		return 0, errors.New("reply too large")
+	}
+	buffer := pool.Get(length)
+	buffer[0], buffer[1], buffer[2] = 0, 0, 0
+	copy(buffer[3+copy(buffer[3:], socksAddr):], b)
+	if err := p.listener.writer.write(buffer, p.from); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *socksUDPPacket) LocalAddr() net.Addr {
+	return p.from
+}
+
+func (p *socksUDPPacket) Drop() {
+	_ = pool.Put(p.buf)
+}
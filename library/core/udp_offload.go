@@ -0,0 +1,124 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// from linux/udp.h, not in the pinned x/sys
+const (
+	solUdp     = 17
+	udpSegment = 103
+	udpGro     = 104
+)
+
+var (
+	udpOffloadEnabled bool
+	udpOffloadOnce    sync.Once
+	udpOffloadSupport bool
+)
+
+// SetUdpOffload enables UDP GRO on the UDP sockets libcore reads in batches,
+// the SOCKS inbound and the direct and QUIC outbound ones, and UDP GSO on the
+// replies of the SOCKS inbound, where the kernel supports them.
+func SetUdpOffload(enabled bool) {
+	udpOffloadEnabled = enabled
+}
+
+// UdpOffloadSupported reports whether the running kernel supports UDP_SEGMENT and UDP_GRO.
+func UdpOffloadSupported() bool {
+	udpOffloadOnce.Do(func() {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
+		if err != nil {
+			return
+		}
+		defer unix.Close(fd)
+		if _, err = unix.GetsockoptInt(fd, solUdp, udpSegment); err != nil {
+			return
+		}
+		udpOffloadSupport = unix.SetsockoptInt(fd, solUdp, udpGro, 1) == nil
+	})
+	return udpOffloadSupport
+}
+
+func enableUdpGro(conn *net.UDPConn) bool {
+	if !udpOffloadEnabled || !UdpOffloadSupported() {
+		return false
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var setErr error
+	err = rawConn.Control(func(fd uintptr) {
+		setErr = unix.SetsockoptInt(int(fd), solUdp, udpGro, 1)
+	})
+	return err == nil && setErr == nil
+}
+
+// groSegmentSize returns the segment size of a coalesced read, or 0.
+func groSegmentSize(oob []byte) int {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, message := range messages {
+		if message.Header.Level == solUdp && message.Header.Type == udpGro && len(message.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&message.Data[0])))
+		}
+	}
+	return 0
+}
+
+const (
+	// udpMaxSegments is UDP_MAX_SEGMENTS of the kernel
+	udpMaxSegments = 64
+	// udpMaxGsoSize is the largest payload of a GSO send over IPv4
+	udpMaxGsoSize = 65535 - 8 - 20
+)
+
+// gsoRunEnd returns the end of the run of writes from start that a single GSO
+// send can carry: the packets to the same address, of the same size but for a
+// shorter last one.
+func gsoRunEnd(writes []batchWrite, start int) int {
+	size := len(writes[start].buffer)
+	total := size
+	end := start + 1
+	for end < len(writes) && end-start < udpMaxSegments && sameUDPAddr(writes[end].addr, writes[start].addr) {
+		n := len(writes[end].buffer)
+		if n > size || total+n > udpMaxGsoSize {
+			break
+		}
+		total += n
+		end++
+		if n < size {
+			break
+		}
+	}
+	return end
+}
+
+func sameUDPAddr(a, b net.Addr) bool {
+	x, ok := a.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	y, ok := b.(*net.UDPAddr)
+	return ok && x.Port == y.Port && x.Zone == y.Zone && x.IP.Equal(y.IP)
+}
+
+// appendGsoControlMessage appends the UDP_SEGMENT control message that splits
+// a send into segments of segmentSize.
+func appendGsoControlMessage(oob []byte, segmentSize int) []byte {
+	start := len(oob)
+	oob = append(oob, make([]byte, unix.CmsgSpace(2))...)
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[start]))
+	header.Level = solUdp
+	header.Type = udpSegment
+	header.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[start+unix.CmsgLen(0)])) = uint16(segmentSize)
+	return oob
+}
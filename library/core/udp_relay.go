@@ -0,0 +1,191 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/inbound"
+	"github.com/Dreamacro/clash/common/pool"
+	"github.com/Dreamacro/clash/component/resolver"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+const (
+	udpSessionTimeout = 60 * time.Second
+	udpSessionQueue   = 64
+)
+
+// udpNat maps each client address of the SOCKS UDP inbound to its session.
+type udpNat struct {
+	mapping sync.Map
+}
+
+// udpSession queues the packets of a client, written by the goroutine of the
+// session once its outbound packet connection is dialed.
+type udpSession struct {
+	packets chan *inbound.PacketAdapter
+	done    chan struct{}
+}
+
+func (s *ClashBasedInstance) listenUDP() error {
+	if !s.out.SupportUDP() {
+		return nil
+	}
+	in, err := listenSocksUDP(s.listenAddress(), s.udpIn)
+	if err != nil {
+		return err
+	}
+	if s.sendBuffer > 0 {
+		_ = in.UDPConn().SetWriteBuffer(s.sendBuffer)
+	}
+	if s.receiveBuffer > 0 {
+		_ = in.UDPConn().SetReadBuffer(s.receiveBuffer)
+	}
+	s.udpListener = in
+	return nil
+}
+
+func (s *ClashBasedInstance) udpLoop() {
+	for {
+		var packet *inbound.PacketAdapter
+		select {
+		case <-s.ctx.Done():
+			for {
+				select {
+				case packet = <-s.udpIn:
+					packet.Drop()
+				default:
+					return
+				}
+			}
+		case packet = <-s.udpIn:
+		}
+		s.handleUDP(packet)
+	}
+}
+
+// handleUDP runs on the udpLoop and only hands the packet to the session of
+// its client, dialing and resolving are done by the session goroutine.
+func (s *ClashBasedInstance) handleUDP(packet *inbound.PacketAdapter) {
+	metadata := packet.Metadata()
+	if (s.quicBlocked() && metadata.DstPort == "443") || isBlocked(metadata.Host) || s.downgrade.match(metadata)&downgradeTcpOnly != 0 {
+		packet.Drop()
+		return
+	}
+
+	// sessions are only stored here and deleted by their own goroutine, so a
+	// client gets a new session only once the previous one is gone
+	key := packet.LocalAddr().String()
+	item, ok := s.udpNat.mapping.Load(key)
+	if !ok {
+		session := &udpSession{
+			packets: make(chan *inbound.PacketAdapter, udpSessionQueue),
+			done:    make(chan struct{}),
+		}
+		s.udpNat.mapping.Store(key, session)
+		s.relays.Add(1)
+		atomic.AddUint64(&s.udpSessions, 1)
+		go s.runUDPSession(key, session, packet)
+		item = session
+	}
+	session := item.(*udpSession)
+	select {
+	case session.packets <- packet:
+	case <-session.done:
+		packet.Drop()
+	default:
+		// still dialing with a full queue, or the outbound is too slow
+		packet.Drop()
+	}
+}
+
+// runUDPSession dials the outbound packet connection of a client, then writes
+// its packets until the relay of the replies ends.
+func (s *ClashBasedInstance) runUDPSession(key string, session *udpSession, first *inbound.PacketAdapter) {
+	defer s.relays.Done()
+	defer func() {
+		s.udpNat.mapping.Delete(key)
+		close(session.done)
+		for {
+			select {
+			case packet := <-session.packets:
+				packet.Drop()
+			default:
+				return
+			}
+		}
+	}()
+
+	metadata := first.Metadata()
+	pc, err := s.out.DialUDP(metadata)
+	s.status.dialed(err)
+	if err != nil {
+		log.Warnf("[UDP] dial %s failed: %s", metadata.RemoteAddress(), err.Error())
+		return
+	}
+	tracked := s.trackConnection("udp", metadata, pc)
+	defer s.untrackConnection(tracked)
+	conn := net.PacketConn(&statsPacketConn{&statsPacketConn{&statsPacketConn{pc, &tracked.uplink, &tracked.downlink}, &s.udpUplink, &s.udpDownlink}, &s.uplink, &s.downlink})
+	defer conn.Close()
+	atomic.AddInt32(&s.activeUdp, 1)
+	defer atomic.AddInt32(&s.activeUdp, -1)
+
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		s.relayUDP(conn, first)
+	}()
+	for {
+		select {
+		case packet := <-session.packets:
+			s.writeUDP(conn, packet, packet.Metadata())
+		case <-relayDone:
+			return
+		}
+	}
+}
+
+func (s *ClashBasedInstance) writeUDP(conn net.PacketConn, packet *inbound.PacketAdapter, metadata *clashC.Metadata) {
+	defer packet.Drop()
+	if metadata.DstIP == nil {
+		ip, err := resolver.ResolveIP(metadata.Host)
+		if err != nil {
+			log.Warnf("[UDP] resolve %s failed: %s", metadata.Host, err.Error())
+			return
+		}
+		metadata.DstIP = ip
+	}
+	if _, err := conn.WriteTo(packet.Data(), metadata.UDPAddr()); err != nil {
+		_ = conn.Close()
+	}
+}
+
+// relayUDP writes the replies back to the client until the session is idle
+// for udpSessionTimeout or the instance is forced closed.
+func (s *ClashBasedInstance) relayUDP(conn net.PacketConn, packet *inbound.PacketAdapter) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-s.relayCtx.Done():
+			_ = conn.Close()
+		case <-stop:
+		}
+	}()
+
+	buf := pool.Get(pool.RelayBufferSize)
+	defer pool.Put(buf)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, err = packet.WriteBack(buf[:n], from); err != nil {
+			return
+		}
+	}
+}
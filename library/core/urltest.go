@@ -51,12 +51,16 @@ func UrlTestV2ray(instance *V2RayInstance, inbound string, link string, timeout
 }
 
 func UrlTestClashBased(instance *ClashBasedInstance, link string, timeout int32) (int32, error) {
-	return urlTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
+	latency, err := urlTest(func(ctx context.Context, network, addr string) (net.Conn, error) {
 		dest, err := addrToMetadata(addr)
 		if err != nil {
 			return nil, err
 		}
-		dest.NetWork = networkForClash(network)
+		if dest.NetWork, err = networkForClash(network); err != nil {
+			return nil, err
+		}
 		return instance.out.DialContext(ctx, dest)
 	}, link, timeout)
+	instance.recordUrlTest(latency, err)
+	return latency, err
 }
@@ -45,6 +45,10 @@ func NewV2rayInstance() *V2RayInstance {
 func (instance *V2RayInstance) LoadConfig(content string, forTest bool) error {
 	instance.access.Lock()
 	defer instance.access.Unlock()
+	content, err := decryptConfigSecrets(content)
+	if err != nil {
+		return err
+	}
 	config, err := serial.LoadJSONConfig(strings.NewReader(content))
 	if err != nil {
 		return err
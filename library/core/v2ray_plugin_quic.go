@@ -0,0 +1,120 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+)
+
+// v2rayQuicShadowsocks is Shadowsocks over the quic mode of v2ray-plugin: the
+// QUIC transport of v2ray with TLS, no packet header and no packet encryption,
+// each connection being a stream of one shared session. Like v2ray-plugin,
+// only TCP is relayed.
+type v2rayQuicShadowsocks struct {
+	*outbound.ShadowSocks
+	tlsConfig *tls.Config
+	options   *socketOptions
+
+	access  sync.Mutex
+	session quic.Session
+	conn    *rebindablePacketConn
+}
+
+func (s *v2rayQuicShadowsocks) socketOptions() *socketOptions {
+	return s.options
+}
+
+func (s *v2rayQuicShadowsocks) getSession(ctx context.Context) (quic.Session, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.session != nil {
+		select {
+		case <-s.session.Context().Done():
+			s.closeSession()
+		default:
+			return s.session, nil
+		}
+	}
+
+	serverAddr, err := net.ResolveUDPAddr("udp", s.Addr())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenRebindable(s.options)
+	if err != nil {
+		return nil, err
+	}
+	// the QUIC settings of the v2ray transport
+	session, err := quic.DialContext(ctx, conn, serverAddr, s.tlsConfig.ServerName, s.tlsConfig, &quic.Config{
+		ConnectionIDLength:   12,
+		HandshakeIdleTimeout: 8 * time.Second,
+		MaxIdleTimeout:       30 * time.Second,
+		KeepAlive:            true,
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	s.session = session
+	s.conn = conn
+	return session, nil
+}
+
+func (s *v2rayQuicShadowsocks) closeSession() {
+	if s.session != nil {
+		_ = s.session.CloseWithError(0, "")
+		s.session = nil
+	}
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *v2rayQuicShadowsocks) Close() error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.closeSession()
+	return nil
+}
+
+func (s *v2rayQuicShadowsocks) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	session, err := s.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn := &quicStreamConn{Stream: stream, session: session}
+	sc, err := s.ShadowSocks.StreamConn(conn, metadata)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return outbound.NewConn(sc, s), nil
+}
+
+func (s *v2rayQuicShadowsocks) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	return nil, errors.New("udp is not supported by the v2ray-plugin quic mode")
+}
+
+// newV2rayQuicTLSConfig builds the client TLS config of the quic mode, with the
+// default ALPN of the v2ray TLS settings, which the server side uses too.
+func newV2rayQuicTLSConfig(opts map[string]interface{}) *tls.Config {
+	host, _ := opts["host"].(string)
+	skipCertVerify, _ := opts["skip-cert-verify"].(bool)
+	return &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: skipCertVerify,
+		NextProtos:         []string{"h2", "http/1.1"},
+	}
+}
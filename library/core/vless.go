@@ -0,0 +1,237 @@
+package libcore
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	xrayUuid "github.com/xtls/xray-core/common/uuid"
+)
+
+// xrayStreamSettings builds the streamSettings object of an Xray outbound.
+func xrayStreamSettings(network string, security string, sni string, skipCertVerify bool, cert *ClientCertificate, path string, host string, serviceName string) (map[string]interface{}, error) {
+	if network == "" {
+		network = "tcp"
+	}
+	settings := map[string]interface{}{
+		"network": network,
+	}
+	switch network {
+	case "tcp":
+	case "ws":
+		ws := map[string]interface{}{"path": path}
+		if host != "" {
+			ws["headers"] = map[string]string{"Host": host}
+		}
+		settings["wsSettings"] = ws
+	case "h2", "http":
+		settings["network"] = "http"
+		h2 := map[string]interface{}{"path": path}
+		if host != "" {
+			h2["host"] = splitList(host)
+		}
+		settings["httpSettings"] = h2
+	case "grpc":
+		settings["grpcSettings"] = map[string]interface{}{"serviceName": serviceName}
+	default:
+		return nil, fmt.Errorf("unsupported network %s", network)
+	}
+
+	switch security {
+	case "tls", "xtls":
+		tlsSettings := map[string]interface{}{
+			"serverName":    sni,
+			"allowInsecure": skipCertVerify,
+		}
+		if cert != nil {
+			tlsSettings["certificates"] = []interface{}{cert.xrayCertificate()}
+		}
+		settings["security"] = security
+		settings[security+"Settings"] = tlsSettings
+	case "", "none":
+		if cert != nil {
+			return nil, errors.New("client certificate requires tls security")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported security %s", security)
+	}
+	return settings, nil
+}
+
+// NewVLESSInstance creates a VLESS instance, run by an embedded Xray core.
+// security is "none", "tls" or "xtls", flows such as xtls-rprx-direct require
+// xtls. network is "tcp" (or empty), "ws", "h2", "grpc" or "httpupgrade", the
+// latter implemented here without Xray. clientCert and clientKey are the
+// optional PEM encoded client certificate chain and key, for servers requiring
+// mutual TLS.
+func NewVLESSInstance(socksPort int32, server string, port int32, uuid string, flow string, security string, sni string, skipCertVerify bool, network string, path string, host string, serviceName string, clientCert string, clientKey string) (*ClashBasedInstance, error) {
+	cert, err := clientCertificate(clientCert, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	if network == "httpupgrade" {
+		return newVLESSHttpUpgradeInstance(socksPort, server, port, uuid, flow, security, sni, skipCertVerify, cert, path, host)
+	}
+	outboundObject, err := vlessOutbound(server, port, uuid, flow, security, sni, skipCertVerify, cert, network, path, host, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	out, err := newXrayOutbound("vless", net.JoinHostPort(server, strconv.Itoa(int(port))), outboundObject)
+	if err != nil {
+		return nil, err
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
+
+func vlessOutbound(server string, port int32, uuid string, flow string, security string, sni string, skipCertVerify bool, cert *ClientCertificate, network string, path string, host string, serviceName string) (map[string]interface{}, error) {
+	if err := decryptSecrets(&uuid); err != nil {
+		return nil, err
+	}
+	if flow != "" && (security != "xtls" || !strings.HasPrefix(flow, "xtls-rprx-")) {
+		return nil, fmt.Errorf("flow %s requires xtls security", flow)
+	}
+	if security == "xtls" && network != "" && network != "tcp" {
+		return nil, fmt.Errorf("xtls does not support %s transport", network)
+	}
+	streamSettings, err := xrayStreamSettings(network, security, sni, skipCertVerify, cert, path, host, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	user := map[string]interface{}{
+		"id":         uuid,
+		"encryption": "none",
+	}
+	if flow != "" {
+		user["flow"] = flow
+	}
+	return map[string]interface{}{
+		"protocol": "vless",
+		"settings": map[string]interface{}{
+			"vnext": []interface{}{map[string]interface{}{
+				"address": server,
+				"port":    port,
+				"users":   []interface{}{user},
+			}},
+		},
+		"streamSettings": streamSettings,
+	}, nil
+}
+
+// newVLESSHttpUpgradeInstance runs VLESS over the httpupgrade transport,
+// which Xray does not implement.
+func newVLESSHttpUpgradeInstance(socksPort int32, server string, port int32, uuid string, flow string, security string, sni string, skipCertVerify bool, cert *ClientCertificate, path string, host string) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&uuid); err != nil {
+		return nil, err
+	}
+	id, err := xrayUuid.ParseString(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if flow != "" {
+		return nil, fmt.Errorf("flow %s is not supported over httpupgrade", flow)
+	}
+	if sni == "" {
+		sni = server
+	}
+	if host == "" {
+		host = sni
+	}
+	var tlsConfig *tls.Config
+	switch security {
+	case "", "none":
+		if cert != nil {
+			return nil, errors.New("client certificate requires tls security")
+		}
+	case "tls":
+		if tlsConfig, err = clientTLSConfig(&tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: skipCertVerify,
+		}, cert); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported security %s over httpupgrade", security)
+	}
+	address := net.JoinHostPort(server, strconv.Itoa(int(port)))
+	return newClashBasedInstance(socksPort, &httpUpgradeInstance{
+		Base:      outbound.NewBase("vless", address, clashC.Vmess, false),
+		server:    address,
+		tlsConfig: tlsConfig,
+		host:      host,
+		path:      path,
+		protocol:  &vlessProtocol{id: id},
+	}), nil
+}
+
+const (
+	vlessVersion    = 0
+	vlessCommandTCP = 1
+
+	vlessAddressIPv4   = 1
+	vlessAddressDomain = 2
+	vlessAddressIPv6   = 3
+)
+
+// vlessProtocol writes the VLESS request, without flow, the TLS layer being
+// part of the transport.
+type vlessProtocol struct {
+	id xrayUuid.UUID
+}
+
+func (v *vlessProtocol) StreamConn(c net.Conn, metadata *clashC.Metadata) (net.Conn, error) {
+	port, err := strconv.ParseUint(metadata.DstPort, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port " + metadata.DstPort)
+	}
+	request := make([]byte, 0, 24+len(metadata.Host))
+	request = append(request, vlessVersion)
+	request = append(request, v.id.Bytes()...)
+	// no addons
+	request = append(request, 0, vlessCommandTCP, byte(port>>8), byte(port))
+	if ip := metadata.DstIP.To4(); metadata.Host == "" && ip != nil {
+		request = append(request, vlessAddressIPv4)
+		request = append(request, ip...)
+	} else if metadata.Host == "" && metadata.DstIP != nil {
+		request = append(request, vlessAddressIPv6)
+		request = append(request, metadata.DstIP.To16()...)
+	} else {
+		if len(metadata.Host) > 255 {
+			return nil, errors.New("domain too long")
+		}
+		request = append(request, vlessAddressDomain, byte(len(metadata.Host)))
+		request = append(request, metadata.Host...)
+	}
+	if _, err = c.Write(request); err != nil {
+		return nil, err
+	}
+	return &vlessConn{Conn: c}, nil
+}
+
+// vlessConn skips the response header before the first read.
+type vlessConn struct {
+	net.Conn
+	responseRead bool
+}
+
+func (c *vlessConn) Read(b []byte) (int, error) {
+	if !c.responseRead {
+		var header [2]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		if header[0] != vlessVersion {
+			return 0, fmt.Errorf("unexpected vless version %d", header[0])
+		}
+		if _, err := io.CopyN(io.Discard, c.Conn, int64(header[1])); err != nil {
+			return 0, err
+		}
+		c.responseRead = true
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,97 @@
+package libcore
+
+import (
+	cryptoTls "crypto/tls"
+	"fmt"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+)
+
+// NewVMessInstance creates a VMess instance. network is "tcp" (or empty), "ws",
+// "http", "h2", "grpc", "httpupgrade" or "xhttp", path and host apply to all
+// but grpc.
+func NewVMessInstance(socksPort int32, server string, port int32, uuid string, alterId int32, security string, network string, tls bool, sni string, skipCertVerify bool, path string, host string, grpcServiceName string) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&uuid); err != nil {
+		return nil, err
+	}
+	if security == "" {
+		security = "auto"
+	}
+	option := outbound.VmessOption{
+		Server:         server,
+		Port:           int(port),
+		UUID:           uuid,
+		AlterID:        int(alterId),
+		Cipher:         security,
+		UDP:            true,
+		TLS:            tls,
+		ServerName:     sni,
+		SkipCertVerify: skipCertVerify,
+	}
+	switch network {
+	case "", "tcp":
+	case "ws":
+		option.Network = "ws"
+		option.WSPath = path
+		if host != "" {
+			option.WSHeaders = map[string]string{"Host": host}
+		}
+	case "http":
+		option.Network = "http"
+		option.HTTPOpts = outbound.HTTPOptions{Method: "GET"}
+		if path != "" {
+			option.HTTPOpts.Path = []string{path}
+		}
+		if host != "" {
+			option.HTTPOpts.Headers = map[string][]string{"Host": {host}}
+		}
+	case "h2":
+		option.Network = "h2"
+		option.TLS = true
+		option.HTTP2Opts = outbound.HTTP2Options{Path: path}
+		if host != "" {
+			option.HTTP2Opts.Host = []string{host}
+		}
+	case "grpc":
+		option.Network = "grpc"
+		option.GrpcOpts = outbound.GrpcOptions{GrpcServiceName: grpcServiceName}
+	case "httpupgrade", "xhttp", "splithttp":
+		// the transport is done by httpUpgradeInstance or splitHTTPInstance
+		option.TLS = false
+	default:
+		return nil, fmt.Errorf("unsupported vmess network %s", network)
+	}
+	out, err := outbound.NewVmess(option)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "httpupgrade", "xhttp", "splithttp":
+		if host == "" {
+			host = server
+		}
+		var tlsConfig *cryptoTls.Config
+		if tls {
+			tlsConfig = &cryptoTls.Config{
+				ServerName:         sni,
+				InsecureSkipVerify: skipCertVerify,
+			}
+			if sni == "" {
+				tlsConfig.ServerName = server
+			}
+		}
+		base := outbound.NewBase(out.Name(), out.Addr(), out.Type(), false)
+		if network == "httpupgrade" {
+			return newClashBasedInstance(socksPort, &httpUpgradeInstance{
+				Base:      base,
+				server:    out.Addr(),
+				tlsConfig: tlsConfig,
+				host:      host,
+				path:      path,
+				protocol:  out,
+			}), nil
+		}
+		return newClashBasedInstance(socksPort, newSplitHTTPInstance(base, out.Addr(), tlsConfig, host, path, out)), nil
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
@@ -0,0 +1,81 @@
+package libcore
+
+import (
+	"net"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/log"
+)
+
+type WatchdogListener interface {
+	// OnListenerRecovered is called after the inbound was found dead and rebound,
+	// or with recovered false if rebinding failed.
+	OnListenerRecovered(recovered bool, message string)
+}
+
+// SetWatchdog probes the inbound every intervalMs milliseconds until the
+// instance is closed, and rebinds it when it stops accepting connections.
+func (s *ClashBasedInstance) SetWatchdog(intervalMs int32, listener WatchdogListener) {
+	if intervalMs <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.checkListener(listener)
+			}
+		}
+	}()
+}
+
+func (s *ClashBasedInstance) checkListener(listener WatchdogListener) {
+	s.access.Lock()
+	if s.state != instanceStateStarted {
+		s.access.Unlock()
+		return
+	}
+	address := s.listenAddress()
+	s.access.Unlock()
+
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return
+	}
+	reason := err.Error()
+	log.Warnf("inbound %s is dead: %s, rebinding", address, reason)
+
+	s.access.Lock()
+	if s.state != instanceStateStarted {
+		s.access.Unlock()
+		return
+	}
+	_ = s.in.Close()
+	s.in = nil
+	if s.udpListener != nil {
+		_ = s.udpListener.Close()
+		s.udpListener = nil
+	}
+	if s.httpIn != nil {
+		_ = s.httpIn.Close()
+		s.httpIn = nil
+	}
+	err = s.listen()
+	s.access.Unlock()
+
+	if err != nil {
+		log.Errorf("rebind inbound %s failed: %s", address, err.Error())
+		if listener != nil {
+			listener.OnListenerRecovered(false, err.Error())
+		}
+		return
+	}
+	if listener != nil {
+		listener.OnListenerRecovered(true, reason)
+	}
+}
@@ -0,0 +1,440 @@
+package libcore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	"github.com/Dreamacro/clash/component/resolver"
+	clashC "github.com/Dreamacro/clash/constant"
+	"github.com/pkg/errors"
+	"github.com/xjasonlyu/tun2socks/log"
+	wgConn "golang.zx2c4.com/wireguard/conn"
+	wgDevice "golang.zx2c4.com/wireguard/device"
+	wgTun "golang.zx2c4.com/wireguard/tun"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+const (
+	wgDefaultMTU = 1420
+	wgNIC        = 1
+)
+
+// parseWireGuardKey decodes a base64 key to the hex form of the wireguard-go
+// configuration.
+func parseWireGuardKey(name string, value string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(decoded) != wgDevice.NoisePublicKeySize {
+		return "", fmt.Errorf("invalid %s", name)
+	}
+	return hex.EncodeToString(decoded), nil
+}
+
+// wireGuardTun is the TUN device of wireguard-go backed by the netstack: the
+// packets the netstack sends are encrypted to the peer, and the packets of the
+// peer are injected into it.
+type wireGuardTun struct {
+	endpoint *channel.Endpoint
+	mtu      int
+	events   chan wgTun.Event
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func newWireGuardTun(endpoint *channel.Endpoint, mtu int) *wireGuardTun {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &wireGuardTun{
+		endpoint: endpoint,
+		mtu:      mtu,
+		events:   make(chan wgTun.Event, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	t.events <- wgTun.EventUp
+	return t
+}
+
+func (t *wireGuardTun) File() *os.File {
+	return nil
+}
+
+func (t *wireGuardTun) Read(buf []byte, offset int) (int, error) {
+	info, ok := t.endpoint.ReadContext(t.ctx)
+	if !ok {
+		return 0, os.ErrClosed
+	}
+	n := 0
+	for _, view := range info.Pkt.Views() {
+		n += copy(buf[offset+n:], view)
+	}
+	return n, nil
+}
+
+// Write injects a decrypted packet, which wireguard-go has checked against
+// the allowed IPs of the peer.
+func (t *wireGuardTun) Write(buf []byte, offset int) (int, error) {
+	packet := buf[offset:]
+	var protocol tcpip.NetworkProtocolNumber
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		protocol = ipv4.ProtocolNumber
+	case header.IPv6Version:
+		protocol = ipv6.ProtocolNumber
+	default:
+		return 0, fmt.Errorf("invalid IP version %d", header.IPVersion(packet))
+	}
+	t.endpoint.InjectInbound(protocol, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.View(append([]byte(nil), packet...)).ToVectorisedView(),
+	}))
+	return len(buf), nil
+}
+
+func (t *wireGuardTun) Flush() error {
+	return nil
+}
+
+func (t *wireGuardTun) MTU() (int, error) {
+	return t.mtu, nil
+}
+
+func (t *wireGuardTun) Name() (string, error) {
+	return "wireguard", nil
+}
+
+func (t *wireGuardTun) Events() chan wgTun.Event {
+	return t.events
+}
+
+func (t *wireGuardTun) Close() error {
+	t.cancel()
+	close(t.events)
+	return nil
+}
+
+// wireGuardBind is the UDP socket of wireguard-go, protected from the VPN and
+// rebound when the network changes.
+type wireGuardBind struct {
+	options *socketOptions
+	access  sync.Mutex
+	conn    *rebindablePacketConn
+}
+
+func (b *wireGuardBind) Open(uint16) ([]wgConn.ReceiveFunc, uint16, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.conn != nil {
+		return nil, 0, wgConn.ErrBindAlreadyOpen
+	}
+	conn, err := listenRebindable(b.options)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.conn = conn
+	receive := func(buf []byte) (int, wgConn.Endpoint, error) {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		udpAddr, _ := addr.(*net.UDPAddr)
+		return n, (*wgConn.StdNetEndpoint)(udpAddr), nil
+	}
+	var port uint16
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		port = uint16(udpAddr.Port)
+	}
+	return []wgConn.ReceiveFunc{receive}, port, nil
+}
+
+func (b *wireGuardBind) Close() error {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+func (b *wireGuardBind) SetMark(uint32) error {
+	return nil
+}
+
+func (b *wireGuardBind) Send(buf []byte, endpoint wgConn.Endpoint) error {
+	b.access.Lock()
+	conn := b.conn
+	b.access.Unlock()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	addr, ok := endpoint.(*wgConn.StdNetEndpoint)
+	if !ok {
+		return fmt.Errorf("unexpected endpoint %T", endpoint)
+	}
+	_, err := conn.WriteTo(buf, (*net.UDPAddr)(addr))
+	return err
+}
+
+func (b *wireGuardBind) ParseEndpoint(s string) (wgConn.Endpoint, error) {
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		return nil, err
+	}
+	return (*wgConn.StdNetEndpoint)(addr), nil
+}
+
+// wireGuardInstance dials through a userspace netstack whose packets are
+// tunneled to the WireGuard peer by wireguard-go.
+type wireGuardInstance struct {
+	*outbound.Base
+	stack    *stack.Stack
+	endpoint *channel.Endpoint
+	bind     *wireGuardBind
+	config   string
+	mtu      int
+	hasIPv6  bool
+
+	access sync.Mutex
+	device *wgDevice.Device
+}
+
+func (w *wireGuardInstance) socketOptions() *socketOptions {
+	return w.bind.options
+}
+
+func (w *wireGuardInstance) start() error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if w.device != nil {
+		select {
+		case <-w.device.Wait():
+		default:
+			return nil
+		}
+	}
+	device := wgDevice.NewDevice(newWireGuardTun(w.endpoint, w.mtu), w.bind, &wgDevice.Logger{
+		Verbosef: func(format string, args ...interface{}) {
+			log.Debugf("[WireGuard] "+format, args...)
+		},
+		Errorf: func(format string, args ...interface{}) {
+			log.Warnf("[WireGuard] "+format, args...)
+		},
+	})
+	if err := device.IpcSet(w.config); err != nil {
+		device.Close()
+		return errors.WithMessage(err, "configure wireguard")
+	}
+	if err := device.Up(); err != nil {
+		device.Close()
+		return err
+	}
+	w.device = device
+	return nil
+}
+
+func (w *wireGuardInstance) Close() error {
+	w.access.Lock()
+	defer w.access.Unlock()
+	if w.device != nil {
+		w.device.Close()
+		w.device = nil
+	}
+	return nil
+}
+
+func (w *wireGuardInstance) resolve(metadata *clashC.Metadata) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, error) {
+	ip := metadata.DstIP
+	if ip == nil {
+		var err error
+		if w.hasIPv6 {
+			ip, err = resolver.ResolveIP(metadata.Host)
+		} else {
+			ip, err = resolver.ResolveIPv4(metadata.Host)
+		}
+		if err != nil {
+			return tcpip.FullAddress{}, 0, err
+		}
+	}
+	port, _ := strconv.Atoi(metadata.DstPort)
+	address := tcpip.FullAddress{NIC: wgNIC, Port: uint16(port)}
+	if ip4 := ip.To4(); ip4 != nil {
+		address.Addr = tcpip.Address(ip4)
+		return address, ipv4.ProtocolNumber, nil
+	}
+	address.Addr = tcpip.Address(ip.To16())
+	return address, ipv6.ProtocolNumber, nil
+}
+
+func (w *wireGuardInstance) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	address, protocol, err := w.resolve(metadata)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := gonet.DialContextTCP(ctx, w.stack, address, protocol)
+	if err != nil {
+		return nil, err
+	}
+	return outbound.NewConn(conn, w), nil
+}
+
+func (w *wireGuardInstance) DialUDP(metadata *clashC.Metadata) (clashC.PacketConn, error) {
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	_, protocol, err := w.resolve(metadata)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := gonet.DialUDP(w.stack, nil, nil, protocol)
+	if err != nil {
+		return nil, err
+	}
+	return newPacketConn(wgPacketConn{conn}, w), nil
+}
+
+// wgPacketConn passes IPv4 addresses in their 4 byte form, as the netstack
+// expects.
+type wgPacketConn struct {
+	*gonet.UDPConn
+}
+
+func (c wgPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		if ip4 := udpAddr.IP.To4(); ip4 != nil {
+			addr = &net.UDPAddr{IP: ip4, Port: udpAddr.Port}
+		}
+	}
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+func newWireGuardStack(endpoint *channel.Endpoint, localAddress string, allowedIPs []string) (*stack.Stack, bool, error) {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+		HandleLocal:        true,
+	})
+	if err := s.CreateNIC(wgNIC, endpoint); err != nil {
+		return nil, false, fmt.Errorf("create nic: %s", err)
+	}
+
+	var hasIPv6 bool
+	for _, item := range splitList(localAddress) {
+		ip, prefix, err := net.ParseCIDR(item)
+		if err != nil {
+			if ip = net.ParseIP(item); ip == nil {
+				return nil, false, fmt.Errorf("invalid local address %s", item)
+			}
+		}
+		address := tcpip.ProtocolAddress{Protocol: ipv4.ProtocolNumber}
+		if ip4 := ip.To4(); ip4 != nil {
+			address.AddressWithPrefix = tcpip.AddressWithPrefix{Address: tcpip.Address(ip4), PrefixLen: 32}
+		} else {
+			address.Protocol = ipv6.ProtocolNumber
+			address.AddressWithPrefix = tcpip.AddressWithPrefix{Address: tcpip.Address(ip.To16()), PrefixLen: 128}
+			hasIPv6 = true
+		}
+		if prefix != nil {
+			address.AddressWithPrefix.PrefixLen, _ = prefix.Mask.Size()
+		}
+		if err := s.AddProtocolAddress(wgNIC, address); err != nil {
+			return nil, false, fmt.Errorf("add address %s: %s", item, err)
+		}
+	}
+
+	var routes []tcpip.Route
+	for _, item := range allowedIPs {
+		_, prefix, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid allowed ip %s", item)
+		}
+		destination := prefix.IP
+		if ip4 := destination.To4(); ip4 != nil {
+			destination = ip4
+		}
+		subnet, err := tcpip.NewSubnet(tcpip.Address(destination), tcpip.AddressMask(prefix.Mask))
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid allowed ip %s: %s", item, err.Error())
+		}
+		routes = append(routes, tcpip.Route{Destination: subnet, NIC: wgNIC})
+	}
+	s.SetRouteTable(routes)
+	return s, hasIPv6, nil
+}
+
+// NewWireGuardInstance creates a userspace WireGuard instance with a single
+// peer, run by wireguard-go. localAddress is the comma separated tunnel
+// addresses, allowedIPs the comma separated CIDRs routed to the peer and
+// presharedKey may be empty. The keys are base64 encoded, mtu defaults to 1420
+// and persistentKeepalive is in seconds, 0 to disable it.
+func NewWireGuardInstance(socksPort int32, localAddress string, privateKey string, peerPublicKey string, presharedKey string, endpoint string, allowedIPs string, mtu int32, persistentKeepalive int32) (*ClashBasedInstance, error) {
+	if err := decryptSecrets(&privateKey, &presharedKey); err != nil {
+		return nil, err
+	}
+	privateKey, err := parseWireGuardKey("private key", privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if peerPublicKey, err = parseWireGuardKey("peer public key", peerPublicKey); err != nil {
+		return nil, err
+	}
+	if _, _, err = net.SplitHostPort(endpoint); err != nil {
+		return nil, errors.WithMessage(err, "invalid endpoint")
+	}
+	if persistentKeepalive < 0 || persistentKeepalive > 0xffff {
+		return nil, fmt.Errorf("invalid persistent keepalive %d", persistentKeepalive)
+	}
+	routes := splitList(allowedIPs)
+
+	config := &strings.Builder{}
+	fmt.Fprintf(config, "private_key=%s\n", privateKey)
+	fmt.Fprintf(config, "public_key=%s\n", peerPublicKey)
+	if presharedKey != "" {
+		if presharedKey, err = parseWireGuardKey("preshared key", presharedKey); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(config, "preshared_key=%s\n", presharedKey)
+	}
+	fmt.Fprintf(config, "endpoint=%s\n", endpoint)
+	fmt.Fprintf(config, "persistent_keepalive_interval=%d\n", persistentKeepalive)
+	for _, route := range routes {
+		fmt.Fprintf(config, "allowed_ip=%s\n", route)
+	}
+
+	if mtu <= 0 {
+		mtu = wgDefaultMTU
+	}
+	linkEndpoint := channel.New(512, uint32(mtu), "")
+	s, hasIPv6, err := newWireGuardStack(linkEndpoint, localAddress, routes)
+	if err != nil {
+		return nil, err
+	}
+	out := &wireGuardInstance{
+		Base:     outbound.NewBase("wireguard", endpoint, clashC.Direct, true),
+		stack:    s,
+		endpoint: linkEndpoint,
+		bind:     &wireGuardBind{options: &socketOptions{}},
+		config:   config.String(),
+		mtu:      int(mtu),
+		hasIPv6:  hasIPv6,
+	}
+	return newClashBasedInstance(socksPort, out), nil
+}
@@ -0,0 +1,66 @@
+package libcore
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Dreamacro/clash/adapter/outbound"
+	clashC "github.com/Dreamacro/clash/constant"
+	v2rayNet "github.com/xtls/xray-core/common/net"
+	"github.com/xtls/xray-core/core"
+)
+
+// xrayOutbound dials through a single outbound of an embedded Xray core
+// without inbounds, for the protocols only Xray implements.
+type xrayOutbound struct {
+	*outbound.Base
+	instance *V2RayInstance
+}
+
+// newXrayOutbound starts an Xray core running the outbound (an Xray outbound
+// object) to server, "host:port".
+func newXrayOutbound(name string, server string, xrayOutboundObject map[string]interface{}) (*xrayOutbound, error) {
+	xrayOutboundObject["tag"] = "proxy"
+	content, err := json.Marshal(map[string]interface{}{
+		"log":       map[string]interface{}{"loglevel": "warning"},
+		"outbounds": []interface{}{xrayOutboundObject},
+	})
+	if err != nil {
+		return nil, err
+	}
+	instance := NewV2rayInstance()
+	if err = instance.LoadConfig(string(content), false); err != nil {
+		return nil, err
+	}
+	if err = instance.Start(); err != nil {
+		return nil, err
+	}
+	return &xrayOutbound{
+		Base:     outbound.NewBase(name, server, clashC.Vmess, true),
+		instance: instance,
+	}, nil
+}
+
+func (o *xrayOutbound) DialContext(ctx context.Context, metadata *clashC.Metadata) (clashC.Conn, error) {
+	destination, err := v2rayNet.ParseDestination("tcp:" + metadata.RemoteAddress())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := core.Dial(ctx, o.instance.core, destination)
+	if err != nil {
+		return nil, err
+	}
+	return outbound.NewConn(conn, o), nil
+}
+
+func (o *xrayOutbound) DialUDP(_ *clashC.Metadata) (clashC.PacketConn, error) {
+	pc, err := core.DialUDP(context.Background(), o.instance.core)
+	if err != nil {
+		return nil, err
+	}
+	return newPacketConn(pc, o), nil
+}
+
+func (o *xrayOutbound) Close() error {
+	return o.instance.Close()
+}